@@ -0,0 +1,198 @@
+package carmirror
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// How often queued requests check whether a session slot has been freed.
+const admissionPollInterval = 100 * time.Millisecond
+
+// admission limits how many sessions the remote server runs at once.
+// Requests starting a new session wait in a bounded queue for a free slot,
+// and are turned away with a Retry-After when the queue is full or the wait times out.
+// Requests for sessions the server already knows are always let through, and any other session cookie is ignored.
+type admission struct {
+	maxSessions  int
+	queueDepth   int
+	queueTimeout time.Duration
+	// active counts sessions known to the server
+	active func() int
+	// known reports whether the server knows the session with a token
+	known func(token string) bool
+
+	mu sync.Mutex
+	// admitted counts new sessions let through whose handler hasn't registered them yet
+	admitted int
+	queued   int
+}
+
+func newAdmission(maxSessions int, queueDepth int, queueTimeout time.Duration, active func() int, known func(token string) bool) *admission {
+	return &admission{
+		maxSessions:  maxSessions,
+		queueDepth:   queueDepth,
+		queueTimeout: queueTimeout,
+		active:       active,
+		known:        known,
+	}
+}
+
+// tryAdmit takes a session slot if one is free.
+func (a *admission) tryAdmit() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.active()+a.admitted >= a.maxSessions {
+		return false
+	}
+	a.admitted++
+	return true
+}
+
+func (a *admission) release() {
+	a.mu.Lock()
+	a.admitted--
+	a.mu.Unlock()
+}
+
+// admit waits in the queue for a session slot. It returns false if the queue is full,
+// the wait times out or the request goes away.
+func (a *admission) admit(r *http.Request) bool {
+	if a.tryAdmit() {
+		return true
+	}
+
+	a.mu.Lock()
+	if a.queued >= a.queueDepth {
+		a.mu.Unlock()
+		return false
+	}
+	a.queued++
+	a.mu.Unlock()
+
+	defer func() {
+		a.mu.Lock()
+		a.queued--
+		a.mu.Unlock()
+	}()
+
+	timeout := time.NewTimer(a.queueTimeout)
+	defer timeout.Stop()
+	ticker := time.NewTicker(admissionPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if a.tryAdmit() {
+				return true
+			}
+		case <-timeout.C:
+			return false
+		case <-r.Context().Done():
+			return false
+		}
+	}
+}
+
+// retryAfter is the number of seconds rejected clients are asked to wait.
+func (a *admission) retryAfter() int {
+	return int(math.Max(1, math.Ceil(a.queueTimeout.Seconds())))
+}
+
+// Wrap returns a handler that admits requests starting a new session before calling next.
+// cookie is the name of the session cookie next issues. A cookie only skips admission for a session the server knows,
+// as the server starts a new session for any token it doesn't.
+func (a *admission) Wrap(next http.HandlerFunc, cookie string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if c, err := r.Cookie(cookie); err == nil && a.known(c.Value) {
+			next(w, r)
+			return
+		}
+
+		if !a.admit(r) {
+			log.Debugw("session rejected", "object", "admission", "method", "Wrap", "remote", r.RemoteAddr)
+			w.Header().Set("Retry-After", strconv.Itoa(a.retryAfter()))
+			http.Error(w, "too many sessions", http.StatusServiceUnavailable)
+			return
+		}
+		// Once next returns the session is registered with the server and counted as active.
+		defer a.release()
+
+		next(w, r)
+	}
+}
+
+// retryTransport retries requests a remote turned away with 503 Service Unavailable or
+// 429 Too Many Requests, waiting for the Retry-After it asks for or backing off exponentially.
+type retryTransport struct {
+	base       http.RoundTripper
+	maxRetries int
+}
+
+// Longest wait between retries, whatever the remote asks for.
+const maxRetryWait = time.Minute
+
+func (t *retryTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if t.maxRetries < 1 {
+		return t.base.RoundTrip(r)
+	}
+
+	// Protocol request bodies are streamed, so buffer them to be able to send them again.
+	var body []byte
+	if r.Body != nil {
+		var err error
+		if body, err = io.ReadAll(r.Body); err != nil {
+			return nil, err
+		}
+		r.Body.Close()
+	}
+
+	for attempt := 0; ; attempt++ {
+		req := r.Clone(r.Context())
+		if body != nil {
+			req.Body = io.NopCloser(bytes.NewReader(body))
+			req.ContentLength = int64(len(body))
+		}
+
+		resp, err := t.base.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusServiceUnavailable && resp.StatusCode != http.StatusTooManyRequests {
+			return resp, nil
+		}
+		if attempt >= t.maxRetries {
+			return resp, nil
+		}
+
+		wait := backoff(attempt)
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds >= 0 {
+			wait = time.Duration(seconds) * time.Second
+		}
+		if wait > maxRetryWait {
+			wait = maxRetryWait
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		log.Debugw("remote busy, retrying", "object", "retryTransport", "method", "RoundTrip", "url", r.URL.String(), "attempt", attempt+1, "wait", wait)
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+			timer.Stop()
+			return nil, fmt.Errorf("waiting to retry: %w", r.Context().Err())
+		}
+	}
+}
+
+// backoff returns the exponential backoff for a retry attempt, starting at half a second.
+func backoff(attempt int) time.Duration {
+	return time.Duration(math.Min(float64(maxRetryWait), float64(500*time.Millisecond)*math.Pow(2, float64(attempt))))
+}
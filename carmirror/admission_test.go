@@ -0,0 +1,86 @@
+package carmirror
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAdmissionRejectsWhenFull(t *testing.T) {
+	active := 1
+	adm := newAdmission(1, 0, time.Second, func() int { return active }, func(token string) bool { return token == "existing" })
+	handler := adm.Wrap(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}, "sinkSessionId")
+
+	// A new session is turned away while the only slot is taken
+	res := httptest.NewRecorder()
+	handler(res, httptest.NewRequest("POST", "/dag/cm/blocks", nil))
+	if res.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected %d, got %d", http.StatusServiceUnavailable, res.Code)
+	}
+	if res.Header().Get("Retry-After") != "1" {
+		t.Errorf("expected Retry-After of 1, got %q", res.Header().Get("Retry-After"))
+	}
+
+	// An existing session is always let through
+	req := httptest.NewRequest("POST", "/dag/cm/blocks", nil)
+	req.AddCookie(&http.Cookie{Name: "sinkSessionId", Value: "existing"})
+	res = httptest.NewRecorder()
+	handler(res, req)
+	if res.Code != http.StatusAccepted {
+		t.Errorf("expected existing session to be accepted, got %d", res.Code)
+	}
+
+	// A cookie for a session the server doesn't know would start a new one, so is admitted like any other
+	req = httptest.NewRequest("POST", "/dag/cm/blocks", nil)
+	req.AddCookie(&http.Cookie{Name: "sinkSessionId", Value: "made-up"})
+	res = httptest.NewRecorder()
+	handler(res, req)
+	if res.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected an unknown session to be turned away, got %d", res.Code)
+	}
+
+	// Once the slot frees up, new sessions are admitted
+	active = 0
+	res = httptest.NewRecorder()
+	handler(res, httptest.NewRequest("POST", "/dag/cm/blocks", nil))
+	if res.Code != http.StatusAccepted {
+		t.Errorf("expected new session to be accepted, got %d", res.Code)
+	}
+}
+
+func TestRetryTransportHonoursRetryAfter(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != "batch" {
+			t.Errorf("expected the request body on every attempt, got %q", body)
+		}
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: &retryTransport{base: http.DefaultTransport, maxRetries: 2}}
+	res, err := client.Post(server.URL, "application/cbor", strings.NewReader("batch"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusAccepted {
+		t.Errorf("expected %d after retrying, got %d", http.StatusAccepted, res.StatusCode)
+	}
+	if attempts != 2 {
+		t.Errorf("expected 2 attempts, got %d", attempts)
+	}
+}
@@ -0,0 +1,158 @@
+package carmirror
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	cmipld "github.com/fission-codes/go-car-mirror/ipld"
+	"github.com/fission-codes/go-car-mirror/stats"
+	"github.com/fission-codes/kubo-car-mirror/carmirror/client"
+)
+
+// jsonFields describes the fields of struct type t as encoding/json sees them, by name.
+func jsonFields(t reflect.Type) map[string]string {
+	fields := make(map[string]string)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		if f.Anonymous {
+			for name, desc := range jsonFields(f.Type) {
+				fields[name] = desc
+			}
+			continue
+		}
+		fields[f.Name] = f.Type.Kind().String() + " " + string(f.Tag)
+	}
+	return fields
+}
+
+func TestClientTypes(t *testing.T) {
+	// The client has copies of our response types, so it needn't depend on Kubo. They must stay in step.
+	for _, pair := range []struct{ ours, client interface{} }{
+		{SessionSummary{}, client.SessionSummary{}},
+		{SessionFilter{}, client.SessionFilter{}},
+		{RemotePush{}, client.RemotePush{}},
+		{FanOutResponse{}, client.PushResponse{}},
+		{SourcePull{}, client.SourcePull{}},
+		{MultiPullResponse{}, client.PullResponse{}},
+		{StopResponse{}, client.StopResponse{}},
+		{stats.Bucket{}, client.Bucket{}},
+	} {
+		ours, theirs := reflect.TypeOf(pair.ours), reflect.TypeOf(pair.client)
+		if a, b := jsonFields(ours), jsonFields(theirs); !reflect.DeepEqual(a, b) {
+			t.Errorf("expected client.%s to match %s, got %v and %v", theirs.Name(), ours.Name(), b, a)
+		}
+	}
+}
+
+func TestClient(t *testing.T) {
+	ctx := context.Background()
+	cms, _ := newTestCarMirrors(t, 2)
+	if err := cms[1].StartRemote(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer cms[1].Close()
+	sink := "http://" + cms[1].RemoteAddr().String()
+	unreachable := "http://127.0.0.1:1"
+
+	block, err := cmipld.TryBlockFromCBOR("client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cms[0].blockStore.Add(ctx, block); err != nil {
+		t.Fatal(err)
+	}
+	root := block.Id().String()
+
+	// The commands API, as the plugin serves it.
+	m := http.NewServeMux()
+	m.Handle("/push/new", cms[0].NewPushSessionHandler())
+	m.Handle("/pull/new", cms[0].NewPullSessionHandler())
+	m.Handle("/ls", cms[0].LsHandler())
+	m.Handle("/cancel", cms[0].CancelHandler())
+	m.Handle("/stats", cms[0].StatsHandler())
+	server := httptest.NewServer(m)
+	defer server.Close()
+	c, err := client.New(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := c.Push(ctx, client.PushRequest{Cid: root, Addrs: []string{sink, unreachable}, Quorum: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Completed != 1 || len(res.Remotes) != 2 || res.Remotes[0].Session == "" || res.Remotes[0].Blocks != 1 {
+		t.Errorf("expected the push to the sink to complete the quorum, got %+v", res)
+	}
+	// A push to one remote reports nothing but its root and transfer.
+	if res, err := c.Push(ctx, client.PushRequest{Cid: root, Addrs: []string{sink}}); err != nil || res.Cid != root || res.Transfer == "" || res.Remotes != nil {
+		t.Errorf("expected the push to complete, got %+v, %v", res, err)
+	}
+	if res, err := c.Pull(ctx, client.PullRequest{Cid: root, Addrs: []string{sink}}); err != nil || res.Cid != root {
+		t.Errorf("expected the pull to complete, got %+v, %v", res, err)
+	}
+
+	sessions, err := c.Ls(ctx, client.LsRequest{SessionFilter: client.SessionFilter{Role: client.RoleClient, Remote: sink}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range sessions {
+		if s.Remote != sink || s.Role != client.RoleClient || s.Running() {
+			t.Errorf("expected only ended sessions with the sink, got %+v", s)
+		}
+	}
+	// Only the push to the unreachable remote may still be running.
+	stopped, err := c.Cancel(ctx, client.StopRequest{All: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range stopped.Sessions {
+		if s.Remote != unreachable {
+			t.Errorf("expected only the push to the unreachable remote to be cancelled, got %+v", s)
+		}
+	}
+	if buckets, err := c.Stats(ctx, ""); err != nil || len(buckets) == 0 {
+		t.Errorf("expected the stats to be reported, got %v, %v", buckets, err)
+	}
+
+	var apiErr *client.Error
+	if _, err := c.Pull(ctx, client.PullRequest{Cid: "not a cid", Addrs: []string{sink}}); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusInternalServerError {
+		t.Errorf("expected the bad cid to be reported, got %v", err)
+	}
+
+	// Two pushes to a remote that doesn't answer yet are each watched by their own transfer.
+	release := make(chan struct{})
+	stalled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer stalled.Close()
+	defer close(release)
+	background := client.TransferOptions{Background: true}
+	first, err := c.Push(ctx, client.PushRequest{Cid: root, Addrs: []string{stalled.URL}, TransferOptions: background})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := c.Push(ctx, client.PushRequest{Cid: root, Addrs: []string{stalled.URL}, TransferOptions: background})
+	if err != nil || second.Transfer == first.Transfer {
+		t.Fatalf("expected a transfer of its own, got %+v, %v", second, err)
+	}
+	running := <-c.Watch(ctx, first.Transfer, time.Millisecond)
+	if len(running) != 1 || running[0].Transfer != first.Transfer || running[0].Remote != stalled.URL {
+		t.Errorf("expected only the first push's session to be watched, got %+v", running)
+	}
+	if _, err := c.Cancel(ctx, client.StopRequest{SessionFilter: client.SessionFilter{Transfer: first.Transfer}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Cancel(ctx, client.StopRequest{SessionFilter: client.SessionFilter{Transfer: second.Transfer}}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,24 @@
+package carmirror
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+)
+
+// RequireBearerToken wraps a commands API handler so it only serves requests
+// carrying `Authorization: Bearer <token>`.
+func RequireBearerToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(bearerToken(r)), []byte(token)) != 1 {
+			log.Debugw("RequireBearerToken", "path", r.URL.Path, "error", "unauthorized")
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": "unauthorized",
+			})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,125 @@
+package carmirror
+
+import (
+	"container/list"
+	"context"
+	"sync"
+
+	cmcore "github.com/fission-codes/go-car-mirror/core"
+	cmipld "github.com/fission-codes/go-car-mirror/ipld"
+)
+
+// blockCacheSize is how many bytes of recently read blocks a blockCache keeps.
+const blockCacheSize = 64 << 20
+
+// blockCache is a block store that keeps recently read blocks, so pushes of the same DAG to several remotes
+// at once read each block from Kubo once. Concurrent reads of a block that isn't cached share one read.
+// Writes go straight to the underlying store.
+type blockCache struct {
+	cmcore.BlockStore[cmipld.Cid]
+	maxBytes int64
+
+	mu    sync.Mutex
+	bytes int64
+	// Cached blocks, most recently used at the front, and their elements by CID
+	lru     *list.List
+	entries map[cmipld.Cid]*list.Element
+	// Reads in progress, by CID
+	reads map[cmipld.Cid]*blockRead
+}
+
+type blockRead struct {
+	done  chan struct{}
+	block cmcore.Block[cmipld.Cid]
+	err   error
+	// abandoned is set if the read failed because its reader's context was done, rather than for the block
+	abandoned bool
+}
+
+func newBlockCache(store cmcore.BlockStore[cmipld.Cid], maxBytes int64) *blockCache {
+	return &blockCache{
+		BlockStore: store,
+		maxBytes:   maxBytes,
+		lru:        list.New(),
+		entries:    make(map[cmipld.Cid]*list.Element),
+		reads:      make(map[cmipld.Cid]*blockRead),
+	}
+}
+
+// Get reads a block through the cache. A reader waiting on another's read of the block tries the read itself
+// if the other reader gave up, so one cancelled push doesn't fail the others.
+func (bc *blockCache) Get(ctx context.Context, cid cmipld.Cid) (cmcore.Block[cmipld.Cid], error) {
+	for {
+		bc.mu.Lock()
+		if e, ok := bc.entries[cid]; ok {
+			bc.lru.MoveToFront(e)
+			bc.mu.Unlock()
+			return e.Value.(cmcore.Block[cmipld.Cid]), nil
+		}
+		if read, ok := bc.reads[cid]; ok {
+			bc.mu.Unlock()
+			select {
+			case <-read.done:
+				if read.abandoned && ctx.Err() == nil {
+					continue
+				}
+				return read.block, read.err
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		read := &blockRead{done: make(chan struct{})}
+		bc.reads[cid] = read
+		bc.mu.Unlock()
+
+		read.block, read.err = bc.BlockStore.Get(ctx, cid)
+		read.abandoned = read.err != nil && ctx.Err() != nil
+
+		bc.mu.Lock()
+		delete(bc.reads, cid)
+		if read.err == nil {
+			bc.add(read.block)
+		}
+		bc.mu.Unlock()
+		close(read.done)
+		return read.block, read.err
+	}
+}
+
+func (bc *blockCache) Has(ctx context.Context, cid cmipld.Cid) (bool, error) {
+	bc.mu.Lock()
+	_, ok := bc.entries[cid]
+	bc.mu.Unlock()
+	if ok {
+		return true, nil
+	}
+	return bc.BlockStore.Has(ctx, cid)
+}
+
+// add caches block, evicting the least recently used blocks to make room. It must be called holding mu.
+func (bc *blockCache) add(block cmcore.Block[cmipld.Cid]) {
+	size := int64(len(block.RawData()))
+	if size > bc.maxBytes {
+		return
+	}
+	if _, ok := bc.entries[block.Id()]; ok {
+		return
+	}
+	for bc.bytes+size > bc.maxBytes {
+		oldest := bc.lru.Back()
+		evicted := bc.lru.Remove(oldest).(cmcore.Block[cmipld.Cid])
+		delete(bc.entries, evicted.Id())
+		bc.bytes -= int64(len(evicted.RawData()))
+	}
+	bc.entries[block.Id()] = bc.lru.PushFront(block)
+	bc.bytes += size
+}
+
+// clear forgets every cached block.
+func (bc *blockCache) clear() {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	bc.lru.Init()
+	bc.entries = make(map[cmipld.Cid]*list.Element)
+	bc.bytes = 0
+}
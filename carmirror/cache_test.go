@@ -0,0 +1,137 @@
+package carmirror
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	cmcore "github.com/fission-codes/go-car-mirror/core"
+	cmipld "github.com/fission-codes/go-car-mirror/ipld"
+)
+
+// countingStore counts the blocks read from it.
+type countingStore struct {
+	cmcore.BlockStore[cmipld.Cid]
+	gets atomic.Int32
+}
+
+func (cs *countingStore) Get(ctx context.Context, cid cmipld.Cid) (cmcore.Block[cmipld.Cid], error) {
+	cs.gets.Add(1)
+	return cs.BlockStore.Get(ctx, cid)
+}
+
+func TestBlockCache(t *testing.T) {
+	ctx := context.Background()
+	nodes, err := MakeAPISwarm(ctx, false, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &countingStore{BlockStore: NewKuboStore(nodes[0])}
+	var ids []cmipld.Cid
+	var sizes []int64
+	for _, s := range []string{"one", "two", "three"} {
+		block, err := cmipld.TryBlockFromCBOR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.Add(ctx, block); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, block.Id())
+		sizes = append(sizes, int64(len(block.RawData())))
+	}
+
+	// Room for the last two blocks.
+	cache := newBlockCache(store, sizes[1]+sizes[2])
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := cache.Get(ctx, ids[0]); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := store.gets.Load(); n != 1 {
+		t.Errorf("expected concurrent reads to share one read, got %d", n)
+	}
+
+	cache.Get(ctx, ids[1])
+	cache.Get(ctx, ids[2])
+	if has, _ := cache.Has(ctx, ids[0]); !has {
+		t.Errorf("expected evicted blocks to still be found in the store")
+	}
+	cache.Get(ctx, ids[0])
+	if n := store.gets.Load(); n != 4 {
+		t.Errorf("expected the least recently used block to be evicted, got %d reads", n)
+	}
+
+	cache.clear()
+	cache.Get(ctx, ids[2])
+	if n := store.gets.Load(); n != 5 {
+		t.Errorf("expected a cleared cache to read again, got %d reads", n)
+	}
+}
+
+// stallingStore holds reads of blocks until released, or until their context is done.
+type stallingStore struct {
+	cmcore.BlockStore[cmipld.Cid]
+	reading chan struct{}
+	release chan struct{}
+}
+
+func (ss *stallingStore) Get(ctx context.Context, cid cmipld.Cid) (cmcore.Block[cmipld.Cid], error) {
+	ss.reading <- struct{}{}
+	select {
+	case <-ss.release:
+		return ss.BlockStore.Get(ctx, cid)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestBlockCacheAbandonedRead(t *testing.T) {
+	ctx := context.Background()
+	nodes, err := MakeAPISwarm(ctx, false, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kubo := NewKuboStore(nodes[0])
+	block, err := cmipld.TryBlockFromCBOR("one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kubo.Add(ctx, block); err != nil {
+		t.Fatal(err)
+	}
+	store := &stallingStore{BlockStore: kubo, reading: make(chan struct{}, 2), release: make(chan struct{})}
+	cache := newBlockCache(store, blockCacheSize)
+
+	// The first reader gives up while a second waits on its read.
+	firstCtx, cancel := context.WithCancel(ctx)
+	first := make(chan error)
+	go func() {
+		_, err := cache.Get(firstCtx, block.Id())
+		first <- err
+	}()
+	<-store.reading
+	second := make(chan error)
+	go func() {
+		_, err := cache.Get(ctx, block.Id())
+		second <- err
+	}()
+	cancel()
+	if err := <-first; err == nil {
+		t.Errorf("expected the cancelled read to fail")
+	}
+
+	// The second reader reads the block itself.
+	<-store.reading
+	close(store.release)
+	if err := <-second; err != nil {
+		t.Errorf("expected a waiting reader to read again when the first gave up, got %v", err)
+	}
+}
@@ -4,18 +4,23 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
-	"strings"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	cmbatch "github.com/fission-codes/go-car-mirror/batch"
 	instrumented "github.com/fission-codes/go-car-mirror/core/instrumented"
 	"github.com/fission-codes/go-car-mirror/filter"
-	cmhttp "github.com/fission-codes/go-car-mirror/http"
 	cmipld "github.com/fission-codes/go-car-mirror/ipld"
 	stats "github.com/fission-codes/go-car-mirror/stats"
 	coreiface "github.com/ipfs/boxo/coreiface"
+	"github.com/ipfs/boxo/mfs"
 	gocid "github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
 	golog "github.com/ipfs/go-log"
 	"github.com/pkg/errors"
 	"github.com/zeebo/xxh3"
@@ -27,6 +32,9 @@ var log = golog.Logger("kubo-car-mirror")
 
 const HASH_FUNCTION = 3
 
+// sessionReapInterval is how often what is kept about sessions the remote server has ended is forgotten.
+const sessionReapInterval = 10 * time.Second
+
 func init() {
 	filter.RegisterHash(3, XX3HashBlockId)
 }
@@ -36,8 +44,9 @@ func XX3HashBlockId(id cmipld.Cid, seed uint64) uint64 {
 }
 
 type CarMirror struct {
-	// CAR Mirror config
-	cfg *Config
+	// CAR Mirror config, whose reloadable settings Reconfigure changes while holding reconfigure
+	cfg         *Config
+	reconfigure sync.Mutex
 
 	// CoreAPI
 	capi coreiface.CoreAPI
@@ -46,10 +55,49 @@ type CarMirror struct {
 	blockStore *KuboStore
 
 	// HTTP client for CAR Mirror requests
-	client *cmhttp.Client[cmipld.Cid, *cmipld.Cid]
+	client *Client
+
+	// CAR Mirror request handlers and session state for the remote server
+	server *Server
+
+	// HTTP server listening for remote CAR Mirror requests
+	remote *http.Server
+
+	// Content and peer policy, nil if none is configured
+	policy *Policy
+
+	// UCAN authorization of remote sessions, nil if no trusted roots are configured
+	auth *ucanAuthorizer
+
+	// Session slots, taken by remote sessions and imports, nil if MaxSessions is 0
+	admission *admission
+
+	// Prometheus metrics
+	metrics *Metrics
+
+	// Session history, only kept for running sessions if no datastore is configured
+	history *History
 
-	// HTTP server for CAR Mirror requests
-	server *cmhttp.Server[cmipld.Cid, *cmipld.Cid]
+	// Mirror rules, watched while the remote server runs
+	mirrors *Mirrors
+
+	// Scheduled jobs, run while the remote server runs
+	schedules *Schedules
+
+	// Flushes and stops the tracer provider, if we created it
+	shutdownTracing func(context.Context) error
+
+	// Set once shutdown has begun, after which new sessions are refused
+	closing atomic.Bool
+	// Address the remote server is listening on, once started
+	remoteAddr net.Addr
+	// Stops the remote server's goroutines, which wg waits for
+	stopRemote context.CancelFunc
+	wg         sync.WaitGroup
+	// Shutdown only happens once, and its outcome is kept for later calls
+	shutdownOnce sync.Once
+	aborted      []SessionSummary
+	shutdownErr  error
 }
 
 // Config encapsulates CAR Mirror configuration
@@ -57,6 +105,122 @@ type Config struct {
 	HTTPRemoteAddr       string
 	MaxBlocksPerRound    uint32
 	MaxBlocksPerColdCall uint32
+
+	// HTTPReadTimeout and HTTPWriteTimeout bound how long the remote server spends reading a request and writing its response.
+	// 0 means no limit.
+	HTTPReadTimeout  time.Duration
+	HTTPWriteTimeout time.Duration
+	// HTTPMaxHeaderBytes limits the size of remote request headers.
+	HTTPMaxHeaderBytes int
+
+	// BloomCapacity is the number of blocks the bloom filters sent to remotes are sized for.
+	BloomCapacity uint
+	// BloomFunction is the registered hash function bloom filters use, usually HASH_FUNCTION.
+	BloomFunction uint64
+	// Instrument selects the parts of the protocol that report stats.
+	Instrument instrumented.InstrumentationOptions
+
+	// TLSCertFile and TLSKeyFile enable TLS on the remote server.
+	TLSCertFile string
+	TLSKeyFile  string
+	// TLSClientCAFile enables mutual TLS, requiring remote clients to present a certificate signed by this CA.
+	TLSClientCAFile string
+
+	// TLSRootCAFile replaces the system roots when verifying https:// remotes.
+	TLSRootCAFile string
+	// TLSClientCertFile and TLSClientKeyFile are presented to https:// remotes that require mutual TLS.
+	TLSClientCertFile string
+	TLSClientKeyFile  string
+
+	// UCANTrustedRoots are the DIDs allowed to root UCAN delegation chains.
+	// When set, remote push and pull requests must carry a UCAN granting them.
+	UCANTrustedRoots []string
+	// UCANAudience must be the audience of presented UCANs. Empty means this node's DID.
+	UCANAudience string
+	// UCANToken is presented to remotes when a request doesn't supply its own token.
+	UCANToken string
+
+	// MaxOutboundRate and MaxInboundRate limit the bytes per second sent and received
+	// across all sessions, as client and server. 0 means unlimited.
+	MaxOutboundRate uint64
+	MaxInboundRate  uint64
+	// RemoteRates limit the bytes per second, in each direction, used with individual remotes by URL.
+	RemoteRates map[string]uint64
+
+	// MaxSessions limits the sessions the remote server runs at once. 0 means unlimited.
+	MaxSessions int
+	// SessionQueueDepth is how many new sessions may wait for a free slot once MaxSessions is reached.
+	SessionQueueDepth int
+	// SessionQueueTimeout is how long a new session waits for a slot before being asked to retry later.
+	SessionQueueTimeout time.Duration
+	// MaxRetries is how many times the client retries a request when a remote asks it to retry later.
+	MaxRetries int
+
+	// DenylistFile lists CIDs, plain or double-hashed, that are never served or stored.
+	DenylistFile string
+	// AllowlistFile, if set, lists the only roots remote sessions may start from.
+	AllowlistFile string
+	// DeniedPeersFile lists IP addresses, CIDR ranges and DIDs whose remote requests are refused.
+	DeniedPeersFile string
+
+	// Compression is the content coding, zstd, gzip or none, used for protocol bodies when the peer accepts it.
+	Compression string
+	// CompressionLevel is the zstd (1-22) or gzip (1-9) level. 0 means the coding's default.
+	CompressionLevel int
+
+	// TracingExporter is where OpenTelemetry spans go: stdout, file or none.
+	// Empty means Kubo's tracer provider, configured with the OTEL_TRACES_EXPORTER environment variables.
+	TracingExporter string
+	// TracingFile is the file the file exporter appends spans to.
+	TracingFile string
+
+	// ShutdownGracePeriod is how long running sessions are given to finish when the service is closed,
+	// before they are cancelled. 0 cancels them straight away.
+	ShutdownGracePeriod time.Duration
+
+	// Datastore persists the history of sessions, the progress of mirror rules and scheduled jobs, usually Kubo's datastore.
+	// Nil keeps no history, mirror rules start afresh and scheduled jobs are forgotten on restart.
+	Datastore datastore.Datastore
+	// HistoryRetention is how long the records of ended sessions are kept. 0 keeps them for ever.
+	HistoryRetention time.Duration
+
+	// ExportDir is the directory pushes to a file write their CAR files in, and read filter snapshots from.
+	// Empty refuses pushes to a file.
+	ExportDir string
+	// ImportDir is the directory CAR files are imported from. Empty refuses imports.
+	ImportDir string
+
+	// Mirrors are the rules pushing IPNS names and MFS paths to remotes whenever their root changes.
+	Mirrors []MirrorRule
+	// MirrorInterval is how often mirror rules' sources are checked for a new root.
+	MirrorInterval time.Duration
+	// FilesRoot is Kubo's MFS root, which mfs: sources are resolved in.
+	FilesRoot *mfs.Root
+}
+
+// batchConfig returns the protocol settings for sessions.
+func (cfg *Config) batchConfig() cmbatch.Config {
+	return cmbatch.Config{
+		MaxBlocksPerRound:    cfg.MaxBlocksPerRound,
+		MaxBlocksPerColdCall: cfg.MaxBlocksPerColdCall,
+		BloomFunction:        cfg.BloomFunction,
+		BloomCapacity:        cfg.BloomCapacity,
+		Instrument:           cfg.Instrument,
+	}
+}
+
+// DefaultConfig returns the configuration New starts from, before its options are applied.
+func DefaultConfig() *Config {
+	return &Config{
+		HTTPReadTimeout:    100 * time.Second,
+		HTTPWriteTimeout:   100 * time.Second,
+		HTTPMaxHeaderBytes: 1 << 20,
+		BloomCapacity:      1024,
+		BloomFunction:      HASH_FUNCTION,
+		Instrument:         instrumented.INSTRUMENT_ORCHESTRATOR | instrumented.INSTRUMENT_STORE | instrumented.INSTRUMENT_FILTER,
+		MirrorInterval:     time.Minute,
+		HistoryRetention:   30 * 24 * time.Hour,
+	}
 }
 
 // Validate confirms the configuration is valid
@@ -73,13 +237,105 @@ func (cfg *Config) Validate() error {
 		return fmt.Errorf("MaxBlocksPerColdCall must be a positive number")
 	}
 
+	if cfg.HTTPReadTimeout < 0 {
+		return fmt.Errorf("HTTPReadTimeout must not be negative")
+	}
+
+	if cfg.HTTPWriteTimeout < 0 {
+		return fmt.Errorf("HTTPWriteTimeout must not be negative")
+	}
+
+	if cfg.HTTPMaxHeaderBytes < 0 {
+		return fmt.Errorf("HTTPMaxHeaderBytes must not be negative")
+	}
+
+	if cfg.BloomCapacity < 1 {
+		return fmt.Errorf("BloomCapacity must be a positive number")
+	}
+
+	if _, ok := filter.RegistryLookup[cmipld.Cid](cfg.BloomFunction); !ok {
+		return fmt.Errorf("BloomFunction %d is not a registered hash function", cfg.BloomFunction)
+	}
+
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		return fmt.Errorf("TLSCertFile and TLSKeyFile must be set together")
+	}
+
+	if cfg.TLSClientCAFile != "" && !cfg.TLSEnabled() {
+		return fmt.Errorf("TLSClientCAFile requires TLSCertFile and TLSKeyFile")
+	}
+
+	if (cfg.TLSClientCertFile == "") != (cfg.TLSClientKeyFile == "") {
+		return fmt.Errorf("TLSClientCertFile and TLSClientKeyFile must be set together")
+	}
+
+	if cfg.MaxSessions < 0 {
+		return fmt.Errorf("MaxSessions must not be negative")
+	}
+
+	if cfg.SessionQueueDepth < 0 {
+		return fmt.Errorf("SessionQueueDepth must not be negative")
+	}
+
+	if cfg.MaxSessions > 0 && cfg.SessionQueueDepth > 0 && cfg.SessionQueueTimeout <= 0 {
+		return fmt.Errorf("SessionQueueTimeout must be positive when sessions are queued")
+	}
+
+	if cfg.MaxRetries < 0 {
+		return fmt.Errorf("MaxRetries must not be negative")
+	}
+
+	if cfg.ShutdownGracePeriod < 0 {
+		return fmt.Errorf("ShutdownGracePeriod must not be negative")
+	}
+
+	if cfg.MirrorInterval <= 0 {
+		return fmt.Errorf("MirrorInterval must be positive")
+	}
+
+	if cfg.HistoryRetention < 0 {
+		return fmt.Errorf("HistoryRetention must not be negative")
+	}
+
+	if cfg.ExportDir != "" && !filepath.IsAbs(cfg.ExportDir) {
+		return fmt.Errorf("ExportDir must be an absolute path")
+	}
+	if cfg.ImportDir != "" && !filepath.IsAbs(cfg.ImportDir) {
+		return fmt.Errorf("ImportDir must be an absolute path")
+	}
+
+	names := make(map[string]bool)
+	for i := range cfg.Mirrors {
+		if err := cfg.Mirrors[i].Validate(); err != nil {
+			return fmt.Errorf("Mirrors: %w", err)
+		}
+		if names[cfg.Mirrors[i].Name] {
+			return fmt.Errorf("Mirrors: mirror %s is configured twice", cfg.Mirrors[i].Name)
+		}
+		names[cfg.Mirrors[i].Name] = true
+	}
+
+	if _, err := newCompressor(cfg.Compression, cfg.CompressionLevel); err != nil {
+		return fmt.Errorf("Compression: %w", err)
+	}
+
+	switch cfg.TracingExporter {
+	case TracingExporterKubo, TracingExporterNone, TracingExporterStdout:
+	case TracingExporterFile:
+		if cfg.TracingFile == "" {
+			return fmt.Errorf("TracingFile is required by the file TracingExporter")
+		}
+	default:
+		return fmt.Errorf("TracingExporter must be %s, %s or %s", TracingExporterStdout, TracingExporterFile, TracingExporterNone)
+	}
+
 	return nil
 }
 
 // New creates a local CAR Mirror service.
 func New(capi coreiface.CoreAPI, blockStore *KuboStore, opts ...func(cfg *Config)) (*CarMirror, error) {
 	// Add default stuff to the config
-	cfg := &Config{}
+	cfg := DefaultConfig()
 
 	for _, opt := range opts {
 		opt(cfg)
@@ -89,56 +345,522 @@ func New(capi coreiface.CoreAPI, blockStore *KuboStore, opts ...func(cfg *Config
 		return nil, err
 	}
 
-	cmResponderConfig := cmbatch.Config{
-		MaxBlocksPerRound:    cfg.MaxBlocksPerRound,
-		MaxBlocksPerColdCall: cfg.MaxBlocksPerColdCall,
-		BloomFunction:        HASH_FUNCTION,
-		BloomCapacity:        1024,
-		// TODO: Make this configurable via config file
-		Instrument: instrumented.INSTRUMENT_ORCHESTRATOR | instrumented.INSTRUMENT_STORE | instrumented.INSTRUMENT_FILTER,
+	cmResponderConfig := cfg.batchConfig()
+
+	transport, err := cfg.clientTransport()
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := cfg.serverTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	compressor, err := newCompressor(cfg.Compression, cfg.CompressionLevel)
+	if err != nil {
+		return nil, err
 	}
 
-	cmServerConfig := cmhttp.Config{
-		Address: cfg.HTTPRemoteAddr,
+	tracerProvider, shutdownTracing, err := newTracerProvider(cfg.TracingExporter, cfg.TracingFile)
+	if err != nil {
+		return nil, err
+	}
+	tracer := tracerProvider.Tracer(tracerName)
+
+	var policy *Policy
+	if cfg.DenylistFile != "" || cfg.AllowlistFile != "" || cfg.DeniedPeersFile != "" {
+		if policy, err = NewPolicy(cfg.DenylistFile, cfg.AllowlistFile, cfg.DeniedPeersFile); err != nil {
+			return nil, err
+		}
 	}
+	blockStore.SetPolicy(policy)
+
+	history := NewHistory(cfg.Datastore, cfg.HistoryRetention)
 
 	cm := &CarMirror{
 		cfg:        cfg,
 		capi:       capi,
 		blockStore: blockStore,
-		client:     cmhttp.NewClient[cmipld.Cid](blockStore, cmResponderConfig),
-		server:     cmhttp.NewServer[cmipld.Cid](blockStore, cmServerConfig, cmResponderConfig),
+		client:     NewClient(deniedAsMissing{blockStore}, cmResponderConfig, transport),
+		server:     NewServer(deniedAsMissing{blockStore}, cmResponderConfig),
+		policy:     policy,
+		metrics:    NewMetrics(cmResponderConfig.BloomCapacity),
+		history:    history,
+
+		shutdownTracing: shutdownTracing,
+	}
+	cm.metrics.sessions = cm.sessionMetrics
+	cm.metrics.remotes = newServedRemotes(cfg)
+	if cm.mirrors, err = NewMirrors(context.Background(), cfg.Datastore, cfg.Mirrors, cm.resolveSource,
+		func(ctx context.Context, remote string, root, base gocid.Cid) error {
+			return cm.push(ctx, remote, 0, "", "", []gocid.Cid{root}, base)
+		}); err != nil {
+		return nil, err
+	}
+	if cm.schedules, err = NewSchedules(context.Background(), cfg.Datastore, cm.scheduledSync); err != nil {
+		return nil, err
+	}
+	cm.client.defaultToken = cfg.UCANToken
+
+	// Global limits are shared between the client and the remote server.
+	cm.client.outbound = NewRateLimiter(cfg.MaxOutboundRate)
+	cm.client.inbound = NewRateLimiter(cfg.MaxInboundRate)
+	cm.client.remoteRates = cfg.RemoteRates
+	cm.client.maxRetries = cfg.MaxRetries
+	cm.client.compressor = compressor
+	cm.client.metrics = cm.metrics
+	cm.client.tracer = tracer
+	cm.server.SetTracer(tracer)
+	cm.server.ended = func(token cmbatch.SessionId, cancelled bool, err error) {
+		history.endServed(string(token), cancelled, err)
+	}
+	cm.client.history = history
+
+	// The Server owns the protocol handlers, and we run our own HTTP server
+	// in front of them so we control how it listens.
+	m := http.NewServeMux()
+	m.Handle("/", http.NotFoundHandler())
+	// A client pulling talks to our source session, and a client pushing to our sink session.
+	handleStatus := cm.server.HandleStatus
+	handleBlocks := cm.server.HandleBlocks
+	// Has queries start no session, so aren't recorded, but are authorized like the push they come before,
+	// and take a session slot while they are answered.
+	handleHas := cm.server.HandleHas
+	// Blocks outside the DAG under a has query's root are only answered for clients that may pull every block.
+	cm.server.answersAll = func(r *http.Request) bool { return cm.auth.grantsAll(r, CapabilityPull) }
+	if cfg.MaxSessions > 0 {
+		cm.admission = newAdmission(cfg.MaxSessions, cfg.SessionQueueDepth, cfg.SessionQueueTimeout, func() int {
+			return len(cm.server.SinkSessions()) + len(cm.server.SourceSessions())
+		}, cm.servesSession)
+		handleStatus = cm.admission.Wrap(handleStatus, "sourceSessionId")
+		handleBlocks = cm.admission.Wrap(handleBlocks, "sinkSessionId")
+		handleHas = cm.admission.Wrap(handleHas, "")
+	}
+	if len(cfg.UCANTrustedRoots) > 0 {
+		// Without an audience, a UCAN issued to any other node would be accepted here.
+		if cfg.UCANAudience == "" {
+			if cfg.UCANAudience, err = nodeDID(context.Background(), capi); err != nil {
+				return nil, fmt.Errorf("UCANAudience is required, as it can't default to this node's DID: %w", err)
+			}
+		}
+		cm.auth = newUCANAuthorizer(NewUCANVerifier(cfg.UCANTrustedRoots, cfg.UCANAudience), cm.links, cm.servesSession)
+		handleStatus = cm.auth.Wrap(handleStatus, CapabilityPull, "sourceSessionId")
+		handleBlocks = cm.auth.Wrap(handleBlocks, CapabilityPush, "sinkSessionId")
+		handleHas = cm.auth.Wrap(handleHas, CapabilityPush, "")
+	}
+	if policy != nil {
+		// Denied peers are turned away before anything else is done for them.
+		handleStatus = policy.Wrap(handleStatus, CapabilityPull, "sourceSessionId")
+		handleBlocks = policy.Wrap(handleBlocks, CapabilityPush, "sinkSessionId")
+		handleHas = policy.Wrap(handleHas, CapabilityPush, "")
+	}
+	handleStatus = history.Wrap(handleStatus, CapabilityPull, "sourceSessionId")
+	handleBlocks = history.Wrap(handleBlocks, CapabilityPush, "sinkSessionId")
+	handleStatus = cm.metrics.Wrap(handleStatus, DirectionPull, "sourceSessionId")
+	handleBlocks = cm.metrics.Wrap(handleBlocks, DirectionPush, "sinkSessionId")
+	// Bodies are decompressed before anything reads them, and throttled as they are on the wire.
+	handleStatus = throttle(compress(handleStatus, compressor, "sourceSessionId"), cm.client.globalLimiters, "sourceSessionId")
+	handleBlocks = throttle(compress(handleBlocks, compressor, "sinkSessionId"), cm.client.globalLimiters, "sinkSessionId")
+	handleHas = throttle(compress(handleHas, compressor, ""), cm.client.globalLimiters, "")
+	handleStatus = traceHandler(handleStatus, tracer, "carmirror.serve.status", "sourceSessionId")
+	handleBlocks = traceHandler(handleBlocks, tracer, "carmirror.serve.blocks", "sinkSessionId")
+	handleHas = traceHandler(handleHas, tracer, "carmirror.serve.has", "")
+	m.HandleFunc("/dag/cm/status", cm.refuseWhenClosing(handleStatus, "sourceSessionId"))
+	m.HandleFunc("/dag/cm/blocks", cm.refuseWhenClosing(handleBlocks, "sinkSessionId"))
+	m.HandleFunc(hasQueryPath, cm.refuseWhenClosing(handleHas, ""))
+
+	cm.remote = &http.Server{
+		Addr:           cfg.HTTPRemoteAddr,
+		Handler:        m,
+		TLSConfig:      tlsConfig,
+		ReadTimeout:    cfg.HTTPReadTimeout,
+		WriteTimeout:   cfg.HTTPWriteTimeout,
+		MaxHeaderBytes: cfg.HTTPMaxHeaderBytes,
 	}
 
 	return cm, nil
 }
 
+// Reconfigure applies the options to the configuration and puts the settings that can change while running into effect:
+// batch sizes, bloom filters, instrumentation, bandwidth limits and retries.
+// Sessions started from now on use them, and running sessions are also held to the new bandwidth limits.
+// Changes to other settings are ignored, as they only take effect when CAR Mirror is created.
+func (cm *CarMirror) Reconfigure(opts ...func(cfg *Config)) error {
+	log.Debugw("enter", "object", "CarMirror", "method", "Reconfigure")
+	cm.reconfigure.Lock()
+	defer cm.reconfigure.Unlock()
+
+	cfg := *cm.cfg
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	batch := cfg.batchConfig()
+	cm.client.Reconfigure(batch, NewRateLimiter(cfg.MaxOutboundRate), NewRateLimiter(cfg.MaxInboundRate), cfg.RemoteRates, cfg.MaxRetries)
+	cm.server.SetConfig(batch)
+	cm.metrics.bloomCapacity.Store(uint64(cfg.BloomCapacity))
+
+	// Only the reloadable settings change, as others are read without holding the lock.
+	cm.cfg.MaxBlocksPerRound = cfg.MaxBlocksPerRound
+	cm.cfg.MaxBlocksPerColdCall = cfg.MaxBlocksPerColdCall
+	cm.cfg.BloomCapacity = cfg.BloomCapacity
+	cm.cfg.BloomFunction = cfg.BloomFunction
+	cm.cfg.Instrument = cfg.Instrument
+	cm.cfg.MaxOutboundRate = cfg.MaxOutboundRate
+	cm.cfg.MaxInboundRate = cfg.MaxInboundRate
+	cm.cfg.RemoteRates = cfg.RemoteRates
+	cm.cfg.MaxRetries = cfg.MaxRetries
+	return nil
+}
+
+// StartRemote starts the remote server, the watching of mirror rules and the scheduler, which run until ctx is done or the service is closed.
 func (cm *CarMirror) StartRemote(ctx context.Context) error {
 	log.Debugw("enter", "object", "CarMirror", "method", "StartRemote")
 	if cm.server == nil {
 		return fmt.Errorf("CAR Mirror is not configured as a remote")
 	}
 
+	// Listen before returning, so a port that can't be used is reported to the caller.
+	listener, err := net.Listen("tcp", cm.cfg.HTTPRemoteAddr)
+	if err != nil {
+		return err
+	}
+	cm.remoteAddr = listener.Addr()
+
+	ctx, cm.stopRemote = context.WithCancel(ctx)
+	cm.wg.Add(5)
+
+	go func() {
+		defer cm.wg.Done()
+		cm.mirrors.run(ctx, cm.cfg.MirrorInterval)
+	}()
+
 	go func() {
+		defer cm.wg.Done()
+		cm.schedules.runSchedules(ctx)
+	}()
+
+	go func() {
+		defer cm.wg.Done()
 		<-ctx.Done()
-		if cm.server != nil {
-			cm.server.Stop()
+		cm.remote.Close()
+	}()
+
+	// Forget what is kept about sessions that have ended, and old history records.
+	go func() {
+		defer cm.wg.Done()
+		ticker := time.NewTicker(sessionReapInterval)
+		defer ticker.Stop()
+		prune := time.NewTicker(historyPruneInterval)
+		defer prune.Stop()
+		if err := cm.history.prune(ctx); err != nil {
+			log.Warnw("failed to prune history", "object", "CarMirror", "method", "StartRemote", "error", err)
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				cm.history.reap(cm.servedSessions())
+				cm.auth.reap()
+				cm.policy.reap(cm.servesSession)
+				cm.server.reap()
+			case <-prune.C:
+				if err := cm.history.prune(ctx); err != nil {
+					log.Warnw("failed to prune history", "object", "CarMirror", "method", "StartRemote", "error", err)
+				}
+			}
 		}
 	}()
 
-	if cm.server != nil {
-		go cm.server.Start()
-	}
+	go func() {
+		defer cm.wg.Done()
+		var err error
+		if cm.cfg.TLSEnabled() {
+			// Certificates are already loaded into the server's TLSConfig
+			err = cm.remote.ServeTLS(listener, "", "")
+		} else {
+			err = cm.remote.Serve(listener)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Errorw("remote server stopped", "object", "CarMirror", "method", "StartRemote", "error", err)
+		}
+	}()
 
 	return nil
 }
 
+// RemoteAddr returns the address the remote server is listening on, or nil if it hasn't been started.
+func (cm *CarMirror) RemoteAddr() net.Addr {
+	return cm.remoteAddr
+}
+
+// refuseWhenClosing returns a remote protocol handler that asks clients starting new sessions to try again later
+// once shutdown has begun. Rounds of running sessions carry on, so they can finish.
+// cookie is the name of the session cookie next issues.
+func (cm *CarMirror) refuseWhenClosing(next http.HandlerFunc, cookie string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Only rounds of sessions we are running may carry on, not any request with a cookie.
+		if c, err := r.Cookie(cookie); cm.closing.Load() && (err != nil || !cm.servesSession(c.Value)) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(shutdownRetryAfter.Seconds())))
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// servedSessions reports whether each session the remote server is running has been cancelled, by session token.
+func (cm *CarMirror) servedSessions() map[string]bool {
+	sessions := make(map[string]bool)
+	for _, token := range cm.server.SourceSessions() {
+		if info, err := cm.server.SourceInfo(token); err == nil {
+			sessions[string(token)] = info.State&cmbatch.CANCELLED != 0
+		}
+	}
+	for _, token := range cm.server.SinkSessions() {
+		if info, err := cm.server.SinkInfo(token); err == nil {
+			sessions[string(token)] = info.State&cmbatch.CANCELLED != 0
+		}
+	}
+	return sessions
+}
+
+// sessionMetrics describes the running client and server sessions for metrics.
+func (cm *CarMirror) sessionMetrics() map[string]sessionMetrics {
+	sessions := make(map[string]sessionMetrics)
+
+	for _, key := range cm.client.SourceSessions() {
+		if info, err := cm.client.SourceInfo(key); err == nil {
+			sessions[sessionID(DirectionPush, key)] = sessionMetrics{DirectionPush, sessionRemote(key), info.HavesEstimate, info.State&cmbatch.CANCELLED != 0, false}
+		}
+	}
+	for _, key := range cm.client.SinkSessions() {
+		if info, err := cm.client.SinkInfo(key); err == nil {
+			sessions[sessionID(DirectionPull, key)] = sessionMetrics{DirectionPull, sessionRemote(key), info.HavesEstimate, info.State&cmbatch.CANCELLED != 0, false}
+		}
+	}
+
+	// Remote clients pull from our source sessions and push to our sink sessions.
+	// Their remote label is the one they started with, which Metrics keeps.
+	for _, token := range cm.server.SourceSessions() {
+		if info, err := cm.server.SourceInfo(token); err == nil {
+			sessions[string(token)] = sessionMetrics{DirectionPull, remoteServed, info.HavesEstimate, info.State&cmbatch.CANCELLED != 0, false}
+		}
+	}
+	for _, token := range cm.server.SinkSessions() {
+		if info, err := cm.server.SinkInfo(token); err == nil {
+			sessions[string(token)] = sessionMetrics{DirectionPush, remoteServed, info.HavesEstimate, info.State&cmbatch.CANCELLED != 0, false}
+		}
+	}
+
+	return sessions
+}
+
+// How often shutdown checks whether running sessions have finished.
+const shutdownPollInterval = 100 * time.Millisecond
+
+// How long clients refused during shutdown are asked to wait, and how long rounds in flight are given
+// to return once the remaining sessions have been cancelled.
+const (
+	shutdownRetryAfter    = 60 * time.Second
+	remoteShutdownTimeout = 5 * time.Second
+)
+
+// Shutdown stops the CAR Mirror service gracefully. New sessions are refused, and running sessions
+// are closed and given until ctx is done to finish, after which they are cancelled. The remote server
+// is then stopped, running sessions recorded in the history and buffered spans flushed.
+// It returns the sessions that had to be cancelled. Later calls return the outcome of the first.
+func (cm *CarMirror) Shutdown(ctx context.Context) ([]SessionSummary, error) {
+	cm.shutdownOnce.Do(func() {
+		log.Debugw("enter", "object", "CarMirror", "method", "Shutdown")
+		cm.closing.Store(true)
+
+		for _, s := range cm.runningSessions(SessionFilter{}) {
+			if err := cm.stopSession(s, false); err != nil {
+				log.Debugw("failed to close session", "object", "CarMirror", "method", "Shutdown", "session", s.ID, "error", err)
+			}
+		}
+
+		ticker := time.NewTicker(shutdownPollInterval)
+		defer ticker.Stop()
+		running := cm.runningSessions(SessionFilter{})
+	drain:
+		for len(running) > 0 {
+			select {
+			case <-ctx.Done():
+				break drain
+			case <-ticker.C:
+				running = cm.runningSessions(SessionFilter{})
+			}
+		}
+
+		cm.aborted = running
+		for _, s := range cm.aborted {
+			cm.history.abort(cm.historyID(s), "interrupted by shutdown")
+			if err := cm.stopSession(s, true); err != nil {
+				log.Debugw("failed to cancel session", "object", "CarMirror", "method", "Shutdown", "session", s.ID, "error", err)
+			}
+		}
+		if len(cm.aborted) > 0 {
+			ids := make([]string, len(cm.aborted))
+			for i, s := range cm.aborted {
+				ids[i] = s.ID
+			}
+			log.Warnw("cancelled sessions that did not finish before shutdown", "object", "CarMirror", "method", "Shutdown", "sessions", ids)
+		}
+
+		if cm.stopRemote != nil {
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), remoteShutdownTimeout)
+			if err := cm.remote.Shutdown(shutdownCtx); err != nil {
+				// Rounds held up in the block store may not return in time.
+				cm.remote.Close()
+			}
+			cancel()
+			cm.stopRemote()
+			cm.wg.Wait()
+		}
+
+		cm.history.reap(cm.servedSessions())
+		cm.history.Close()
+		cm.shutdownErr = cm.shutdownTracing(context.Background())
+	})
+	return cm.aborted, cm.shutdownErr
+}
+
+// Close shuts the CAR Mirror service down, giving running sessions the configured grace period to finish.
+func (cm *CarMirror) Close() error {
+	log.Debugw("enter", "object", "CarMirror", "method", "Close")
+	ctx, cancel := context.WithTimeout(context.Background(), cm.cfg.ShutdownGracePeriod)
+	defer cancel()
+	_, err := cm.Shutdown(ctx)
+	return err
+}
+
+// errClosing is returned to requests for new sessions once shutdown has begun.
+var errClosing = fmt.Errorf("CAR Mirror is shutting down")
+
+// push pushes roots to remote in a session of its own, diffing against base if it is defined, and waits for the
+// session to end. The session is cancelled if ctx is done first. A rate above 0 limits the session's bandwidth,
+// as for GetSourceSession, and the session presents token to the remote, as for NewSourceSession.
+// transfer, if not empty, is the id of the push or pull the session is listed under.
+func (cm *CarMirror) push(ctx context.Context, remote string, rate uint64, token string, transfer string, roots []gocid.Cid, base gocid.Cid) error {
+	_, session, err := cm.startPush(ctx, remote, rate, token, transfer, roots, base)
+	if err != nil {
+		return err
+	}
+	return await(ctx, DirectionPush, session.Done(), func() cmbatch.BatchState { return session.Info().State }, session.Cancel)
+}
+
+// startPush starts the session push waits for, returning the key the client keeps it under.
+func (cm *CarMirror) startPush(ctx context.Context, remote string, rate uint64, token string, transfer string, roots []gocid.Cid, base gocid.Cid) (string, *SourceSession, error) {
+	if cm.closing.Load() {
+		return "", nil, errClosing
+	}
+
+	key, session := cm.client.NewSourceSession(remote, rate, token)
+	if transfer != "" {
+		cm.history.setTransfer(sessionID(DirectionPush, key), transfer)
+	}
+	if base.Defined() {
+		if err := cm.client.SetBase(ctx, key, cmipld.WrapCid(base)); err != nil {
+			log.Debugw("could not diff against the base", "object", "CarMirror", "method", "startPush", "remote", remote, "error", err)
+		}
+	}
+	for _, root := range roots {
+		cm.history.addRoot(sessionID(DirectionPush, key), root.String())
+		if err := session.Enqueue(cmipld.WrapCid(root)); err != nil {
+			session.Cancel()
+			return "", nil, err
+		}
+	}
+	return key, session, nil
+}
+
+// pull pulls the DAGs under roots from remote in a session of its own, and waits for the session to end, as push does.
+// The blocks already held under them aren't pulled again. rate, token and transfer are as for push.
+func (cm *CarMirror) pull(ctx context.Context, remote string, rate uint64, token string, transfer string, roots []gocid.Cid) error {
+	if cm.closing.Load() {
+		return errClosing
+	}
+
+	key, session := cm.client.NewSinkSession(remote, rate, token)
+	if transfer != "" {
+		cm.history.setTransfer(sessionID(DirectionPull, key), transfer)
+	}
+	for _, root := range roots {
+		cm.history.addRoot(sessionID(DirectionPull, key), root.String())
+		if err := session.Enqueue(cmipld.WrapCid(root)); err != nil {
+			session.Cancel()
+			return err
+		}
+	}
+	return await(ctx, DirectionPull, session.Done(), func() cmbatch.BatchState { return session.Info().State }, session.Cancel)
+}
+
+// await waits for a session of our own to end, cancelling it if ctx is done first. what names the transfer in errors.
+func await(ctx context.Context, what string, done <-chan error, state func() cmbatch.BatchState, cancel func() error) error {
+	select {
+	case err := <-done:
+		if err != nil {
+			return err
+		}
+		if state()&cmbatch.CANCELLED != 0 {
+			return fmt.Errorf("%s cancelled", what)
+		}
+		return nil
+	case <-ctx.Done():
+		if err := cancel(); err != nil {
+			log.Debugw("could not cancel session", "object", "CarMirror", "method", "await", "error", err)
+		}
+		return ctx.Err()
+	}
+}
+
+// remoteParams checks addrs names each remote once and parses rate, returning 0 if it is empty.
+func (cm *CarMirror) remoteParams(addrs []string, rate string) (uint64, error) {
+	seen := make(map[string]bool)
+	for _, addr := range addrs {
+		if seen[addr] {
+			return 0, fmt.Errorf("remote %s is given twice", addr)
+		}
+		seen[addr] = true
+	}
+
+	var parsed uint64
+	if rate != "" {
+		var err error
+		if parsed, err = ParseRate(rate); err != nil {
+			return 0, fmt.Errorf("failed to parse rate: %w", err)
+		}
+	}
+	return parsed, nil
+}
+
 type PushParams struct {
-	Cid        string
-	Addr       string
+	Cid  string
+	Addr string
+	// Addrs are every remote to push to, for a push to several remotes at once, the first being Addr.
+	Addrs []string
+	// Quorum is how many of Addrs must complete for the push to succeed, 0 meaning all.
+	Quorum     int
 	Diff       string
+	Token      string `json:"-"`
+	Rate       string
 	Stream     bool
 	Background bool
+	// Transfer, if set, is an id of the caller's for the push, which every session it starts is listed under.
+	Transfer string
+	// DryRun estimates what the push would send to each remote, without pushing.
+	DryRun bool
+	// ToFile is the absolute path of a CAR file the push is written to, instead of sending it to a remote.
+	ToFile string
+	// Filter is the absolute path of a filter snapshot of what the remote holds, for a push to a file.
+	Filter string
 }
 
 func (cm *CarMirror) NewPushSessionHandler() http.HandlerFunc {
@@ -149,11 +871,23 @@ func (cm *CarMirror) NewPushSessionHandler() http.HandlerFunc {
 				Cid:        r.FormValue("cid"),
 				Addr:       r.FormValue("addr"),
 				Diff:       r.FormValue("diff"),
+				Token:      r.FormValue("token"),
+				Rate:       r.FormValue("rate"),
 				Stream:     r.FormValue("stream") == "true",
 				Background: r.FormValue("background") == "true",
+				Transfer:   r.FormValue("transfer"),
+				DryRun:     r.FormValue("dry_run") == "true",
+				ToFile:     r.FormValue("to_file"),
+				Filter:     r.FormValue("filter"),
 			}
+			p.Addrs = r.Form["addr"]
 			log.Debugw("NewPushSessionHandler", "params", p)
 
+			if cm.closing.Load() {
+				WriteError(w, errClosing)
+				return
+			}
+
 			// Parse the CID
 			cid, err := gocid.Parse(p.Cid)
 			if err != nil {
@@ -161,67 +895,145 @@ func (cm *CarMirror) NewPushSessionHandler() http.HandlerFunc {
 				return
 			}
 
-			// Need to get session, enqueue it, run it.
-			session := cm.client.GetSourceSession(p.Addr)
-
-			go func() {
-				if err := session.Enqueue(cmipld.WrapCid(cid)); err != nil {
-					log.Debugw("NewPushSessionHandler", "error", err)
-					WriteError(w, err)
-					return
-				}
-			}()
-
-			if !p.Background {
-				select {
-				case err := <-session.Done():
-					log.Debugw("NewPushSessionHandler", "session", "done")
-					if err != nil {
-						WriteError(w, err)
-					}
+			var diff gocid.Cid
+			if p.Diff != "" {
+				if diff, err = gocid.Parse(p.Diff); err != nil {
+					WriteError(w, errors.Wrap(err, "failed to parse diff CID"))
 					return
-				case <-time.After(10 * time.Minute):
-					// TODO: Unless we handle timeouts in a different manner, maybe make this default configurable plus overrideable per request
-					log.Debugw("NewPushSessionHandler", "session", "timeout")
 				}
 			}
-		}
-	})
-}
-
-type PullParams struct {
-	Cid        string
-	Addr       string
-	Stream     bool
-	Background bool
-}
 
-func (cm *CarMirror) NewPullSessionHandler() http.HandlerFunc {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		case "POST":
-			p := PullParams{
-				Cid:        r.FormValue("cid"),
-				Addr:       r.FormValue("addr"),
-				Stream:     r.FormValue("stream") == "true",
-				Background: r.FormValue("background") == "true",
+			if p.Quorum, err = formInt(r, "quorum"); err != nil {
+				WriteError(w, err)
+				return
 			}
-			log.Debugw("NewPullSessionHandler", "params", p)
 
-			// Parse the CID
-			cid, err := gocid.Parse(p.Cid)
-			if err != nil {
-				WriteError(w, errors.Wrap(err, "failed to parse CID"))
+			if p.Stream && len(p.Addrs) < 2 {
+				WriteError(w, fmt.Errorf("progress can only be streamed when pushing to several remotes"))
 				return
 			}
-			// Initiate the pull
-			log.Debugw("before receive", "object", "CarMirror", "method", "NewPullSessionHandler", "cid", cid.String(), "addr", p.Addr)
 
-			session := cm.client.GetSinkSession(p.Addr)
+			if p.Filter != "" && p.ToFile == "" {
+				WriteError(w, fmt.Errorf("a filter snapshot can only be used when pushing to a file"))
+				return
+			}
 
-			go func() {
-				if err := session.Enqueue(cmipld.WrapCid(cid)); err != nil {
-					log.Debugw("NewPullSessionHandler", "error", err)
+			// An export writes what a remote holding the diff would need to a CAR file, for carrying over by hand.
+			if p.ToFile != "" {
+				if len(p.Addrs) > 0 {
+					WriteError(w, fmt.Errorf("give either a remote or a file to push to"))
+					return
+				}
+				path, err := pathIn("ExportDir", cm.cfg.ExportDir, p.ToFile)
+				if err != nil {
+					WriteError(w, err)
+					return
+				}
+				var snapshot *FilterSnapshot
+				if p.Filter != "" {
+					filterPath, err := pathIn("ExportDir", cm.cfg.ExportDir, p.Filter)
+					if err != nil {
+						WriteError(w, err)
+						return
+					}
+					if snapshot, err = readFilterSnapshotFile(filterPath); err != nil {
+						WriteError(w, err)
+						return
+					}
+				}
+				res, err := cm.export(r.Context(), path, cid, diff, snapshot)
+				if err != nil {
+					log.Debugw("NewPushSessionHandler", "error", err)
+					WriteError(w, err)
+					return
+				}
+				json.NewEncoder(w).Encode(res)
+				return
+			}
+
+			// A dry run reports what each remote is missing, and sends nothing.
+			if p.DryRun {
+				res, err := cm.estimate(r.Context(), p, cid, diff)
+				if err != nil {
+					log.Debugw("NewPushSessionHandler", "error", err)
+					WriteError(w, err)
+					return
+				}
+				json.NewEncoder(w).Encode(res)
+				return
+			}
+
+			// Several remotes are pushed to at once, each reported on.
+			if len(p.Addrs) > 1 {
+				// A streamed push reports its progress a line at a time, the last line being the outcome.
+				enc := json.NewEncoder(w)
+				var report func(*FanOutResponse)
+				if p.Stream {
+					report = func(res *FanOutResponse) {
+						enc.Encode(res)
+						if f, ok := w.(http.Flusher); ok {
+							f.Flush()
+						}
+					}
+				}
+				res, err := cm.fanOutPush(r.Context(), p, cid, diff, report)
+				if err != nil {
+					log.Debugw("NewPushSessionHandler", "error", err)
+					WriteError(w, err)
+					return
+				}
+				if res.Error != "" && !p.Stream {
+					w.WriteHeader(http.StatusInternalServerError)
+				}
+				enc.Encode(res)
+				return
+			}
+			if p.Quorum > 1 {
+				WriteError(w, fmt.Errorf("quorum %d is more than the 1 remote", p.Quorum))
+				return
+			}
+
+			rate, err := cm.remoteParams([]string{p.Addr}, p.Rate)
+			if err != nil {
+				WriteError(w, err)
+				return
+			}
+
+			// A diff is pushed in a session of its own, as a session shared with other pushes to the remote
+			// would skip the diff's blocks for all of them. So is a push with a token, which only its own
+			// session presents, and a push with a transfer id, whose session is listed under it.
+			if diff.Defined() || p.Token != "" || p.Transfer != "" {
+				done := make(chan error, 1)
+				go func() {
+					err := cm.push(context.Background(), p.Addr, rate, p.Token, p.Transfer, []gocid.Cid{cid}, diff)
+					if err != nil {
+						log.Debugw("NewPushSessionHandler", "error", err)
+					}
+					done <- err
+				}()
+				if !p.Background {
+					select {
+					case err := <-done:
+						if err != nil {
+							WriteError(w, err)
+							return
+						}
+					case <-time.After(10 * time.Minute):
+						log.Debugw("NewPushSessionHandler", "session", "timeout")
+						return
+					}
+				}
+				json.NewEncoder(w).Encode(&FanOutResponse{Cid: cid.String(), Transfer: p.Transfer})
+				return
+			}
+
+			// Need to get session, enqueue it, run it.
+			session := cm.client.GetSourceSession(p.Addr, rate)
+			cm.history.addRoot(sessionID(DirectionPush, p.Addr), cid.String())
+
+			go func() {
+				if err := session.Enqueue(cmipld.WrapCid(cid)); err != nil {
+					log.Debugw("NewPushSessionHandler", "error", err)
 					WriteError(w, err)
 					return
 				}
@@ -230,155 +1042,326 @@ func (cm *CarMirror) NewPullSessionHandler() http.HandlerFunc {
 			if !p.Background {
 				select {
 				case err := <-session.Done():
-					log.Debugw("NewPullSessionHandler", "session", "done")
+					log.Debugw("NewPushSessionHandler", "session", "done")
 					if err != nil {
 						WriteError(w, err)
 					}
 					return
 				case <-time.After(10 * time.Minute):
-					// TODO: Do we want this shorter?  In particular for CI so we can kill hung sessions instead of waiting way too long?
 					// TODO: Unless we handle timeouts in a different manner, maybe make this default configurable plus overrideable per request
-					log.Debugw("NewPullSessionHandler", "session", "timeout")
+					log.Debugw("NewPushSessionHandler", "session", "timeout")
 				}
 			}
 		}
 	})
 }
 
-// TODO: Any params?
-type LsParams struct {
-}
-
-type LsResponse struct {
-	SessionId   string
-	SessionInfo string
+type PullParams struct {
+	Cid  string
+	Addr string
+	// Addrs are every source to pull from, for a pull from several sources at once, the first being Addr.
+	Addrs      []string
+	Token      string `json:"-"`
+	Rate       string
+	Stream     bool
+	Background bool
+	// Transfer, if set, is an id of the caller's for the pull, which every session it starts is listed under.
+	Transfer string
 }
 
-func (cm *CarMirror) LsHandler() http.HandlerFunc {
+func (cm *CarMirror) NewPullSessionHandler() http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case "POST":
-			p := LsParams{}
-			log.Debugw("LsHandler", "params", p)
-
-			sessionMap := make(map[string]LsResponse)
-			sessions := make([]LsResponse, 0)
+			p := PullParams{
+				Cid:        r.FormValue("cid"),
+				Addr:       r.FormValue("addr"),
+				Token:      r.FormValue("token"),
+				Rate:       r.FormValue("rate"),
+				Stream:     r.FormValue("stream") == "true",
+				Background: r.FormValue("background") == "true",
+				Transfer:   r.FormValue("transfer"),
+			}
+			p.Addrs = r.Form["addr"]
+			log.Debugw("NewPullSessionHandler", "params", p)
 
-			// Start off with the list of sessions from the stats, so they are returned even if closed.
-			// TODO: This is error prone since we're assuming prefixes (i.e. keys) in the snapshot are session ids.
-			// Currently that is true, but it may not always be true.
-			for _, key := range stats.GLOBAL_REPORTING.Snapshot().Keys() {
-				session := strings.Split(key, ".")[0]
-				sessionMap[session] = LsResponse{SessionId: session, SessionInfo: "unknown"}
+			if cm.closing.Load() {
+				WriteError(w, errClosing)
+				return
 			}
 
-			log.Debugw("LsHandler", "server.sinkSessions", cm.server.SinkSessions())
-			sessionTokens := cm.server.SinkSessions()
-			for _, sessionToken := range sessionTokens {
-				sessionInfo, err := cm.server.SinkInfo(sessionToken)
+			// Parse the CID
+			cid, err := gocid.Parse(p.Cid)
+			if err != nil {
+				WriteError(w, errors.Wrap(err, "failed to parse CID"))
+				return
+			}
+			if p.Stream {
+				WriteError(w, fmt.Errorf("the progress of a pull can't be streamed"))
+				return
+			}
+			// Different subtrees are pulled from each source at once.
+			if len(p.Addrs) > 1 {
+				res, err := cm.multiPull(r.Context(), p, cid)
 				if err != nil {
-					log.Debugw("LsHandler", "error", err)
+					log.Debugw("NewPullSessionHandler", "error", err)
 					WriteError(w, err)
 					return
 				}
-				sessionMap[string(sessionToken)] = LsResponse{SessionId: string(sessionToken), SessionInfo: sessionInfo.String()}
-				log.Debugw("LsHandler", "sessionInfo", sessionInfo)
+				if res.Error != "" {
+					w.WriteHeader(http.StatusInternalServerError)
+				}
+				json.NewEncoder(w).Encode(res)
+				return
 			}
 
-			log.Debugw("LsHandler", "server.sourceSessions", cm.server.SourceSessions())
-			sessionTokens = cm.server.SourceSessions()
-			for _, sessionToken := range sessionTokens {
-				sessionInfo, err := cm.server.SourceInfo(sessionToken)
-				if err != nil {
-					log.Debugw("LsHandler", "error", err)
-					WriteError(w, err)
-					return
+			// Initiate the pull
+			log.Debugw("before receive", "object", "CarMirror", "method", "NewPullSessionHandler", "cid", cid.String(), "addr", p.Addr)
+
+			rate, err := cm.remoteParams([]string{p.Addr}, p.Rate)
+			if err != nil {
+				WriteError(w, err)
+				return
+			}
+
+			// A pull with a token runs in a session of its own, which only it presents the token in.
+			// So does a pull with a transfer id, whose session is listed under it.
+			if p.Token != "" || p.Transfer != "" {
+				done := make(chan error, 1)
+				go func() {
+					err := cm.pull(context.Background(), p.Addr, rate, p.Token, p.Transfer, []gocid.Cid{cid})
+					if err != nil {
+						log.Debugw("NewPullSessionHandler", "error", err)
+					}
+					done <- err
+				}()
+				if !p.Background {
+					select {
+					case err := <-done:
+						if err != nil {
+							WriteError(w, err)
+							return
+						}
+					case <-time.After(10 * time.Minute):
+						log.Debugw("NewPullSessionHandler", "session", "timeout")
+						return
+					}
 				}
-				sessionMap[string(sessionToken)] = LsResponse{SessionId: string(sessionToken), SessionInfo: sessionInfo.String()}
-				log.Debugw("LsHandler", "sessionInfo", sessionInfo)
+				json.NewEncoder(w).Encode(&MultiPullResponse{Cid: cid.String(), Transfer: p.Transfer})
+				return
 			}
 
-			log.Debugw("LsHandler", "client.sinkSessions", cm.client.SinkSessions())
-			// TODO: update client.SinkSessions to return a slice of session tokens instead of strings
-			clientSessionTokens := cm.client.SinkSessions()
-			for _, sessionToken := range clientSessionTokens {
-				sessionInfo, err := cm.client.SinkInfo(sessionToken)
-				if err != nil {
-					log.Debugw("LsHandler", "error", err)
+			session := cm.client.GetSinkSession(p.Addr, rate)
+			cm.history.addRoot(sessionID(DirectionPull, p.Addr), cid.String())
+
+			go func() {
+				if err := session.Enqueue(cmipld.WrapCid(cid)); err != nil {
+					log.Debugw("NewPullSessionHandler", "error", err)
 					WriteError(w, err)
 					return
 				}
-				sessionMap[string(sessionToken)] = LsResponse{SessionId: string(sessionToken), SessionInfo: sessionInfo.String()}
-				log.Debugw("LsHandler", "sessionInfo", sessionInfo)
-			}
+			}()
 
-			log.Debugw("LsHandler", "client.sourceSessions", cm.client.SourceSessions())
-			clientSessionTokens = cm.client.SourceSessions()
-			for _, sessionToken := range clientSessionTokens {
-				sessionInfo, err := cm.client.SourceInfo(sessionToken)
-				if err != nil {
-					log.Debugw("LsHandler", "error", err)
-					WriteError(w, err)
+			if !p.Background {
+				select {
+				case err := <-session.Done():
+					log.Debugw("NewPullSessionHandler", "session", "done")
+					if err != nil {
+						WriteError(w, err)
+					}
 					return
+				case <-time.After(10 * time.Minute):
+					// TODO: Do we want this shorter?  In particular for CI so we can kill hung sessions instead of waiting way too long?
+					// TODO: Unless we handle timeouts in a different manner, maybe make this default configurable plus overrideable per request
+					log.Debugw("NewPullSessionHandler", "session", "timeout")
 				}
-				sessionMap[string(sessionToken)] = LsResponse{SessionId: string(sessionToken), SessionInfo: sessionInfo.String()}
-				log.Debugw("LsHandler", "sessionInfo", sessionInfo)
 			}
+		}
+	})
+}
+
+type LsParams struct {
+	SessionFilter
+	Offset int
+	Limit  int
+}
+
+func (cm *CarMirror) LsHandler() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			p := LsParams{
+				SessionFilter: SessionFilter{
+					State:     r.FormValue("state"),
+					Role:      r.FormValue("role"),
+					Direction: r.FormValue("direction"),
+					Remote:    r.FormValue("remote"),
+					Transfer:  r.FormValue("transfer"),
+				},
+			}
+			var err error
+			if p.Offset, err = formInt(r, "offset"); err != nil {
+				WriteError(w, err)
+				return
+			}
+			if p.Limit, err = formInt(r, "limit"); err != nil {
+				WriteError(w, err)
+				return
+			}
+			if err := p.SessionFilter.Validate(); err != nil {
+				WriteError(w, err)
+				return
+			}
+			log.Debugw("LsHandler", "params", p)
 
-			for _, session := range sessionMap {
-				sessions = append(sessions, session)
+			// Only the sessions up to the end of the page are needed.
+			max := 0
+			if p.Limit > 0 {
+				max = p.Offset + p.Limit
+			}
+			sessions, err := cm.Sessions(r.Context(), p.SessionFilter, max)
+			if err != nil {
+				log.Debugw("LsHandler", "error", err)
+				WriteError(w, err)
+				return
 			}
 
-			// Write the response
-			// TODO: Sort them?
-			json.NewEncoder(w).Encode(sessions)
-			return
+			json.NewEncoder(w).Encode(paginate(sessions, p.Offset, p.Limit))
 		}
 	})
 }
 
-type CancelParams struct {
+// formInt parses the non-negative integer form value key, which defaults to 0.
+func formInt(r *http.Request, key string) (int, error) {
+	value := r.FormValue(key)
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative number", key)
+	}
+	return n, nil
+}
+
+// StopParams select the running sessions to cancel or close: a single session by id,
+// every session matching a filter, or every session if All is set.
+type StopParams struct {
 	Session string
+	SessionFilter
+	All bool
+}
+
+type StopResponse struct {
+	// Sessions that were stopped, as they were beforehand
+	Sessions []SessionSummary
+}
+
+func stopParams(r *http.Request) (StopParams, error) {
+	p := StopParams{
+		Session: r.FormValue("session"),
+		SessionFilter: SessionFilter{
+			State:     r.FormValue("state"),
+			Role:      r.FormValue("role"),
+			Direction: r.FormValue("direction"),
+			Remote:    r.FormValue("remote"),
+			Transfer:  r.FormValue("transfer"),
+		},
+		All: r.FormValue("all") == "true",
+	}
+	if p.Session == "" && p.SessionFilter == (SessionFilter{}) && !p.All {
+		return p, fmt.Errorf("a session, a filter or all is required")
+	}
+	switch p.State {
+	case StateCompleted, StateFailed:
+		return p, fmt.Errorf("%s sessions have already stopped", p.State)
+	}
+	return p, p.SessionFilter.Validate()
+}
+
+// stopSessions cancels, or closes, the running sessions selected by p.
+func (cm *CarMirror) stopSessions(p StopParams, cancel bool) ([]SessionSummary, error) {
+	sessions := cm.runningSessions(p.SessionFilter)
+	sortSessions(sessions)
+
+	stopped := make([]SessionSummary, 0)
+	for _, s := range sessions {
+		if p.Session != "" && s.ID != p.Session {
+			continue
+		}
+		if err := cm.stopSession(s, cancel); err != nil {
+			return stopped, errors.Wrapf(err, "failed to stop session %s", s.ID)
+		}
+		stopped = append(stopped, s)
+	}
+
+	if p.Session != "" && len(stopped) == 0 {
+		return nil, fmt.Errorf("session not found")
+	}
+	return stopped, nil
+}
+
+// historyID returns the id the history keeps a running session under.
+func (cm *CarMirror) historyID(s SessionSummary) string {
+	if s.Role == RoleClient {
+		return sessionID(s.Direction, s.key)
+	}
+	return s.ID
 }
 
+// stopSession cancels, or closes, a running session. Our own sessions are found by the key the client keeps
+// them under, those we serve by token.
+func (cm *CarMirror) stopSession(s SessionSummary, cancel bool) error {
+	token := cmbatch.SessionId(s.ID)
+	switch {
+	case s.Role == RoleClient && s.Side == SideSource && cancel:
+		return cm.client.CancelSource(s.key)
+	case s.Role == RoleClient && s.Side == SideSource:
+		return cm.client.CloseSource(s.key)
+	case s.Role == RoleClient && cancel:
+		return cm.client.CancelSink(s.key)
+	case s.Role == RoleClient:
+		return cm.client.CloseSink(s.key)
+	case s.Side == SideSource && cancel:
+		return cm.server.CancelSource(token)
+	case s.Side == SideSource:
+		return cm.server.CloseSource(token)
+	case cancel:
+		return cm.server.CancelSink(token)
+	default:
+		return cm.server.CloseSink(token)
+	}
+}
+
+// CancelHandler cancels running sessions, ours or those we serve, abandoning transfers in progress.
 func (cm *CarMirror) CancelHandler() http.HandlerFunc {
+	return cm.stopHandler("CancelHandler", true)
+}
+
+// CloseHandler closes running sessions, ours or those we serve, once the transfers in progress are done.
+func (cm *CarMirror) CloseHandler() http.HandlerFunc {
+	return cm.stopHandler("CloseHandler", false)
+}
+
+func (cm *CarMirror) stopHandler(name string, cancel bool) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case "POST":
-			p := CancelParams{
-				Session: r.FormValue("session"),
-			}
-			log.Debugw("CancelHandler", "params", p)
-
-			for _, sessionToken := range cm.client.SinkSessions() {
-				if string(sessionToken) == p.Session {
-					if err := cm.client.CancelSink(sessionToken); err != nil {
-						log.Debugw("CancelHandler", "error", err)
-						WriteError(w, err)
-						return
-					}
-
-					WriteSuccess(w)
-
-					return
-				}
+			p, err := stopParams(r)
+			if err != nil {
+				WriteError(w, err)
+				return
 			}
+			log.Debugw(name, "params", p)
 
-			for _, sessionToken := range cm.client.SourceSessions() {
-				if string(sessionToken) == p.Session {
-					if err := cm.client.CancelSource(sessionToken); err != nil {
-						log.Debugw("CancelHandler", "error", err)
-						WriteError(w, err)
-						return
-					}
-
-					WriteSuccess(w)
-					return
-				}
+			stopped, err := cm.stopSessions(p, cancel)
+			if err != nil {
+				log.Debugw(name, "error", err)
+				WriteError(w, err)
+				return
 			}
 
-			// If we get here, we didn't find the session
-			WriteError(w, fmt.Errorf("session not found"))
+			json.NewEncoder(w).Encode(StopResponse{Sessions: stopped})
 		}
 	})
 }
@@ -413,6 +1396,355 @@ func (cm *CarMirror) StatsHandler() http.HandlerFunc {
 	})
 }
 
+// servesSession reports whether the remote server is running the session with the given token, in either direction.
+func (cm *CarMirror) servesSession(token string) bool {
+	if _, err := cm.server.SourceInfo(cmbatch.SessionId(token)); err == nil {
+		return true
+	}
+	_, err := cm.server.SinkInfo(cmbatch.SessionId(token))
+	return err == nil
+}
+
+type HistoryParams struct {
+	Direction string
+	Remote    string
+	Limit     int
+}
+
+// HistoryHandler lists the sessions that have ended, newest first.
+func (cm *CarMirror) HistoryHandler() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			p := HistoryParams{
+				Direction: r.FormValue("direction"),
+				Remote:    r.FormValue("remote"),
+			}
+			var err error
+			if p.Limit, err = formInt(r, "limit"); err != nil {
+				WriteError(w, err)
+				return
+			}
+			log.Debugw("HistoryHandler", "params", p)
+
+			records, err := cm.history.List(r.Context(), HistoryQuery{Direction: p.Direction, Remote: p.Remote, Limit: p.Limit})
+			if err != nil {
+				log.Debugw("HistoryHandler", "error", err)
+				WriteError(w, err)
+				return
+			}
+
+			json.NewEncoder(w).Encode(records)
+		}
+	})
+}
+
+// MirrorsHandler lists the mirror rules and how far each has got.
+func (cm *CarMirror) MirrorsHandler() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			log.Debugw("MirrorsHandler")
+			json.NewEncoder(w).Encode(cm.mirrors.List())
+		}
+	})
+}
+
+// MirrorAddHandler adds a mirror rule, which is kept across restarts and mirrored straight away.
+// The remote parameter may be given more than once.
+func (cm *CarMirror) MirrorAddHandler() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			if err := r.ParseForm(); err != nil {
+				WriteError(w, err)
+				return
+			}
+			rule := MirrorRule{
+				Name:    r.Form.Get("name"),
+				Source:  r.Form.Get("source"),
+				Remotes: r.Form["remote"],
+			}
+			log.Debugw("MirrorAddHandler", "rule", rule)
+
+			status, err := cm.mirrors.Add(r.Context(), rule)
+			if err != nil {
+				log.Debugw("MirrorAddHandler", "error", err)
+				WriteError(w, err)
+				return
+			}
+
+			json.NewEncoder(w).Encode(status)
+		}
+	})
+}
+
+// MirrorRemoveHandler removes a mirror rule added with MirrorAddHandler.
+func (cm *CarMirror) MirrorRemoveHandler() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			name := r.FormValue("name")
+			log.Debugw("MirrorRemoveHandler", "name", name)
+
+			if err := cm.mirrors.Remove(r.Context(), name); err != nil {
+				log.Debugw("MirrorRemoveHandler", "error", err)
+				WriteError(w, err)
+				return
+			}
+
+			WriteSuccess(w)
+		}
+	})
+}
+
+// PinsHandler lists the pin names.
+func (cm *CarMirror) PinsHandler() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			log.Debugw("PinsHandler")
+
+			pins, err := cm.PinNames(r.Context())
+			if err != nil {
+				log.Debugw("PinsHandler", "error", err)
+				WriteError(w, err)
+				return
+			}
+
+			json.NewEncoder(w).Encode(pins)
+		}
+	})
+}
+
+// PinAddHandler pins cid recursively under name, which mirror rules with the source pin:name follow.
+func (cm *CarMirror) PinAddHandler() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			name := r.FormValue("name")
+			log.Debugw("PinAddHandler", "name", name, "cid", r.FormValue("cid"))
+
+			cid, err := gocid.Parse(r.FormValue("cid"))
+			if err != nil {
+				WriteError(w, errors.Wrap(err, "failed to parse CID"))
+				return
+			}
+
+			pin, err := cm.NamePin(r.Context(), name, cid)
+			if err != nil {
+				log.Debugw("PinAddHandler", "error", err)
+				WriteError(w, err)
+				return
+			}
+
+			json.NewEncoder(w).Encode(pin)
+		}
+	})
+}
+
+// PinRemoveHandler removes a pin name, leaving the root it named pinned.
+func (cm *CarMirror) PinRemoveHandler() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			name := r.FormValue("name")
+			log.Debugw("PinRemoveHandler", "name", name)
+
+			if err := cm.UnnamePin(r.Context(), name); err != nil {
+				log.Debugw("PinRemoveHandler", "error", err)
+				WriteError(w, err)
+				return
+			}
+
+			WriteSuccess(w)
+		}
+	})
+}
+
+// SchedulesHandler lists the scheduled jobs, their recent runs and when they next run.
+func (cm *CarMirror) SchedulesHandler() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			log.Debugw("SchedulesHandler")
+			json.NewEncoder(w).Encode(cm.schedules.List())
+		}
+	})
+}
+
+// ScheduleAddHandler adds a scheduled job, which is kept across restarts.
+// The job pushes or pulls cid, or pushes every recursive pin when pins is true.
+func (cm *CarMirror) ScheduleAddHandler() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			schedule := Schedule{
+				Name:      r.FormValue("name"),
+				Cron:      r.FormValue("cron"),
+				Direction: r.FormValue("direction"),
+				Remote:    r.FormValue("addr"),
+				Cid:       r.FormValue("cid"),
+				Pins:      r.FormValue("pins") == "true",
+			}
+			log.Debugw("ScheduleAddHandler", "schedule", schedule)
+
+			status, err := cm.schedules.Add(r.Context(), schedule)
+			if err != nil {
+				log.Debugw("ScheduleAddHandler", "error", err)
+				WriteError(w, err)
+				return
+			}
+
+			json.NewEncoder(w).Encode(status)
+		}
+	})
+}
+
+// ScheduleRemoveHandler removes a scheduled job.
+func (cm *CarMirror) ScheduleRemoveHandler() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			name := r.FormValue("name")
+			log.Debugw("ScheduleRemoveHandler", "name", name)
+
+			if err := cm.schedules.Remove(r.Context(), name); err != nil {
+				log.Debugw("ScheduleRemoveHandler", "error", err)
+				WriteError(w, err)
+				return
+			}
+
+			WriteSuccess(w)
+		}
+	})
+}
+
+// VerifyHandler verifies the DAG under cid is complete and intact locally, pulling missing blocks from
+// repair_from if it is given.
+func (cm *CarMirror) VerifyHandler() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			p := VerifyParams{
+				Cid:        r.FormValue("cid"),
+				RepairFrom: r.FormValue("repair_from"),
+				Token:      r.FormValue("token"),
+				Rate:       r.FormValue("rate"),
+			}
+			log.Debugw("VerifyHandler", "params", p)
+
+			cid, err := gocid.Parse(p.Cid)
+			if err != nil {
+				WriteError(w, errors.Wrap(err, "failed to parse CID"))
+				return
+			}
+
+			res, err := cm.verify(r.Context(), p, cid)
+			if err != nil {
+				log.Debugw("VerifyHandler", "error", err)
+				WriteError(w, err)
+				return
+			}
+
+			json.NewEncoder(w).Encode(res)
+		}
+	})
+}
+
+// FilterExportHandler writes a filter snapshot of the blocks held locally under each cid.
+func (cm *CarMirror) FilterExportHandler() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			if err := r.ParseForm(); err != nil {
+				WriteError(w, err)
+				return
+			}
+			log.Debugw("FilterExportHandler", "cids", r.Form["cid"])
+
+			var roots []gocid.Cid
+			for _, c := range r.Form["cid"] {
+				cid, err := gocid.Parse(c)
+				if err != nil {
+					WriteError(w, errors.Wrap(err, "failed to parse CID"))
+					return
+				}
+				roots = append(roots, cid)
+			}
+
+			snapshot, err := cm.snapshotFilter(r.Context(), roots)
+			if err != nil {
+				log.Debugw("FilterExportHandler", "error", err)
+				WriteError(w, err)
+				return
+			}
+
+			json.NewEncoder(w).Encode(snapshot)
+		}
+	})
+}
+
+// ImportHandler imports the CAR file at path, relative to ImportDir or within it. An import writes blocks as a
+// push does, so it takes a session slot while it runs, queuing behind MaxSessions like a remote session.
+func (cm *CarMirror) ImportHandler() http.HandlerFunc {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			log.Debugw("ImportHandler", "path", r.FormValue("path"))
+
+			path, err := pathIn("ImportDir", cm.cfg.ImportDir, r.FormValue("path"))
+			if err != nil {
+				WriteError(w, err)
+				return
+			}
+
+			res, err := cm.importCAR(r.Context(), path)
+			if err != nil {
+				log.Debugw("ImportHandler", "error", err)
+				WriteError(w, err)
+				return
+			}
+
+			json.NewEncoder(w).Encode(res)
+		}
+	})
+	if cm.admission != nil {
+		return cm.admission.Wrap(handler, "")
+	}
+	return handler
+}
+
+// MetricsHandler serves metrics in Prometheus exposition format.
+func (cm *CarMirror) MetricsHandler() http.Handler {
+	return cm.metrics.Handler()
+}
+
+// PolicyReloadHandler re-reads the content and peer policy files.
+func (cm *CarMirror) PolicyReloadHandler() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			log.Debugw("PolicyReloadHandler")
+
+			if cm.policy == nil {
+				WriteError(w, fmt.Errorf("no policy is configured"))
+				return
+			}
+
+			if err := cm.policy.Reload(); err != nil {
+				log.Debugw("PolicyReloadHandler", "error", err)
+				WriteError(w, err)
+				return
+			}
+			// Blocks read before the reload may now be denied.
+			cm.client.readCache.clear()
+
+			WriteSuccess(w)
+		}
+	})
+}
+
 func WriteSuccess(w http.ResponseWriter) {
 	w.WriteHeader(http.StatusOK)
 	res := map[string]string{
@@ -2,7 +2,12 @@ package carmirror
 
 import (
 	"context"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 
 	cm "github.com/fission-codes/go-car-mirror/core"
 	cmipld "github.com/fission-codes/go-car-mirror/ipld"
@@ -120,6 +125,30 @@ func MakeAPISwarm(ctx context.Context, fullIdentity bool, n int) ([]coreiface.Co
 	return apis, nil
 }
 
+// newTestCarMirrors makes n CAR Mirrors, each with a node of its own, batching few blocks and tracing nothing.
+func newTestCarMirrors(t *testing.T, n int) ([]*CarMirror, []coreiface.CoreAPI) {
+	var mirrors []*CarMirror
+	var apis []coreiface.CoreAPI
+	for i := 0; i < n; i++ {
+		nodes, err := MakeAPISwarm(context.Background(), false, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mirror, err := New(nodes[0], NewKuboStore(nodes[0]), func(cfg *Config) {
+			cfg.HTTPRemoteAddr = "127.0.0.1:0"
+			cfg.MaxBlocksPerRound = 10
+			cfg.MaxBlocksPerColdCall = 10
+			cfg.TracingExporter = TracingExporterNone
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		mirrors = append(mirrors, mirror)
+		apis = append(apis, nodes[0])
+	}
+	return mirrors, apis
+}
+
 func TestStore(t *testing.T) {
 	if nodes, err := MakeAPISwarm(context.Background(), false, 1); err != nil {
 		t.Errorf("error instantiating test API, %v", err)
@@ -146,3 +175,130 @@ func TestStore(t *testing.T) {
 		}
 	}
 }
+
+func TestShutdown(t *testing.T) {
+	nodes, err := MakeAPISwarm(context.Background(), false, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	baseline := serviceGoroutines()
+
+	addr := "127.0.0.1:0"
+	for i := 0; i < 3; i++ {
+		cm, err := New(nodes[0], NewKuboStore(nodes[0]), func(cfg *Config) {
+			cfg.HTTPRemoteAddr = addr
+			cfg.MaxBlocksPerRound = 10
+			cfg.MaxBlocksPerColdCall = 10
+			cfg.Compression = EncodingNone
+			cfg.TracingExporter = TracingExporterNone
+			cfg.ShutdownGracePeriod = time.Second
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Each start reuses the port the last one released.
+		if err := cm.StartRemote(context.Background()); err != nil {
+			t.Fatalf("start %d: %v", i, err)
+		}
+		addr = cm.RemoteAddr().String()
+
+		resp, err := client.Get("http://" + addr + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if aborted, err := cm.Shutdown(context.Background()); err != nil || len(aborted) != 0 {
+			t.Fatalf("expected a clean shutdown, got %v aborted and %v", aborted, err)
+		}
+		if _, err := client.Get("http://" + addr + "/"); err == nil {
+			t.Fatalf("expected the remote server to be stopped")
+		}
+	}
+
+	// Goroutines of the node and the HTTP client come and go, so only the service's own are counted.
+	deadline := time.Now().Add(2 * time.Second)
+	for serviceGoroutines() > baseline && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := serviceGoroutines(); n > baseline {
+		t.Errorf("expected %d service goroutines after shutdown, got %d", baseline, n)
+	}
+
+	// While closing, a made-up session cookie doesn't get a new session started.
+	cm, err := New(nodes[0], NewKuboStore(nodes[0]), func(cfg *Config) {
+		cfg.HTTPRemoteAddr = addr
+		cfg.MaxBlocksPerRound = 10
+		cfg.MaxBlocksPerColdCall = 10
+		cfg.TracingExporter = TracingExporterNone
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm.closing.Store(true)
+	handler := cm.refuseWhenClosing(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("expected the request to be refused")
+	}, "sinkSessionId")
+	req := httptest.NewRequest("POST", "/dag/cm/blocks", nil)
+	req.AddCookie(&http.Cookie{Name: "sinkSessionId", Value: "made-up"})
+	w := httptest.NewRecorder()
+	handler(w, req)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected a made-up session to be refused while closing, got %d", w.Code)
+	}
+}
+
+// serviceGoroutines counts the goroutines the service runs, whose stacks have the service's methods in them.
+func serviceGoroutines() int {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	count := 0
+	for _, g := range strings.Split(string(buf), "\n\n") {
+		if strings.Contains(g, "carmirror.(*CarMirror)") {
+			count++
+		}
+	}
+	return count
+}
+
+func TestReconfigure(t *testing.T) {
+	cms, _ := newTestCarMirrors(t, 1)
+	cm := cms[0]
+
+	err := cm.Reconfigure(func(cfg *Config) {
+		cfg.MaxBlocksPerRound = 32
+		cfg.MaxOutboundRate = 1024
+		cfg.RemoteRates = map[string]uint64{"http://remote:2503": 512}
+		cfg.HTTPRemoteAddr = ":2504"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cm.client.maxBlocksPerRound != 32 || cm.cfg.MaxBlocksPerRound != 32 {
+		t.Errorf("expected new sessions to use 32 blocks per round")
+	}
+	if outbound, _ := cm.client.globalLimiters(); outbound.Rate() != 1024 {
+		t.Errorf("expected the global outbound limit to be 1024, got %d", outbound.Rate())
+	}
+	if outbound, _ := cm.client.limiters("http://remote:2503"); outbound[1].Rate() != 512 {
+		t.Errorf("expected the remote outbound limit to be 512, got %d", outbound[1].Rate())
+	}
+	if cm.cfg.HTTPRemoteAddr != "127.0.0.1:0" {
+		t.Errorf("expected the listen address to need a restart, got %s", cm.cfg.HTTPRemoteAddr)
+	}
+
+	if err := cm.Reconfigure(func(cfg *Config) { cfg.MaxBlocksPerRound = 0 }); err == nil {
+		t.Errorf("expected an invalid setting to be rejected")
+	}
+	if cm.client.maxBlocksPerRound != 32 {
+		t.Errorf("expected a rejected change not to be applied")
+	}
+}
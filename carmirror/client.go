@@ -0,0 +1,530 @@
+package carmirror
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"strings"
+	"sync"
+
+	cmbatch "github.com/fission-codes/go-car-mirror/batch"
+	cmcore "github.com/fission-codes/go-car-mirror/core"
+	instrumented "github.com/fission-codes/go-car-mirror/core/instrumented"
+	cmerrors "github.com/fission-codes/go-car-mirror/errors"
+	"github.com/fission-codes/go-car-mirror/filter"
+	cmhttp "github.com/fission-codes/go-car-mirror/http"
+	cmipld "github.com/fission-codes/go-car-mirror/ipld"
+	stats "github.com/fission-codes/go-car-mirror/stats"
+	"github.com/fission-codes/go-car-mirror/util"
+	gocid "github.com/ipfs/go-cid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type SourceSession = cmcore.SourceSession[cmipld.Cid, cmbatch.BatchState]
+type SinkSession = cmcore.SinkSession[cmipld.Cid, cmbatch.BatchState]
+
+// Client is a CAR Mirror protocol client.
+// It follows cmhttp.Client, but lets us control the HTTP transport used to reach remotes,
+// which cmhttp.Client hard codes to http.DefaultTransport.
+type Client struct {
+	store cmcore.BlockStore[cmipld.Cid]
+	// Blocks recently read by source sessions, shared so concurrent pushes of a DAG read it once
+	readCache *blockCache
+	// Sessions by key: the remote's URL for the session shared by transfers with it, or a key of its own
+	// for a dedicated session, as sessionKey returns
+	sourceSessions *util.SynchronizedMap[string, *SourceSession]
+	sinkSessions   *util.SynchronizedMap[string, *SinkSession]
+	// Filters of the blocks the remote of each source session has, by session key
+	sourceFilters *util.SynchronizedMap[string, filter.Filter[cmipld.Cid]]
+	// mu guards the settings below that Reconfigure changes
+	mu                   sync.RWMutex
+	maxBlocksPerRound    uint32
+	maxBlocksPerColdCall uint32
+	allocator            func() filter.Filter[cmipld.Cid]
+	instrumented         instrumented.InstrumentationOptions
+	transport            http.RoundTripper
+	// Bearer token presented to remotes by sessions started without one of their own
+	defaultToken string
+	// Bandwidth limits shared by all sessions
+	outbound *RateLimiter
+	inbound  *RateLimiter
+	// Bandwidth limits for individual remotes, by URL, created from remoteRates
+	remoteLimiters *util.SynchronizedMap[string, *remoteLimiters]
+	remoteRates    map[string]uint64
+	// How many times to retry requests remotes turn away as busy
+	maxRetries int
+	// Compression for protocol bodies, and the codings each remote accepts, by URL
+	compressor      *compressor
+	remoteEncodings *util.SynchronizedMap[string, string]
+	// Prometheus metrics, may be nil
+	metrics *Metrics
+	tracer  trace.Tracer
+	// Session history, may be nil
+	history *History
+}
+
+// Reconfigure changes the batch settings, retries and bandwidth limits of sessions started from now on.
+// The new global and remote limits also apply to the next requests of running sessions,
+// except those started with a rate of their own.
+func (c *Client) Reconfigure(config cmbatch.Config, outbound *RateLimiter, inbound *RateLimiter, remoteRates map[string]uint64, maxRetries int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maxBlocksPerRound = config.MaxBlocksPerRound
+	c.maxBlocksPerColdCall = config.MaxBlocksPerColdCall
+	c.allocator = cmbatch.NewBloomAllocator[cmipld.Cid](&config)
+	c.instrumented = config.Instrument
+	c.outbound = outbound
+	c.inbound = inbound
+	c.maxRetries = maxRetries
+
+	for url, rate := range c.remoteRates {
+		if newRate, ok := remoteRates[url]; !ok || newRate != rate {
+			c.remoteLimiters.Remove(url)
+		}
+	}
+	for url := range remoteRates {
+		if _, ok := c.remoteRates[url]; !ok {
+			c.remoteLimiters.Remove(url)
+		}
+	}
+	c.remoteRates = remoteRates
+}
+
+// globalLimiters returns the outbound and inbound limiters shared by all sessions, as client and as server.
+func (c *Client) globalLimiters() (*RateLimiter, *RateLimiter) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.outbound, c.inbound
+}
+
+// remoteLimiters limit the bandwidth used with a single remote, in each direction.
+type remoteLimiters struct {
+	outbound *RateLimiter
+	inbound  *RateLimiter
+}
+
+// NewClient creates a CAR Mirror protocol client that sends requests using the given transport.
+// A nil transport means http.DefaultTransport.
+func NewClient(store cmcore.BlockStore[cmipld.Cid], config cmbatch.Config, transport http.RoundTripper) *Client {
+	return &Client{
+		store:                store,
+		readCache:            newBlockCache(store, blockCacheSize),
+		sourceSessions:       util.NewSynchronizedMap[string, *SourceSession](),
+		sinkSessions:         util.NewSynchronizedMap[string, *SinkSession](),
+		sourceFilters:        util.NewSynchronizedMap[string, filter.Filter[cmipld.Cid]](),
+		maxBlocksPerRound:    config.MaxBlocksPerRound,
+		maxBlocksPerColdCall: config.MaxBlocksPerColdCall,
+		allocator:            cmbatch.NewBloomAllocator[cmipld.Cid](&config),
+		instrumented:         config.Instrument,
+		transport:            transport,
+		remoteLimiters:       util.NewSynchronizedMap[string, *remoteLimiters](),
+		remoteEncodings:      util.NewSynchronizedMap[string, string](),
+		tracer:               otel.Tracer(tracerName),
+	}
+}
+
+// limiters returns the outbound and inbound limiters that apply to the remote at url, at the rate configured for it.
+func (c *Client) limiters(url string) ([]*RateLimiter, []*RateLimiter) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	remote := c.remoteLimiters.GetOrInsert(url, func() *remoteLimiters {
+		return &remoteLimiters{
+			outbound: NewRateLimiter(c.remoteRates[url]),
+			inbound:  NewRateLimiter(c.remoteRates[url]),
+		}
+	})
+	return []*RateLimiter{c.outbound, remote.outbound}, []*RateLimiter{c.inbound, remote.inbound}
+}
+
+// sessionLimiters returns what limits a session with the remote at url. A rate above 0 limits the session on its own,
+// in place of the rate configured for the remote, and 0 means the configured rate.
+func (c *Client) sessionLimiters(url string, rate uint64) func() ([]*RateLimiter, []*RateLimiter) {
+	if rate == 0 {
+		return func() ([]*RateLimiter, []*RateLimiter) { return c.limiters(url) }
+	}
+	remote := &remoteLimiters{outbound: NewRateLimiter(rate), inbound: NewRateLimiter(rate)}
+	return func() ([]*RateLimiter, []*RateLimiter) {
+		outbound, inbound := c.globalLimiters()
+		return []*RateLimiter{outbound, remote.outbound}, []*RateLimiter{inbound, remote.inbound}
+	}
+}
+
+// tokenOr returns the bearer token a session started with token presents, which is token unless it is empty.
+func (c *Client) tokenOr(token string) string {
+	if token != "" {
+		return token
+	}
+	return c.defaultToken
+}
+
+// sessionID identifies a running client session in the history and metrics, by the key it is kept under.
+func sessionID(direction string, key string) string {
+	return direction + " " + key
+}
+
+// sessionKey returns a key for a dedicated session with the remote at url, which no other transfer shares.
+func sessionKey(url string) string {
+	return url + "#" + string(generateToken())
+}
+
+// sessionRemote returns the URL of the remote of the session kept under key.
+func sessionRemote(key string) string {
+	url, _, _ := strings.Cut(key, "#")
+	return url
+}
+
+// newHTTPClient creates the HTTP client for a session with the remote at url, limited to rate if it is above 0
+// and presenting token, as tokenOr returns. session is the context holding the session's span, and id identifies the session.
+func (c *Client) newHTTPClient(session context.Context, id string, url string, rate uint64, token string) *http.Client {
+	jar, err := cookiejar.New(&cookiejar.Options{}) // TODO: set public suffix list
+	if err != nil {
+		panic(err)
+	}
+
+	transport := c.remoteTransport(url, rate)
+	transport = &metricsTransport{base: transport, metrics: c.metrics, remote: url}
+	transport = &historyTransport{base: transport, history: c.history, id: id}
+	transport = &tracingTransport{base: transport, tracer: c.tracer, session: session}
+	transport = &tokenTransport{base: transport, token: c.tokenOr(token)}
+
+	return &http.Client{Jar: jar, Transport: transport}
+}
+
+// remoteTransport creates the transport every request to the remote at url goes through, retrying it when the remote
+// is busy, throttling it and compressing it. rate is as for sessionLimiters.
+func (c *Client) remoteTransport(url string, rate uint64) http.RoundTripper {
+	base := c.transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	c.mu.RLock()
+	maxRetries := c.maxRetries
+	c.mu.RUnlock()
+	var transport http.RoundTripper = &retryTransport{base: base, maxRetries: maxRetries}
+	transport = &throttledTransport{
+		base:     transport,
+		limiters: c.sessionLimiters(url, rate),
+		stats:    stats.GLOBAL_STATS.WithContext(url),
+	}
+	// Compression sits above throttling, so bandwidth limits apply to the bytes on the wire.
+	return &compressTransport{
+		base:            transport,
+		compressor:      c.compressor,
+		remoteEncodings: c.remoteEncodings,
+		url:             url,
+		stats:           stats.GLOBAL_STATS.WithContext(url),
+	}
+}
+
+func (c *Client) startSourceSession(key string, rate uint64, token string) *SourceSession {
+	url := sessionRemote(key)
+	id := sessionID(DirectionPush, key)
+	c.history.start(id, string(generateToken()), RoleClient, DirectionPush, url)
+	ctx, span := c.tracer.Start(context.Background(), "carmirror.push", trace.WithAttributes(attribute.String("carmirror.remote", url)))
+
+	c.mu.RLock()
+	instrument, maxBlocksPerRound, maxBlocksPerColdCall, allocator := c.instrumented, c.maxBlocksPerRound, c.maxBlocksPerColdCall, c.allocator
+	c.mu.RUnlock()
+
+	sourceConnection := cmhttp.NewHttpClientSourceConnection[cmipld.Cid, *cmipld.Cid](
+		c.newHTTPClient(ctx, id, url, rate, token),
+		url+"/dag/cm/blocks",
+		stats.GLOBAL_STATS.WithContext(url),
+		instrument,
+		maxBlocksPerRound,
+		maxBlocksPerColdCall,
+	)
+
+	sourceFilter := filter.NewSynchronizedFilter[cmipld.Cid](filter.NewEmptyFilter(allocator))
+	c.sourceFilters.Add(key, sourceFilter)
+
+	newSession := sourceConnection.Session(
+		&tracingStore{BlockStore: c.readCache, tracer: c.tracer, session: ctx},
+		sourceFilter,
+		true, // Requester
+	)
+
+	newSender := sourceConnection.ImmediateSender(newSession, maxBlocksPerRound)
+
+	go func() {
+		log.Debugw("starting source session", "object", "Client", "method", "startSourceSession", "url", url)
+		c.metrics.sessionStarted(DirectionPush, url)
+		newSession.Run(newSender)
+		cancelled := newSession.Info().State&cmbatch.CANCELLED != 0
+		c.metrics.sessionEnded(DirectionPush, url, cancelled)
+		c.history.end(id, cancelled)
+		if cancelled {
+			span.SetStatus(codes.Error, "cancelled")
+		}
+		span.End()
+
+		// TODO: potential race condition if Run() completes before the
+		// session is added to the list of source sessions (which happens
+		// when startSourceSession returns)
+		c.sourceSessions.Remove(key)
+		c.sourceFilters.Remove(key)
+		log.Debugw("source session ended", "object", "Client", "method", "startSourceSession", "url", url)
+	}()
+
+	// Wait for the session to start
+	<-newSession.Started()
+
+	return newSession
+}
+
+// GetSourceSession returns the source session for the given URL, starting one if needed.
+// Every push to the remote made this way shares the session, and is told the same outcome.
+// A rate above 0 limits the bandwidth of a session it starts, in place of the rate configured for the remote.
+// A session already running keeps the limits it started with.
+func (c *Client) GetSourceSession(url string, rate uint64) *SourceSession {
+	if session, ok := c.sourceSessions.Get(url); ok {
+		return session
+	}
+
+	return c.sourceSessions.GetOrInsert(url, func() *SourceSession {
+		return c.startSourceSession(url, rate, "")
+	})
+}
+
+// NewSourceSession starts a source session of its own with the remote at url, returning it and the key it is kept
+// under, which the session's other methods take in place of the URL. rate is as for GetSourceSession.
+// The session presents token to the remote, if given, in place of the default token; no other session does.
+func (c *Client) NewSourceSession(url string, rate uint64, token string) (string, *SourceSession) {
+	key := sessionKey(url)
+	return key, c.sourceSessions.GetOrInsert(key, func() *SourceSession {
+		return c.startSourceSession(key, rate, token)
+	})
+}
+
+// maxBaseBlocks is how many blocks of a base DAG SetBase marks as held by the remote.
+const maxBaseBlocks = 4096
+
+// SetBase tells the source session kept under key that the remote has the DAG under base,
+// so blocks shared with it aren't sent. Call it after starting the session and before enqueueing roots.
+// Only the first maxBaseBlocks of base, breadth first, are marked, as those near the root are the ones
+// a new root is most likely to share, and the remote reports the rest as it receives blocks.
+func (c *Client) SetBase(ctx context.Context, key string, base cmipld.Cid) error {
+	sourceFilter, ok := c.sourceFilters.Get(key)
+	if !ok {
+		return cmhttp.ErrInvalidSession
+	}
+
+	marked := 0
+	return walkDAG(ctx, c.store, []gocid.Cid{base.Unwrap()}, func(id gocid.Cid, _ cmcore.Block[cmipld.Cid], err error) (bool, error) {
+		if marked == maxBaseBlocks {
+			return false, errStopWalk
+		}
+		marked++
+		sourceFilter.Add(cmipld.WrapCid(id))
+		if err != nil && err != cmerrors.ErrBlockNotFound {
+			return false, err
+		}
+		return true, nil
+	})
+}
+
+// errHasUnsupported is returned by Has for remotes that don't answer has queries, such as stock CAR Mirror servers.
+var errHasUnsupported = fmt.Errorf("remote doesn't answer has queries")
+
+// Has asks the remote at url which of ids, blocks of the DAG under root, it has, without starting a session.
+// ctx may hold the span the query is traced in, rate is as for GetSourceSession and token as for NewSourceSession.
+func (c *Client) Has(ctx context.Context, url string, rate uint64, token string, root cmipld.Cid, ids []cmipld.Cid) ([]bool, error) {
+	query := hasQuery{Root: root.String(), Cids: make([]string, len(ids))}
+	for i, id := range ids {
+		query.Cids[i] = id.String()
+	}
+	body, err := json.Marshal(query)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url+hasQueryPath, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	var transport http.RoundTripper = &tracingTransport{base: c.remoteTransport(url, rate), tracer: c.tracer, session: ctx}
+	transport = &tokenTransport{base: transport, token: c.tokenOr(token)}
+	resp, err := (&http.Client{Transport: transport}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusMethodNotAllowed {
+		return nil, errHasUnsupported
+	}
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("remote responded %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+
+	var res hasResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+	if len(res.Have) != len(ids) {
+		return nil, fmt.Errorf("remote answered about %d blocks, not %d", len(res.Have), len(ids))
+	}
+	return res.Have, nil
+}
+
+// AddHeld tells the source session kept under key that the remote has the blocks in held, so they aren't sent.
+// Call it after starting the session and before enqueueing roots.
+func (c *Client) AddHeld(key string, held filter.Filter[cmipld.Cid]) error {
+	sourceFilter, ok := c.sourceFilters.Get(key)
+	if !ok {
+		return cmhttp.ErrInvalidSession
+	}
+	sourceFilter.AddAll(held)
+	return nil
+}
+
+func (c *Client) startSinkSession(key string, rate uint64, token string) *SinkSession {
+	url := sessionRemote(key)
+	id := sessionID(DirectionPull, key)
+	c.history.start(id, string(generateToken()), RoleClient, DirectionPull, url)
+	ctx, span := c.tracer.Start(context.Background(), "carmirror.pull", trace.WithAttributes(attribute.String("carmirror.remote", url)))
+
+	c.mu.RLock()
+	instrument, maxBlocksPerRound, allocator := c.instrumented, c.maxBlocksPerRound, c.allocator
+	c.mu.RUnlock()
+
+	sinkConnection := cmhttp.NewHttpClientSinkConnection[cmipld.Cid, *cmipld.Cid](
+		c.newHTTPClient(ctx, id, url, rate, token),
+		url+"/dag/cm/status",
+		stats.GLOBAL_STATS.WithContext(url),
+		instrument,
+		maxBlocksPerRound,
+	)
+
+	newSession := sinkConnection.Session(
+		&tracingStore{BlockStore: c.store, tracer: c.tracer, session: ctx},
+		cmcore.NewSimpleStatusAccumulator(allocator()),
+		true, // Requester
+	)
+
+	sender := sinkConnection.ImmediateSender(newSession)
+
+	go func() {
+		log.Debugw("starting sink session", "object", "Client", "method", "startSinkSession", "url", url)
+		c.metrics.sessionStarted(DirectionPull, url)
+		newSession.Run(sender)
+		cancelled := newSession.Info().State&cmbatch.CANCELLED != 0
+		c.metrics.sessionEnded(DirectionPull, url, cancelled)
+		c.history.end(id, cancelled)
+		if cancelled {
+			span.SetStatus(codes.Error, "cancelled")
+		}
+		span.End()
+
+		// TODO: potential race condition if Run() completes before the
+		// session is added to the list of sink sessions (which happens
+		// when startSinkSession returns)
+		c.sinkSessions.Remove(key)
+		log.Debugw("ended sink session", "object", "Client", "method", "startSinkSession", "url", url)
+	}()
+
+	// Wait for the session to start
+	<-newSession.Started()
+
+	return newSession
+}
+
+// GetSinkSession returns the sink session for the given URL, starting one if needed.
+// rate is as for GetSourceSession.
+func (c *Client) GetSinkSession(url string, rate uint64) *SinkSession {
+	if session, ok := c.sinkSessions.Get(url); ok {
+		return session
+	}
+
+	return c.sinkSessions.GetOrInsert(url, func() *SinkSession {
+		return c.startSinkSession(url, rate, "")
+	})
+}
+
+// NewSinkSession starts a sink session of its own with the remote at url, as NewSourceSession does.
+func (c *Client) NewSinkSession(url string, rate uint64, token string) (string, *SinkSession) {
+	key := sessionKey(url)
+	return key, c.sinkSessions.GetOrInsert(key, func() *SinkSession {
+		return c.startSinkSession(key, rate, token)
+	})
+}
+
+// SourceSessions returns the keys of the running source sessions.
+func (c *Client) SourceSessions() []string {
+	return c.sourceSessions.Keys()
+}
+
+func (c *Client) SourceInfo(key string) (*cmcore.SourceSessionInfo[cmbatch.BatchState], error) {
+	if session, ok := c.sourceSessions.Get(key); ok {
+		return session.Info(), nil
+	}
+	return nil, cmhttp.ErrInvalidSession
+}
+
+// SinkSessions returns the keys of the running sink sessions.
+func (c *Client) SinkSessions() []string {
+	return c.sinkSessions.Keys()
+}
+
+func (c *Client) SinkInfo(key string) (*cmcore.SinkSessionInfo[cmbatch.BatchState], error) {
+	if session, ok := c.sinkSessions.Get(key); ok {
+		return session.Info(), nil
+	}
+	return nil, cmhttp.ErrInvalidSession
+}
+
+// CancelSource cancels the source session kept under key.
+func (c *Client) CancelSource(key string) error {
+	log.Debugw("enter", "object", "Client", "method", "CancelSource", "key", key)
+	session, ok := c.sourceSessions.Get(key)
+	if !ok {
+		return cmhttp.ErrInvalidSession
+	}
+	err := session.Cancel()
+	log.Debugw("exit", "object", "Client", "method", "CancelSource", "err", err)
+	return err
+}
+
+// CancelSink cancels the sink session kept under key.
+func (c *Client) CancelSink(key string) error {
+	log.Debugw("enter", "object", "Client", "method", "CancelSink", "key", key)
+	session, ok := c.sinkSessions.Get(key)
+	if !ok {
+		return cmhttp.ErrInvalidSession
+	}
+	err := session.Cancel()
+	log.Debugw("exit", "object", "Client", "method", "CancelSink", "err", err)
+	return err
+}
+
+// CloseSource closes the source session kept under key once the transfers in progress are done.
+func (c *Client) CloseSource(key string) error {
+	log.Debugw("enter", "object", "Client", "method", "CloseSource", "key", key)
+	session, ok := c.sourceSessions.Get(key)
+	if !ok {
+		return cmhttp.ErrInvalidSession
+	}
+	err := session.Close()
+	log.Debugw("exit", "object", "Client", "method", "CloseSource", "err", err)
+	return err
+}
+
+// CloseSink closes the sink session kept under key once the transfers in progress are done.
+func (c *Client) CloseSink(key string) error {
+	log.Debugw("enter", "object", "Client", "method", "CloseSink", "key", key)
+	session, ok := c.sinkSessions.Get(key)
+	if !ok {
+		return cmhttp.ErrInvalidSession
+	}
+	err := session.Close()
+	log.Debugw("exit", "object", "Client", "method", "CloseSink", "err", err)
+	return err
+}
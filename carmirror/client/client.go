@@ -0,0 +1,532 @@
+// Package client drives a running CAR Mirror plugin through its local commands API, as the carmirror command does.
+// It has no dependencies on Kubo, so services can import it to push and pull without shelling out.
+// Its types are copies of the plugin's, which the carmirror package's tests keep in step.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultAddr is where the plugin serves the commands API unless configured otherwise.
+	DefaultAddr = "http://localhost:2502"
+	// DefaultProgressInterval is how often progress is reported, unless a request sets its own interval.
+	DefaultProgressInterval = time.Second
+)
+
+// Session states, roles and directions, as reported by Ls.
+const (
+	StateActive     = "active"
+	StateClosing    = "closing"
+	StateCancelling = "cancelling"
+	StateCompleted  = "completed"
+	StateFailed     = "failed"
+
+	RoleClient = "client"
+	RoleServer = "server"
+
+	DirectionPush = "push"
+	DirectionPull = "pull"
+)
+
+// Error is an error reported by the commands API.
+type Error struct {
+	// StatusCode is the HTTP status of the response, such as 401 when the bearer token is wrong.
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("carmirror: %s (status %d)", e.Message, e.StatusCode)
+}
+
+// Config configures a Client.
+type Config struct {
+	// Token is the bearer token the commands API requires, if any.
+	Token string
+	// HTTPClient sends requests. The default has no timeout, as pushes and pulls wait for the transfer to end;
+	// bound them with their context instead.
+	HTTPClient *http.Client
+}
+
+// Client sends commands to a CAR Mirror plugin.
+type Client struct {
+	base  string
+	token string
+	http  *http.Client
+}
+
+// New returns a client of the commands API at addr, such as DefaultAddr, or unix:///path/to/socket.
+func New(addr string, opts ...func(cfg *Config)) (*Client, error) {
+	cfg := &Config{}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	c := &Client{base: strings.TrimSuffix(addr, "/"), token: cfg.Token, http: cfg.HTTPClient}
+	if strings.HasPrefix(addr, "unix://") {
+		socket := strings.TrimPrefix(addr, "unix://")
+		if c.http == nil {
+			c.http = &http.Client{
+				Transport: &http.Transport{
+					DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+						var d net.Dialer
+						return d.DialContext(ctx, "unix", socket)
+					},
+				},
+			}
+		}
+		// The host is ignored when dialing the socket
+		c.base = "http://unix"
+	} else if _, err := url.ParseRequestURI(addr); err != nil {
+		return nil, fmt.Errorf("bad commands address: %w", err)
+	}
+	if c.http == nil {
+		c.http = &http.Client{}
+	}
+	return c, nil
+}
+
+// SessionSummary describes a running or ended session.
+type SessionSummary struct {
+	// ID identifies the session: a token of the plugin's own for its sessions, or the session token for sessions it serves.
+	ID        string
+	Role      string
+	Side      string
+	Direction string
+	Remote    string
+	// Transfer is the id of the push or pull that started the session, if it was given one.
+	Transfer string `json:",omitempty"`
+	State    string
+	Roots    []string
+	// Pending is how many blocks are waiting to be sent or processed.
+	Pending uint
+	Rounds  uint64
+	Blocks  uint64
+	Bytes   uint64
+	Start   *time.Time `json:",omitempty"`
+	End     *time.Time `json:",omitempty"`
+	Error   string     `json:",omitempty"`
+}
+
+// Running reports whether the session hasn't ended.
+func (s SessionSummary) Running() bool {
+	return s.State != StateCompleted && s.State != StateFailed
+}
+
+// SessionFilter selects sessions. Empty fields match every session.
+type SessionFilter struct {
+	State     string
+	Role      string
+	Direction string
+	Remote    string
+	Transfer  string
+}
+
+func (f SessionFilter) encode(params url.Values) {
+	for key, value := range map[string]string{"state": f.State, "role": f.Role, "direction": f.Direction, "remote": f.Remote, "transfer": f.Transfer} {
+		if value != "" {
+			params.Set(key, value)
+		}
+	}
+}
+
+// TransferOptions are shared by pushes and pulls.
+type TransferOptions struct {
+	// Token is a UCAN granting the transfer at the remotes.
+	Token string
+	// Rate limits the bandwidth used with the remotes, e.g. 5MiB.
+	Rate string
+	// Background returns once the transfer has started, rather than when it ends.
+	Background bool
+	// Transfer is the id every session of the transfer is listed under. Empty means a random id.
+	// Each transfer with an id has sessions of its own, which no other transfer shares.
+	Transfer string
+	// OnProgress, if set, is called with the transfer's running sessions every ProgressInterval until the transfer
+	// ends. It isn't called for background transfers, which can be watched with Watch.
+	OnProgress       func([]SessionSummary)
+	ProgressInterval time.Duration
+}
+
+func (o TransferOptions) encode(params url.Values) {
+	params.Set("transfer", o.Transfer)
+	if o.Token != "" {
+		params.Set("token", o.Token)
+	}
+	if o.Rate != "" {
+		params.Set("rate", o.Rate)
+	}
+	params.Set("background", strconv.FormatBool(o.Background))
+}
+
+// PushRequest pushes Cid from the plugin's node to one or more remotes.
+type PushRequest struct {
+	Cid string
+	// Addrs are the remotes to push to, pushed to at once if there are several.
+	Addrs []string
+	// Quorum is how many of several remotes must complete for the push to succeed, 0 meaning all.
+	Quorum int
+	// Diff is the root of a DAG the remotes already have, whose blocks needn't be sent.
+	Diff string
+	TransferOptions
+}
+
+// RemotePush reports the push to one of several remotes.
+type RemotePush struct {
+	Remote string
+	// State is active while the push runs, then completed or failed.
+	State string
+	Start time.Time
+	End   *time.Time `json:",omitempty"`
+	Error string     `json:",omitempty"`
+	// Session is the id the push to the remote is listed under by Ls.
+	Session string `json:",omitempty"`
+	// Rounds, blocks and bytes of blocks sent so far.
+	Rounds uint64
+	Blocks uint64
+	Bytes  uint64
+}
+
+// PushResponse reports a push. The plugin only reports pushes to several remotes; for a push to one,
+// only Cid and Transfer are set.
+type PushResponse struct {
+	Cid       string
+	Quorum    int
+	Completed int
+	Failed    int
+	Remotes   []RemotePush
+	// Transfer is the id the push's sessions are listed under, which Watch follows.
+	Transfer string `json:",omitempty"`
+	// Error is why the quorum wasn't reached, empty if it was or the push runs in the background.
+	Error string `json:",omitempty"`
+}
+
+// Push pushes the DAG under r.Cid, waiting for the push to end unless r.Background is set.
+// If a push to several remotes misses its quorum, the report is returned along with an *Error.
+func (c *Client) Push(ctx context.Context, r PushRequest) (*PushResponse, error) {
+	if len(r.Addrs) == 0 {
+		return nil, fmt.Errorf("a remote to push to is required")
+	}
+	params := url.Values{}
+	params.Set("cid", r.Cid)
+	for _, addr := range r.Addrs {
+		params.Add("addr", addr)
+	}
+	if r.Diff != "" {
+		params.Set("diff", r.Diff)
+	}
+	if r.Quorum != 0 {
+		params.Set("quorum", strconv.Itoa(r.Quorum))
+	}
+	r.Transfer = transferID(r.Transfer)
+	r.TransferOptions.encode(params)
+
+	res := &PushResponse{Cid: r.Cid, Transfer: r.Transfer}
+	stop := c.reportProgress(ctx, r.TransferOptions)
+	err := c.do(ctx, "/push/new", params, res)
+	stop()
+	if err != nil && res.Remotes == nil {
+		return nil, err
+	}
+	return res, err
+}
+
+// PullRequest pulls Cid from one or more remotes to the plugin's node.
+type PullRequest struct {
+	Cid string
+	// Addrs are the remotes to pull from, each pulling different subtrees at once if there are several.
+	Addrs []string
+	TransferOptions
+}
+
+// SourcePull reports the pull from one of several remotes.
+type SourcePull struct {
+	Remote string
+	// State is active while the source is used, completed once the DAG is complete, or failed once it is given up on.
+	State string
+	// Subtrees is how many subtrees were pulled from the source.
+	Subtrees int
+	Failures int
+	// Error is why the last pull from the source failed.
+	Error string `json:",omitempty"`
+}
+
+// PullResponse reports a pull. The plugin only reports pulls from several remotes; for a pull from one,
+// only Cid and Transfer are set.
+type PullResponse struct {
+	Cid string
+	// Blocks is how many blocks the DAG has, once it has been verified complete.
+	Blocks  int `json:",omitempty"`
+	Sources []SourcePull
+	// Transfer is the id the pull's sessions are listed under, which Watch follows.
+	Transfer string `json:",omitempty"`
+	// Error is why the DAG couldn't be completed, empty if it was or the pull runs in the background.
+	Error string `json:",omitempty"`
+}
+
+// Pull pulls the DAG under r.Cid, waiting for the pull to end unless r.Background is set.
+// If a pull from several remotes can't complete the DAG, the report is returned along with an *Error.
+func (c *Client) Pull(ctx context.Context, r PullRequest) (*PullResponse, error) {
+	if len(r.Addrs) == 0 {
+		return nil, fmt.Errorf("a remote to pull from is required")
+	}
+	params := url.Values{}
+	params.Set("cid", r.Cid)
+	for _, addr := range r.Addrs {
+		params.Add("addr", addr)
+	}
+	r.Transfer = transferID(r.Transfer)
+	r.TransferOptions.encode(params)
+
+	res := &PullResponse{Cid: r.Cid, Transfer: r.Transfer}
+	stop := c.reportProgress(ctx, r.TransferOptions)
+	err := c.do(ctx, "/pull/new", params, res)
+	stop()
+	if err != nil && res.Sources == nil {
+		return nil, err
+	}
+	return res, err
+}
+
+// LsRequest selects a page of the sessions matching a filter.
+type LsRequest struct {
+	SessionFilter
+	Offset int
+	// Limit is the most sessions to list, 0 meaning all.
+	Limit int
+}
+
+// Ls lists running and ended sessions, oldest first. A page shorter than the limit is the last.
+func (c *Client) Ls(ctx context.Context, r LsRequest) ([]SessionSummary, error) {
+	params := url.Values{}
+	r.SessionFilter.encode(params)
+	if r.Offset != 0 {
+		params.Set("offset", strconv.Itoa(r.Offset))
+	}
+	if r.Limit != 0 {
+		params.Set("limit", strconv.Itoa(r.Limit))
+	}
+	var sessions []SessionSummary
+	if err := c.do(ctx, "/ls", params, &sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// StopRequest selects the running sessions to cancel or close: a single session by id,
+// every session matching a filter, or every session if All is set.
+type StopRequest struct {
+	Session string
+	SessionFilter
+	All bool
+}
+
+// StopResponse lists the sessions stopped, as they were beforehand.
+type StopResponse struct {
+	Sessions []SessionSummary
+}
+
+// Cancel cancels running sessions, abandoning transfers in progress.
+func (c *Client) Cancel(ctx context.Context, r StopRequest) (*StopResponse, error) {
+	return c.stop(ctx, "/cancel", r)
+}
+
+// Close closes running sessions once the transfers in progress are done.
+func (c *Client) Close(ctx context.Context, r StopRequest) (*StopResponse, error) {
+	return c.stop(ctx, "/close", r)
+}
+
+func (c *Client) stop(ctx context.Context, path string, r StopRequest) (*StopResponse, error) {
+	params := url.Values{}
+	if r.Session != "" {
+		params.Set("session", r.Session)
+	}
+	r.SessionFilter.encode(params)
+	if r.All {
+		params.Set("all", "true")
+	}
+	res := &StopResponse{}
+	if err := c.do(ctx, path, params, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Bucket counts the events of one kind, and the bytes they moved.
+type Bucket struct {
+	Count    uint64
+	Bytes    uint64
+	Interval time.Duration
+}
+
+// Stats returns the plugin's event counts by name, only those of session if it isn't empty.
+func (c *Client) Stats(ctx context.Context, session string) (map[string]Bucket, error) {
+	params := url.Values{}
+	if session != "" {
+		params.Set("session", session)
+	}
+	res := make(map[string]Bucket)
+	if err := c.do(ctx, "/stats", params, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Watch reports the running sessions of transfer, the Transfer of a push or pull response, every interval,
+// until none are running or ctx is done, then closes the channel. It is how background transfers are followed.
+// Sessions that can't be listed are tried again on the next tick. A pull from several remotes may have none
+// running for a moment between subtrees, so its outcome is best read from the history once the channel closes.
+func (c *Client) Watch(ctx context.Context, transfer string, interval time.Duration) <-chan []SessionSummary {
+	updates := make(chan []SessionSummary)
+	go func() {
+		defer close(updates)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			running, err := c.running(ctx, transfer)
+			if err == nil {
+				if len(running) == 0 {
+					return
+				}
+				select {
+				case updates <- running:
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return updates
+}
+
+// running lists the running sessions of transfer.
+func (c *Client) running(ctx context.Context, transfer string) ([]SessionSummary, error) {
+	sessions, err := c.Ls(ctx, LsRequest{SessionFilter: SessionFilter{Role: RoleClient, Transfer: transfer}})
+	if err != nil {
+		return nil, err
+	}
+	var running []SessionSummary
+	for _, s := range sessions {
+		if s.Running() {
+			running = append(running, s)
+		}
+	}
+	return running, nil
+}
+
+// transferID returns id, or a random transfer id if it is empty.
+func transferID(id string) string {
+	if id != "" {
+		return id
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// reportProgress calls o.OnProgress with the running sessions of o.Transfer until the returned function is called.
+func (c *Client) reportProgress(ctx context.Context, o TransferOptions) func() {
+	if o.OnProgress == nil || o.Background {
+		return func() {}
+	}
+	interval := o.ProgressInterval
+	if interval <= 0 {
+		interval = DefaultProgressInterval
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if running, err := c.running(ctx, o.Transfer); err == nil && ctx.Err() == nil {
+					o.OnProgress(running)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	// Progress is never reported once the transfer has returned.
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// Call POSTs params to the endpoint at path, such as "/verify", decoding the response body into res if there is one.
+// It is for the endpoints without a method of their own; errors are returned as for them.
+func (c *Client) Call(ctx context.Context, path string, params url.Values, res interface{}) error {
+	return c.do(ctx, path, params, res)
+}
+
+// do POSTs params to path, decoding the response body into res if there is one.
+// Errors the API reports are returned as *Error, after decoding any report in the body into res.
+func (c *Client) do(ctx context.Context, path string, params url.Values, res interface{}) error {
+	endpoint := c.base + path
+	if len(params) > 0 {
+		endpoint += "?" + params.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, nil)
+	if err != nil {
+		return err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		apiErr := &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(body))}
+		// Errors are written as {"error": ...}, except by transfers with several remotes, which report why they
+		// failed in Error alongside how each remote got on. Field names match either way.
+		var e struct{ Error string }
+		if json.Unmarshal(body, &e) == nil {
+			apiErr.Message = e.Error
+			json.Unmarshal(body, res)
+		}
+		if apiErr.Message == "" {
+			apiErr.Message = http.StatusText(resp.StatusCode)
+		}
+		return apiErr
+	}
+
+	// Pushes and pulls with one remote write nothing when they succeed.
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return nil
+	}
+	return json.NewDecoder(bytes.NewReader(body)).Decode(res)
+}
@@ -0,0 +1,108 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPush(t *testing.T) {
+	ctx := context.Background()
+	var listed atomic.Int32
+	var transfer atomic.Value
+	m := http.NewServeMux()
+	m.HandleFunc("/push/new", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("cid") != "CID" || len(r.Form["addr"]) != 2 || r.FormValue("quorum") != "1" || r.FormValue("transfer") == "" {
+			t.Errorf("unexpected push params %v", r.Form)
+		}
+		transfer.Store(r.FormValue("transfer"))
+		// Progress is polled while the push runs.
+		for listed.Load() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(PushResponse{Cid: "CID", Quorum: 1, Failed: 2, Remotes: []RemotePush{{Remote: "a"}, {Remote: "b"}}, Error: "quorum not reached"})
+	})
+	m.HandleFunc("/ls", func(w http.ResponseWriter, r *http.Request) {
+		// Only the push's own sessions are listed.
+		if r.FormValue("role") != RoleClient || r.FormValue("transfer") != transfer.Load() {
+			t.Errorf("unexpected ls params %v", r.Form)
+		}
+		json.NewEncoder(w).Encode([]SessionSummary{
+			{ID: "a", Remote: "a", Transfer: r.FormValue("transfer"), State: StateActive, Blocks: 3},
+			{ID: "b", Remote: "b", Transfer: r.FormValue("transfer"), State: StateActive},
+			{ID: "c", Remote: "a", Transfer: r.FormValue("transfer"), State: StateCompleted},
+		})
+	})
+	server := httptest.NewServer(m)
+	defer server.Close()
+
+	c, err := New(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var progress [][]SessionSummary
+	res, err := c.Push(ctx, PushRequest{Cid: "CID", Addrs: []string{"a", "b"}, Quorum: 1, TransferOptions: TransferOptions{
+		OnProgress: func(running []SessionSummary) {
+			progress = append(progress, running)
+			listed.Add(1)
+		},
+		ProgressInterval: time.Millisecond,
+	}})
+
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusInternalServerError || apiErr.Message != "quorum not reached" {
+		t.Errorf("expected the quorum error, got %v", err)
+	}
+	if res == nil || len(res.Remotes) != 2 || res.Failed != 2 || res.Transfer != transfer.Load() {
+		t.Errorf("expected the report of both remotes, got %+v", res)
+	}
+	if len(progress) == 0 || len(progress[0]) != 2 || progress[0][0].Blocks != 3 {
+		t.Errorf("expected the running sessions of the push to be reported, got %+v", progress)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	ctx := context.Background()
+	m := http.NewServeMux()
+	m.HandleFunc("/ls", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "unauthorized"})
+			return
+		}
+		json.NewEncoder(w).Encode([]SessionSummary{{ID: "a", State: StateActive}})
+	})
+	m.HandleFunc("/pull/new", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "too many sessions", http.StatusServiceUnavailable)
+	})
+	server := httptest.NewServer(m)
+	defer server.Close()
+
+	c, err := New(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var apiErr *Error
+	if _, err := c.Ls(ctx, LsRequest{}); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized || apiErr.Message != "unauthorized" {
+		t.Errorf("expected an unauthorized error, got %v", err)
+	}
+
+	c, err = New(server.URL, func(cfg *Config) {
+		cfg.Token = "secret"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, err := c.Ls(ctx, LsRequest{}); err != nil || len(res) != 1 || res[0].ID != "a" {
+		t.Errorf("expected the session to be listed, got %+v, %v", res, err)
+	}
+	if res, err := c.Pull(ctx, PullRequest{Cid: "CID", Addrs: []string{"a"}}); res != nil || !errors.As(err, &apiErr) || apiErr.Message != "too many sessions" {
+		t.Errorf("expected a plain text error, got %+v, %v", res, err)
+	}
+}
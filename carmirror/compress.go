@@ -0,0 +1,385 @@
+package carmirror
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	stats "github.com/fission-codes/go-car-mirror/stats"
+	"github.com/fission-codes/go-car-mirror/util"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Content codings used for protocol bodies.
+const (
+	EncodingZstd = "zstd"
+	EncodingGzip = "gzip"
+	EncodingNone = "none"
+)
+
+// The codings we can decode, in order of preference, as advertised in Accept-Encoding.
+var supportedEncodings = []string{EncodingZstd, EncodingGzip}
+
+// Most bytes a compressed body may decode to, so a small body can't expand without bound.
+// It is far more than a round of blocks or a bloom filter takes.
+const maxDecompressedBody = 256 << 20
+
+var errBodyTooLarge = errors.New("decompressed body too large")
+
+// compressor compresses bodies with a content coding at a given level.
+// A nil compressor leaves bodies uncompressed.
+type compressor struct {
+	encoding string
+	level    int
+}
+
+// newCompressor validates an encoding and level from the config. Level 0 means the coding's default.
+// It returns nil if encoding is empty or EncodingNone.
+func newCompressor(encoding string, level int) (*compressor, error) {
+	switch encoding {
+	case "", EncodingNone:
+		return nil, nil
+	case EncodingZstd:
+		if level < 0 || level > 22 {
+			return nil, fmt.Errorf("zstd compression level must be between 1 and 22")
+		}
+	case EncodingGzip:
+		if level < 0 || level > gzip.BestCompression {
+			return nil, fmt.Errorf("gzip compression level must be between 1 and %d", gzip.BestCompression)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported compression %q, expected %s, %s or %s", encoding, EncodingZstd, EncodingGzip, EncodingNone)
+	}
+	return &compressor{encoding: encoding, level: level}, nil
+}
+
+// negotiate returns the coding to use for a peer that accepts the given Accept-Encoding,
+// preferring our own, or "" if the body should be sent uncompressed.
+func (c *compressor) negotiate(acceptEncoding string) string {
+	if c == nil {
+		return ""
+	}
+	if acceptsEncoding(acceptEncoding, c.encoding) {
+		return c.encoding
+	}
+	for _, encoding := range supportedEncodings {
+		if acceptsEncoding(acceptEncoding, encoding) {
+			return encoding
+		}
+	}
+	return ""
+}
+
+// writer returns a writer compressing into w with the given coding.
+func (c *compressor) writer(encoding string, w io.Writer) (io.WriteCloser, error) {
+	level := 0
+	if encoding == c.encoding {
+		level = c.level
+	}
+	switch encoding {
+	case EncodingZstd:
+		opts := []zstd.EOption{}
+		if level > 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+		return zstd.NewWriter(w, opts...)
+	case EncodingGzip:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	}
+	return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+}
+
+// decompressReader returns a reader decoding r with the given coding.
+func decompressReader(encoding string, r io.Reader) (io.ReadCloser, error) {
+	switch encoding {
+	case EncodingZstd:
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	case EncodingGzip:
+		return gzip.NewReader(r)
+	}
+	return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+}
+
+// isSupportedEncoding reports whether we can decode encoding.
+func isSupportedEncoding(encoding string) bool {
+	for _, e := range supportedEncodings {
+		if e == encoding {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsEncoding reports whether an Accept-Encoding header value accepts encoding with a non zero quality.
+func acceptsEncoding(header string, encoding string) bool {
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(name), encoding) && strings.TrimSpace(name) != "*" {
+			continue
+		}
+		if params = strings.TrimSpace(params); strings.HasPrefix(params, "q=") {
+			if v, err := strconv.ParseFloat(strings.TrimPrefix(params, "q="), 64); err == nil && v == 0 {
+				continue
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	io.Reader
+	n uint64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += uint64(n)
+	return n, err
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	io.Writer
+	n uint64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.n += uint64(n)
+	return n, err
+}
+
+// decompressedBody decodes a compressed body of at most limit bytes decoded, logging its compressed and
+// uncompressed sizes to stats once it is closed.
+type decompressedBody struct {
+	io.ReadCloser
+	body         io.Closer
+	compressed   *countingReader
+	uncompressed *countingReader
+	limit        int64
+	stats        stats.Stats
+	direction    string
+}
+
+func newDecompressedBody(encoding string, body io.ReadCloser, limit int64, s stats.Stats, direction string) (*decompressedBody, error) {
+	compressed := &countingReader{Reader: body}
+	decoder, err := decompressReader(encoding, compressed)
+	if err != nil {
+		return nil, err
+	}
+	return &decompressedBody{
+		ReadCloser: decoder,
+		body:       body,
+		compressed: compressed,
+		// One byte past the limit is read to tell a body of exactly limit bytes from a longer one.
+		uncompressed: &countingReader{Reader: io.LimitReader(decoder, limit+1)},
+		limit:        limit,
+		stats:        s,
+		direction:    direction,
+	}, nil
+}
+
+func (b *decompressedBody) Read(p []byte) (int, error) {
+	n, err := b.uncompressed.Read(p)
+	if b.uncompressed.n > uint64(b.limit) {
+		return n - int(b.uncompressed.n-uint64(b.limit)), errBodyTooLarge
+	}
+	return n, err
+}
+
+func (b *decompressedBody) Close() error {
+	b.ReadCloser.Close()
+	if b.stats != nil {
+		logCompression(b.stats, b.direction, b.compressed.n, b.uncompressed.n)
+	}
+	return b.body.Close()
+}
+
+// logCompression records the compressed and uncompressed sizes of a body.
+// direction is "in" or "out".
+func logCompression(s stats.Stats, direction string, compressed uint64, uncompressed uint64) {
+	s.LogBytes("bytes."+direction+".compressed", compressed)
+	s.LogBytes("bytes."+direction+".uncompressed", uncompressed)
+}
+
+// compressTransport negotiates compressed protocol bodies with a remote.
+// Responses are requested compressed from the start. Request bodies are only compressed
+// once the remote has advertised, with an Accept-Encoding response header, that it can decode them.
+type compressTransport struct {
+	base       http.RoundTripper
+	compressor *compressor
+	// Accept-Encoding advertised by each remote, by URL
+	remoteEncodings *util.SynchronizedMap[string, string]
+	url             string
+	stats           stats.Stats
+}
+
+func (t *compressTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if t.compressor == nil {
+		return t.base.RoundTrip(r)
+	}
+
+	r = r.Clone(r.Context())
+	// Setting Accept-Encoding ourselves stops net/http from transparently decoding gzip.
+	r.Header.Set("Accept-Encoding", strings.Join(supportedEncodings, ", "))
+
+	accepted, _ := t.remoteEncodings.Get(t.url)
+	if encoding := t.compressor.negotiate(accepted); encoding != "" && r.Body != nil && r.Body != http.NoBody {
+		body := r.Body
+		reader, writer := io.Pipe()
+		compressed := &countingWriter{Writer: writer}
+		encoder, err := t.compressor.writer(encoding, compressed)
+		if err != nil {
+			return nil, err
+		}
+		go func() {
+			n, err := io.Copy(encoder, body)
+			body.Close()
+			if closeErr := encoder.Close(); err == nil {
+				err = closeErr
+			}
+			if err == nil {
+				logCompression(t.stats, "out", compressed.n, uint64(n))
+			}
+			writer.CloseWithError(err)
+		}()
+
+		r.Body = reader
+		r.ContentLength = -1
+		r.Header.Del("Content-Length")
+		r.Header.Set("Content-Encoding", encoding)
+	}
+
+	resp, err := t.base.RoundTrip(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if advertised := resp.Header.Get("Accept-Encoding"); advertised != "" {
+		t.remoteEncodings.Add(t.url, advertised)
+	}
+
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" {
+		body, err := newDecompressedBody(encoding, resp.Body, maxDecompressedBody, t.stats, "in")
+		if err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		resp.Body = body
+		resp.ContentLength = -1
+		resp.Header.Del("Content-Encoding")
+		resp.Header.Del("Content-Length")
+	}
+
+	return resp, nil
+}
+
+// compressResponseWriter compresses a response once its status is written.
+type compressResponseWriter struct {
+	http.ResponseWriter
+	compressor   *compressor
+	encoding     string
+	encoder      io.WriteCloser
+	compressed   *countingWriter
+	uncompressed uint64
+	wroteHeader  bool
+}
+
+func (w *compressResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	if w.encoding != "" {
+		w.compressed = &countingWriter{Writer: w.ResponseWriter}
+		encoder, err := w.compressor.writer(w.encoding, w.compressed)
+		if err == nil {
+			w.encoder = encoder
+			w.Header().Set("Content-Encoding", w.encoding)
+			w.Header().Del("Content-Length")
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *compressResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.uncompressed += uint64(len(p))
+	if w.encoder == nil {
+		return w.ResponseWriter.Write(p)
+	}
+	return w.encoder.Write(p)
+}
+
+// close finishes the compressed stream, returning the compressed size, or false if the response wasn't compressed.
+func (w *compressResponseWriter) close() (uint64, bool) {
+	if w.encoder == nil {
+		return 0, false
+	}
+	w.encoder.Close()
+	return w.compressed.n, true
+}
+
+// compress decodes compressed request bodies for a remote protocol handler and compresses
+// its responses when the client accepts it, recording sizes against the server session.
+// Every response advertises the codings we accept for requests.
+func compress(next http.HandlerFunc, c *compressor, cookie string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Accept-Encoding", strings.Join(supportedEncodings, ", "))
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		var body *decompressedBody
+		if encoding := r.Header.Get("Content-Encoding"); encoding != "" {
+			if !isSupportedEncoding(encoding) {
+				http.Error(w, fmt.Sprintf("unsupported content encoding %q", encoding), http.StatusUnsupportedMediaType)
+				return
+			}
+			var err error
+			if body, err = newDecompressedBody(encoding, r.Body, maxDecompressedBody, nil, "in"); err != nil {
+				http.Error(w, "bad compressed body", http.StatusBadRequest)
+				return
+			}
+			// The server only closes the body it read the request from, so the decoder is closed here.
+			defer body.Close()
+			r.Body = body
+			r.Header.Del("Content-Encoding")
+		}
+
+		writer := &compressResponseWriter{
+			ResponseWriter: w,
+			compressor:     c,
+			encoding:       c.negotiate(r.Header.Get("Accept-Encoding")),
+		}
+
+		next(writer, r)
+		compressed, ok := writer.close()
+
+		session := sessionFromRequest(w, r, cookie)
+		if session == "" {
+			return
+		}
+		s := stats.GLOBAL_STATS.WithContext(session)
+		if body != nil {
+			logCompression(s, "in", body.compressed.n, body.uncompressed.n)
+		}
+		if ok {
+			logCompression(s, "out", compressed, writer.uncompressed)
+		}
+	}
+}
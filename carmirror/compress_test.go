@@ -0,0 +1,113 @@
+package carmirror
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	stats "github.com/fission-codes/go-car-mirror/stats"
+	"github.com/fission-codes/go-car-mirror/util"
+)
+
+func TestAcceptsEncoding(t *testing.T) {
+	for _, tc := range []struct {
+		header   string
+		encoding string
+		expected bool
+	}{
+		{"zstd, gzip", EncodingGzip, true},
+		{"gzip;q=0.5", EncodingGzip, true},
+		{"gzip;q=0", EncodingGzip, false},
+		{"*", EncodingZstd, true},
+		{"br, deflate", EncodingZstd, false},
+		{"", EncodingZstd, false},
+	} {
+		if actual := acceptsEncoding(tc.header, tc.encoding); actual != tc.expected {
+			t.Errorf("acceptsEncoding(%q, %q) = %v, expected %v", tc.header, tc.encoding, actual, tc.expected)
+		}
+	}
+}
+
+func TestCompressNegotiation(t *testing.T) {
+	c, err := newCompressor(EncodingZstd, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload := bytes.Repeat([]byte("compressible dag-cbor "), 1000)
+	echo := compress(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil || !bytes.Equal(body, payload) {
+			http.Error(w, "bad body", http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		w.Write(body)
+	}, c, "sessionId")
+
+	var requestEncodings []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestEncodings = append(requestEncodings, r.Header.Get("Content-Encoding"))
+		echo(w, r)
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: &compressTransport{
+		base:            http.DefaultTransport,
+		compressor:      c,
+		remoteEncodings: util.NewSynchronizedMap[string, string](),
+		url:             server.URL,
+		stats:           stats.GLOBAL_STATS.WithContext(server.URL),
+	}}
+
+	for i := 0; i < 2; i++ {
+		resp, err := client.Post(server.URL, "application/cbor", bytes.NewReader(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusAccepted || !bytes.Equal(body, payload) {
+			t.Fatalf("request %d: unexpected response %d", i, resp.StatusCode)
+		}
+	}
+
+	// The first request goes out plain, and once the server has advertised zstd the second is compressed.
+	if requestEncodings[0] != "" || requestEncodings[1] != EncodingZstd {
+		t.Errorf("expected request encodings [\"\" zstd], got %q", requestEncodings)
+	}
+}
+
+func TestDecompressedBodyLimit(t *testing.T) {
+	c, err := newCompressor(EncodingZstd, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var compressed bytes.Buffer
+	encoder, err := c.writer(EncodingZstd, &compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoder.Write(make([]byte, 1024))
+	encoder.Close()
+
+	for limit, expected := range map[int64]error{1024: nil, 1023: errBodyTooLarge} {
+		body, err := newDecompressedBody(EncodingZstd, io.NopCloser(bytes.NewReader(compressed.Bytes())), limit, nil, "in")
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := io.ReadAll(body)
+		body.Close()
+		if err != expected {
+			t.Errorf("limit %d: expected %v, got %v", limit, expected, err)
+		}
+		if int64(len(decoded)) > limit {
+			t.Errorf("limit %d: expected at most the limit to be read, got %d bytes", limit, len(decoded))
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package carmirror
+
+import (
+	"context"
+	"fmt"
+
+	cmcore "github.com/fission-codes/go-car-mirror/core"
+	cmerrors "github.com/fission-codes/go-car-mirror/errors"
+	cmipld "github.com/fission-codes/go-car-mirror/ipld"
+	gocid "github.com/ipfs/go-cid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// hasBatchSize is how many blocks an estimate asks each remote about at a time.
+const hasBatchSize = 1024
+
+// RemoteEstimate is what a push would send to one remote.
+type RemoteEstimate struct {
+	Remote string
+	// MissingBlocks and MissingBytes are the blocks of the DAG the remote doesn't have, which a push would send.
+	// Bytes are block data, not counting the CAR framing they are sent in.
+	MissingBlocks int
+	MissingBytes  uint64
+	// Queries is how many has queries the remote was asked.
+	Queries int
+	// UpperBound is set for a remote that doesn't answer has queries, as a stock CAR Mirror server doesn't.
+	// Every block is counted as missing, so a push would send at most the counts.
+	UpperBound bool `json:",omitempty"`
+	// Error is why the remote couldn't be asked, in which case the counts are incomplete.
+	Error string `json:",omitempty"`
+}
+
+// EstimateResponse reports what a push of one root would send to each remote, found without sending any blocks.
+type EstimateResponse struct {
+	Cid string
+	// Blocks and Bytes are the size of the DAG held locally.
+	Blocks int
+	Bytes  uint64
+	// LocalMissing is how many blocks of the DAG aren't held locally, or are denied by the content policy,
+	// which a push couldn't send.
+	LocalMissing int `json:",omitempty"`
+	Remotes      []RemoteEstimate
+}
+
+// estimate finds what pushing root to each remote in p.Addrs would send. It walks the local DAG once, asking every
+// remote which of its blocks it has in has queries, which start no session. Blocks of the diff base that a push
+// would mark as held are taken to be held, as the push would, and aren't asked about.
+// Remotes that don't answer has queries aren't asked again, and every block is counted as missing for them.
+func (cm *CarMirror) estimate(ctx context.Context, p PushParams, root gocid.Cid, diff gocid.Cid) (*EstimateResponse, error) {
+	if len(p.Addrs) == 0 {
+		return nil, fmt.Errorf("no remote to estimate a push to")
+	}
+	rate, err := cm.remoteParams(p.Addrs, p.Rate)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, span := cm.client.tracer.Start(ctx, "carmirror.estimate", trace.WithAttributes(attribute.String("carmirror.cid", root.String())))
+	defer span.End()
+
+	held := make(map[gocid.Cid]bool)
+	if diff.Defined() {
+		// The same blocks SetBase marks, the first maxBaseBlocks of the base breadth first.
+		base, err := cm.walk(ctx, diff, maxBaseBlocks)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range base {
+			held[id] = true
+		}
+	}
+
+	res := &EstimateResponse{Cid: root.String()}
+	for _, addr := range p.Addrs {
+		res.Remotes = append(res.Remotes, RemoteEstimate{Remote: addr})
+	}
+
+	// ask asks every remote still answering about a batch of blocks, and counts those they are missing.
+	var batch []cmipld.Cid
+	sizes := make(map[cmipld.Cid]int)
+	ask := func() {
+		for i := range res.Remotes {
+			remote := &res.Remotes[i]
+			if remote.Error != "" {
+				continue
+			}
+			var have []bool
+			var err error
+			if !remote.UpperBound {
+				remote.Queries++
+				have, err = cm.client.Has(ctx, remote.Remote, rate, p.Token, cmipld.WrapCid(root), batch)
+			}
+			if err == errHasUnsupported {
+				log.Debugw("remote doesn't answer has queries", "object", "CarMirror", "method", "estimate", "remote", remote.Remote)
+				remote.UpperBound = true
+				err = nil
+			}
+			if remote.UpperBound {
+				have = make([]bool, len(batch))
+			}
+			if err != nil {
+				log.Debugw("has query failed", "object", "CarMirror", "method", "estimate", "remote", remote.Remote, "error", err)
+				remote.Error = err.Error()
+				continue
+			}
+			for j, id := range batch {
+				if !have[j] {
+					remote.MissingBlocks++
+					remote.MissingBytes += uint64(sizes[id])
+				}
+			}
+		}
+		batch = batch[:0]
+		sizes = make(map[cmipld.Cid]int)
+	}
+
+	err = walkDAG(ctx, cm.blockStore, []gocid.Cid{root}, func(id gocid.Cid, block cmcore.Block[cmipld.Cid], err error) (bool, error) {
+		if err == cmerrors.ErrBlockNotFound || err == ErrDeniedBlock {
+			res.LocalMissing++
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		size := len(block.RawData())
+		res.Blocks++
+		res.Bytes += uint64(size)
+
+		if held[id] {
+			return true, nil
+		}
+		batch = append(batch, block.Id())
+		sizes[block.Id()] = size
+		if len(batch) == hasBatchSize {
+			ask()
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(batch) > 0 {
+		ask()
+	}
+	return res, nil
+}
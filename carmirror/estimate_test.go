@@ -0,0 +1,87 @@
+package carmirror
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	cmipld "github.com/fission-codes/go-car-mirror/ipld"
+	"github.com/ipfs/boxo/ipld/merkledag"
+	gocid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+func TestEstimate(t *testing.T) {
+	ctx := context.Background()
+	cms, apis := newTestCarMirrors(t, 2)
+	local, remote := cms[0], cms[1]
+	if err := remote.StartRemote(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+	addr := "http://" + remote.RemoteAddr().String()
+
+	// The local node has a root linking to two leaves, and the remote has one of the leaves.
+	root := merkledag.NodeWithData([]byte("root"))
+	left, right := merkledag.NewRawNode([]byte("left")), merkledag.NewRawNode([]byte("right"))
+	for name, leaf := range map[string]ipld.Node{"left": left, "right": right} {
+		if err := root.AddNodeLink(name, leaf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := apis[0].Dag().AddMany(ctx, []ipld.Node{root, left, right}); err != nil {
+		t.Fatal(err)
+	}
+	if err := apis[1].Dag().Add(ctx, left); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := local.estimate(ctx, PushParams{Addrs: []string{addr, "http://127.0.0.1:1"}}, root.Cid(), gocid.Undef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Blocks != 3 || res.LocalMissing != 0 {
+		t.Errorf("expected the DAG's 3 blocks to be walked, got %+v", res)
+	}
+	want := uint64(len(root.RawData()) + len(right.RawData()))
+	if r := res.Remotes[0]; r.Error != "" || r.MissingBlocks != 2 || r.MissingBytes != want || r.Queries != 1 {
+		t.Errorf("expected the remote to be missing the root and right leaf, %d bytes, got %+v", want, r)
+	}
+	if r := res.Remotes[1]; r.Error == "" {
+		t.Errorf("expected the unreachable remote to fail, got %+v", r)
+	}
+
+	// Nothing was sent.
+	if has, err := remote.blockStore.Has(ctx, cmipld.WrapCid(root.Cid())); err != nil || has {
+		t.Errorf("expected the remote not to have the root, got %v, %v", has, err)
+	}
+
+	// Blocks under the diff base are taken to be held.
+	res, err = local.estimate(ctx, PushParams{Addrs: []string{addr}}, root.Cid(), right.Cid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := res.Remotes[0]; r.MissingBlocks != 1 || r.MissingBytes != uint64(len(root.RawData())) {
+		t.Errorf("expected only the root to be missing, got %+v", r)
+	}
+
+	// A remote without has queries gets an upper bound, and is only asked once.
+	var queries int
+	stock := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries++
+		http.NotFound(w, r)
+	}))
+	defer stock.Close()
+	res, err = local.estimate(ctx, PushParams{Addrs: []string{stock.URL}}, root.Cid(), gocid.Undef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := res.Remotes[0]; r.Error != "" || !r.UpperBound || r.MissingBlocks != 3 || r.MissingBytes != res.Bytes || queries != 1 {
+		t.Errorf("expected every block to be counted as missing after one query, got %+v after %d", r, queries)
+	}
+
+	if _, err := local.estimate(ctx, PushParams{Addrs: []string{addr, addr}}, root.Cid(), gocid.Undef); err == nil {
+		t.Errorf("expected a remote given twice to be rejected")
+	}
+}
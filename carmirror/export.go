@@ -0,0 +1,288 @@
+package carmirror
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	cmbatch "github.com/fission-codes/go-car-mirror/batch"
+	cmcore "github.com/fission-codes/go-car-mirror/core"
+	cmerrors "github.com/fission-codes/go-car-mirror/errors"
+	"github.com/fission-codes/go-car-mirror/filter"
+	cmipld "github.com/fission-codes/go-car-mirror/ipld"
+	blocks "github.com/ipfs/go-block-format"
+	gocid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	carblockstore "github.com/ipld/go-car/v2/blockstore"
+)
+
+const (
+	// exportURL is the URL an export's source session pushes to, which is served in process.
+	exportURL = "http://car-export"
+	// How long an export may take, after which it fails.
+	exportTimeout = 10 * time.Minute
+)
+
+// ExportResponse reports a push written to a CAR file.
+type ExportResponse struct {
+	Cid  string
+	Path string
+	// Diff is the root of the DAG the remote is taken to have, and FilterRoots the roots of the filter snapshot
+	// describing what it has.
+	Diff        string   `json:",omitempty"`
+	FilterRoots []string `json:",omitempty"`
+	// Blocks and Bytes are what was written, the blocks the remote would need.
+	Blocks int
+	Bytes  uint64
+}
+
+// carSink is the block store of the sink an export pushes to. It holds the blocks the remote is taken to have, those
+// under the diff base or in the remote's filter snapshot, and writes every other block it receives to a CARv2 file.
+type carSink struct {
+	// Local blocks, which held blocks are read from
+	local cmcore.BlockStore[cmipld.Cid]
+	car   *carblockstore.ReadWrite
+
+	// Blocks in the remote's filter snapshot, and blocks of the diff base, either may be nil
+	remote filter.Filter[cmipld.Cid]
+	base   filter.Filter[cmipld.Cid]
+
+	mu sync.Mutex
+	// Blocks written to the file
+	held    map[gocid.Cid]bool
+	written int
+	bytes   uint64
+}
+
+func (cs *carSink) Get(ctx context.Context, id cmipld.Cid) (cmcore.Block[cmipld.Cid], error) {
+	if ok, _ := cs.Has(ctx, id); !ok {
+		return nil, cmerrors.ErrBlockNotFound
+	}
+	return cs.local.Get(ctx, id)
+}
+
+func (cs *carSink) Has(ctx context.Context, id cmipld.Cid) (bool, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.has(id), nil
+}
+
+// has reports whether the remote is taken to have the block. It must be called holding mu.
+func (cs *carSink) has(id cmipld.Cid) bool {
+	return cs.held[id.Unwrap()] || (cs.remote != nil && !cs.remote.DoesNotContain(id)) || (cs.base != nil && !cs.base.DoesNotContain(id))
+}
+
+func (cs *carSink) All(ctx context.Context) (<-chan cmipld.Cid, error) {
+	return nil, fmt.Errorf("an export's blocks can't be listed")
+}
+
+func (cs *carSink) Add(ctx context.Context, rawBlock cmcore.RawBlock[cmipld.Cid]) (cmcore.Block[cmipld.Cid], error) {
+	block, err := blocks.NewBlockWithCid(rawBlock.RawData(), rawBlock.Id().Unwrap())
+	if err != nil {
+		return nil, err
+	}
+	node, err := ipld.DefaultBlockDecoder.Decode(block)
+	if err != nil {
+		return nil, err
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if !cs.has(rawBlock.Id()) {
+		if err := cs.car.Put(ctx, block); err != nil {
+			return nil, err
+		}
+		cs.held[block.Cid()] = true
+		cs.written++
+		cs.bytes += uint64(len(block.RawData()))
+	}
+	return cmipld.WrapBlock(node), nil
+}
+
+func (cs *carSink) AddMany(ctx context.Context, rawBlocks []cmcore.RawBlock[cmipld.Cid]) ([]cmcore.Block[cmipld.Cid], error) {
+	var added []cmcore.Block[cmipld.Cid]
+	for _, rawBlock := range rawBlocks {
+		block, err := cs.Add(ctx, rawBlock)
+		if err != nil {
+			return nil, err
+		}
+		added = append(added, block)
+	}
+	return added, nil
+}
+
+// handlerTransport serves requests with a handler in process, rather than sending them.
+type handlerTransport struct {
+	handler http.HandlerFunc
+}
+
+func (t *handlerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	w := &bufferedResponse{header: make(http.Header), status: http.StatusOK}
+	t.handler(w, r)
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", w.status, http.StatusText(w.status)),
+		StatusCode:    w.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        w.header,
+		Body:          io.NopCloser(&w.body),
+		ContentLength: int64(w.body.Len()),
+		Request:       r,
+	}, nil
+}
+
+// bufferedResponse is a response written by a handler served in process, kept to be read back.
+type bufferedResponse struct {
+	header      http.Header
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (w *bufferedResponse) Header() http.Header {
+	return w.header
+}
+
+func (w *bufferedResponse) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status, w.wroteHeader = status, true
+	}
+}
+
+func (w *bufferedResponse) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.body.Write(b)
+}
+
+// pathIn resolves name, a path relative to dir or within it, refusing paths that lead outside dir once symbolic links
+// are followed. setting names the setting dir comes from, which must be set.
+func pathIn(setting string, dir string, name string) (string, error) {
+	if dir == "" {
+		return "", fmt.Errorf("%s isn't configured", setting)
+	}
+	if name == "" {
+		return "", fmt.Errorf("no file given")
+	}
+	path := name
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	path = filepath.Clean(path)
+
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", err
+	}
+	// A file that doesn't exist yet is resolved through its directory.
+	resolved, err := filepath.EvalSymlinks(path)
+	if os.IsNotExist(err) {
+		var parent string
+		if parent, err = filepath.EvalSymlinks(filepath.Dir(path)); err == nil {
+			resolved = filepath.Join(parent, filepath.Base(path))
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(realDir, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside %s %s", name, setting, dir)
+	}
+	return resolved, nil
+}
+
+// export writes the blocks a push of root would send to a remote into a new CARv2 file at path, with root as its root.
+// The remote is taken to hold the blocks in snapshot, if it isn't nil, and the DAG under base, if it is defined. All of
+// base is taken to be held, through a filter snapshot of it, however large it is. The push is a source session like
+// any other, whose sink is served in process and writes the blocks it receives to the file.
+func (cm *CarMirror) export(ctx context.Context, path string, root gocid.Cid, base gocid.Cid, snapshot *FilterSnapshot) (*ExportResponse, error) {
+	sink := &carSink{local: deniedAsMissing{cm.blockStore}, held: make(map[gocid.Cid]bool)}
+	if snapshot != nil {
+		sink.remote = snapshot.Filter
+	}
+	if base.Defined() {
+		held, err := cm.snapshotFilter(ctx, []gocid.Cid{base})
+		if err != nil {
+			return nil, err
+		}
+		sink.base = held.Filter
+	}
+
+	// The file must be new, so an export never writes over another file.
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	car, err := carblockstore.OpenReadWriteFile(f, []gocid.Cid{root})
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	sink.car = car
+	if err := cm.exportTo(ctx, sink, root); err != nil {
+		car.Discard()
+		os.Remove(path)
+		return nil, err
+	}
+	if err := car.Finalize(); err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+
+	res := &ExportResponse{Cid: root.String(), Path: path, Blocks: sink.written, Bytes: sink.bytes}
+	if base.Defined() {
+		res.Diff = base.String()
+	}
+	if snapshot != nil {
+		res.FilterRoots = snapshot.Roots
+	}
+	return res, nil
+}
+
+// exportTo pushes root to sink in process, the source taking the sink to hold what it is taken to hold, and waits for
+// the push to finish, for at most exportTimeout.
+func (cm *CarMirror) exportTo(ctx context.Context, sink *carSink, root gocid.Cid) error {
+	if cm.closing.Load() {
+		return errClosing
+	}
+
+	cm.reconfigure.Lock()
+	config := cm.cfg.batchConfig()
+	cm.reconfigure.Unlock()
+	server := NewServer(sink, config)
+	server.SetTracer(cm.client.tracer)
+	client := NewClient(deniedAsMissing{cm.blockStore}, config, &handlerTransport{handler: server.HandleBlocks})
+	client.tracer = cm.client.tracer
+
+	key, session := client.NewSourceSession(exportURL, 0, "")
+	for _, held := range []filter.Filter[cmipld.Cid]{sink.remote, sink.base} {
+		if held == nil {
+			continue
+		}
+		if err := client.AddHeld(key, held); err != nil {
+			session.Cancel()
+			return err
+		}
+	}
+	if err := session.Enqueue(cmipld.WrapCid(root)); err != nil {
+		session.Cancel()
+		return err
+	}
+
+	exportCtx, cancel := context.WithTimeout(ctx, exportTimeout)
+	defer cancel()
+	err := await(exportCtx, "export", session.Done(), func() cmbatch.BatchState { return session.Info().State }, session.Cancel)
+	if err != nil && ctx.Err() == nil && exportCtx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("export timed out")
+	}
+	return err
+}
@@ -0,0 +1,147 @@
+package carmirror
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/boxo/ipld/merkledag"
+	gocid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	carblockstore "github.com/ipld/go-car/v2/blockstore"
+)
+
+func TestExport(t *testing.T) {
+	ctx := context.Background()
+	cms, nodes := newTestCarMirrors(t, 1)
+	cm := cms[0]
+
+	// The remote has the old root, linking to the left leaf. The new root links to both leaves.
+	left, right := merkledag.NewRawNode([]byte("left")), merkledag.NewRawNode([]byte("right"))
+	old, root := merkledag.NodeWithData([]byte("old")), merkledag.NodeWithData([]byte("new"))
+	if err := old.AddNodeLink("left", left); err != nil {
+		t.Fatal(err)
+	}
+	for name, leaf := range map[string]ipld.Node{"left": left, "right": right} {
+		if err := root.AddNodeLink(name, leaf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := nodes[0].Dag().AddMany(ctx, []ipld.Node{old, root, left, right}); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	read := func(path string) []gocid.Cid {
+		car, err := carblockstore.OpenReadOnly(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer car.Close()
+		if roots, err := car.Roots(); err != nil || len(roots) != 1 || roots[0] != root.Cid() {
+			t.Errorf("expected the new root to be the file's root, got %v, %v", roots, err)
+		}
+		ids, err := car.AllKeysChan(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []gocid.Cid
+		for id := range ids {
+			got = append(got, id)
+		}
+		return got
+	}
+
+	path := filepath.Join(dir, "diff.car")
+	res, err := cm.export(ctx, path, root.Cid(), old.Cid(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Blocks != 2 || res.Bytes != uint64(len(root.RawData())+len(right.RawData())) {
+		t.Errorf("expected the new root and right leaf to be written, got %+v", res)
+	}
+	got := read(path)
+	if len(got) != 2 {
+		t.Errorf("expected 2 blocks in the file, got %v", got)
+	}
+	for _, id := range got {
+		if id == left.Cid() {
+			t.Errorf("expected the left leaf the remote has not to be written")
+		}
+	}
+
+	full := filepath.Join(dir, "full.car")
+	if res, err := cm.export(ctx, full, root.Cid(), gocid.Undef, nil); err != nil || res.Blocks != 3 {
+		t.Fatalf("expected the whole DAG to be written, got %+v, %v", res, err)
+	}
+	if got := read(full); len(got) != 3 {
+		t.Errorf("expected 3 blocks in the file, got %v", got)
+	}
+
+	if _, err := cm.export(ctx, path, root.Cid(), gocid.Undef, nil); err == nil {
+		t.Errorf("expected an existing file not to be overwritten")
+	}
+
+	// However large the base is, all of it is taken to be held.
+	bigOld, bigRoot := merkledag.NodeWithData([]byte("big old")), merkledag.NodeWithData([]byte("big new"))
+	nodesAdded := []ipld.Node{bigOld, bigRoot, right}
+	for i := 0; i < 5000; i++ {
+		leaf := merkledag.NewRawNode([]byte(fmt.Sprintf("leaf %d", i)))
+		name := fmt.Sprint(i)
+		if err := bigOld.AddNodeLink(name, leaf); err != nil {
+			t.Fatal(err)
+		}
+		if err := bigRoot.AddNodeLink(name, leaf); err != nil {
+			t.Fatal(err)
+		}
+		nodesAdded = append(nodesAdded, leaf)
+	}
+	if err := bigRoot.AddNodeLink("right", right); err != nil {
+		t.Fatal(err)
+	}
+	if err := nodes[0].Dag().AddMany(ctx, nodesAdded); err != nil {
+		t.Fatal(err)
+	}
+	res, err = cm.export(ctx, filepath.Join(dir, "big.car"), bigRoot.Cid(), bigOld.Cid(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Blocks != 2 {
+		t.Errorf("expected only the new root and right leaf to be written, got %+v", res)
+	}
+}
+
+func TestPathIn(t *testing.T) {
+	dir, outside := t.TempDir(), t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]string{
+		"out.car":                       filepath.Join(dir, "out.car"),
+		filepath.Join(dir, "abs.car"):   filepath.Join(dir, "abs.car"),
+		"sub/../out.car":                filepath.Join(dir, "out.car"),
+		"../out.car":                    "",
+		filepath.Join(outside, "x.car"): "",
+		"link/out.car":                  "",
+		"":                              "",
+	} {
+		got, err := pathIn("ExportDir", dir, name)
+		if want == "" {
+			if err == nil {
+				t.Errorf("expected %q to be refused, got %s", name, got)
+			}
+			continue
+		}
+		realDir, _ := filepath.EvalSymlinks(dir)
+		if err != nil || got != filepath.Join(realDir, filepath.Base(want)) {
+			t.Errorf("expected %q to resolve to %s, got %s, %v", name, want, got, err)
+		}
+	}
+
+	if _, err := pathIn("ExportDir", "", "out.car"); err == nil {
+		t.Errorf("expected paths to be refused when no directory is configured")
+	}
+}
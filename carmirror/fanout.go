@@ -0,0 +1,152 @@
+package carmirror
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	cmbatch "github.com/fission-codes/go-car-mirror/batch"
+	gocid "github.com/ipfs/go-cid"
+)
+
+// How long a fan-out push waits for its quorum, after which it reports how far each remote has got.
+const fanOutTimeout = 10 * time.Minute
+
+// How often a fan-out push streaming its progress reports it.
+const fanOutReportInterval = time.Second
+
+// RemotePush is how a push to one remote of a fan-out push has got on.
+type RemotePush struct {
+	Remote string
+	// State is active while the push runs, then completed or failed.
+	State string
+	Start time.Time
+	End   *time.Time `json:",omitempty"`
+	Error string     `json:",omitempty"`
+	// Session is the id the push is listed under by ls and in the history.
+	Session string `json:",omitempty"`
+	// Rounds, blocks and bytes of blocks sent so far.
+	Rounds uint64
+	Blocks uint64
+	Bytes  uint64
+}
+
+// FanOutResponse reports a push of one root to several remotes.
+type FanOutResponse struct {
+	Cid string
+	// Quorum is how many remotes must complete for the push to succeed.
+	Quorum    int
+	Completed int
+	Failed    int
+	Remotes   []RemotePush
+	// Transfer is the id the push's sessions are listed under, if it was given one.
+	Transfer string `json:",omitempty"`
+	// Error is why the quorum wasn't reached, empty if it was or the push runs in the background.
+	Error string `json:",omitempty"`
+}
+
+// fanOutPush pushes root to every remote in p.Addrs at once. The sessions read blocks through the client's shared cache,
+// so each block is read from Kubo once. Unless p.Background is set, it waits until p.Quorum remotes have completed,
+// or too many have failed for the quorum to be reached. Pushes still running when it returns carry on.
+// If report is set, it is called with how far each remote has got every fanOutReportInterval, and as each ends.
+func (cm *CarMirror) fanOutPush(ctx context.Context, p PushParams, root gocid.Cid, diff gocid.Cid, report func(*FanOutResponse)) (*FanOutResponse, error) {
+	quorum := p.Quorum
+	if quorum == 0 {
+		quorum = len(p.Addrs)
+	}
+	if quorum > len(p.Addrs) {
+		return nil, fmt.Errorf("quorum %d is more than the %d remotes", quorum, len(p.Addrs))
+	}
+	if report != nil && p.Background {
+		return nil, fmt.Errorf("the progress of a push in the background can't be streamed")
+	}
+	rate, err := cm.remoteParams(p.Addrs, p.Rate)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &FanOutResponse{Cid: root.String(), Quorum: quorum, Transfer: p.Transfer}
+	type outcome struct {
+		i   int
+		err error
+	}
+	outcomes := make(chan outcome, len(p.Addrs))
+	// The history ids of the sessions, by remote
+	ids := make([]string, len(p.Addrs))
+	for i, addr := range p.Addrs {
+		res.Remotes = append(res.Remotes, RemotePush{Remote: addr, State: StateActive, Start: time.Now()})
+
+		// Sessions outlive the request if it returns first.
+		key, session, err := cm.startPush(context.Background(), addr, rate, p.Token, p.Transfer, []gocid.Cid{root}, diff)
+		if err != nil {
+			outcomes <- outcome{i, err}
+			continue
+		}
+		ids[i] = sessionID(DirectionPush, key)
+		go func(i int, session *SourceSession) {
+			err := await(context.Background(), DirectionPush, session.Done(), func() cmbatch.BatchState { return session.Info().State }, session.Cancel)
+			outcomes <- outcome{i, err}
+		}(i, session)
+	}
+
+	if p.Background {
+		cm.fanOutProgress(res, ids)
+		return res, nil
+	}
+
+	var tick <-chan time.Time
+	if report != nil {
+		ticker := time.NewTicker(fanOutReportInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	timeout := time.NewTimer(fanOutTimeout)
+	defer timeout.Stop()
+	for res.Completed < quorum && res.Failed <= len(p.Addrs)-quorum {
+		select {
+		case o := <-outcomes:
+			end := time.Now()
+			remote := &res.Remotes[o.i]
+			remote.End = &end
+			if o.err != nil {
+				remote.State, remote.Error = StateFailed, o.err.Error()
+				res.Failed++
+				log.Debugw("fan-out push failed", "object", "CarMirror", "method", "fanOutPush", "remote", remote.Remote, "error", o.err)
+			} else {
+				remote.State = StateCompleted
+				res.Completed++
+			}
+			if report != nil {
+				cm.fanOutProgress(res, ids)
+				report(res)
+			}
+		case <-tick:
+			cm.fanOutProgress(res, ids)
+			report(res)
+		case <-timeout.C:
+			cm.fanOutProgress(res, ids)
+			res.Error = fmt.Sprintf("timed out with %d of the %d remotes needed complete", res.Completed, quorum)
+			return res, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	cm.fanOutProgress(res, ids)
+	if res.Completed < quorum {
+		res.Error = fmt.Sprintf("%d of %d remotes failed, so %d can't complete", res.Failed, len(p.Addrs), quorum)
+	}
+	return res, nil
+}
+
+// fanOutProgress copies how far the push to each remote has got from the history, ids being the sessions' ids.
+func (cm *CarMirror) fanOutProgress(res *FanOutResponse, ids []string) {
+	for i, id := range ids {
+		record, ok := cm.history.record(id)
+		if !ok {
+			continue
+		}
+		remote := &res.Remotes[i]
+		remote.Session, remote.Rounds, remote.Blocks, remote.Bytes = record.Session, record.Rounds, record.Blocks, record.Bytes
+	}
+}
@@ -0,0 +1,70 @@
+package carmirror
+
+import (
+	"context"
+	"testing"
+
+	cmipld "github.com/fission-codes/go-car-mirror/ipld"
+	gocid "github.com/ipfs/go-cid"
+)
+
+func TestFanOutPush(t *testing.T) {
+	ctx := context.Background()
+	cms, _ := newTestCarMirrors(t, 2)
+	if err := cms[1].StartRemote(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer cms[1].Close()
+	sink := "http://" + cms[1].RemoteAddr().String()
+	unreachable := "http://127.0.0.1:1"
+
+	block, err := cmipld.TryBlockFromCBOR("fan out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cms[0].blockStore.Add(ctx, block); err != nil {
+		t.Fatal(err)
+	}
+	root := block.Id().Unwrap()
+
+	// One remote completing is enough for a quorum of one.
+	addrs := []string{sink, unreachable}
+	reports := 0
+	res, err := cms[0].fanOutPush(ctx, PushParams{Addrs: addrs, Quorum: 1}, root, gocid.Undef, func(*FanOutResponse) { reports++ })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Error != "" || res.Completed != 1 || res.Remotes[0].State != StateCompleted {
+		t.Errorf("expected the push to the sink to complete the quorum, got %+v", res)
+	}
+	if reports == 0 {
+		t.Errorf("expected the push to report its progress")
+	}
+	if sent := res.Remotes[0]; sent.Session == "" || sent.Blocks != 1 || sent.Bytes == 0 {
+		t.Errorf("expected the progress of the push to the sink, got %+v", sent)
+	}
+	if has, _ := cms[1].blockStore.Has(ctx, block.Id()); !has {
+		t.Errorf("expected the block to reach the sink")
+	}
+
+	// Every remote is needed by default, and the failure is reported against its remote.
+	if res, err = cms[0].fanOutPush(ctx, PushParams{Addrs: addrs}, root, gocid.Undef, nil); err != nil {
+		t.Fatal(err)
+	}
+	if res.Error == "" || res.Quorum != 2 || res.Failed != 1 || res.Remotes[1].State != StateFailed || res.Remotes[1].Error == "" {
+		t.Errorf("expected the quorum to be missed because of the unreachable remote, got %+v", res)
+	}
+
+	for _, p := range []PushParams{
+		{Addrs: addrs, Quorum: 3},
+		{Addrs: []string{sink, sink}},
+		{Addrs: addrs, Rate: "fast"},
+	} {
+		if _, err := cms[0].fanOutPush(ctx, p, root, gocid.Undef, nil); err == nil {
+			t.Errorf("expected %+v to be rejected", p)
+		}
+	}
+	if _, err := cms[0].fanOutPush(ctx, PushParams{Addrs: addrs, Background: true}, root, gocid.Undef, func(*FanOutResponse) {}); err == nil {
+		t.Errorf("expected the progress of a push in the background not to be streamed")
+	}
+}
@@ -0,0 +1,539 @@
+package carmirror
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	"github.com/zeebo/xxh3"
+)
+
+// HistoryRecord describes a session that has ended.
+type HistoryRecord struct {
+	// Session is the session's id: a random id for our own pushes and pulls, or the session token for sessions we serve.
+	Session string
+	// Role is client for our own sessions, or server for sessions we serve.
+	Role      string
+	Direction string
+	// Remote is the remote's URL, or the client's address for sessions we serve.
+	Remote string
+	// Transfer is the id of the push or pull that started one of our own sessions, if it was given one.
+	Transfer string `json:",omitempty"`
+	Roots    []string
+	Start    time.Time
+	End      time.Time
+	Rounds   uint64
+	// Blocks and bytes of blocks transferred, before compression.
+	Blocks uint64
+	Bytes  uint64
+	// Error is why the session failed, empty if it completed.
+	Error string `json:",omitempty"`
+}
+
+// HistoryQuery selects history records. Empty fields match every record.
+type HistoryQuery struct {
+	Direction string
+	Remote    string
+	// Limit is the most records returned, newest first unless Oldest is set. 0 means no limit.
+	Limit int
+	// Oldest lists the records oldest first.
+	Oldest bool
+	// Match, if set, selects records too.
+	Match func(record *HistoryRecord) bool
+}
+
+func (q HistoryQuery) matches(record *HistoryRecord) bool {
+	return (q.Direction == "" || q.Direction == record.Direction) && (q.Remote == "" || q.Remote == record.Remote) &&
+		(q.Match == nil || q.Match(record))
+}
+
+// Records are kept under this prefix in the datastore, keyed so they sort by start time.
+var historyPrefix = datastore.NewKey("/carmirror/history")
+
+// How often sessions we serve are checked for having ended.
+const historyReapInterval = 10 * time.Second
+
+// How long the records of our own sessions are kept in memory after they end, for whoever waits on them to read.
+const endedRecordTTL = time.Minute
+
+// How often records older than the retention period are deleted.
+const historyPruneInterval = time.Hour
+
+var errNoHistory = fmt.Errorf("session history is not configured")
+
+// Session roles.
+const (
+	RoleClient = "client"
+	RoleServer = "server"
+)
+
+// History records sessions as they run, and persists them to a datastore once they end.
+// Without a datastore only running sessions are tracked. A nil History records nothing.
+type History struct {
+	ds datastore.Datastore
+	// How long records are kept, 0 for ever
+	retention time.Duration
+
+	mu sync.Mutex
+	// Running sessions, by id
+	running map[string]*runningRecord
+	// Sessions we serve that ended before their first round was recorded, by id
+	finished map[string]finishedSession
+	// Our own sessions that ended lately, by id
+	ended map[string]endedRecord
+}
+
+// endedRecord is the record of one of our own sessions that has ended.
+type endedRecord struct {
+	HistoryRecord
+	at time.Time
+}
+
+// finishedSession is how a session we serve ended.
+type finishedSession struct {
+	at        time.Time
+	cancelled bool
+	err       error
+}
+
+type runningRecord struct {
+	HistoryRecord
+	// Sessions we serve end without us being told, and are noticed by reap
+	served bool
+}
+
+// NewHistory creates a history persisted to ds, which may be nil, keeping records for retention, or for ever if it is 0.
+func NewHistory(ds datastore.Datastore, retention time.Duration) *History {
+	return &History{
+		ds:        ds,
+		retention: retention,
+		running:   make(map[string]*runningRecord),
+		finished:  make(map[string]finishedSession),
+		ended:     make(map[string]endedRecord),
+	}
+}
+
+// start records a session starting. id identifies the running session, and session is the id it is recorded with.
+func (h *History) start(id string, session string, role string, direction string, remote string) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.running[id] = &runningRecord{HistoryRecord: HistoryRecord{
+		Session:   session,
+		Role:      role,
+		Direction: direction,
+		Remote:    remote,
+		Start:     time.Now(),
+	}}
+}
+
+// serve records a session started by a remote client, and its first round, as for observeRound.
+func (h *History) serve(id string, direction string, remote string, roots []string, counter *blockCounter, err error) {
+	if h == nil {
+		return
+	}
+	h.start(id, id, RoleServer, direction, remote)
+	h.observeRound(id, counter, err)
+	h.mu.Lock()
+	h.running[id].served = true
+	h.running[id].Roots = roots
+	finished, ok := h.finished[id]
+	delete(h.finished, id)
+	h.mu.Unlock()
+
+	if ok {
+		h.endServed(id, finished.cancelled, finished.err)
+	}
+}
+
+// endServed records a session we serve ending, with the error it ended with, if any.
+func (h *History) endServed(id string, cancelled bool, err error) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	record, ok := h.running[id]
+	if !ok {
+		// The session ended during its first round, before it was recorded.
+		h.finished[id] = finishedSession{at: time.Now(), cancelled: cancelled, err: err}
+		h.mu.Unlock()
+		return
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	h.mu.Unlock()
+
+	h.end(id, cancelled)
+}
+
+// addRoot records a root enqueued in a running session.
+func (h *History) addRoot(id string, root string) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if record, ok := h.running[id]; ok {
+		for _, r := range record.Roots {
+			if r == root {
+				return
+			}
+		}
+		record.Roots = append(record.Roots, root)
+	}
+}
+
+// setTransfer records the push or pull a running session belongs to.
+func (h *History) setTransfer(id string, transfer string) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if record, ok := h.running[id]; ok {
+		record.Transfer = transfer
+	}
+}
+
+// observeRound adds the blocks counted in a round to a running session, and records the round's error, if any.
+func (h *History) observeRound(id string, counter *blockCounter, err error) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if record, ok := h.running[id]; ok {
+		record.Rounds++
+		record.Blocks += counter.blocks()
+		record.Bytes += counter.bytes
+		if err != nil {
+			record.Error = err.Error()
+		}
+	}
+}
+
+// abort records why a running session is about to be cancelled, unless it has already failed.
+func (h *History) abort(id string, reason string) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if record, ok := h.running[id]; ok && record.Error == "" {
+		record.Error = reason
+	}
+}
+
+// end records a session ending and persists it. A cancelled session without a more specific error is recorded as cancelled.
+func (h *History) end(id string, cancelled bool) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	record, ok := h.running[id]
+	delete(h.running, id)
+	if ok {
+		record.End = time.Now()
+		if cancelled && record.Error == "" {
+			record.Error = "cancelled"
+		}
+		if !record.served {
+			h.ended[id] = endedRecord{HistoryRecord: record.HistoryRecord, at: record.End}
+		}
+	}
+	h.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	if h.ds == nil {
+		return
+	}
+	if err := h.put(context.Background(), &record.HistoryRecord); err != nil {
+		log.Errorw("failed to record session history", "object", "History", "method", "end", "session", record.Session, "error", err)
+	}
+}
+
+// runningRecords returns the records of the running sessions, by id.
+func (h *History) runningRecords() map[string]HistoryRecord {
+	records := make(map[string]HistoryRecord)
+	if h == nil {
+		return records
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for id, record := range h.running {
+		r := record.HistoryRecord
+		r.Roots = append([]string(nil), record.Roots...)
+		records[id] = r
+	}
+	return records
+}
+
+// record returns the record of the running session with id, or of one of our own sessions that ended lately.
+func (h *History) record(id string) (HistoryRecord, bool) {
+	if h == nil {
+		return HistoryRecord{}, false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if record, ok := h.running[id]; ok {
+		r := record.HistoryRecord
+		r.Roots = append([]string(nil), record.Roots...)
+		return r, true
+	}
+	record, ok := h.ended[id]
+	return record.HistoryRecord, ok
+}
+
+// reap ends the sessions we serve that are no longer running, in case their end wasn't recorded,
+// and forgets how sessions ended whose first round never was, and the records of our own sessions that ended a while ago.
+// running holds whether each running session has been cancelled, by id.
+func (h *History) reap(running map[string]bool) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	ended := make(map[string]bool)
+	for id, record := range h.running {
+		if !record.served {
+			continue
+		}
+		if cancelled, ok := running[id]; ok {
+			if cancelled && record.Error == "" {
+				record.Error = "cancelled"
+			}
+			continue
+		}
+		ended[id] = record.Error != ""
+	}
+	for id, finished := range h.finished {
+		if time.Since(finished.at) > historyReapInterval {
+			delete(h.finished, id)
+		}
+	}
+	for id, record := range h.ended {
+		if time.Since(record.at) > endedRecordTTL {
+			delete(h.ended, id)
+		}
+	}
+	h.mu.Unlock()
+
+	for id, failed := range ended {
+		h.end(id, failed)
+	}
+}
+
+// Close ends every running session, recording that it was interrupted.
+func (h *History) Close() {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	ids := make([]string, 0, len(h.running))
+	for id, record := range h.running {
+		if record.Error == "" {
+			record.Error = "interrupted by shutdown"
+		}
+		ids = append(ids, id)
+	}
+	h.mu.Unlock()
+
+	for _, id := range ids {
+		h.end(id, true)
+	}
+}
+
+func (h *History) put(ctx context.Context, record *HistoryRecord) error {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	// Sessions with the same remote can start in the same instant in different directions.
+	name := fmt.Sprintf("%016x%016x", record.Start.UnixNano(), xxh3.HashString(record.Direction+" "+record.Session))
+	return h.ds.Put(ctx, historyPrefix.ChildString(name), b)
+}
+
+// prune deletes the records of sessions that started longer ago than the retention period.
+func (h *History) prune(ctx context.Context) error {
+	if h == nil || h.ds == nil || h.retention == 0 {
+		return nil
+	}
+
+	// Keys start with the start time, so they sort oldest first and the oldest are deleted until a newer one is found.
+	results, err := h.ds.Query(ctx, dsq.Query{
+		Prefix:   historyPrefix.String(),
+		Orders:   []dsq.Order{dsq.OrderByKey{}},
+		KeysOnly: true,
+	})
+	if err != nil {
+		return err
+	}
+	defer results.Close()
+
+	cutoff := fmt.Sprintf("%016x", time.Now().Add(-h.retention).UnixNano())
+	pruned := 0
+	for result := range results.Next() {
+		if result.Error != nil {
+			return result.Error
+		}
+		key := datastore.NewKey(result.Key)
+		if key.Name() >= cutoff {
+			break
+		}
+		if err := h.ds.Delete(ctx, key); err != nil {
+			return err
+		}
+		pruned++
+	}
+	if pruned > 0 {
+		log.Debugw("pruned history", "object", "History", "method", "prune", "records", pruned)
+	}
+	return nil
+}
+
+// List returns the recorded sessions matching q, newest first.
+func (h *History) List(ctx context.Context, q HistoryQuery) ([]HistoryRecord, error) {
+	if h == nil || h.ds == nil {
+		return nil, errNoHistory
+	}
+
+	var order dsq.Order = dsq.OrderByKeyDescending{}
+	if q.Oldest {
+		order = dsq.OrderByKey{}
+	}
+	results, err := h.ds.Query(ctx, dsq.Query{
+		Prefix: historyPrefix.String(),
+		Orders: []dsq.Order{order},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+
+	records := make([]HistoryRecord, 0)
+	for result := range results.Next() {
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		var record HistoryRecord
+		if err := json.Unmarshal(result.Value, &record); err != nil {
+			log.Debugw("skipping unreadable history record", "object", "History", "method", "List", "key", result.Key, "error", err)
+			continue
+		}
+		if !q.matches(&record) {
+			continue
+		}
+		records = append(records, record)
+		if q.Limit > 0 && len(records) == q.Limit {
+			break
+		}
+	}
+	return records, nil
+}
+
+// historyTransport records the rounds of a client session with a remote in the session's history.
+type historyTransport struct {
+	base    http.RoundTripper
+	history *History
+	// Id of the running session
+	id string
+}
+
+func (t *historyTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if t.history == nil {
+		return t.base.RoundTrip(r)
+	}
+
+	counter := &blockCounter{}
+	push := strings.HasSuffix(r.URL.Path, "/blocks")
+	if push && r.Body != nil {
+		r = r.Clone(r.Context())
+		r.Body = newTeeBody(r.Body, counter)
+	}
+
+	resp, err := t.base.RoundTrip(r)
+	if err != nil {
+		t.history.observeRound(t.id, counter, err)
+		return nil, err
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		err = fmt.Errorf("remote responded %s", resp.Status)
+	}
+
+	if push {
+		t.history.observeRound(t.id, counter, err)
+		return resp, nil
+	}
+
+	resp.Body = &observedBody{
+		ReadCloser: newTeeBody(resp.Body, counter),
+		done:       func() { t.history.observeRound(t.id, counter, err) },
+	}
+	return resp, nil
+}
+
+// Wrap returns a remote protocol handler that records the sessions it serves, and the rounds it answers with an error.
+// How the sessions end is recorded by endServed. can is the capability the handler serves, and cookie the name of
+// the session cookie it issues.
+func (h *History) Wrap(next http.HandlerFunc, can string, cookie string) http.HandlerFunc {
+	direction := DirectionPull
+	if can == CapabilityPush {
+		direction = DirectionPush
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, noCookie := r.Cookie(cookie)
+
+		var roots []string
+		if noCookie != nil {
+			// The first request of a session names its roots.
+			ids, err := requestRoots(r, can)
+			if err != nil {
+				http.Error(w, "bad message format", http.StatusBadRequest)
+				return
+			}
+			for _, id := range ids {
+				roots = append(roots, id.String())
+			}
+		}
+
+		counter := &blockCounter{}
+		writer := &countingResponseWriter{ResponseWriter: w}
+		if direction == DirectionPush {
+			r.Body = newTeeBody(r.Body, counter)
+		} else {
+			writer.w = counter
+		}
+
+		next(writer, r)
+
+		session := sessionFromRequest(w, r, cookie)
+		if session == "" {
+			return
+		}
+		var err error
+		if writer.status >= http.StatusBadRequest {
+			err = fmt.Errorf("responded %d %s", writer.status, http.StatusText(writer.status))
+		}
+		if noCookie != nil {
+			remote, _, splitErr := net.SplitHostPort(r.RemoteAddr)
+			if splitErr != nil {
+				remote = r.RemoteAddr
+			}
+			h.serve(session, direction, remote, roots, counter, err)
+			return
+		}
+		h.observeRound(session, counter, err)
+	}
+}
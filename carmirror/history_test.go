@@ -0,0 +1,137 @@
+package carmirror
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+)
+
+func TestHistory(t *testing.T) {
+	ctx := context.Background()
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	h := NewHistory(ds, 0)
+
+	push := sessionID(DirectionPush, "http://remote:2503")
+	h.start(push, "pushed", RoleClient, DirectionPush, "http://remote:2503")
+	h.addRoot(push, "bafyroot")
+	h.addRoot(push, "bafyroot")
+	h.observeRound(push, &blockCounter{sections: 3, bytes: 100}, nil)
+	h.end(push, false)
+
+	h.serve("token", DirectionPull, "10.0.0.1", []string{"bafyother"}, &blockCounter{}, nil)
+	h.reap(map[string]bool{"token": true})
+	h.reap(map[string]bool{})
+
+	// The history is read back from the datastore, as it would be after a restart.
+	records, err := NewHistory(ds, 0).List(ctx, HistoryQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(records))
+	}
+
+	served, pushed := records[0], records[1]
+	if served.Session != "token" || served.Error != "cancelled" || served.Remote != "10.0.0.1" {
+		t.Errorf("expected the cancelled served session first, got %+v", served)
+	}
+	if pushed.Blocks != 2 || pushed.Bytes != 100 || len(pushed.Roots) != 1 || pushed.Error != "" || pushed.End.Before(pushed.Start) {
+		t.Errorf("unexpected push record %+v", pushed)
+	}
+
+	records, err = h.List(ctx, HistoryQuery{Direction: DirectionPush})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Session != "pushed" {
+		t.Errorf("expected only the push, got %+v", records)
+	}
+
+	records, err = h.List(ctx, HistoryQuery{Oldest: true, Limit: 1, Match: func(record *HistoryRecord) bool {
+		return record.Role == RoleClient
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Session != "pushed" {
+		t.Errorf("expected the oldest client session, got %+v", records)
+	}
+
+	var none *History
+	if _, err := none.List(ctx, HistoryQuery{}); err != errNoHistory {
+		t.Errorf("expected errNoHistory without a datastore, got %v", err)
+	}
+}
+
+func TestHistoryServedErrors(t *testing.T) {
+	ctx := context.Background()
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	h := NewHistory(ds, 0)
+
+	// A session that fails in its first round ends before the round is recorded.
+	h.endServed("early", false, fmt.Errorf("bad request"))
+	h.serve("early", DirectionPush, "10.0.0.1", nil, &blockCounter{}, nil)
+
+	// A session whose round failed, which then ends without an error of its own.
+	h.serve("round", DirectionPull, "10.0.0.1", nil, &blockCounter{}, fmt.Errorf("responded 500 Internal Server Error"))
+	h.endServed("round", false, nil)
+
+	h.serve("late", DirectionPull, "10.0.0.1", nil, &blockCounter{}, nil)
+	h.endServed("late", true, nil)
+
+	// A session cancelled at the end of the shutdown grace period.
+	h.serve("aborted", DirectionPush, "10.0.0.1", nil, &blockCounter{}, nil)
+	h.abort("aborted", "interrupted by shutdown")
+	h.endServed("aborted", true, nil)
+
+	records, err := h.List(ctx, HistoryQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := make(map[string]string)
+	for _, record := range records {
+		errs[record.Session] = record.Error
+	}
+	expected := map[string]string{"early": "bad request", "round": "responded 500 Internal Server Error", "late": "cancelled", "aborted": "interrupted by shutdown"}
+	for session, e := range expected {
+		if errs[session] != e {
+			t.Errorf("expected session %s to be recorded with error %q, got %q", session, e, errs[session])
+		}
+	}
+	if len(h.runningRecords()) != 0 {
+		t.Errorf("expected no running sessions, got %+v", h.runningRecords())
+	}
+}
+
+func TestHistoryPrune(t *testing.T) {
+	ctx := context.Background()
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	h := NewHistory(ds, time.Hour)
+
+	for _, age := range []time.Duration{3 * time.Hour, 2 * time.Hour, time.Minute} {
+		record := HistoryRecord{Session: age.String(), Role: RoleClient, Direction: DirectionPush, Start: time.Now().Add(-age)}
+		if err := h.put(ctx, &record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := h.prune(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := h.List(ctx, HistoryQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Session != time.Minute.String() {
+		t.Errorf("expected only the recent record to be kept, got %+v", records)
+	}
+
+	// Without a retention period records are kept for ever.
+	if err := NewHistory(ds, 0).prune(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
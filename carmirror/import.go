@@ -0,0 +1,109 @@
+package carmirror
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	cmcore "github.com/fission-codes/go-car-mirror/core"
+	cmipld "github.com/fission-codes/go-car-mirror/ipld"
+	carv2 "github.com/ipld/go-car/v2"
+)
+
+// ImportRoot reports whether the DAG under a root declared by an imported CAR file is now complete locally, as a
+// verify would. Missing blocks must come from elsewhere.
+type ImportRoot struct {
+	VerifyResponse
+}
+
+// ImportResponse reports a CAR file imported.
+type ImportResponse struct {
+	Path string
+	// Blocks and Bytes are what the file held, and Denied how many of its blocks the content policy dropped.
+	Blocks int
+	Bytes  uint64
+	Denied int `json:",omitempty"`
+	Roots  []ImportRoot
+}
+
+// importCAR adds the blocks in the CARv1 or CARv2 file at path to the local store as a push would, and reports
+// which of the roots it declares are now complete. Each block is checked against its multihash, the content policy
+// applies to its roots and blocks, and blocks are added in batches of MaxBlocksPerRound. As with a push, nothing
+// is pinned. There is no storage quota: an import adds every block the file holds that the content policy allows.
+func (cm *CarMirror) importCAR(ctx context.Context, path string) (*ImportResponse, error) {
+	if cm.closing.Load() {
+		return nil, errClosing
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	// The reader fails on the first block whose data doesn't hash to its CID.
+	reader, err := carv2.NewBlockReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("bad CAR file: %w", err)
+	}
+	for _, root := range reader.Roots {
+		if !cm.policy.IsRootAllowed(root) {
+			cm.policy.countDenied("denied.roots")
+			return nil, fmt.Errorf("root %s denied", root)
+		}
+	}
+
+	cm.reconfigure.Lock()
+	batchSize := int(cm.cfg.MaxBlocksPerRound)
+	cm.reconfigure.Unlock()
+
+	res := &ImportResponse{Path: path}
+	batch := make([]cmcore.RawBlock[cmipld.Cid], 0, batchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if _, err := cm.blockStore.AddMany(ctx, batch); err != nil {
+			return err
+		}
+		batch = batch[:0]
+		return nil
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		block, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bad CAR file after %d blocks: %w", res.Blocks, err)
+		}
+		res.Blocks++
+		res.Bytes += uint64(len(block.RawData()))
+		// Denied blocks are dropped by the store, and only counted here.
+		if cm.policy.IsDenied(block.Cid()) {
+			res.Denied++
+		}
+		batch = append(batch, cmipld.WrapRawBlock(block))
+		if len(batch) >= batchSize {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	log.Debugw("imported", "object", "CarMirror", "method", "importCAR", "path", path, "blocks", res.Blocks, "denied", res.Denied)
+
+	for _, root := range reader.Roots {
+		verified, _, err := verifyDAG(ctx, cm.blockStore, root)
+		if err != nil {
+			return nil, err
+		}
+		res.Roots = append(res.Roots, ImportRoot{*verified})
+	}
+	return res, nil
+}
@@ -0,0 +1,84 @@
+package carmirror
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	cmipld "github.com/fission-codes/go-car-mirror/ipld"
+	"github.com/ipfs/boxo/ipld/merkledag"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+func TestImport(t *testing.T) {
+	ctx := context.Background()
+	cms, apis := newTestCarMirrors(t, 3)
+	source, updated, fresh := cms[0], cms[1], cms[2]
+
+	// The source exports what a node holding the old root, linking to the left leaf, needs for the new root.
+	left, right := merkledag.NewRawNode([]byte("left")), merkledag.NewRawNode([]byte("right"))
+	old, root := merkledag.NodeWithData([]byte("old")), merkledag.NodeWithData([]byte("new"))
+	if err := old.AddNodeLink("left", left); err != nil {
+		t.Fatal(err)
+	}
+	for name, leaf := range map[string]ipld.Node{"left": left, "right": right} {
+		if err := root.AddNodeLink(name, leaf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := apis[0].Dag().AddMany(ctx, []ipld.Node{old, root, left, right}); err != nil {
+		t.Fatal(err)
+	}
+	if err := apis[1].Dag().AddMany(ctx, []ipld.Node{old, left}); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "bundle.car")
+	if _, err := source.export(ctx, path, root.Cid(), old.Cid(), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := updated.importCAR(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Blocks != 2 || len(res.Roots) != 1 || !res.Roots[0].Complete {
+		t.Errorf("expected the new root to be complete, got %+v", res)
+	}
+	if has, err := updated.blockStore.Has(ctx, cmipld.WrapCid(right.Cid())); err != nil || !has {
+		t.Errorf("expected the right leaf to be imported, got %v, %v", has, err)
+	}
+
+	// A node without the old DAG is still missing the left leaf.
+	res, err = fresh.importCAR(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Roots) != 1 || res.Roots[0].Complete || res.Roots[0].MissingBlocks != 1 || res.Roots[0].Missing[0] != left.Cid().String() {
+		t.Errorf("expected the left leaf to be missing, got %+v", res)
+	}
+
+	// Through the handler, files are only imported from ImportDir, and an import needs a session slot.
+	importFrom := func(name string) int {
+		w := httptest.NewRecorder()
+		fresh.ImportHandler()(w, httptest.NewRequest("POST", "/import?path="+url.QueryEscape(name), nil))
+		return w.Code
+	}
+	if code := importFrom(path); code != http.StatusInternalServerError {
+		t.Errorf("expected an import to be refused with no ImportDir, got %d", code)
+	}
+	fresh.cfg.ImportDir = filepath.Dir(path)
+	if code := importFrom("../bundle.car"); code != http.StatusInternalServerError {
+		t.Errorf("expected a path outside ImportDir to be refused, got %d", code)
+	}
+	if code := importFrom("bundle.car"); code != http.StatusOK {
+		t.Errorf("expected a file in ImportDir to be imported, got %d", code)
+	}
+	fresh.admission = newAdmission(1, 0, time.Millisecond, func() int { return 1 }, func(string) bool { return false })
+	if code := importFrom("bundle.car"); code != http.StatusServiceUnavailable {
+		t.Errorf("expected an import to wait for a session slot, got %d", code)
+	}
+}
@@ -0,0 +1,528 @@
+package carmirror
+
+import (
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fission-codes/go-bloom"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Session directions used as metric labels. A push sends blocks from the client to the server,
+// and a pull sends them from the server to the client.
+const (
+	DirectionPush = "push"
+	DirectionPull = "pull"
+)
+
+// Metrics exposes CAR Mirror activity in Prometheus exposition format.
+// Everything is labelled with the direction of the session and the remote it is with:
+// the remote's URL for our own pushes and pulls. Sessions we serve are labelled from a set fixed by the
+// configuration, so that clients can't grow the label set: the trusted root DID their UCAN is delegated from,
+// else the configured remote at the client's address, else remoteServed.
+// A nil Metrics records nothing.
+type Metrics struct {
+	registry          *prometheus.Registry
+	sessionsStarted   *prometheus.CounterVec
+	sessionsCompleted *prometheus.CounterVec
+	sessionsFailed    *prometheus.CounterVec
+	blocks            *prometheus.CounterVec
+	bytes             *prometheus.CounterVec
+	roundDuration     *prometheus.HistogramVec
+	roundErrors       *prometheus.CounterVec
+	filterItems       *prometheus.GaugeVec
+	filterFPP         *prometheus.GaugeVec
+
+	// Capacity bloom filters start with, for false positive estimates
+	bloomCapacity atomic.Uint64
+
+	// sessions reports the sessions currently running, by id
+	sessions func() map[string]sessionMetrics
+	// remotes labels sessions remote clients start with us
+	remotes *servedRemotes
+
+	mu sync.Mutex
+	// Sessions started by remote clients, which end without us being told, by id
+	served map[string]sessionMetrics
+}
+
+// sessionMetrics describes a running session for metrics.
+type sessionMetrics struct {
+	direction string
+	remote    string
+	// Estimated number of blocks in the session's filter
+	filterItems uint
+	cancelled   bool
+	// Whether a round of a served session was answered with an error
+	failed bool
+}
+
+var metricLabels = []string{"direction", "remote"}
+
+// The remote label of sessions remote clients start with us that don't match a configured DID or remote.
+const remoteServed = "served"
+
+// How many served sessions are tracked before ended ones are counted without waiting for a scrape.
+const maxServedSessions = 1024
+
+// NewMetrics creates the metrics for a node whose bloom filters start with bloomCapacity.
+func NewMetrics(bloomCapacity uint) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		sessionsStarted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "carmirror",
+			Name:      "sessions_started_total",
+			Help:      "Sessions started.",
+		}, metricLabels),
+		sessionsCompleted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "carmirror",
+			Name:      "sessions_completed_total",
+			Help:      "Sessions that ran to completion.",
+		}, metricLabels),
+		sessionsFailed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "carmirror",
+			Name:      "sessions_failed_total",
+			Help:      "Sessions that were cancelled or failed.",
+		}, metricLabels),
+		blocks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "carmirror",
+			Name:      "blocks_total",
+			Help:      "Blocks transferred.",
+		}, metricLabels),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "carmirror",
+			Name:      "block_bytes_total",
+			Help:      "Bytes of blocks transferred, before compression.",
+		}, metricLabels),
+		roundDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "carmirror",
+			Name:      "round_duration_seconds",
+			Help:      "Time taken by protocol rounds, from request to response.",
+			Buckets:   prometheus.ExponentialBuckets(0.005, 2, 14),
+		}, metricLabels),
+		roundErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "carmirror",
+			Name:      "round_errors_total",
+			Help:      "Protocol rounds that failed or were answered with an error.",
+		}, metricLabels),
+		filterItems: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "carmirror",
+			Name:      "filter_items",
+			Help:      "Estimated blocks held in the bloom filters of running sessions.",
+		}, metricLabels),
+		filterFPP: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "carmirror",
+			Name:      "filter_false_positive_ratio",
+			Help:      "Estimated false positive probability of the fullest bloom filter of running sessions.",
+		}, metricLabels),
+		served: make(map[string]sessionMetrics),
+	}
+	m.bloomCapacity.Store(uint64(bloomCapacity))
+
+	m.registry.MustRegister(
+		m.sessionsStarted,
+		m.sessionsCompleted,
+		m.sessionsFailed,
+		m.blocks,
+		m.bytes,
+		m.roundDuration,
+		m.roundErrors,
+		m.filterItems,
+		m.filterFPP,
+	)
+	return m
+}
+
+// Handler serves the metrics in Prometheus exposition format.
+func (m *Metrics) Handler() http.Handler {
+	metrics := promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.refresh()
+		metrics.ServeHTTP(w, r)
+	})
+}
+
+// refresh updates the filter gauges from the running sessions, and counts served sessions that have ended.
+func (m *Metrics) refresh() {
+	if m.sessions == nil {
+		return
+	}
+	running := m.sessions()
+	m.reap(running)
+
+	type labels struct{ direction, remote string }
+	items := make(map[labels]uint)
+	fpp := make(map[labels]float64)
+	for _, session := range running {
+		l := labels{session.direction, session.remote}
+		items[l] += session.filterItems
+		if estimate := bloomFalsePositiveRate(m.bloomCapacity.Load(), uint64(session.filterItems)); estimate > fpp[l] {
+			fpp[l] = estimate
+		}
+	}
+
+	m.filterItems.Reset()
+	m.filterFPP.Reset()
+	for l, n := range items {
+		m.filterItems.WithLabelValues(l.direction, l.remote).Set(float64(n))
+		m.filterFPP.WithLabelValues(l.direction, l.remote).Set(fpp[l])
+	}
+}
+
+// reap counts served sessions that are no longer running as ended, and updates the state of the rest.
+// Running served sessions keep the remote label they started with.
+func (m *Metrics) reap(running map[string]sessionMetrics) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, session := range m.served {
+		if current, ok := running[id]; ok {
+			current.remote = session.remote
+			current.failed = session.failed
+			m.served[id] = current
+			running[id] = current
+			continue
+		}
+		delete(m.served, id)
+		m.sessionEnded(session.direction, session.remote, session.cancelled || session.failed)
+	}
+}
+
+func (m *Metrics) sessionStarted(direction string, remote string) {
+	if m != nil {
+		m.sessionsStarted.WithLabelValues(direction, remote).Inc()
+	}
+}
+
+func (m *Metrics) sessionEnded(direction string, remote string, failed bool) {
+	if m == nil {
+		return
+	}
+	if failed {
+		m.sessionsFailed.WithLabelValues(direction, remote).Inc()
+	} else {
+		m.sessionsCompleted.WithLabelValues(direction, remote).Inc()
+	}
+}
+
+// serve records a session started by a remote client, whose end is noticed on refresh.
+func (m *Metrics) serve(id string, direction string, remote string) {
+	m.sessionStarted(direction, remote)
+	m.mu.Lock()
+	m.served[id] = sessionMetrics{direction: direction, remote: remote}
+	tracked := len(m.served)
+	m.mu.Unlock()
+
+	// Without regular scrapes, ended sessions would pile up.
+	if tracked > maxServedSessions && m.sessions != nil {
+		m.reap(m.sessions())
+	}
+}
+
+// serveFailed records that a round of a served session was answered with an error,
+// so the session is counted as failed when it ends.
+func (m *Metrics) serveFailed(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if session, ok := m.served[id]; ok {
+		session.failed = true
+		m.served[id] = session
+	}
+}
+
+func (m *Metrics) roundFailed(direction string, remote string) {
+	if m != nil {
+		m.roundErrors.WithLabelValues(direction, remote).Inc()
+	}
+}
+
+func (m *Metrics) observeRound(direction string, remote string, elapsed time.Duration, counter *blockCounter) {
+	if m == nil {
+		return
+	}
+	m.roundDuration.WithLabelValues(direction, remote).Observe(elapsed.Seconds())
+	m.blocks.WithLabelValues(direction, remote).Add(float64(counter.blocks()))
+	m.bytes.WithLabelValues(direction, remote).Add(float64(counter.bytes))
+}
+
+// bloomFalsePositiveRate estimates the false positive probability of a session filter holding n items.
+// Filters start with capacity items and, once full, are extended with filters of double the capacity,
+// so the estimate combines each filter in the chain.
+func bloomFalsePositiveRate(capacity uint64, n uint64) float64 {
+	if capacity == 0 || n == 0 {
+		return 0
+	}
+	pass := 1.0
+	for c := capacity; n > 0; c *= 2 {
+		items := n
+		if items > c {
+			items = c
+		}
+		n -= items
+		m, k := bloom.EstimateParameters(c, bloom.EstimateFPP(c))
+		p := math.Pow(1-math.Exp(-float64(k)*float64(items)/float64(m)), float64(k))
+		pass *= 1 - p
+	}
+	return 1 - pass
+}
+
+// blockCounter counts the blocks in a blocks message as it streams past.
+// Messages are a sequence of uvarint length prefixed sections: the archive header, then one per block.
+type blockCounter struct {
+	sections uint64
+	// Bytes of block sections, excluding the header
+	bytes uint64
+
+	// Length prefix being read, and the bytes of the current section still to skip
+	prefix    uint64
+	shift     uint
+	remaining uint64
+}
+
+func (c *blockCounter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if c.remaining > 0 {
+			skip := uint64(len(p))
+			if skip > c.remaining {
+				skip = c.remaining
+			}
+			if c.sections > 1 {
+				c.bytes += skip
+			}
+			c.remaining -= skip
+			p = p[skip:]
+			continue
+		}
+
+		b := p[0]
+		p = p[1:]
+		c.prefix |= uint64(b&0x7f) << c.shift
+		c.shift += 7
+		if b&0x80 == 0 {
+			c.sections++
+			c.remaining = c.prefix
+			c.prefix, c.shift = 0, 0
+		}
+	}
+	return n, nil
+}
+
+// blocks returns the number of blocks seen.
+func (c *blockCounter) blocks() uint64 {
+	if c.sections == 0 {
+		return 0
+	}
+	return c.sections - 1
+}
+
+// teeBody copies what is read from a body to a writer.
+type teeBody struct {
+	io.Reader
+	io.Closer
+}
+
+func newTeeBody(body io.ReadCloser, w io.Writer) io.ReadCloser {
+	return &teeBody{Reader: io.TeeReader(body, w), Closer: body}
+}
+
+// metricsTransport records the rounds of a client session with a remote.
+type metricsTransport struct {
+	base    http.RoundTripper
+	metrics *Metrics
+	remote  string
+}
+
+func (t *metricsTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if t.metrics == nil {
+		return t.base.RoundTrip(r)
+	}
+
+	// Pushes send blocks to /dag/cm/blocks, and pulls receive them in response to /dag/cm/status.
+	counter := &blockCounter{}
+	direction := DirectionPull
+	if strings.HasSuffix(r.URL.Path, "/blocks") {
+		direction = DirectionPush
+		if r.Body != nil {
+			r = r.Clone(r.Context())
+			r.Body = newTeeBody(r.Body, counter)
+		}
+	}
+
+	start := time.Now()
+	resp, err := t.base.RoundTrip(r)
+	if err != nil {
+		t.metrics.roundFailed(direction, t.remote)
+		return nil, err
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		t.metrics.roundFailed(direction, t.remote)
+	}
+
+	if direction == DirectionPush {
+		t.metrics.observeRound(direction, t.remote, time.Since(start), counter)
+		return resp, nil
+	}
+
+	resp.Body = &observedBody{
+		ReadCloser: newTeeBody(resp.Body, counter),
+		done: func() {
+			t.metrics.observeRound(direction, t.remote, time.Since(start), counter)
+		},
+	}
+	return resp, nil
+}
+
+// observedBody calls done once the body is closed.
+type observedBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (b *observedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.done)
+	return err
+}
+
+// countingResponseWriter records the status of a response, and copies it to a writer, if any, as it is written.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	w      io.Writer
+	status int
+}
+
+func (w *countingResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *countingResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.w != nil {
+		w.w.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Wrap returns a remote protocol handler that records its rounds, the sessions it starts and the rounds it
+// answers with an error. direction is the direction of the sessions the handler serves, and cookie the name of the
+// session cookie it issues.
+func (m *Metrics) Wrap(next http.HandlerFunc, direction string, cookie string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		counter := &blockCounter{}
+		writer := &countingResponseWriter{ResponseWriter: w}
+		if direction == DirectionPush {
+			r.Body = newTeeBody(r.Body, counter)
+		} else {
+			writer.w = counter
+		}
+
+		_, noCookie := r.Cookie(cookie)
+		start := time.Now()
+		next(writer, r)
+		elapsed := time.Since(start)
+
+		remote := m.remotes.label(r)
+		failed := writer.status >= http.StatusBadRequest
+		if failed {
+			m.roundFailed(direction, remote)
+		}
+		session := sessionFromRequest(w, r, cookie)
+		if session == "" {
+			return
+		}
+		if noCookie != nil {
+			m.serve(session, direction, remote)
+		}
+		if failed {
+			m.serveFailed(session)
+		}
+		m.observeRound(direction, remote, elapsed, counter)
+	}
+}
+
+// servedRemotes labels the sessions remote clients start with us from the trusted root DIDs and configured remotes.
+type servedRemotes struct {
+	dids map[string]bool
+	// Configured remote URLs by the IP address in them
+	hosts map[string]string
+}
+
+// newServedRemotes creates the labels of served sessions from the trusted root DIDs, and the remotes configured
+// with a rate limit or as mirror targets. Only remotes given by IP address can be matched to a client.
+func newServedRemotes(cfg *Config) *servedRemotes {
+	s := &servedRemotes{dids: make(map[string]bool), hosts: make(map[string]string)}
+	for _, did := range cfg.UCANTrustedRoots {
+		s.dids[did] = true
+	}
+	var remotes []string
+	for remote := range cfg.RemoteRates {
+		remotes = append(remotes, remote)
+	}
+	for _, rule := range cfg.Mirrors {
+		remotes = append(remotes, rule.Remotes...)
+	}
+	for _, remote := range remotes {
+		u, err := url.Parse(remote)
+		if err != nil {
+			continue
+		}
+		if ip := net.ParseIP(u.Hostname()); ip != nil {
+			s.hosts[ip.String()] = remote
+		}
+	}
+	return s
+}
+
+// label returns the remote label of a request: the trusted root DID its UCAN is delegated from, else the configured
+// remote at the client's address, else remoteServed.
+func (s *servedRemotes) label(r *http.Request) string {
+	if s == nil {
+		return remoteServed
+	}
+	if len(s.dids) > 0 {
+		if token := bearerToken(r); token != "" {
+			if u, err := ParseUCAN(token); err == nil {
+				if did := s.rootDID(u); did != "" {
+					return did
+				}
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if remote, ok := s.hosts[ip.String()]; ok {
+			return remote
+		}
+	}
+	return remoteServed
+}
+
+// rootDID returns the first trusted root DID to issue u or a proof in its chain, or "" if none did.
+func (s *servedRemotes) rootDID(u *UCAN) string {
+	for _, proof := range u.Proofs {
+		if did := s.rootDID(proof); did != "" {
+			return did
+		}
+	}
+	if s.dids[u.Payload.Iss] {
+		return u.Payload.Iss
+	}
+	return ""
+}
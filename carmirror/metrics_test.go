@@ -0,0 +1,173 @@
+package carmirror
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	cmcore "github.com/fission-codes/go-car-mirror/core"
+	cmipld "github.com/fission-codes/go-car-mirror/ipld"
+	"github.com/fission-codes/go-car-mirror/messages"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestBlockCounter(t *testing.T) {
+	var raw []cmcore.RawBlock[cmipld.Cid]
+	var size uint64
+	for i := 0; i < 3; i++ {
+		block := cmipld.WrapRawBlock(blocks.NewBlock([]byte(fmt.Sprintf("block %d", i))))
+		raw = append(raw, block)
+		size += uint64(len(block.Id().Bytes()) + len(block.RawData()))
+	}
+
+	var buf bytes.Buffer
+	if err := messages.NewBlocksMessage[cmipld.Cid, *cmipld.Cid](raw).Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// Feed the message a byte at a time, as a worst case for split length prefixes.
+	counter := &blockCounter{}
+	for _, b := range buf.Bytes() {
+		counter.Write([]byte{b})
+	}
+
+	if counter.blocks() != 3 {
+		t.Errorf("expected 3 blocks, got %d", counter.blocks())
+	}
+	if counter.bytes != size {
+		t.Errorf("expected %d bytes, got %d", size, counter.bytes)
+	}
+}
+
+func TestBloomFalsePositiveRate(t *testing.T) {
+	if rate := bloomFalsePositiveRate(1024, 0); rate != 0 {
+		t.Errorf("expected empty filter to have no false positives, got %v", rate)
+	}
+
+	full := bloomFalsePositiveRate(1024, 1024)
+	if full <= 0 || full > 0.01 {
+		t.Errorf("expected a full filter to stay near its target rate, got %v", full)
+	}
+	if extended := bloomFalsePositiveRate(1024, 4096); extended <= full {
+		t.Errorf("expected extended filter to have a higher rate than %v, got %v", full, extended)
+	}
+}
+
+func TestMetricsWrap(t *testing.T) {
+	m := NewMetrics(1024)
+	running := map[string]sessionMetrics{}
+	m.sessions = func() map[string]sessionMetrics { return running }
+
+	status := http.StatusAccepted
+	handler := m.Wrap(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := r.Cookie("sourceSessionId"); err != nil {
+			http.SetCookie(w, &http.Cookie{Name: "sourceSessionId", Value: r.RemoteAddr})
+		}
+		w.WriteHeader(status)
+	}, DirectionPull, "sourceSessionId")
+	round := func(addr string, cookie bool) {
+		r := httptest.NewRequest(http.MethodPost, "/dag/cm/status", nil)
+		r.RemoteAddr = addr
+		if cookie {
+			r.AddCookie(&http.Cookie{Name: "sourceSessionId", Value: addr})
+		}
+		handler(httptest.NewRecorder(), r)
+	}
+
+	// Sessions from different clients share one label.
+	round("192.0.2.1:4000", false)
+	round("192.0.2.2:4000", false)
+	if n := testutil.CollectAndCount(m.sessionsStarted); n != 1 {
+		t.Errorf("expected one label set for served sessions, got %d", n)
+	}
+	if n := testutil.ToFloat64(m.sessionsStarted.WithLabelValues(DirectionPull, remoteServed)); n != 2 {
+		t.Errorf("expected 2 served sessions started, got %v", n)
+	}
+
+	status = http.StatusInternalServerError
+	round("192.0.2.1:4000", true)
+	if n := testutil.ToFloat64(m.roundErrors.WithLabelValues(DirectionPull, remoteServed)); n != 1 {
+		t.Errorf("expected the failed round to be counted, got %v", n)
+	}
+
+	// Once both sessions end, the one with a failed round is counted as failed.
+	m.refresh()
+	if failed, completed := testutil.ToFloat64(m.sessionsFailed.WithLabelValues(DirectionPull, remoteServed)), testutil.ToFloat64(m.sessionsCompleted.WithLabelValues(DirectionPull, remoteServed)); failed != 1 || completed != 1 {
+		t.Errorf("expected 1 failed and 1 completed session, got %v and %v", failed, completed)
+	}
+}
+
+func TestServedRemoteLabels(t *testing.T) {
+	rootPub, rootKey, _ := ed25519.GenerateKey(nil)
+	userPub, userKey, _ := ed25519.GenerateKey(nil)
+	serverPub, _, _ := ed25519.GenerateKey(nil)
+	rootDID, userDID, serverDID := DIDFromPublicKey(rootPub), DIDFromPublicKey(userPub), DIDFromPublicKey(serverPub)
+
+	capabilities := []Capability{{With: ResourceAll, Can: CapabilityPull}}
+	delegation, err := NewUCAN(rootKey, userDID, capabilities, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	delegated, err := NewUCAN(userKey, serverDID, capabilities, time.Now().Add(time.Hour), delegation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	untrusted, err := NewUCAN(userKey, serverDID, capabilities, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewMetrics(1024)
+	m.remotes = newServedRemotes(&Config{
+		UCANTrustedRoots: []string{rootDID},
+		RemoteRates:      map[string]uint64{"http://192.0.2.5:2503": 1024, "http://backup:2503": 1024},
+		Mirrors:          []MirrorRule{{Name: "site", Source: "mfs:/site", Remotes: []string{"http://[2001:db8::1]:2503"}}},
+	})
+
+	for _, c := range []struct {
+		addr  string
+		token string
+		label string
+	}{
+		{"192.0.2.9:4000", delegated, rootDID},
+		{"192.0.2.5:4000", "", "http://192.0.2.5:2503"},
+		{"[2001:db8:0::1]:4000", "", "http://[2001:db8::1]:2503"},
+		{"192.0.2.5:4000", untrusted, "http://192.0.2.5:2503"},
+		{"192.0.2.9:4000", untrusted, remoteServed},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/dag/cm/status", nil)
+		r.RemoteAddr = c.addr
+		if c.token != "" {
+			r.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		if label := m.remotes.label(r); label != c.label {
+			t.Errorf("expected %s to be labelled %s, got %s", c.addr, c.label, label)
+		}
+	}
+
+	// A served session keeps its label while it runs, and is counted under it when it ends.
+	running := map[string]sessionMetrics{"session": {direction: DirectionPull, remote: remoteServed, filterItems: 10}}
+	m.sessions = func() map[string]sessionMetrics { return running }
+	handler := m.Wrap(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "sourceSessionId", Value: "session"})
+		w.WriteHeader(http.StatusAccepted)
+	}, DirectionPull, "sourceSessionId")
+	r := httptest.NewRequest(http.MethodPost, "/dag/cm/status", nil)
+	r.RemoteAddr = "192.0.2.5:4000"
+	handler(httptest.NewRecorder(), r)
+
+	m.refresh()
+	if n := testutil.ToFloat64(m.filterItems.WithLabelValues(DirectionPull, "http://192.0.2.5:2503")); n != 10 {
+		t.Errorf("expected the running session's filter under its remote, got %v", n)
+	}
+	running = map[string]sessionMetrics{}
+	m.refresh()
+	if n := testutil.ToFloat64(m.sessionsCompleted.WithLabelValues(DirectionPull, "http://192.0.2.5:2503")); n != 1 {
+		t.Errorf("expected the ended session to be counted under its remote, got %v", n)
+	}
+}
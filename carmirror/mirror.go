@@ -0,0 +1,432 @@
+package carmirror
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipfs/boxo/coreiface/path"
+	"github.com/ipfs/boxo/mfs"
+	gocid "github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// Kinds of mirror sources, written before the colon in MirrorRule.Source.
+const (
+	SourceIPNS = "ipns"
+	SourceMFS  = "mfs"
+	SourcePin  = "pin"
+)
+
+// Mirror rules and their progress are kept under this prefix in the datastore, by name.
+var mirrorPrefix = datastore.NewKey("/carmirror/mirrors")
+
+// How long resolving a source and pushing its root to a remote may take.
+const mirrorTimeout = 10 * time.Minute
+
+var mirrorNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+var errUnknownMirror = fmt.Errorf("unknown mirror")
+
+// MirrorRule pushes the root of a source to remotes whenever it changes.
+type MirrorRule struct {
+	Name string
+	// Source is "ipns:" followed by a key name or IPNS name, "mfs:" followed by an MFS path,
+	// or "pin:" followed by the CID of a recursive pin or a pin name.
+	Source  string
+	Remotes []string
+}
+
+// Validate confirms the rule is complete.
+func (r *MirrorRule) Validate() error {
+	if !mirrorNamePattern.MatchString(r.Name) {
+		return fmt.Errorf("mirror name %q must be letters, digits, '.', '_' or '-'", r.Name)
+	}
+	kind, value := splitSource(r.Source)
+	switch kind {
+	case SourceIPNS, SourceMFS, SourcePin:
+		if value == "" {
+			return fmt.Errorf("mirror %s: source %q names nothing", r.Name, r.Source)
+		}
+	default:
+		return fmt.Errorf("mirror %s: source %q must start with ipns:, mfs: or pin:", r.Name, r.Source)
+	}
+	if len(r.Remotes) == 0 {
+		return fmt.Errorf("mirror %s: at least one remote is required", r.Name)
+	}
+	return nil
+}
+
+// splitSource splits a source into its kind and what it names.
+func splitSource(source string) (string, string) {
+	kind, value, _ := strings.Cut(source, ":")
+	return kind, value
+}
+
+// MirrorTarget is how far a rule has got mirroring to one remote.
+type MirrorTarget struct {
+	Remote string
+	// Root is the last root mirrored to the remote, which the next push diffs against.
+	Root     string     `json:",omitempty"`
+	Mirrored *time.Time `json:",omitempty"`
+	// Error is why the last push failed, empty if it succeeded.
+	Error string `json:",omitempty"`
+}
+
+// MirrorStatus describes a rule and how far mirroring has got.
+type MirrorStatus struct {
+	MirrorRule
+	// Configured rules come from the configuration, and others were added through the commands API.
+	Configured bool
+	// Root is the source's root when it was last checked.
+	Root    string     `json:",omitempty"`
+	Checked *time.Time `json:",omitempty"`
+	// Error is why the source couldn't be resolved, empty if it could.
+	Error   string `json:",omitempty"`
+	Targets []MirrorTarget
+}
+
+// Mirrors watches the sources of mirror rules and pushes their roots to the rules' remotes when they change.
+// Rules and their progress are persisted to a datastore, if there is one, so pushes resume diffing after a restart.
+type Mirrors struct {
+	ds datastore.Datastore
+	// resolve returns the current root of a source
+	resolve func(ctx context.Context, source string) (gocid.Cid, error)
+	// push mirrors root to remote, diffing against base if it is defined
+	push func(ctx context.Context, remote string, root gocid.Cid, base gocid.Cid) error
+
+	mu    sync.Mutex
+	rules map[string]*MirrorStatus
+	// syncing serialises syncs, and wake asks run to sync straight away
+	syncing sync.Mutex
+	wake    chan struct{}
+}
+
+// NewMirrors creates the mirrors for the configured rules and those added earlier, which are read from ds if it isn't nil.
+func NewMirrors(ctx context.Context, ds datastore.Datastore, configured []MirrorRule,
+	resolve func(ctx context.Context, source string) (gocid.Cid, error),
+	push func(ctx context.Context, remote string, root gocid.Cid, base gocid.Cid) error,
+) (*Mirrors, error) {
+	m := &Mirrors{
+		ds:      ds,
+		resolve: resolve,
+		push:    push,
+		rules:   make(map[string]*MirrorStatus),
+		wake:    make(chan struct{}, 1),
+	}
+
+	saved, err := m.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rule := range configured {
+		if err := rule.Validate(); err != nil {
+			return nil, err
+		}
+		if _, ok := m.rules[rule.Name]; ok {
+			return nil, fmt.Errorf("mirror %s is configured twice", rule.Name)
+		}
+		status := newMirrorStatus(rule, true)
+		// Progress carries over for remotes the rule still has.
+		if previous, ok := saved[rule.Name]; ok {
+			status.Root, status.Checked = previous.Root, previous.Checked
+			for i := range status.Targets {
+				for _, target := range previous.Targets {
+					if target.Remote == status.Targets[i].Remote {
+						status.Targets[i] = target
+					}
+				}
+			}
+		}
+		m.rules[rule.Name] = status
+	}
+
+	for name, status := range saved {
+		if _, ok := m.rules[name]; ok {
+			continue
+		}
+		if status.Configured {
+			// The rule has been removed from the configuration.
+			m.delete(ctx, name)
+			continue
+		}
+		m.rules[name] = status
+	}
+
+	return m, nil
+}
+
+func newMirrorStatus(rule MirrorRule, configured bool) *MirrorStatus {
+	status := &MirrorStatus{MirrorRule: rule, Configured: configured}
+	for _, remote := range rule.Remotes {
+		status.Targets = append(status.Targets, MirrorTarget{Remote: remote})
+	}
+	return status
+}
+
+func (m *Mirrors) load(ctx context.Context) (map[string]*MirrorStatus, error) {
+	saved := make(map[string]*MirrorStatus)
+	if m.ds == nil {
+		return saved, nil
+	}
+
+	results, err := m.ds.Query(ctx, dsq.Query{Prefix: mirrorPrefix.String()})
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+
+	for result := range results.Next() {
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		var status MirrorStatus
+		if err := json.Unmarshal(result.Value, &status); err != nil {
+			log.Debugw("skipping unreadable mirror", "object", "Mirrors", "method", "load", "key", result.Key, "error", err)
+			continue
+		}
+		saved[status.Name] = &status
+	}
+	return saved, nil
+}
+
+// save persists a rule's status. It must be called holding mu.
+func (m *Mirrors) save(ctx context.Context, status *MirrorStatus) {
+	if m.ds == nil {
+		return
+	}
+	b, err := json.Marshal(status)
+	if err == nil {
+		err = m.ds.Put(ctx, mirrorPrefix.ChildString(status.Name), b)
+	}
+	if err != nil {
+		log.Errorw("could not save mirror", "object", "Mirrors", "method", "save", "mirror", status.Name, "error", err)
+	}
+}
+
+func (m *Mirrors) delete(ctx context.Context, name string) {
+	if m.ds == nil {
+		return
+	}
+	if err := m.ds.Delete(ctx, mirrorPrefix.ChildString(name)); err != nil {
+		log.Errorw("could not delete mirror", "object", "Mirrors", "method", "delete", "mirror", name, "error", err)
+	}
+}
+
+// List returns the rules and their progress, by name.
+func (m *Mirrors) List() []MirrorStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	statuses := make([]MirrorStatus, 0, len(m.rules))
+	for _, status := range m.rules {
+		statuses = append(statuses, status.copy())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+func (s *MirrorStatus) copy() MirrorStatus {
+	c := *s
+	c.Remotes = append([]string(nil), s.Remotes...)
+	c.Targets = append([]MirrorTarget(nil), s.Targets...)
+	return c
+}
+
+// Add adds a rule, which is mirrored straight away.
+func (m *Mirrors) Add(ctx context.Context, rule MirrorRule) (MirrorStatus, error) {
+	if err := rule.Validate(); err != nil {
+		return MirrorStatus{}, err
+	}
+
+	m.mu.Lock()
+	if _, ok := m.rules[rule.Name]; ok {
+		m.mu.Unlock()
+		return MirrorStatus{}, fmt.Errorf("mirror %s already exists", rule.Name)
+	}
+	status := newMirrorStatus(rule, false)
+	m.rules[rule.Name] = status
+	m.save(ctx, status)
+	added := status.copy()
+	m.mu.Unlock()
+
+	m.Wake()
+	return added, nil
+}
+
+// Remove removes a rule added through the commands API. Configured rules are removed from the configuration instead.
+func (m *Mirrors) Remove(ctx context.Context, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	status, ok := m.rules[name]
+	if !ok {
+		return errUnknownMirror
+	}
+	if status.Configured {
+		return fmt.Errorf("mirror %s is configured, remove it from the Mirrors setting instead", name)
+	}
+	delete(m.rules, name)
+	m.delete(ctx, name)
+	return nil
+}
+
+// Wake asks run to check the sources straight away.
+func (m *Mirrors) Wake() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Sync checks every rule's source, and pushes roots that have changed to the remotes that don't have them yet.
+func (m *Mirrors) Sync(ctx context.Context) {
+	m.syncing.Lock()
+	defer m.syncing.Unlock()
+
+	m.mu.Lock()
+	names := make([]string, 0, len(m.rules))
+	for name := range m.rules {
+		names = append(names, name)
+	}
+	m.mu.Unlock()
+	sort.Strings(names)
+
+	for _, name := range names {
+		if ctx.Err() != nil {
+			return
+		}
+		m.syncRule(ctx, name)
+	}
+}
+
+func (m *Mirrors) syncRule(ctx context.Context, name string) {
+	m.mu.Lock()
+	status, ok := m.rules[name]
+	if !ok {
+		m.mu.Unlock()
+		return
+	}
+	rule := status.copy()
+	m.mu.Unlock()
+
+	resolveCtx, cancel := context.WithTimeout(ctx, mirrorTimeout)
+	root, err := m.resolve(resolveCtx, rule.Source)
+	cancel()
+	checked := time.Now()
+
+	m.mu.Lock()
+	status.Checked = &checked
+	status.Error = ""
+	status.Root = ""
+	if err != nil {
+		status.Error = err.Error()
+	} else {
+		status.Root = root.String()
+	}
+	m.save(ctx, status)
+	m.mu.Unlock()
+	if err != nil {
+		log.Debugw("could not resolve mirror source", "object", "Mirrors", "method", "syncRule", "mirror", name, "source", rule.Source, "error", err)
+		return
+	}
+
+	for i, target := range rule.Targets {
+		if target.Root == root.String() && target.Error == "" {
+			continue
+		}
+		var base gocid.Cid
+		if target.Root != "" {
+			base, _ = gocid.Parse(target.Root)
+		}
+
+		log.Debugw("mirroring", "object", "Mirrors", "method", "syncRule", "mirror", name, "remote", target.Remote, "root", root, "base", base)
+		pushCtx, cancel := context.WithTimeout(ctx, mirrorTimeout)
+		err := m.push(pushCtx, target.Remote, root, base)
+		cancel()
+		if ctx.Err() != nil {
+			// Stopped, rather than failed.
+			return
+		}
+
+		m.mu.Lock()
+		// The rule may have been removed while we pushed.
+		if current, ok := m.rules[name]; ok && current == status {
+			if err != nil {
+				status.Targets[i].Error = err.Error()
+				log.Warnw("mirror push failed", "object", "Mirrors", "method", "syncRule", "mirror", name, "remote", target.Remote, "error", err)
+			} else {
+				mirrored := time.Now()
+				status.Targets[i] = MirrorTarget{Remote: target.Remote, Root: root.String(), Mirrored: &mirrored}
+			}
+			m.save(ctx, status)
+		}
+		m.mu.Unlock()
+	}
+}
+
+// run syncs every interval, and when woken, until ctx is done.
+func (m *Mirrors) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if len(m.List()) > 0 {
+			m.Sync(ctx)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-m.wake:
+		}
+	}
+}
+
+// resolveSource returns the current root of a mirror rule's source.
+func (cm *CarMirror) resolveSource(ctx context.Context, source string) (gocid.Cid, error) {
+	kind, value := splitSource(source)
+	switch kind {
+	case SourceIPNS:
+		// Our own keys are named, and anything else is resolved as an IPNS name.
+		p := path.New("/ipns/" + value)
+		keys, err := cm.capi.Key().List(ctx)
+		if err != nil {
+			return gocid.Undef, err
+		}
+		for _, key := range keys {
+			if key.Name() == value {
+				p = key.Path()
+			}
+		}
+		resolved, err := cm.capi.ResolvePath(ctx, p)
+		if err != nil {
+			return gocid.Undef, err
+		}
+		return resolved.Cid(), nil
+
+	case SourceMFS:
+		if cm.cfg.FilesRoot == nil {
+			return gocid.Undef, fmt.Errorf("MFS is not available")
+		}
+		fsNode, err := mfs.Lookup(cm.cfg.FilesRoot, value)
+		if err != nil {
+			return gocid.Undef, err
+		}
+		node, err := fsNode.GetNode()
+		if err != nil {
+			return gocid.Undef, err
+		}
+		return node.Cid(), nil
+
+	case SourcePin:
+		return cm.resolvePin(ctx, value)
+
+	default:
+		return gocid.Undef, fmt.Errorf("unsupported source %q", source)
+	}
+}
@@ -0,0 +1,212 @@
+package carmirror
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	cmipld "github.com/fission-codes/go-car-mirror/ipld"
+	gocid "github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/multiformats/go-multihash"
+)
+
+func testCid(t *testing.T, s string) gocid.Cid {
+	hash, err := multihash.Sum([]byte(s), multihash.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return gocid.NewCidV1(gocid.Raw, hash)
+}
+
+func TestMirrors(t *testing.T) {
+	ctx := context.Background()
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+
+	roots := map[string]gocid.Cid{"mfs:/site": testCid(t, "v1")}
+	resolve := func(ctx context.Context, source string) (gocid.Cid, error) {
+		if root, ok := roots[source]; ok {
+			return root, nil
+		}
+		return gocid.Undef, fmt.Errorf("no such source")
+	}
+	type push struct{ remote, root, base string }
+	var pushes []push
+	failing := map[string]bool{}
+	pushFn := func(ctx context.Context, remote string, root gocid.Cid, base gocid.Cid) error {
+		if failing[remote] {
+			return fmt.Errorf("remote unreachable")
+		}
+		p := push{remote: remote, root: root.String()}
+		if base.Defined() {
+			p.base = base.String()
+		}
+		pushes = append(pushes, p)
+		return nil
+	}
+
+	configured := []MirrorRule{{Name: "site", Source: "mfs:/site", Remotes: []string{"http://a:2503", "http://b:2503"}}}
+	m, err := NewMirrors(ctx, ds, configured, resolve, pushFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failing["http://b:2503"] = true
+	m.Sync(ctx)
+	if len(pushes) != 1 || pushes[0] != (push{"http://a:2503", roots["mfs:/site"].String(), ""}) {
+		t.Fatalf("expected the first root to be pushed to a, got %+v", pushes)
+	}
+
+	// An unchanged root is only pushed to the remote that failed, once it is back.
+	failing["http://b:2503"] = false
+	m.Sync(ctx)
+	if len(pushes) != 2 || pushes[1].remote != "http://b:2503" {
+		t.Fatalf("expected the failed push to be retried, got %+v", pushes)
+	}
+	m.Sync(ctx)
+	if len(pushes) != 2 {
+		t.Fatalf("expected nothing to be pushed for an unchanged root, got %+v", pushes)
+	}
+
+	// After a restart, a new root is diffed against the last one mirrored.
+	old := roots["mfs:/site"]
+	roots["mfs:/site"] = testCid(t, "v2")
+	if m, err = NewMirrors(ctx, ds, configured, resolve, pushFn); err != nil {
+		t.Fatal(err)
+	}
+	m.Sync(ctx)
+	if len(pushes) != 4 || pushes[2].base != old.String() || pushes[3].base != old.String() {
+		t.Fatalf("expected the new root to be diffed against the old one, got %+v", pushes)
+	}
+
+	if _, err := m.Add(ctx, MirrorRule{Name: "keys", Source: "ftp:backups", Remotes: []string{"http://a:2503"}}); err == nil {
+		t.Errorf("expected an unknown kind of source to be rejected")
+	}
+	if _, err := m.Add(ctx, MirrorRule{Name: "blog", Source: "ipns:blog", Remotes: []string{"http://a:2503"}}); err != nil {
+		t.Fatal(err)
+	}
+	m.Sync(ctx)
+	statuses := m.List()
+	if len(statuses) != 2 || statuses[0].Name != "blog" || statuses[0].Error == "" || statuses[0].Configured {
+		t.Fatalf("expected the added rule to report that its source can't be resolved, got %+v", statuses)
+	}
+
+	if err := m.Remove(ctx, "site"); err == nil {
+		t.Errorf("expected a configured rule not to be removable")
+	}
+	if err := m.Remove(ctx, "blog"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rules removed from the configuration are forgotten.
+	if m, err = NewMirrors(ctx, ds, nil, resolve, pushFn); err != nil {
+		t.Fatal(err)
+	}
+	if statuses := m.List(); len(statuses) != 0 {
+		t.Errorf("expected no rules, got %+v", statuses)
+	}
+}
+
+func TestDedicatedPushes(t *testing.T) {
+	ctx := context.Background()
+	cms, _ := newTestCarMirrors(t, 2)
+	if err := cms[1].StartRemote(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer cms[1].Close()
+	sink := "http://" + cms[1].RemoteAddr().String()
+
+	// Pushes to the same remote at once each have a session, and each is told its own outcome.
+	var roots []gocid.Cid
+	for i := 0; i < 3; i++ {
+		block, err := cmipld.TryBlockFromCBOR(fmt.Sprintf("dedicated push %d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := cms[0].blockStore.Add(ctx, block); err != nil {
+			t.Fatal(err)
+		}
+		roots = append(roots, block.Id().Unwrap())
+	}
+	errs := make(chan error, len(roots))
+	for _, root := range roots {
+		go func(root gocid.Cid) {
+			errs <- cms[0].push(ctx, sink, 0, "", "", []gocid.Cid{root}, gocid.Undef)
+		}(root)
+	}
+	for range roots {
+		if err := <-errs; err != nil {
+			t.Errorf("expected every push to complete, got %v", err)
+		}
+	}
+	for _, root := range roots {
+		if has, _ := cms[1].blockStore.Has(ctx, cmipld.WrapCid(root)); !has {
+			t.Errorf("expected %s to reach the sink", root)
+		}
+	}
+
+	// A push whose context is done is cancelled, rather than left running.
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := cms[0].push(cancelled, "http://127.0.0.1:1", 0, "", "", roots[:1], gocid.Undef); err != context.Canceled {
+		t.Errorf("expected the push to end with its context, got %v", err)
+	}
+	if sessions := cms[0].runningSessions(SessionFilter{}); len(sessions) != 0 {
+		for _, s := range sessions {
+			if s.State != StateCancelling {
+				t.Errorf("expected the push to be cancelled, got %+v", s)
+			}
+		}
+	}
+}
+
+func TestPinSource(t *testing.T) {
+	ctx := context.Background()
+	cms, _ := newTestCarMirrors(t, 1)
+	cm := cms[0]
+	cm.cfg.Datastore = dssync.MutexWrap(datastore.NewMapDatastore())
+
+	var roots []gocid.Cid
+	for i := 0; i < 2; i++ {
+		block, err := cmipld.TryBlockFromCBOR(fmt.Sprintf("pinned %d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := cm.blockStore.Add(ctx, block); err != nil {
+			t.Fatal(err)
+		}
+		roots = append(roots, block.Id().Unwrap())
+	}
+
+	// A root that isn't pinned isn't mirrored, by CID or by name.
+	if _, err := cm.resolveSource(ctx, "pin:"+roots[0].String()); err == nil {
+		t.Errorf("expected an unpinned root to be refused")
+	}
+	if _, err := cm.resolveSource(ctx, "pin:dataset"); err == nil {
+		t.Errorf("expected an unknown pin name to be refused")
+	}
+
+	// A name follows the root it was last given, which is pinned.
+	for _, root := range roots {
+		if _, err := cm.NamePin(ctx, "dataset", root); err != nil {
+			t.Fatal(err)
+		}
+		if resolved, err := cm.resolveSource(ctx, "pin:dataset"); err != nil || resolved != root {
+			t.Errorf("expected the name to resolve to %s, got %s, %v", root, resolved, err)
+		}
+		if resolved, err := cm.resolveSource(ctx, "pin:"+root.String()); err != nil || resolved != root {
+			t.Errorf("expected the pinned root to resolve, got %s, %v", resolved, err)
+		}
+	}
+	if pins, err := cm.PinNames(ctx); err != nil || len(pins) != 1 || pins[0].Cid != roots[1].String() {
+		t.Errorf("expected the one name, got %+v, %v", pins, err)
+	}
+
+	if err := cm.UnnamePin(ctx, "dataset"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cm.resolveSource(ctx, "pin:dataset"); err == nil {
+		t.Errorf("expected a removed name to be refused")
+	}
+}
@@ -0,0 +1,325 @@
+package carmirror
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	cmcore "github.com/fission-codes/go-car-mirror/core"
+	cmerrors "github.com/fission-codes/go-car-mirror/errors"
+	cmipld "github.com/fission-codes/go-car-mirror/ipld"
+	gocid "github.com/ipfs/go-cid"
+)
+
+const (
+	// How long a pull from several sources may take, after which it fails.
+	multiPullTimeout = 10 * time.Minute
+	// How long a subtree is left with one source before an idle source is also given it.
+	slowSubtreeAfter = 30 * time.Second
+	// How often idle sources are given the missing blocks found under subtrees still being pulled.
+	rebalanceInterval = time.Second
+	// How many pulls from a source may fail before it is given no more work.
+	maxSourceFailures = 3
+	// How many times the DAG is checked and its missing blocks pulled again before the pull fails.
+	maxPullRounds = 3
+)
+
+// SourcePull is how pulling from one source of a multi-source pull has got on.
+type SourcePull struct {
+	Remote string
+	// State is active while the source is used, completed once the DAG is complete, or failed once it is given up on.
+	State string
+	// Subtrees is how many subtrees were pulled from the source.
+	Subtrees int
+	Failures int
+	// Error is why the last pull from the source failed.
+	Error string `json:",omitempty"`
+}
+
+// MultiPullResponse reports a pull of one root from several sources.
+type MultiPullResponse struct {
+	Cid string
+	// Blocks is how many blocks the DAG has, once it has been verified complete.
+	Blocks  int `json:",omitempty"`
+	Sources []SourcePull
+	// Transfer is the id the pull's sessions are listed under, if it was given one.
+	Transfer string `json:",omitempty"`
+	// Error is why the DAG couldn't be completed, empty if it was or the pull runs in the background.
+	Error string `json:",omitempty"`
+}
+
+// parallelPull pulls the DAG under root from several sources at once, each pulling a different subtree.
+type parallelPull struct {
+	root    gocid.Cid
+	sources []string
+	// pull pulls the DAG under a subtree root from remote, returning once the session ends, or once ctx is done
+	pull func(ctx context.Context, remote string, root gocid.Cid) error
+	// frontier returns the blocks missing locally under roots, walking at most limit local blocks, 0 meaning all,
+	// and how many local blocks it walked
+	frontier          func(ctx context.Context, roots []gocid.Cid, limit int) ([]gocid.Cid, int, error)
+	slowAfter         time.Duration
+	rebalanceInterval time.Duration
+}
+
+// subtreePull is a subtree being pulled, from one source or, once it is slow, several.
+type subtreePull struct {
+	sources map[int]bool
+	started time.Time
+}
+
+type subtreeResult struct {
+	source int
+	root   gocid.Cid
+	err    error
+}
+
+// run pulls the DAG and verifies it is complete. Each source pulls one subtree at a time. A subtree whose pull fails
+// goes back to be pulled from another source, and sources that keep failing are given no more work.
+func (pp *parallelPull) run(ctx context.Context) *MultiPullResponse {
+	res := &MultiPullResponse{Cid: pp.root.String()}
+	for _, remote := range pp.sources {
+		res.Sources = append(res.Sources, SourcePull{Remote: remote, State: StateActive})
+	}
+
+	busy := make([]bool, len(pp.sources))
+	// Cancel the pull each busy source is running
+	cancels := make([]context.CancelFunc, len(pp.sources))
+	// Pulls cancelled because another source finished their subtree first, whose results don't count
+	abandoned := make([]bool, len(pp.sources))
+	pulling := make(map[gocid.Cid]*subtreePull)
+	results := make(chan subtreeResult, len(pp.sources))
+
+	fail := func(err error) *MultiPullResponse {
+		for i := range pp.sources {
+			if busy[i] {
+				cancels[i]()
+			}
+			if res.Sources[i].State == StateActive {
+				res.Sources[i].State = StateFailed
+			}
+		}
+		res.Error = err.Error()
+		return res
+	}
+
+	// Subtrees no source is pulling yet, starting with the blocks missing near the root.
+	pending, _, err := pp.frontier(ctx, []gocid.Cid{pp.root}, maxBaseBlocks)
+	if err != nil {
+		return fail(err)
+	}
+
+	// next takes the subtree source i should pull: a pending one, or else one that is slow with other sources.
+	next := func(i int) (gocid.Cid, bool) {
+		for len(pending) > 0 {
+			root := pending[0]
+			pending = pending[1:]
+			if p, ok := pulling[root]; !ok || !p.sources[i] {
+				return root, true
+			}
+		}
+		var slowest gocid.Cid
+		var started time.Time
+		for root, p := range pulling {
+			if !p.sources[i] && time.Since(p.started) >= pp.slowAfter && (!slowest.Defined() || p.started.Before(started)) {
+				slowest, started = root, p.started
+			}
+		}
+		return slowest, slowest.Defined()
+	}
+
+	ticker := time.NewTicker(pp.rebalanceInterval)
+	defer ticker.Stop()
+	for round := 1; ; {
+		// Once nothing is left to pull, check the whole DAG is here, and pull what isn't again.
+		if len(pending) == 0 && len(pulling) == 0 {
+			missing, blocks, err := pp.frontier(ctx, []gocid.Cid{pp.root}, 0)
+			if err != nil {
+				return fail(err)
+			}
+			if len(missing) == 0 {
+				res.Blocks = blocks
+				for i := range res.Sources {
+					if res.Sources[i].State == StateActive {
+						res.Sources[i].State = StateCompleted
+					}
+				}
+				return res
+			}
+			if round == maxPullRounds {
+				return fail(fmt.Errorf("%d blocks are still missing after %d rounds, such as %s", len(missing), round, missing[0]))
+			}
+			log.Debugw("blocks missing, pulling them again", "object", "parallelPull", "method", "run", "root", pp.root, "missing", len(missing), "round", round)
+			round++
+			pending = missing
+		}
+
+		live := 0
+		for i, remote := range pp.sources {
+			if res.Sources[i].State == StateFailed {
+				continue
+			}
+			live++
+			if busy[i] {
+				continue
+			}
+			root, ok := next(i)
+			if !ok {
+				continue
+			}
+			p, ok := pulling[root]
+			if !ok {
+				p = &subtreePull{sources: make(map[int]bool), started: time.Now()}
+				pulling[root] = p
+			}
+			p.sources[i] = true
+			busy[i] = true
+			pullCtx, cancel := context.WithCancel(ctx)
+			cancels[i] = cancel
+			go func(i int, remote string, root gocid.Cid) {
+				results <- subtreeResult{i, root, pp.pull(pullCtx, remote, root)}
+			}(i, remote, root)
+		}
+		if live == 0 {
+			return fail(fmt.Errorf("every source failed"))
+		}
+
+		select {
+		case r := <-results:
+			busy[r.source] = false
+			cancels[r.source]()
+			if abandoned[r.source] {
+				abandoned[r.source] = false
+				continue
+			}
+			p := pulling[r.root]
+			if p != nil {
+				delete(p.sources, r.source)
+			}
+
+			if r.err != nil {
+				source := &res.Sources[r.source]
+				source.Failures++
+				source.Error = r.err.Error()
+				if source.Failures >= maxSourceFailures {
+					source.State = StateFailed
+				}
+				log.Debugw("subtree pull failed", "object", "parallelPull", "method", "run", "remote", source.Remote, "subtree", r.root, "error", r.err)
+				// Another source takes the subtree over, unless one already has it.
+				if p != nil && len(p.sources) == 0 {
+					delete(pulling, r.root)
+					pending = append([]gocid.Cid{r.root}, pending...)
+				}
+				continue
+			}
+
+			res.Sources[r.source].Subtrees++
+			if p != nil {
+				// Sources still pulling the subtree needn't.
+				for other := range p.sources {
+					abandoned[other] = true
+					cancels[other]()
+				}
+				delete(pulling, r.root)
+			}
+
+		case <-ticker.C:
+			// Idle sources take the missing blocks found under subtrees still being pulled.
+			idle := 0
+			for i := range pp.sources {
+				if !busy[i] && res.Sources[i].State != StateFailed {
+					idle++
+				}
+			}
+			if idle == 0 || len(pending) > 0 || len(pulling) == 0 {
+				continue
+			}
+			roots := make([]gocid.Cid, 0, len(pulling))
+			for root := range pulling {
+				roots = append(roots, root)
+			}
+			missing, _, err := pp.frontier(ctx, roots, maxBaseBlocks)
+			if err != nil {
+				log.Debugw("could not find missing blocks", "object", "parallelPull", "method", "run", "error", err)
+				continue
+			}
+			for _, root := range missing {
+				if _, ok := pulling[root]; !ok && len(pending) < idle {
+					pending = append(pending, root)
+				}
+			}
+
+		case <-ctx.Done():
+			return fail(ctx.Err())
+		}
+	}
+}
+
+// multiPull pulls root from every remote in p.Addrs at once, each pulling different subtrees.
+// Unless p.Background is set, it waits until the DAG is complete or the pull fails.
+func (cm *CarMirror) multiPull(ctx context.Context, p PullParams, root gocid.Cid) (*MultiPullResponse, error) {
+	rate, err := cm.remoteParams(p.Addrs, p.Rate)
+	if err != nil {
+		return nil, err
+	}
+
+	pp := &parallelPull{
+		root:    root,
+		sources: p.Addrs,
+		pull: func(ctx context.Context, remote string, root gocid.Cid) error {
+			return cm.pull(ctx, remote, rate, p.Token, p.Transfer, []gocid.Cid{root})
+		},
+		frontier:          cm.frontier,
+		slowAfter:         slowSubtreeAfter,
+		rebalanceInterval: rebalanceInterval,
+	}
+
+	if p.Background {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), multiPullTimeout)
+			defer cancel()
+			if res := pp.run(ctx); res.Error != "" {
+				log.Warnw("pull from several sources failed", "object", "CarMirror", "method", "multiPull", "cid", root, "error", res.Error)
+			}
+		}()
+		res := &MultiPullResponse{Cid: root.String(), Transfer: p.Transfer}
+		for _, addr := range p.Addrs {
+			res.Sources = append(res.Sources, SourcePull{Remote: addr, State: StateActive})
+		}
+		return res, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, multiPullTimeout)
+	defer cancel()
+	res := pp.run(ctx)
+	res.Transfer = p.Transfer
+	return res, nil
+}
+
+// frontier walks the local blocks under roots breadth first, returning the blocks they link to that aren't here,
+// and how many local blocks it walked. It walks at most limit blocks, or all of them if limit is 0.
+func (cm *CarMirror) frontier(ctx context.Context, roots []gocid.Cid, limit int) ([]gocid.Cid, int, error) {
+	var missing []gocid.Cid
+	walked := 0
+	err := walkDAG(ctx, cm.blockStore, roots, func(id gocid.Cid, _ cmcore.Block[cmipld.Cid], err error) (bool, error) {
+		if limit > 0 && walked == limit {
+			return false, errStopWalk
+		}
+		if err == cmerrors.ErrBlockNotFound {
+			missing = append(missing, id)
+			return false, nil
+		}
+		// Denied blocks wouldn't be stored if they were pulled.
+		if err == ErrDeniedBlock {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		walked++
+		return true, nil
+	})
+	if err != nil {
+		return nil, walked, err
+	}
+	return missing, walked, nil
+}
@@ -0,0 +1,196 @@
+package carmirror
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipfs/boxo/ipld/merkledag"
+	gocid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// testDAG is a DAG held by sources, and the part of it copied locally.
+type testDAG struct {
+	children map[gocid.Cid][]gocid.Cid
+
+	mu    sync.Mutex
+	local map[gocid.Cid]bool
+}
+
+// newTestDAG makes a root with three children, each with two leaves.
+func newTestDAG(t *testing.T) (*testDAG, gocid.Cid) {
+	d := &testDAG{children: make(map[gocid.Cid][]gocid.Cid), local: make(map[gocid.Cid]bool)}
+	root := testCid(t, "root")
+	for _, child := range []string{"a", "b", "c"} {
+		c := testCid(t, child)
+		d.children[root] = append(d.children[root], c)
+		d.children[c] = []gocid.Cid{testCid(t, child+"1"), testCid(t, child+"2")}
+	}
+	return d, root
+}
+
+// copy copies the subtree under root locally, except the blocks in skip.
+func (d *testDAG) copy(root gocid.Cid, skip map[gocid.Cid]bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	queue := []gocid.Cid{root}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		if !skip[id] {
+			d.local[id] = true
+		}
+		queue = append(queue, d.children[id]...)
+	}
+}
+
+func (d *testDAG) frontier(ctx context.Context, roots []gocid.Cid, limit int) ([]gocid.Cid, int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var missing []gocid.Cid
+	walked := 0
+	queue := append([]gocid.Cid(nil), roots...)
+	for len(queue) > 0 && (limit == 0 || walked < limit) {
+		id := queue[0]
+		queue = queue[1:]
+		if !d.local[id] {
+			missing = append(missing, id)
+			continue
+		}
+		walked++
+		queue = append(queue, d.children[id]...)
+	}
+	return missing, walked, nil
+}
+
+// testSources are sources that copy subtrees, fail, or hang until their pull is cancelled.
+type testSources struct {
+	dag *testDAG
+	// skip are blocks the partial source doesn't have
+	skip map[gocid.Cid]bool
+
+	mu     sync.Mutex
+	pulled map[string][]gocid.Cid
+}
+
+func (s *testSources) pull(ctx context.Context, remote string, root gocid.Cid) error {
+	s.mu.Lock()
+	s.pulled[remote] = append(s.pulled[remote], root)
+	s.mu.Unlock()
+
+	switch {
+	case strings.HasPrefix(remote, "good"):
+		s.dag.copy(root, nil)
+	case strings.HasPrefix(remote, "partial"):
+		s.dag.copy(root, s.skip)
+	case strings.HasPrefix(remote, "bad"):
+		return fmt.Errorf("connection refused")
+	case strings.HasPrefix(remote, "slow"):
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return nil
+}
+
+func TestParallelPull(t *testing.T) {
+	run := func(t *testing.T, dag *testDAG, root gocid.Cid, skip map[gocid.Cid]bool, sources ...string) (*MultiPullResponse, *testSources) {
+		s := &testSources{dag: dag, skip: skip, pulled: make(map[string][]gocid.Cid)}
+		pp := &parallelPull{
+			root:              root,
+			sources:           sources,
+			pull:              s.pull,
+			frontier:          dag.frontier,
+			slowAfter:         20 * time.Millisecond,
+			rebalanceInterval: 5 * time.Millisecond,
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		return pp.run(ctx), s
+	}
+
+	t.Run("subtrees are shared out, and failed ones reassigned", func(t *testing.T) {
+		dag, root := newTestDAG(t)
+		dag.local[root] = true
+		res, s := run(t, dag, root, nil, "good1", "good2", "bad")
+		if res.Error != "" || res.Blocks != 10 {
+			t.Fatalf("expected all 10 blocks, got %+v", res)
+		}
+		if len(s.pulled["good1"]) == 0 || len(s.pulled["good2"]) == 0 {
+			t.Errorf("expected both good sources to pull subtrees, got %v", s.pulled)
+		}
+		if res.Sources[2].Failures == 0 || res.Sources[0].Subtrees+res.Sources[1].Subtrees != 3 {
+			t.Errorf("expected the bad source's subtree to be pulled from a good one, got %+v", res.Sources)
+		}
+	})
+
+	t.Run("a slow subtree is also given to an idle source", func(t *testing.T) {
+		dag, root := newTestDAG(t)
+		dag.copy(root, map[gocid.Cid]bool{testCid(t, "a"): true, testCid(t, "a1"): true, testCid(t, "a2"): true})
+		res, _ := run(t, dag, root, nil, "slow", "good")
+		if res.Error != "" || res.Blocks != 10 || res.Sources[1].Subtrees != 1 || res.Sources[0].Subtrees != 0 {
+			t.Fatalf("expected the good source to take over the slow subtree, got %+v", res)
+		}
+	})
+
+	t.Run("blocks no source has are reported", func(t *testing.T) {
+		dag, root := newTestDAG(t)
+		res, s := run(t, dag, root, map[gocid.Cid]bool{testCid(t, "b2"): true}, "partial")
+		if !strings.Contains(res.Error, "1 blocks are still missing") || res.Sources[0].State != StateFailed {
+			t.Fatalf("expected the missing block to fail the pull, got %+v", res)
+		}
+		if n := len(s.pulled["partial"]); n != maxPullRounds {
+			t.Errorf("expected the missing block to be pulled again each round, got %d pulls", n)
+		}
+	})
+
+	t.Run("the pull fails once every source has", func(t *testing.T) {
+		dag, root := newTestDAG(t)
+		res, _ := run(t, dag, root, nil, "bad1", "bad2")
+		if res.Error != "every source failed" || res.Sources[0].Failures != maxSourceFailures {
+			t.Fatalf("expected every source to fail, got %+v", res)
+		}
+	})
+}
+
+func TestMultiPull(t *testing.T) {
+	ctx := context.Background()
+	cms, apis := newTestCarMirrors(t, 3)
+
+	// Both sources have the DAG: a root linking to two leaves.
+	root := merkledag.NodeWithData([]byte("root"))
+	dag := []ipld.Node{root}
+	for _, s := range []string{"left", "right"} {
+		leaf := merkledag.NewRawNode([]byte(s))
+		if err := root.AddNodeLink(s, leaf); err != nil {
+			t.Fatal(err)
+		}
+		dag = append(dag, leaf)
+	}
+	var addrs []string
+	for i, cm := range cms[1:] {
+		if err := apis[i+1].Dag().AddMany(ctx, dag); err != nil {
+			t.Fatal(err)
+		}
+		if err := cm.StartRemote(ctx); err != nil {
+			t.Fatal(err)
+		}
+		defer cm.Close()
+		addrs = append(addrs, "http://"+cm.RemoteAddr().String())
+	}
+
+	res, err := cms[0].multiPull(ctx, PullParams{Addrs: addrs}, root.Cid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Error != "" || res.Blocks != 3 {
+		t.Fatalf("expected the DAG's 3 blocks to be pulled, got %+v", res)
+	}
+
+	if _, err := cms[0].multiPull(ctx, PullParams{Addrs: []string{addrs[0], addrs[0]}}, root.Cid()); err == nil {
+		t.Errorf("expected a source given twice to be rejected")
+	}
+}
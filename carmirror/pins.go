@@ -0,0 +1,126 @@
+package carmirror
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/ipfs/boxo/coreiface/options"
+	"github.com/ipfs/boxo/coreiface/path"
+	gocid "github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// Pin names are kept under this prefix in the datastore, by name.
+// This version of Kubo doesn't name pins, so mirror rules name them here instead.
+var pinNamePrefix = datastore.NewKey("/carmirror/pins")
+
+var errUnknownPinName = fmt.Errorf("unknown pin name")
+
+// PinName names a recursive pin, so a mirror rule can follow the root it names as it changes.
+type PinName struct {
+	Name string
+	Cid  string
+}
+
+// NamePin pins cid recursively and names it, replacing the root the name had.
+// The root the name had stays pinned, as it may be pinned for other reasons too.
+func (cm *CarMirror) NamePin(ctx context.Context, name string, cid gocid.Cid) (PinName, error) {
+	if cm.cfg.Datastore == nil {
+		return PinName{}, fmt.Errorf("pin names need a datastore")
+	}
+	if !mirrorNamePattern.MatchString(name) {
+		return PinName{}, fmt.Errorf("pin name %q must be letters, digits, '.', '_' or '-'", name)
+	}
+	if err := cm.capi.Pin().Add(ctx, path.IpfsPath(cid), options.Pin.Recursive(true)); err != nil {
+		return PinName{}, err
+	}
+
+	pin := PinName{Name: name, Cid: cid.String()}
+	b, err := json.Marshal(pin)
+	if err != nil {
+		return PinName{}, err
+	}
+	if err := cm.cfg.Datastore.Put(ctx, pinNamePrefix.ChildString(name), b); err != nil {
+		return PinName{}, err
+	}
+	// Rules following the name push its new root straight away.
+	cm.mirrors.Wake()
+	return pin, nil
+}
+
+// UnnamePin removes a pin name, leaving the root it named pinned.
+func (cm *CarMirror) UnnamePin(ctx context.Context, name string) error {
+	if _, err := cm.pinNamed(ctx, name); err != nil {
+		return err
+	}
+	return cm.cfg.Datastore.Delete(ctx, pinNamePrefix.ChildString(name))
+}
+
+// PinNames returns the pin names, by name.
+func (cm *CarMirror) PinNames(ctx context.Context) ([]PinName, error) {
+	pins := []PinName{}
+	if cm.cfg.Datastore == nil {
+		return pins, nil
+	}
+
+	results, err := cm.cfg.Datastore.Query(ctx, dsq.Query{Prefix: pinNamePrefix.String()})
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+
+	for result := range results.Next() {
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		var pin PinName
+		if err := json.Unmarshal(result.Value, &pin); err != nil {
+			log.Debugw("skipping unreadable pin name", "object", "CarMirror", "method", "PinNames", "key", result.Key, "error", err)
+			continue
+		}
+		pins = append(pins, pin)
+	}
+	sort.Slice(pins, func(i, j int) bool { return pins[i].Name < pins[j].Name })
+	return pins, nil
+}
+
+// pinNamed returns the root name names.
+func (cm *CarMirror) pinNamed(ctx context.Context, name string) (gocid.Cid, error) {
+	if cm.cfg.Datastore == nil {
+		return gocid.Undef, errUnknownPinName
+	}
+	b, err := cm.cfg.Datastore.Get(ctx, pinNamePrefix.ChildString(name))
+	if err == datastore.ErrNotFound {
+		return gocid.Undef, errUnknownPinName
+	}
+	if err != nil {
+		return gocid.Undef, err
+	}
+	var pin PinName
+	if err := json.Unmarshal(b, &pin); err != nil {
+		return gocid.Undef, err
+	}
+	return gocid.Parse(pin.Cid)
+}
+
+// resolvePin returns the root of a pin source, which is the CID of a recursive pin or a pin name.
+// The root must still be pinned recursively.
+func (cm *CarMirror) resolvePin(ctx context.Context, value string) (gocid.Cid, error) {
+	root, err := gocid.Parse(value)
+	if err != nil {
+		if root, err = cm.pinNamed(ctx, value); err != nil {
+			return gocid.Undef, fmt.Errorf("pin %s: %w", value, err)
+		}
+	}
+	_, pinned, err := cm.capi.Pin().IsPinned(ctx, path.IpfsPath(root), options.Pin.IsPinned.Recursive())
+	if err != nil {
+		return gocid.Undef, err
+	}
+	if !pinned {
+		return gocid.Undef, fmt.Errorf("pin %s: %s isn't pinned recursively", value, root)
+	}
+	return root, nil
+}
@@ -0,0 +1,353 @@
+package carmirror
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	stats "github.com/fission-codes/go-car-mirror/stats"
+	"github.com/fission-codes/go-car-mirror/util"
+	gocid "github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multibase"
+)
+
+// Stats context for policy decisions, which don't belong to any one session.
+const policyStatsContext = "policy"
+
+// Policy decides what content and which peers the node will mirror.
+// It is loaded from files, which can be reloaded while running.
+// A nil Policy allows everything.
+//
+// The denylist uses the compact denylist format: one entry per line, either a CID
+// (optionally as /ipfs/CID) or a double-hashed entry `//HEX`, where HEX is the hex encoded
+// sha256 of the base32 CIDv1 followed by "/". Lines starting with # or ! are comments,
+// and anything before a `---` line is a header. Entries with paths are ignored, since
+// blocks are only ever denied whole.
+//
+// The allowlist has one root CID per line. When it is set, sessions may only start from listed roots.
+//
+// The denied peers file has one IP address, CIDR range or DID per line.
+type Policy struct {
+	denylistFile    string
+	allowlistFile   string
+	deniedPeersFile string
+	stats           stats.Stats
+	// Tokens of the sessions whose first request passed the policy, whose later rounds aren't checked again
+	sessions *util.SynchronizedMap[string, bool]
+
+	mu           sync.RWMutex
+	deniedHashes map[string]bool
+	allowedRoots map[string]bool
+	deniedNets   []*net.IPNet
+	deniedDIDs   map[string]bool
+}
+
+// NewPolicy loads a policy from the given files, any of which may be empty.
+func NewPolicy(denylistFile string, allowlistFile string, deniedPeersFile string) (*Policy, error) {
+	p := &Policy{
+		denylistFile:    denylistFile,
+		allowlistFile:   allowlistFile,
+		deniedPeersFile: deniedPeersFile,
+		stats:           stats.GLOBAL_STATS.WithContext(policyStatsContext),
+		sessions:        util.NewSynchronizedMap[string, bool](),
+	}
+	if err := p.Reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Reload re-reads the policy files, keeping the current policy if any of them is invalid.
+func (p *Policy) Reload() error {
+	if p == nil {
+		return nil
+	}
+
+	deniedHashes := make(map[string]bool)
+	if err := readLines(p.denylistFile, true, func(line string) error {
+		if hash, ok := parseDenylistEntry(line); ok {
+			deniedHashes[hash] = true
+		}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("loading denylist: %w", err)
+	}
+
+	var allowedRoots map[string]bool
+	if p.allowlistFile != "" {
+		allowedRoots = make(map[string]bool)
+		if err := readLines(p.allowlistFile, false, func(line string) error {
+			cid, err := gocid.Parse(strings.TrimPrefix(line, "/ipfs/"))
+			if err != nil {
+				return err
+			}
+			allowedRoots[doubleHash(cid)] = true
+			return nil
+		}); err != nil {
+			return fmt.Errorf("loading allowlist: %w", err)
+		}
+	}
+
+	var deniedNets []*net.IPNet
+	deniedDIDs := make(map[string]bool)
+	if err := readLines(p.deniedPeersFile, false, func(line string) error {
+		switch {
+		case strings.HasPrefix(line, "did:"):
+			deniedDIDs[line] = true
+		case strings.Contains(line, "/"):
+			_, ipNet, err := net.ParseCIDR(line)
+			if err != nil {
+				return err
+			}
+			deniedNets = append(deniedNets, ipNet)
+		default:
+			ip := net.ParseIP(line)
+			if ip == nil {
+				return fmt.Errorf("invalid peer %q", line)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			deniedNets = append(deniedNets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("loading denied peers: %w", err)
+	}
+
+	p.mu.Lock()
+	p.deniedHashes = deniedHashes
+	p.allowedRoots = allowedRoots
+	p.deniedNets = deniedNets
+	p.deniedDIDs = deniedDIDs
+	p.mu.Unlock()
+
+	log.Debugw("policy loaded", "object", "Policy", "method", "Reload", "denied", len(deniedHashes), "allowed", len(allowedRoots), "deniedNets", len(deniedNets), "deniedDIDs", len(deniedDIDs))
+	return nil
+}
+
+// readLines calls fn with each trimmed, non blank, non comment line of the file at path.
+// An empty path has no lines. If header is true, lines before a `---` line are skipped.
+func readLines(path string, header bool, fn func(string) error) error {
+	if path == "" {
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if header && line == "---" {
+			lines = lines[:0]
+			continue
+		}
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "!") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	for _, line := range lines {
+		if err := fn(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseDenylistEntry returns the double hash a denylist line blocks.
+func parseDenylistEntry(line string) (string, bool) {
+	if strings.HasPrefix(line, "//") {
+		hash := strings.ToLower(strings.TrimPrefix(line, "//"))
+		if _, err := hex.DecodeString(hash); err != nil || len(hash) != 2*sha256.Size {
+			return "", false
+		}
+		return hash, true
+	}
+
+	line = strings.TrimPrefix(line, "/ipfs/")
+	if strings.Contains(line, "/") {
+		// Path entries block content within a DAG, which we can't express for whole blocks.
+		return "", false
+	}
+	cid, err := gocid.Parse(line)
+	if err != nil {
+		return "", false
+	}
+	return doubleHash(cid), true
+}
+
+// doubleHash returns the hex sha256 of the base32 CIDv1 followed by "/", as used by denylists.
+func doubleHash(cid gocid.Cid) string {
+	v1 := gocid.NewCidV1(cid.Type(), cid.Hash())
+	s, _ := v1.StringOfBase(multibase.Base32)
+	sum := sha256.Sum256([]byte(s + "/"))
+	return hex.EncodeToString(sum[:])
+}
+
+// IsDenied reports whether cid is on the denylist.
+func (p *Policy) IsDenied(cid gocid.Cid) bool {
+	if p == nil {
+		return false
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if len(p.deniedHashes) == 0 {
+		return false
+	}
+	return p.deniedHashes[doubleHash(cid)]
+}
+
+// IsRootAllowed reports whether a session may start from root.
+func (p *Policy) IsRootAllowed(root gocid.Cid) bool {
+	if p == nil {
+		return true
+	}
+	hash := doubleHash(root)
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.deniedHashes[hash] {
+		return false
+	}
+	return p.allowedRoots == nil || p.allowedRoots[hash]
+}
+
+// restrictsRoots reports whether any roots are denied or an allowlist is set.
+func (p *Policy) restrictsRoots() bool {
+	if p == nil {
+		return false
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return len(p.deniedHashes) > 0 || p.allowedRoots != nil
+}
+
+// IsPeerDenied reports whether the request comes from a denied address or is made with a UCAN issued by a denied DID,
+// or delegated through a proof issued by one.
+func (p *Policy) IsPeerDenied(r *http.Request) bool {
+	if p == nil {
+		return false
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		for _, ipNet := range p.deniedNets {
+			if ipNet.Contains(ip) {
+				return true
+			}
+		}
+	}
+
+	if len(p.deniedDIDs) > 0 {
+		if token := bearerToken(r); token != "" {
+			if u, err := ParseUCAN(token); err == nil && p.deniesIssuer(u) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// deniesIssuer reports whether u, or any proof in its chain, is issued by a denied DID. p.mu must be held.
+func (p *Policy) deniesIssuer(u *UCAN) bool {
+	if p.deniedDIDs[u.Payload.Iss] {
+		return true
+	}
+	for _, proof := range u.Proofs {
+		if p.deniesIssuer(proof) {
+			return true
+		}
+	}
+	return false
+}
+
+// countDenied records a denial in the policy stats.
+func (p *Policy) countDenied(event string) {
+	if p != nil {
+		p.stats.Log(event)
+	}
+}
+
+// Wrap returns a remote protocol handler that turns away denied peers, and sessions starting from roots that aren't allowed.
+// can is the capability the handler serves and cookie the name of the session cookie it issues, or empty if it
+// starts no session. Only a cookie for a session whose first request passed skips the roots check,
+// as the server starts a new session for any token it doesn't know.
+func (p *Policy) Wrap(next http.HandlerFunc, can string, cookie string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if p.IsPeerDenied(r) {
+			log.Debugw("peer denied", "object", "Policy", "method", "Wrap", "remote", r.RemoteAddr)
+			p.countDenied("denied.peers")
+			http.Error(w, "peer denied", http.StatusForbidden)
+			return
+		}
+
+		if cookie != "" {
+			if c, err := r.Cookie(cookie); err == nil {
+				if _, ok := p.sessions.Get(c.Value); ok {
+					next(w, r)
+					return
+				}
+			}
+		}
+
+		if p.restrictsRoots() {
+			roots, err := requestRoots(r, can)
+			if err != nil {
+				http.Error(w, "bad message format", http.StatusBadRequest)
+				return
+			}
+			for _, root := range roots {
+				if !p.IsRootAllowed(root) {
+					log.Debugw("root denied", "object", "Policy", "method", "Wrap", "root", root)
+					p.countDenied("denied.roots")
+					http.Error(w, fmt.Sprintf("root %s denied", root), http.StatusForbidden)
+					return
+				}
+			}
+		}
+
+		next(w, r)
+
+		// Remember the session the handler just created.
+		for _, c := range (&http.Response{Header: w.Header()}).Cookies() {
+			if cookie != "" && c.Name == cookie {
+				p.sessions.Add(c.Value, true)
+			}
+		}
+	}
+}
+
+// reap forgets the sessions that have ended, so their tokens are checked again if they come back.
+// running reports whether the server still runs the session with a token.
+func (p *Policy) reap(running func(token string) bool) {
+	if p == nil {
+		return
+	}
+	for _, id := range p.sessions.Keys() {
+		if !running(id) {
+			p.sessions.Remove(id)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package carmirror
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	cmbatch "github.com/fission-codes/go-car-mirror/batch"
+	cmipld "github.com/fission-codes/go-car-mirror/ipld"
+	"github.com/fission-codes/go-car-mirror/messages"
+	"github.com/ipfs/boxo/ipld/merkledag"
+	gocid "github.com/ipfs/go-cid"
+)
+
+func TestPolicy(t *testing.T) {
+	plain := gocid.MustParse("QmWXCR7ZwcQpvzJA5fjkQMJTe2rwJgYUtoSxBXFZ3uBY1W")
+	hashed := gocid.MustParse("bafyreiabvqm2pj3jfsffymh5zqhdkfffmjq5gy7mxjvvvdrgpyqj7lzy6q")
+	allowed := gocid.MustParse("bafkqaaa")
+
+	dir := t.TempDir()
+	write := func(name string, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	deny := write("deny.txt", "version: 1\n---\n# blocked\n/ipfs/"+plain.String()+"\n//"+doubleHash(hashed)+"\n/ipfs/"+allowed.String()+"/some/path\n")
+	allow := write("allow.txt", allowed.String()+"\n"+plain.String()+"\n")
+	peers := write("peers.txt", "10.0.0.0/8\n192.0.2.1\ndid:key:z6MkDenied\n")
+
+	p, err := NewPolicy(deny, allow, peers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !p.IsDenied(plain) || !p.IsDenied(hashed) {
+		t.Errorf("expected listed CIDs to be denied")
+	}
+	if p.IsDenied(allowed) {
+		t.Errorf("expected path entries to be ignored")
+	}
+	if !p.IsRootAllowed(allowed) {
+		t.Errorf("expected allowlisted root to be allowed")
+	}
+	if p.IsRootAllowed(plain) {
+		t.Errorf("expected denied root to be refused even if allowlisted")
+	}
+	if p.IsRootAllowed(hashed) {
+		t.Errorf("expected root missing from allowlist to be refused")
+	}
+
+	for addr, denied := range map[string]bool{"10.1.2.3:4000": true, "192.0.2.1:4000": true, "192.0.2.2:4000": false} {
+		r := httptest.NewRequest("POST", "/dag/cm/blocks", nil)
+		r.RemoteAddr = addr
+		if p.IsPeerDenied(r) != denied {
+			t.Errorf("expected %s denied to be %v", addr, denied)
+		}
+	}
+
+	// Reloading picks up edits
+	write("deny.txt", "")
+	if err := p.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if p.IsDenied(plain) {
+		t.Errorf("expected reloaded denylist to be empty")
+	}
+
+	// A nil policy allows everything
+	var none *Policy
+	if none.IsDenied(plain) || !none.IsRootAllowed(hashed) {
+		t.Errorf("expected nil policy to allow everything")
+	}
+}
+
+func TestPolicyDeniedProofIssuer(t *testing.T) {
+	deniedPub, deniedKey, _ := ed25519.GenerateKey(nil)
+	userPub, userKey, _ := ed25519.GenerateKey(nil)
+	serverPub, _, _ := ed25519.GenerateKey(nil)
+	userDID, serverDID := DIDFromPublicKey(userPub), DIDFromPublicKey(serverPub)
+
+	peers := filepath.Join(t.TempDir(), "peers.txt")
+	if err := os.WriteFile(peers, []byte(DIDFromPublicKey(deniedPub)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewPolicy("", "", peers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The user issues the token, with a proof issued by the denied DID.
+	capabilities := []Capability{{With: ResourceAll, Can: CapabilityPush}}
+	delegation, err := NewUCAN(deniedKey, userDID, capabilities, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	delegated, err := NewUCAN(userKey, serverDID, capabilities, time.Now().Add(time.Hour), delegation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	own, err := NewUCAN(userKey, serverDID, capabilities, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for token, denied := range map[string]bool{delegated: true, own: false} {
+		r := httptest.NewRequest("POST", "/dag/cm/blocks", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		if p.IsPeerDenied(r) != denied {
+			t.Errorf("expected token denied to be %v", denied)
+		}
+	}
+}
+
+func TestPolicySessions(t *testing.T) {
+	allowed := merkledag.NewRawNode([]byte("allowed"))
+	other := merkledag.NewRawNode([]byte("other"))
+	allow := filepath.Join(t.TempDir(), "allow.txt")
+	if err := os.WriteFile(allow, []byte(allowed.Cid().String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewPolicy("", allow, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The handler issues a session cookie on the first request, as the server does.
+	handler := p.Wrap(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := r.Cookie("sourceSessionId"); err != nil {
+			http.SetCookie(w, &http.Cookie{Name: "sourceSessionId", Value: "session"})
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}, CapabilityPull, "sourceSessionId")
+	pull := func(cookie string, id gocid.Cid) int {
+		have := cmbatch.NewBloomAllocator[cmipld.Cid](&cmbatch.Config{BloomCapacity: 1024, BloomFunction: HASH_FUNCTION})()
+		var body bytes.Buffer
+		if err := messages.NewStatusMessage[cmipld.Cid, *cmipld.Cid](have, []cmipld.Cid{cmipld.WrapCid(id)}).Write(&body); err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest(http.MethodPost, "/dag/cm/status", &body)
+		if cookie != "" {
+			r.AddCookie(&http.Cookie{Name: "sourceSessionId", Value: cookie})
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w.Code
+	}
+
+	// A cookie for a session that never passed the policy is checked like a new session.
+	if code := pull("made-up", other.Cid()); code != http.StatusForbidden {
+		t.Errorf("expected an unknown session starting from a denied root to be refused, got %d", code)
+	}
+	if code := pull("", allowed.Cid()); code != http.StatusAccepted {
+		t.Fatalf("expected a session starting from an allowed root to be accepted, got %d", code)
+	}
+	// Later rounds of a session that passed aren't checked again.
+	if code := pull("session", other.Cid()); code != http.StatusAccepted {
+		t.Errorf("expected a later round of the session to be accepted, got %d", code)
+	}
+
+	p.reap(func(string) bool { return false })
+	if code := pull("session", other.Cid()); code != http.StatusForbidden {
+		t.Errorf("expected an ended session to be checked again, got %d", code)
+	}
+}
@@ -0,0 +1,272 @@
+package carmirror
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	stats "github.com/fission-codes/go-car-mirror/stats"
+)
+
+// Largest read or write passed through a throttled body at once, so waits stay short.
+const maxThrottleChunk = 32 * 1024
+
+// ParseRate parses a human readable bandwidth such as "5MiB" or "500kB/s" into bytes per second.
+// An empty string means unlimited, which is 0.
+func ParseRate(s string) (uint64, error) {
+	s = strings.TrimSuffix(strings.TrimSpace(s), "/s")
+	if s == "" {
+		return 0, nil
+	}
+	return humanize.ParseBytes(s)
+}
+
+// RateLimiter is a token bucket limiting throughput to a number of bytes per second.
+// A nil RateLimiter does not limit.
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter creates a limiter allowing bytesPerSecond, with a burst of one second's worth.
+// It returns nil, meaning unlimited, if bytesPerSecond is 0.
+func NewRateLimiter(bytesPerSecond uint64) *RateLimiter {
+	if bytesPerSecond == 0 {
+		return nil
+	}
+	return &RateLimiter{
+		rate:   float64(bytesPerSecond),
+		burst:  float64(bytesPerSecond),
+		tokens: float64(bytesPerSecond),
+		last:   time.Now(),
+	}
+}
+
+// Rate returns the limit in bytes per second, or 0 if unlimited.
+func (l *RateLimiter) Rate() uint64 {
+	if l == nil {
+		return 0
+	}
+	return uint64(l.rate)
+}
+
+// chunk returns the largest number of bytes that should be waited for at once.
+func (l *RateLimiter) chunk() int {
+	if l == nil || l.burst >= maxThrottleChunk {
+		return maxThrottleChunk
+	}
+	return int(math.Max(1, l.burst))
+}
+
+// Wait blocks until n bytes may pass, or ctx is done.
+func (l *RateLimiter) Wait(ctx context.Context, n int) error {
+	if l == nil || n <= 0 {
+		return nil
+	}
+
+	// Reserve the tokens now, going into debt if needed, then sleep off the debt.
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if delay == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func throttleChunk(limiters []*RateLimiter) int {
+	chunk := maxThrottleChunk
+	for _, l := range limiters {
+		if c := l.chunk(); c < chunk {
+			chunk = c
+		}
+	}
+	return chunk
+}
+
+// throttledReader limits reads from a body and records the observed throughput
+// in stats once the body is exhausted or closed.
+type throttledReader struct {
+	io.ReadCloser
+	ctx      context.Context
+	limiters []*RateLimiter
+	chunk    int
+	stats    stats.Stats
+	event    string
+	start    time.Time
+	total    uint64
+	once     sync.Once
+}
+
+func newThrottledReader(ctx context.Context, body io.ReadCloser, limiters []*RateLimiter, s stats.Stats, event string) *throttledReader {
+	return &throttledReader{
+		ReadCloser: body,
+		ctx:        ctx,
+		limiters:   limiters,
+		chunk:      throttleChunk(limiters),
+		stats:      s,
+		event:      event,
+		start:      time.Now(),
+	}
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > r.chunk {
+		p = p[:r.chunk]
+	}
+	n, err := r.ReadCloser.Read(p)
+	r.total += uint64(n)
+	for _, l := range r.limiters {
+		if waitErr := l.Wait(r.ctx, n); waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+	if err == io.EOF {
+		r.record()
+	}
+	return n, err
+}
+
+func (r *throttledReader) Close() error {
+	r.record()
+	return r.ReadCloser.Close()
+}
+
+// record logs bytes and elapsed time under the same event, so throughput is Bytes / Interval.
+func (r *throttledReader) record() {
+	r.once.Do(func() {
+		if r.stats == nil {
+			return
+		}
+		r.stats.LogBytes(r.event, r.total)
+		r.stats.LogInterval(r.event, time.Since(r.start))
+	})
+}
+
+// throttledResponseWriter limits writes to a response.
+type throttledResponseWriter struct {
+	http.ResponseWriter
+	ctx      context.Context
+	limiters []*RateLimiter
+	chunk    int
+	total    uint64
+}
+
+func (w *throttledResponseWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > w.chunk {
+			n = w.chunk
+		}
+		for _, l := range w.limiters {
+			if err := l.Wait(w.ctx, n); err != nil {
+				return written, err
+			}
+		}
+		n, err := w.ResponseWriter.Write(p[:n])
+		written += n
+		w.total += uint64(n)
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// throttledTransport applies bandwidth limits to protocol requests sent to a remote,
+// and records the observed throughput against the remote's session stats.
+type throttledTransport struct {
+	base     http.RoundTripper
+	limiters func() (outbound []*RateLimiter, inbound []*RateLimiter)
+	stats    stats.Stats
+}
+
+func (t *throttledTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	outbound, inbound := t.limiters()
+
+	if r.Body != nil {
+		r = r.Clone(r.Context())
+		r.Body = newThrottledReader(r.Context(), r.Body, outbound, t.stats, "throughput.out")
+	}
+
+	resp, err := t.base.RoundTrip(r)
+	if err != nil {
+		return nil, err
+	}
+
+	resp.Body = newThrottledReader(r.Context(), resp.Body, inbound, t.stats, "throughput.in")
+	return resp, nil
+}
+
+// throttle limits the bandwidth of a remote protocol handler to the limits returned by limiters,
+// recording throughput against the server session handling the request.
+func throttle(next http.HandlerFunc, limiters func() (outbound *RateLimiter, inbound *RateLimiter), cookie string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		outbound, inbound := limiters()
+		body := newThrottledReader(r.Context(), r.Body, []*RateLimiter{inbound}, nil, "")
+		r.Body = body
+
+		writer := &throttledResponseWriter{
+			ResponseWriter: w,
+			ctx:            r.Context(),
+			limiters:       []*RateLimiter{outbound},
+			chunk:          throttleChunk([]*RateLimiter{outbound}),
+		}
+
+		start := time.Now()
+		next(writer, r)
+		elapsed := time.Since(start)
+
+		session := sessionFromRequest(w, r, cookie)
+		if session == "" {
+			return
+		}
+
+		s := stats.GLOBAL_STATS.WithContext(session)
+		s.LogBytes("throughput.in", body.total)
+		s.LogInterval("throughput.in", elapsed)
+		s.LogBytes("throughput.out", writer.total)
+		s.LogInterval("throughput.out", elapsed)
+	}
+}
+
+// sessionFromRequest returns the id of the server session a handled request belongs to,
+// from the session cookie it carried or the one the handler issued, or "" if there is none.
+func sessionFromRequest(w http.ResponseWriter, r *http.Request, cookie string) string {
+	session := ""
+	if c, err := r.Cookie(cookie); err == nil {
+		session = c.Value
+	}
+	for _, c := range (&http.Response{Header: w.Header()}).Cookies() {
+		if c.Name == cookie {
+			session = c.Value
+		}
+	}
+	return session
+}
@@ -0,0 +1,68 @@
+package carmirror
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	cmbatch "github.com/fission-codes/go-car-mirror/batch"
+)
+
+func TestParseRate(t *testing.T) {
+	cases := map[string]uint64{
+		"":        0,
+		"5MiB":    5 * 1024 * 1024,
+		"500kB/s": 500 * 1000,
+		" 1 KiB ": 1024,
+		"12345":   12345,
+	}
+	for in, want := range cases {
+		got, err := ParseRate(in)
+		if err != nil {
+			t.Errorf("ParseRate(%q) returned error %v", in, err)
+		} else if got != want {
+			t.Errorf("ParseRate(%q) = %d, want %d", in, got, want)
+		}
+	}
+
+	if _, err := ParseRate("fast"); err == nil {
+		t.Errorf("expected an error parsing an invalid rate")
+	}
+}
+
+func TestThrottledReader(t *testing.T) {
+	// 4 KiB/s with a 4 KiB burst means 12 KiB takes at least 2 seconds.
+	limiter := NewRateLimiter(4 * 1024)
+	body := io.NopCloser(bytes.NewReader(make([]byte, 12*1024)))
+	reader := newThrottledReader(context.Background(), body, []*RateLimiter{limiter, nil}, nil, "")
+
+	start := time.Now()
+	n, err := io.Copy(io.Discard, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 12*1024 {
+		t.Errorf("read %d bytes, want %d", n, 12*1024)
+	}
+	if elapsed := time.Since(start); elapsed < 1900*time.Millisecond {
+		t.Errorf("read took %v, expected it to be throttled to about 2s", elapsed)
+	}
+}
+
+func TestSessionLimiters(t *testing.T) {
+	c := NewClient(nil, cmbatch.Config{}, nil)
+	c.remoteRates = map[string]uint64{"http://remote:2503": 512}
+
+	// A rate given with a request limits only its session, and no rate keeps the configured one.
+	if outbound, _ := c.sessionLimiters("http://remote:2503", 256)(); outbound[1].Rate() != 256 {
+		t.Errorf("expected the session outbound limit to be 256, got %d", outbound[1].Rate())
+	}
+	if outbound, _ := c.limiters("http://remote:2503"); outbound[1].Rate() != 512 {
+		t.Errorf("expected the remote outbound limit to stay 512, got %d", outbound[1].Rate())
+	}
+	if outbound, _ := c.sessionLimiters("http://remote:2503", 0)(); outbound[1].Rate() != 512 {
+		t.Errorf("expected a session without a rate to keep the remote limit of 512, got %d", outbound[1].Rate())
+	}
+}
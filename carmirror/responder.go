@@ -0,0 +1,257 @@
+package carmirror
+
+import (
+	"context"
+	"sync"
+
+	cmbatch "github.com/fission-codes/go-car-mirror/batch"
+	cmcore "github.com/fission-codes/go-car-mirror/core"
+	"github.com/fission-codes/go-car-mirror/core/instrumented"
+	"github.com/fission-codes/go-car-mirror/filter"
+	cmipld "github.com/fission-codes/go-car-mirror/ipld"
+	"github.com/fission-codes/go-car-mirror/messages"
+	stats "github.com/fission-codes/go-car-mirror/stats"
+	"github.com/fission-codes/go-car-mirror/util"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Instrumentation of served sessions, as cmbatch's responders have it.
+const responderInstrument = instrumented.INSTRUMENT_ORCHESTRATOR | instrumented.INSTRUMENT_STORE
+
+// sessionEnded is told when a served session ends, whether it was cancelled and the error it ended with, if any.
+type sessionEnded func(token cmbatch.SessionId, cancelled bool, err error)
+
+// finish ends the span of a session that has finished running, and reports how it ended,
+// while the session can still be found.
+// It returns whether the session was cancelled.
+func finish(span trace.Span, token cmbatch.SessionId, state cmbatch.BatchState, done <-chan error, ended sessionEnded) bool {
+	// The session sends its error, if any, before closing the channel, and nobody else reads it.
+	err := <-done
+	cancelled := state&cmbatch.CANCELLED != 0
+	if cancelled && err == nil {
+		span.SetStatus(codes.Error, "cancelled")
+	}
+	endSpan(span, err)
+	if ended != nil {
+		ended(token, cancelled, err)
+	}
+	return cancelled
+}
+
+// servedState is what the sessions we serve have in common: whether they have ended, and how.
+type servedState struct {
+	// done is closed when the session has ended, after cancelled is set
+	done      chan struct{}
+	cancelled bool
+}
+
+// pending waits for the response to a round from next, which blocks until the session has one.
+// A cancelled session may never respond to the round in flight, so it reports false if the session is cancelled first.
+// The goroutine waiting for that response is then left waiting, one per cancelled session at most.
+func pending[M any](s *servedState, next func() M) (M, bool) {
+	responses := make(chan M, 1)
+	go func() {
+		responses <- next()
+	}()
+	select {
+	case m := <-responses:
+		return m, true
+	case <-s.done:
+		if s.cancelled {
+			var none M
+			return none, false
+		}
+		// A session that ended otherwise has responded to its last round.
+		return <-responses, true
+	}
+}
+
+// servedSink is a session a remote client is pushing to.
+type servedSink struct {
+	servedState
+	conn    *cmbatch.GenericBatchSinkConnection[cmipld.Cid, *cmipld.Cid]
+	session *SinkSession
+}
+
+// response waits for the status the session answers the round in flight with, reporting false if it is cancelled first.
+func (s *servedSink) response() (*messages.StatusMessage[cmipld.Cid, *cmipld.Cid], bool) {
+	return pending(&s.servedState, s.conn.PendingResponse)
+}
+
+// sinkResponder starts and keeps the sessions remote clients push to. It works as cmbatch.SinkResponder does,
+// but traces each session in a span of its own, which its block store calls are traced in too.
+type sinkResponder struct {
+	store cmcore.BlockStore[cmipld.Cid]
+	ended sessionEnded
+	// mu guards the settings new sessions start with, which running sessions keep a copy of
+	mu       sync.Mutex
+	config   cmbatch.Config
+	tracer   trace.Tracer
+	sessions *util.SynchronizedMap[cmbatch.SessionId, *servedSink]
+}
+
+func newSinkResponder(store cmcore.BlockStore[cmipld.Cid], config cmbatch.Config, tracer trace.Tracer, ended sessionEnded) *sinkResponder {
+	return &sinkResponder{
+		store:    store,
+		config:   config,
+		tracer:   tracer,
+		ended:    ended,
+		sessions: util.NewSynchronizedMap[cmbatch.SessionId, *servedSink](),
+	}
+}
+
+// get returns the session with token, starting one if there is none. ctx holds the span of the round that asks,
+// which the trace of a new session continues from.
+func (sr *sinkResponder) get(ctx context.Context, token cmbatch.SessionId) *servedSink {
+	return sr.sessions.GetOrInsert(token, func() *servedSink {
+		return sr.start(ctx, token)
+	})
+}
+
+// find returns the running session with token, without starting one.
+func (sr *sinkResponder) find(token cmbatch.SessionId) (*servedSink, bool) {
+	return sr.sessions.Get(token)
+}
+
+func (sr *sinkResponder) ids() []cmbatch.SessionId {
+	return sr.sessions.Keys()
+}
+
+func (sr *sinkResponder) setConfig(config cmbatch.Config) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	sr.config = config
+}
+
+func (sr *sinkResponder) setTracer(tracer trace.Tracer) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	sr.tracer = tracer
+}
+
+// settings returns the settings a new session starts with.
+func (sr *sinkResponder) settings() (cmbatch.Config, trace.Tracer) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	return sr.config, sr.tracer
+}
+
+func (sr *sinkResponder) start(ctx context.Context, token cmbatch.SessionId) *servedSink {
+	config, tracer := sr.settings()
+	ctx, span := tracer.Start(ctx, "carmirror.serve.push", trace.WithAttributes(attribute.String("carmirror.session", string(token))))
+
+	conn := cmbatch.NewGenericBatchSinkConnection[cmipld.Cid, *cmipld.Cid](stats.GLOBAL_STATS, responderInstrument, config.MaxBlocksPerRound, false)
+	session := conn.Session(
+		&tracingStore{BlockStore: sr.store, tracer: tracer, session: ctx},
+		// The accumulator locks around its filter, so the filter needn't be synchronized.
+		cmcore.NewSimpleStatusAccumulator(cmbatch.NewBloomAllocator[cmipld.Cid](&config)()),
+		false, // Not a requester
+	)
+	sender := conn.Sender(conn.DeferredSender())
+	served := &servedSink{servedState: servedState{done: make(chan struct{})}, conn: conn, session: session}
+
+	go func() {
+		session.Run(sender)
+		served.cancelled = finish(span, token, session.Info().State, session.Done(), sr.ended)
+		sr.sessions.Remove(token)
+		close(served.done)
+	}()
+	<-session.Started()
+
+	return served
+}
+
+// servedSource is a session a remote client is pulling from.
+type servedSource struct {
+	servedState
+	conn    *cmbatch.GenericBatchSourceConnection[cmipld.Cid, *cmipld.Cid]
+	session *SourceSession
+}
+
+// response waits for the blocks the session answers the round in flight with, reporting false if it is cancelled first.
+func (s *servedSource) response() (*messages.BlocksMessage[cmipld.Cid, *cmipld.Cid], bool) {
+	return pending(&s.servedState, s.conn.PendingResponse)
+}
+
+// sourceResponder starts and keeps the sessions remote clients pull from, as sinkResponder does for pushes.
+type sourceResponder struct {
+	store cmcore.BlockStore[cmipld.Cid]
+	ended sessionEnded
+	// mu guards the settings new sessions start with, which running sessions keep a copy of
+	mu       sync.Mutex
+	config   cmbatch.Config
+	tracer   trace.Tracer
+	sessions *util.SynchronizedMap[cmbatch.SessionId, *servedSource]
+}
+
+func newSourceResponder(store cmcore.BlockStore[cmipld.Cid], config cmbatch.Config, tracer trace.Tracer, ended sessionEnded) *sourceResponder {
+	return &sourceResponder{
+		store:    store,
+		config:   config,
+		tracer:   tracer,
+		ended:    ended,
+		sessions: util.NewSynchronizedMap[cmbatch.SessionId, *servedSource](),
+	}
+}
+
+// get returns the session with token, starting one if there is none, as for sinkResponder.get.
+func (sr *sourceResponder) get(ctx context.Context, token cmbatch.SessionId) *servedSource {
+	return sr.sessions.GetOrInsert(token, func() *servedSource {
+		return sr.start(ctx, token)
+	})
+}
+
+// find returns the running session with token, without starting one.
+func (sr *sourceResponder) find(token cmbatch.SessionId) (*servedSource, bool) {
+	return sr.sessions.Get(token)
+}
+
+func (sr *sourceResponder) ids() []cmbatch.SessionId {
+	return sr.sessions.Keys()
+}
+
+func (sr *sourceResponder) setConfig(config cmbatch.Config) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	sr.config = config
+}
+
+func (sr *sourceResponder) setTracer(tracer trace.Tracer) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	sr.tracer = tracer
+}
+
+// settings returns the settings a new session starts with.
+func (sr *sourceResponder) settings() (cmbatch.Config, trace.Tracer) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	return sr.config, sr.tracer
+}
+
+func (sr *sourceResponder) start(ctx context.Context, token cmbatch.SessionId) *servedSource {
+	config, tracer := sr.settings()
+	ctx, span := tracer.Start(ctx, "carmirror.serve.pull", trace.WithAttributes(attribute.String("carmirror.session", string(token))))
+
+	conn := cmbatch.NewGenericBatchSourceConnection[cmipld.Cid, *cmipld.Cid](stats.GLOBAL_STATS, responderInstrument, config.MaxBlocksPerRound, config.MaxBlocksPerColdCall, false)
+	session := conn.Session(
+		&tracingStore{BlockStore: sr.store, tracer: tracer, session: ctx},
+		// The source session doesn't lock around its filter.
+		filter.NewSynchronizedFilter[cmipld.Cid](cmbatch.NewBloomAllocator[cmipld.Cid](&config)()),
+		false, // Not a requester
+	)
+	sender := conn.Sender(conn.DeferredBatchSender(), config.MaxBlocksPerRound)
+	served := &servedSource{servedState: servedState{done: make(chan struct{})}, conn: conn, session: session}
+
+	go func() {
+		session.Run(sender)
+		served.cancelled = finish(span, token, session.Info().State, session.Done(), sr.ended)
+		sr.sessions.Remove(token)
+		close(served.done)
+	}()
+	<-session.Started()
+
+	return served
+}
@@ -0,0 +1,355 @@
+package carmirror
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ipfs/boxo/coreiface/options"
+	gocid "github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// Scheduled jobs and their runs are kept under this prefix in the datastore, by name.
+var schedulePrefix = datastore.NewKey("/carmirror/schedules")
+
+// How long a scheduled run may take, after which it fails.
+const scheduleTimeout = 6 * time.Hour
+
+// How many of a job's most recent runs are kept.
+const scheduleRunsKept = 10
+
+var errUnknownSchedule = fmt.Errorf("unknown schedule")
+
+// Schedule pushes or pulls roots with a remote on a cron schedule.
+type Schedule struct {
+	Name string
+	// Cron is when the job runs, as five cron fields or a descriptor such as @hourly or @every 30m, in local time.
+	Cron      string
+	Direction string
+	Remote    string
+	// Cid is the root to push or pull.
+	Cid string `json:",omitempty"`
+	// Pins pushes every recursive pin instead of Cid.
+	Pins bool `json:",omitempty"`
+}
+
+// Validate confirms the job is complete, and returns its parsed cron spec.
+func (s *Schedule) Validate() (*cronSpec, error) {
+	if !mirrorNamePattern.MatchString(s.Name) {
+		return nil, fmt.Errorf("schedule name %q must be letters, digits, '.', '_' or '-'", s.Name)
+	}
+	spec, err := parseCron(s.Cron)
+	if err != nil {
+		return nil, err
+	}
+	if s.Direction != DirectionPush && s.Direction != DirectionPull {
+		return nil, fmt.Errorf("schedule %s: direction %q must be push or pull", s.Name, s.Direction)
+	}
+	if s.Remote == "" {
+		return nil, fmt.Errorf("schedule %s: a remote is required", s.Name)
+	}
+	switch {
+	case s.Pins && s.Direction == DirectionPull:
+		return nil, fmt.Errorf("schedule %s: only pushes can send every pin", s.Name)
+	case s.Pins && s.Cid != "":
+		return nil, fmt.Errorf("schedule %s: give a cid or pins, not both", s.Name)
+	case !s.Pins:
+		if _, err := gocid.Parse(s.Cid); err != nil {
+			return nil, fmt.Errorf("schedule %s: cid %q: %w", s.Name, s.Cid, err)
+		}
+	}
+	return spec, nil
+}
+
+// ScheduleRun is the outcome of one run of a job.
+type ScheduleRun struct {
+	Started time.Time
+	Ended   time.Time
+	// Roots is how many roots were transferred, which for pins is every recursive pin.
+	Roots int
+	// Error is why the run failed, empty if it succeeded.
+	Error string `json:",omitempty"`
+}
+
+// ScheduleStatus describes a job, its recent runs, newest first, and when it next runs.
+type ScheduleStatus struct {
+	Schedule
+	Next    time.Time
+	Running bool
+	Runs    []ScheduleRun
+}
+
+// Schedules runs jobs when their cron schedule says, persisting them and their runs to a datastore if there is one.
+// Runs missed while the daemon was stopped are skipped.
+type Schedules struct {
+	ds datastore.Datastore
+	// run carries out a job, returning how many roots it transferred
+	run func(ctx context.Context, s Schedule) (int, error)
+	// now is the clock, replaced in tests
+	now func() time.Time
+
+	mu    sync.Mutex
+	jobs  map[string]*scheduledJob
+	wake  chan struct{}
+	runWg sync.WaitGroup
+}
+
+type scheduledJob struct {
+	status ScheduleStatus
+	spec   *cronSpec
+}
+
+// NewSchedules creates the scheduler for jobs added earlier, which are read from ds if it isn't nil.
+func NewSchedules(ctx context.Context, ds datastore.Datastore, run func(ctx context.Context, s Schedule) (int, error)) (*Schedules, error) {
+	s := &Schedules{
+		ds:   ds,
+		run:  run,
+		now:  time.Now,
+		jobs: make(map[string]*scheduledJob),
+		wake: make(chan struct{}, 1),
+	}
+	if ds == nil {
+		return s, nil
+	}
+
+	results, err := ds.Query(ctx, dsq.Query{Prefix: schedulePrefix.String()})
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+
+	now := s.now()
+	for result := range results.Next() {
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		var status ScheduleStatus
+		if err := json.Unmarshal(result.Value, &status); err != nil {
+			log.Debugw("skipping unreadable schedule", "object", "Schedules", "method", "NewSchedules", "key", result.Key, "error", err)
+			continue
+		}
+		spec, err := status.Validate()
+		if err != nil {
+			log.Debugw("skipping invalid schedule", "object", "Schedules", "method", "NewSchedules", "key", result.Key, "error", err)
+			continue
+		}
+		// A run interrupted by the daemon stopping isn't running any more.
+		status.Running = false
+		status.Next = spec.next(now)
+		s.jobs[status.Name] = &scheduledJob{status: status, spec: spec}
+	}
+	return s, nil
+}
+
+// save persists a job's status. It must be called holding mu.
+func (s *Schedules) save(ctx context.Context, status *ScheduleStatus) {
+	if s.ds == nil {
+		return
+	}
+	b, err := json.Marshal(status)
+	if err == nil {
+		err = s.ds.Put(ctx, schedulePrefix.ChildString(status.Name), b)
+	}
+	if err != nil {
+		log.Errorw("could not save schedule", "object", "Schedules", "method", "save", "schedule", status.Name, "error", err)
+	}
+}
+
+// List returns the jobs and their recent runs, by name.
+func (s *Schedules) List() []ScheduleStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	statuses := make([]ScheduleStatus, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		statuses = append(statuses, job.copy())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+func (j *scheduledJob) copy() ScheduleStatus {
+	c := j.status
+	c.Runs = append([]ScheduleRun(nil), j.status.Runs...)
+	return c
+}
+
+// Add adds a job, which first runs at the next time its schedule matches.
+func (s *Schedules) Add(ctx context.Context, schedule Schedule) (ScheduleStatus, error) {
+	spec, err := schedule.Validate()
+	if err != nil {
+		return ScheduleStatus{}, err
+	}
+
+	s.mu.Lock()
+	if _, ok := s.jobs[schedule.Name]; ok {
+		s.mu.Unlock()
+		return ScheduleStatus{}, fmt.Errorf("schedule %s already exists", schedule.Name)
+	}
+	job := &scheduledJob{status: ScheduleStatus{Schedule: schedule, Next: spec.next(s.now())}, spec: spec}
+	s.jobs[schedule.Name] = job
+	s.save(ctx, &job.status)
+	added := job.copy()
+	s.mu.Unlock()
+
+	// The new job may be due before the one run is waiting for.
+	s.Wake()
+	return added, nil
+}
+
+// Remove removes a job. A run in progress carries on, but isn't recorded.
+func (s *Schedules) Remove(ctx context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.jobs[name]; !ok {
+		return errUnknownSchedule
+	}
+	delete(s.jobs, name)
+	if s.ds != nil {
+		if err := s.ds.Delete(ctx, schedulePrefix.ChildString(name)); err != nil {
+			log.Errorw("could not delete schedule", "object", "Schedules", "method", "Remove", "schedule", name, "error", err)
+		}
+	}
+	return nil
+}
+
+// Wake asks runSchedules to look at the jobs again straight away.
+func (s *Schedules) Wake() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// RunDue starts the jobs that are due and not already running, and returns when the next job is due,
+// or the zero time if there are no jobs.
+func (s *Schedules) RunDue(ctx context.Context) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	var next time.Time
+	for _, job := range s.jobs {
+		if !job.status.Next.After(now) {
+			if job.status.Running {
+				log.Debugw("skipping run, the last is still running", "object", "Schedules", "method", "RunDue", "schedule", job.status.Name)
+			} else {
+				job.status.Running = true
+				s.runWg.Add(1)
+				go s.runJob(ctx, job, job.status.Schedule)
+			}
+			// The next run is counted from now, so runs missed while busy aren't made up.
+			job.status.Next = job.spec.next(now)
+			s.save(ctx, &job.status)
+		}
+		if next.IsZero() || job.status.Next.Before(next) {
+			next = job.status.Next
+		}
+	}
+	return next
+}
+
+func (s *Schedules) runJob(ctx context.Context, job *scheduledJob, schedule Schedule) {
+	defer s.runWg.Done()
+
+	log.Debugw("running schedule", "object", "Schedules", "method", "runJob", "schedule", schedule.Name)
+	run := ScheduleRun{Started: s.now()}
+	runCtx, cancel := context.WithTimeout(ctx, scheduleTimeout)
+	roots, err := s.run(runCtx, schedule)
+	cancel()
+	run.Ended, run.Roots = s.now(), roots
+	if err != nil {
+		run.Error = err.Error()
+		log.Warnw("scheduled run failed", "object", "Schedules", "method", "runJob", "schedule", schedule.Name, "error", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job.status.Running = false
+	// The job may have been removed while it ran.
+	if current, ok := s.jobs[schedule.Name]; !ok || current != job {
+		return
+	}
+	job.status.Runs = append([]ScheduleRun{run}, job.status.Runs...)
+	if len(job.status.Runs) > scheduleRunsKept {
+		job.status.Runs = job.status.Runs[:scheduleRunsKept]
+	}
+	// Record runs cut short by shutdown, but save them under a context that is still live.
+	s.save(context.Background(), &job.status)
+}
+
+// Wait waits for runs in progress to return, which they do once the context given to RunDue is done.
+func (s *Schedules) Wait() {
+	s.runWg.Wait()
+}
+
+// runSchedules runs jobs as they fall due, until ctx is done, then waits for the runs in progress to stop.
+func (s *Schedules) runSchedules(ctx context.Context) {
+	defer s.Wait()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		case <-s.wake:
+			if !timer.Stop() {
+				<-timer.C
+			}
+		}
+
+		// With no jobs, sleep until one is added.
+		wait := 24 * time.Hour
+		if next := s.RunDue(ctx); !next.IsZero() {
+			wait = next.Sub(s.now())
+		}
+		timer.Reset(wait)
+	}
+}
+
+// scheduledSync carries out a scheduled job in a session of its own, waiting for the session to finish.
+func (cm *CarMirror) scheduledSync(ctx context.Context, s Schedule) (int, error) {
+	if cm.closing.Load() {
+		return 0, errClosing
+	}
+
+	var roots []gocid.Cid
+	if s.Pins {
+		pins, err := cm.capi.Pin().Ls(ctx, options.Pin.Ls.Recursive())
+		if err != nil {
+			return 0, err
+		}
+		for pin := range pins {
+			if err := pin.Err(); err != nil {
+				return 0, err
+			}
+			roots = append(roots, pin.Path().Cid())
+		}
+		if len(roots) == 0 {
+			return 0, nil
+		}
+	} else {
+		root, err := gocid.Parse(s.Cid)
+		if err != nil {
+			return 0, err
+		}
+		roots = []gocid.Cid{root}
+	}
+
+	// Pulls have the one root, as only pushes can be of pins.
+	transfer := cm.pull
+	if s.Direction == DirectionPush {
+		transfer = func(ctx context.Context, remote string, rate uint64, token string, transfer string, roots []gocid.Cid) error {
+			return cm.push(ctx, remote, rate, token, transfer, roots, gocid.Undef)
+		}
+	}
+	if err := transfer(ctx, s.Remote, 0, "", "", roots); err != nil {
+		return 0, err
+	}
+	return len(roots), nil
+}
@@ -0,0 +1,179 @@
+package carmirror
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	cmipld "github.com/fission-codes/go-car-mirror/ipld"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+)
+
+func TestCron(t *testing.T) {
+	// A Wednesday.
+	from := time.Date(2023, time.March, 15, 10, 30, 0, 0, time.UTC)
+	for spec, want := range map[string]time.Time{
+		"0 2 * * *":          time.Date(2023, time.March, 16, 2, 0, 0, 0, time.UTC),
+		"@hourly":            time.Date(2023, time.March, 15, 11, 0, 0, 0, time.UTC),
+		"*/20 * * * *":       time.Date(2023, time.March, 15, 10, 40, 0, 0, time.UTC),
+		"15,45 9-17 * * 1-5": time.Date(2023, time.March, 15, 10, 45, 0, 0, time.UTC),
+		"0 0 * * 7":          time.Date(2023, time.March, 19, 0, 0, 0, 0, time.UTC),
+		"0 0 1 * 0":          time.Date(2023, time.March, 19, 0, 0, 0, 0, time.UTC),
+		"0 0 29 2 *":         time.Date(2024, time.February, 29, 0, 0, 0, 0, time.UTC),
+		"@every 90m":         from.Add(90 * time.Minute),
+	} {
+		c, err := parseCron(spec)
+		if err != nil {
+			t.Errorf("%s: %v", spec, err)
+			continue
+		}
+		if got := c.next(from); !got.Equal(want) {
+			t.Errorf("%s: expected %v, got %v", spec, want, got)
+		}
+	}
+
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "5-1 * * * *", "*/0 * * * *", "0 0 30 2 *", "@every 10s", "@often"} {
+		if _, err := parseCron(spec); err == nil {
+			t.Errorf("expected %q to be rejected", spec)
+		}
+	}
+}
+
+func TestSchedules(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+
+	var mu sync.Mutex
+	now := time.Date(2023, time.March, 15, 10, 30, 0, 0, time.Local)
+	clock := func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	advance := func(d time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		now = now.Add(d)
+	}
+
+	ran := make(chan Schedule, 10)
+	run := func(ctx context.Context, s Schedule) (int, error) {
+		ran <- s
+		if s.Name == "broken" {
+			return 0, fmt.Errorf("remote unreachable")
+		}
+		return 1, nil
+	}
+
+	s, err := NewSchedules(ctx, ds, run)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.now = clock
+
+	cid := testCid(t, "backup").String()
+	for _, bad := range []Schedule{
+		{Name: "nightly", Cron: "0 2 * *", Direction: DirectionPull, Remote: "http://backup:2503", Cid: cid},
+		{Name: "nightly", Cron: "0 2 * * *", Direction: "sync", Remote: "http://backup:2503", Cid: cid},
+		{Name: "nightly", Cron: "0 2 * * *", Direction: DirectionPull, Remote: "http://backup:2503", Pins: true},
+		{Name: "nightly", Cron: "0 2 * * *", Direction: DirectionPull, Remote: "http://backup:2503", Cid: "bafy"},
+	} {
+		if _, err := s.Add(ctx, bad); err == nil {
+			t.Errorf("expected %+v to be rejected", bad)
+		}
+	}
+
+	nightly, err := s.Add(ctx, Schedule{Name: "nightly", Cron: "0 2 * * *", Direction: DirectionPull, Remote: "http://backup:2503", Cid: cid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2023, time.March, 16, 2, 0, 0, 0, time.Local); !nightly.Next.Equal(want) {
+		t.Errorf("expected the first run at %v, got %v", want, nightly.Next)
+	}
+	if _, err := s.Add(ctx, Schedule{Name: "broken", Cron: "@hourly", Direction: DirectionPush, Remote: "http://gone:2503", Pins: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing is due yet.
+	if next := s.RunDue(ctx); next.IsZero() || !next.Equal(time.Date(2023, time.March, 15, 11, 0, 0, 0, time.Local)) {
+		t.Errorf("expected the hourly job to be next, got %v", next)
+	}
+	if len(ran) != 0 {
+		t.Fatalf("expected nothing to run")
+	}
+
+	// Both are due by 02:00, and each runs once.
+	advance(16 * time.Hour)
+	s.RunDue(ctx)
+	s.Wait()
+	if len(ran) != 2 {
+		t.Fatalf("expected both jobs to run, got %d runs", len(ran))
+	}
+
+	statuses := s.List()
+	if len(statuses) != 2 || statuses[0].Name != "broken" || statuses[1].Name != "nightly" {
+		t.Fatalf("unexpected schedules %+v", statuses)
+	}
+	if runs := statuses[0].Runs; len(runs) != 1 || runs[0].Error == "" || statuses[0].Running {
+		t.Errorf("expected the failed run to be recorded, got %+v", statuses[0])
+	}
+	if runs := statuses[1].Runs; len(runs) != 1 || runs[0].Error != "" || runs[0].Roots != 1 {
+		t.Errorf("expected the successful run to be recorded, got %+v", statuses[1])
+	}
+	if want := time.Date(2023, time.March, 17, 2, 0, 0, 0, time.Local); !statuses[1].Next.Equal(want) {
+		t.Errorf("expected the next run at %v, got %v", want, statuses[1].Next)
+	}
+
+	// Jobs and their runs survive a restart.
+	restarted, err := NewSchedules(ctx, ds, run)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statuses := restarted.List(); len(statuses) != 2 || len(statuses[1].Runs) != 1 {
+		t.Errorf("expected the jobs to be restored, got %+v", statuses)
+	}
+
+	if err := s.Remove(ctx, "broken"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Remove(ctx, "broken"); err != errUnknownSchedule {
+		t.Errorf("expected removing twice to fail, got %v", err)
+	}
+	if restarted, err = NewSchedules(ctx, ds, run); err != nil {
+		t.Fatal(err)
+	}
+	if statuses := restarted.List(); len(statuses) != 1 || statuses[0].Name != "nightly" {
+		t.Errorf("expected only nightly to remain, got %+v", statuses)
+	}
+}
+
+func TestScheduledSync(t *testing.T) {
+	ctx := context.Background()
+	cms, _ := newTestCarMirrors(t, 2)
+	if err := cms[1].StartRemote(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer cms[1].Close()
+	remote := "http://" + cms[1].RemoteAddr().String()
+
+	block, err := cmipld.TryBlockFromCBOR("scheduled")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cms[1].blockStore.Add(ctx, block); err != nil {
+		t.Fatal(err)
+	}
+
+	// The pull runs in a session of its own, and the job is told how it ended.
+	n, err := cms[0].scheduledSync(ctx, Schedule{Name: "pull", Direction: DirectionPull, Remote: remote, Cid: block.Id().String()})
+	if err != nil || n != 1 {
+		t.Fatalf("expected the job to pull its root, got %d, %v", n, err)
+	}
+	if has, _ := cms[0].blockStore.Has(ctx, block.Id()); !has {
+		t.Errorf("expected the block to have been pulled")
+	}
+}
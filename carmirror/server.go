@@ -0,0 +1,448 @@
+package carmirror
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	cmbatch "github.com/fission-codes/go-car-mirror/batch"
+	cmcore "github.com/fission-codes/go-car-mirror/core"
+	cmerrors "github.com/fission-codes/go-car-mirror/errors"
+	cmhttp "github.com/fission-codes/go-car-mirror/http"
+	cmipld "github.com/fission-codes/go-car-mirror/ipld"
+	"github.com/fission-codes/go-car-mirror/messages"
+	"github.com/fission-codes/go-car-mirror/util"
+	gocid "github.com/ipfs/go-cid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// hasQueryPath is where the remote server answers which of a list of blocks it has.
+	hasQueryPath = "/dag/cm/has"
+	// maxHasQuery is how many blocks one has query may ask about.
+	maxHasQuery = 4096
+)
+
+// hasQuery asks which of Cids, blocks of the DAG under Root, the remote server has.
+// Root is what policy and UCANs are checked against, as for the root of a push.
+type hasQuery struct {
+	Root string
+	Cids []string
+}
+
+// hasResponse answers a has query, with whether each block asked about is held, in the order asked.
+type hasResponse struct {
+	Have []bool
+}
+
+// Server is a CAR Mirror protocol server.
+// It follows cmhttp.Server, but keeps the responders so that the sessions we serve can be closed and cancelled,
+// which cmhttp.Server keeps to itself, and traced.
+type Server struct {
+	store cmcore.BlockStore[cmipld.Cid]
+	// ended, if set before serving, is told when each session ends
+	ended sessionEnded
+	// answersAll, if set before serving, reports whether a has query may be told about blocks outside the DAG
+	// under its root. Unset, it may not.
+	answersAll      func(r *http.Request) bool
+	sinkResponder   *sinkResponder
+	sourceResponder *sourceResponder
+	// Sessions that have been cancelled, whose client is turned away on its next request
+	// rather than the responder starting a new session with the same token, with when they were cancelled.
+	cancelled *util.SynchronizedMap[cmbatch.SessionId, time.Time]
+	// The blocks found under the roots of recent has queries, by root
+	hasScopes *util.SynchronizedMap[gocid.Cid, *hasScope]
+}
+
+// How long the token of a cancelled session is remembered for a client that doesn't come back to be turned away.
+const cancelledTokenTTL = time.Hour
+
+// How long the blocks found under a root are kept once no has query asks about it.
+// An estimate asks about a DAG in one go, and pushes made since may have added blocks the scope hasn't reached.
+const hasScopeTTL = time.Minute
+
+// hasScope is the part of the DAG under a root that has queries have reached, kept between queries so the DAG is
+// followed once, as far as the blocks asked about, rather than walked again for every query.
+type hasScope struct {
+	mu sync.Mutex
+	// Blocks reached by following links from the root through held blocks
+	reached map[gocid.Cid]bool
+	// Reached blocks whose links haven't been followed yet, breadth first
+	pending []gocid.Cid
+	used    time.Time
+}
+
+// NewServer creates a CAR Mirror protocol server for the sessions remote clients start.
+// Sessions are traced with the global tracer provider unless SetTracer is called before serving.
+func NewServer(store cmcore.BlockStore[cmipld.Cid], config cmbatch.Config) *Server {
+	srv := &Server{
+		store:     store,
+		cancelled: util.NewSynchronizedMap[cmbatch.SessionId, time.Time](),
+		hasScopes: util.NewSynchronizedMap[gocid.Cid, *hasScope](),
+	}
+	tracer := otel.Tracer(tracerName)
+	srv.sinkResponder = newSinkResponder(store, config, tracer, srv.sessionEnded)
+	srv.sourceResponder = newSourceResponder(store, config, tracer, srv.sessionEnded)
+	return srv
+}
+
+func (srv *Server) sessionEnded(token cmbatch.SessionId, cancelled bool, err error) {
+	if srv.ended != nil {
+		srv.ended(token, cancelled, err)
+	}
+}
+
+// SetTracer changes the tracer the sessions started from now on are traced with.
+func (srv *Server) SetTracer(tracer trace.Tracer) {
+	srv.sinkResponder.setTracer(tracer)
+	srv.sourceResponder.setTracer(tracer)
+}
+
+// SetConfig changes the batch settings of the sessions remote clients start from now on.
+// Running sessions carry on with the settings they started with.
+func (srv *Server) SetConfig(config cmbatch.Config) {
+	srv.sinkResponder.setConfig(config)
+	srv.sourceResponder.setConfig(config)
+}
+
+// reap forgets the tokens of sessions cancelled longer ago than cancelledTokenTTL, whose clients never came back,
+// and the has scopes no query has used for hasScopeTTL.
+func (srv *Server) reap() {
+	for _, token := range srv.cancelled.Keys() {
+		if at, ok := srv.cancelled.Get(token); ok && time.Since(at) > cancelledTokenTTL {
+			srv.cancelled.Remove(token)
+		}
+	}
+	for _, root := range srv.hasScopes.Keys() {
+		if scope, ok := srv.hasScopes.Get(root); ok {
+			scope.mu.Lock()
+			expired := time.Since(scope.used) > hasScopeTTL
+			scope.mu.Unlock()
+			if expired {
+				srv.hasScopes.Remove(root)
+			}
+		}
+	}
+}
+
+func generateToken() cmbatch.SessionId {
+	// Session tokens are just 128 bit random numbers
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		panic(err)
+	}
+	return cmbatch.SessionId(base64.URLEncoding.EncodeToString(token))
+}
+
+// sessionToken returns the session token from the cookie, issuing a new one if there is no cookie.
+// It reports false, having written an error response, if the request can't continue.
+func (srv *Server) sessionToken(w http.ResponseWriter, r *http.Request, cookie string) (cmbatch.SessionId, bool) {
+	c, err := r.Cookie(cookie)
+	if err != nil {
+		if !errors.Is(err, http.ErrNoCookie) {
+			log.Errorw("could not retrieve cookie", "object", "Server", "method", "sessionToken", "error", err)
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return "", false
+		}
+		token := generateToken()
+		http.SetCookie(w, &http.Cookie{
+			Name:     cookie,
+			Value:    string(token),
+			SameSite: http.SameSiteDefaultMode,
+		})
+		return token, true
+	}
+
+	token := cmbatch.SessionId(c.Value)
+	if _, ok := srv.cancelled.Get(token); ok {
+		srv.cancelled.Remove(token)
+		http.Error(w, "session cancelled", http.StatusGone)
+		return "", false
+	}
+	return token, true
+}
+
+// HandleStatus serves a round of a session a remote client is pulling.
+func (srv *Server) HandleStatus(w http.ResponseWriter, r *http.Request) {
+	log.Debugw("enter", "object", "Server", "method", "HandleStatus")
+	token, ok := srv.sessionToken(w, r, "sourceSessionId")
+	if !ok {
+		return
+	}
+
+	message := messages.StatusMessage[cmipld.Cid, *cmipld.Cid]{}
+	if err := message.Read(bufio.NewReader(r.Body)); err != nil {
+		log.Errorw("parsing status message", "object", "Server", "method", "HandleStatus", "session", token, "error", err)
+		http.Error(w, "bad message format", http.StatusBadRequest)
+		return
+	}
+	r.Body.Close()
+
+	if len(message.Want) == 0 {
+		log.Debugw("received status message with no wants", "object", "Server", "method", "HandleStatus", "session", token)
+		http.Error(w, "bad message format", http.StatusBadRequest)
+		return
+	}
+
+	served := srv.sourceResponder.get(r.Context(), token)
+	if err := served.conn.Receiver(served.session).HandleStatus(message.Have.Any(), message.Want); err != nil {
+		log.Errorw("handling status message", "object", "Server", "method", "HandleStatus", "session", token, "error", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	blocks, ok := served.response()
+	if !ok {
+		http.Error(w, "session cancelled", http.StatusGone)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	if err := blocks.Write(w); err != nil {
+		log.Errorw("unexpected error writing response", "object", "Server", "method", "HandleStatus", "session", token, "error", err)
+	}
+	log.Debugw("exit", "object", "Server", "method", "HandleStatus")
+}
+
+// HandleHas answers a has query, which starts no session, so clients can find out what a push would send.
+// As the answers tell what the node holds, blocks are only said to be held if they are in the DAG under the query's root,
+// unless answersAll lets the request be told about any block.
+func (srv *Server) HandleHas(w http.ResponseWriter, r *http.Request) {
+	log.Debugw("enter", "object", "Server", "method", "HandleHas")
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var query hasQuery
+	if err := json.NewDecoder(r.Body).Decode(&query); err != nil {
+		http.Error(w, "bad message format", http.StatusBadRequest)
+		return
+	}
+	r.Body.Close()
+	if len(query.Cids) > maxHasQuery {
+		http.Error(w, fmt.Sprintf("a has query may ask about at most %d blocks", maxHasQuery), http.StatusBadRequest)
+		return
+	}
+	root, err := gocid.Parse(query.Root)
+	if err != nil {
+		http.Error(w, "a has query must name the root of the DAG it asks about", http.StatusBadRequest)
+		return
+	}
+	ids := make([]gocid.Cid, len(query.Cids))
+	for i, s := range query.Cids {
+		if ids[i], err = gocid.Parse(s); err != nil {
+			http.Error(w, fmt.Sprintf("bad CID %q", s), http.StatusBadRequest)
+			return
+		}
+	}
+
+	res := hasResponse{Have: make([]bool, len(ids))}
+	if srv.answersAll != nil && srv.answersAll(r) {
+		for i, id := range ids {
+			if res.Have[i], err = srv.store.Has(r.Context(), cmipld.WrapCid(id)); err != nil {
+				break
+			}
+		}
+	} else {
+		var under map[gocid.Cid]bool
+		if under, err = srv.heldUnder(r.Context(), root, ids); err == nil {
+			for i, id := range ids {
+				res.Have[i] = under[id]
+			}
+		}
+	}
+	if err != nil {
+		log.Errorw("could not check blocks", "object", "Server", "method", "HandleHas", "root", root, "error", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Errorw("unexpected error writing response", "object", "Server", "method", "HandleHas", "error", err)
+	}
+	log.Debugw("exit", "object", "Server", "method", "HandleHas", "blocks", len(query.Cids))
+}
+
+// heldUnder returns which of ids are held in the DAG under root. The held blocks under root are followed from where
+// earlier queries about root left off, until every block asked about is reached or there are none left to follow,
+// so a client asking about a DAG breadth first, a batch at a time, has each held block read once.
+func (srv *Server) heldUnder(ctx context.Context, root gocid.Cid, ids []gocid.Cid) (map[gocid.Cid]bool, error) {
+	scope := srv.hasScopes.GetOrInsert(root, func() *hasScope {
+		return &hasScope{reached: map[gocid.Cid]bool{root: true}, pending: []gocid.Cid{root}}
+	})
+	scope.mu.Lock()
+	defer scope.mu.Unlock()
+	scope.used = time.Now()
+
+	// The blocks asked about that haven't been reached
+	asked := make(map[gocid.Cid]bool)
+	for _, id := range ids {
+		if !scope.reached[id] {
+			asked[id] = true
+		}
+	}
+	left := len(asked)
+	for left > 0 && len(scope.pending) > 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		block, err := srv.store.Get(ctx, cmipld.WrapCid(scope.pending[0]))
+		if err == cmerrors.ErrBlockNotFound || err == ErrDeniedBlock {
+			// Blocks that aren't held, or are denied, have no links to follow.
+			scope.pending = scope.pending[1:]
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		scope.pending = scope.pending[1:]
+		for _, child := range block.Children() {
+			if c := child.Unwrap(); !scope.reached[c] {
+				scope.reached[c] = true
+				scope.pending = append(scope.pending, c)
+				if asked[c] {
+					left--
+				}
+			}
+		}
+	}
+
+	// Blocks reached may not be held, or no longer be.
+	under := make(map[gocid.Cid]bool)
+	for _, id := range ids {
+		if !scope.reached[id] {
+			continue
+		}
+		held, err := srv.store.Has(ctx, cmipld.WrapCid(id))
+		if err != nil {
+			return nil, err
+		}
+		under[id] = held
+	}
+	return under, nil
+}
+
+// HandleBlocks serves a round of a session a remote client is pushing.
+func (srv *Server) HandleBlocks(w http.ResponseWriter, r *http.Request) {
+	log.Debugw("enter", "object", "Server", "method", "HandleBlocks")
+	token, ok := srv.sessionToken(w, r, "sinkSessionId")
+	if !ok {
+		return
+	}
+
+	message := messages.BlocksMessage[cmipld.Cid, *cmipld.Cid]{}
+	if err := message.Read(bufio.NewReader(r.Body)); err != io.EOF {
+		log.Errorw("parsing blocks message", "object", "Server", "method", "HandleBlocks", "session", token, "error", err)
+		http.Error(w, "bad message format", http.StatusBadRequest)
+		return
+	}
+	r.Body.Close()
+
+	served := srv.sinkResponder.get(r.Context(), token)
+	if err := served.conn.Receiver(served.session).HandleList(message.Car.Blocks); err != nil {
+		log.Errorw("could not handle block list", "object", "Server", "method", "HandleBlocks", "session", token, "error", err)
+	}
+
+	status, ok := served.response()
+	if !ok {
+		http.Error(w, "session cancelled", http.StatusGone)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	if err := status.Write(w); err != nil {
+		log.Errorw("unexpected error writing response", "object", "Server", "method", "HandleBlocks", "session", token, "error", err)
+	}
+	log.Debugw("exit", "object", "Server", "method", "HandleBlocks")
+}
+
+func (srv *Server) SourceSessions() []cmbatch.SessionId {
+	return srv.sourceResponder.ids()
+}
+
+func (srv *Server) SinkSessions() []cmbatch.SessionId {
+	return srv.sinkResponder.ids()
+}
+
+// sourceSession returns the running source session with the given token.
+func (srv *Server) sourceSession(token cmbatch.SessionId) (*SourceSession, error) {
+	if served, ok := srv.sourceResponder.find(token); ok {
+		return served.session, nil
+	}
+	return nil, cmhttp.ErrInvalidSession
+}
+
+// sinkSession returns the running sink session with the given token.
+func (srv *Server) sinkSession(token cmbatch.SessionId) (*SinkSession, error) {
+	if served, ok := srv.sinkResponder.find(token); ok {
+		return served.session, nil
+	}
+	return nil, cmhttp.ErrInvalidSession
+}
+
+func (srv *Server) SourceInfo(token cmbatch.SessionId) (*cmcore.SourceSessionInfo[cmbatch.BatchState], error) {
+	session, err := srv.sourceSession(token)
+	if err != nil {
+		return nil, err
+	}
+	return session.Info(), nil
+}
+
+func (srv *Server) SinkInfo(token cmbatch.SessionId) (*cmcore.SinkSessionInfo[cmbatch.BatchState], error) {
+	session, err := srv.sinkSession(token)
+	if err != nil {
+		return nil, err
+	}
+	return session.Info(), nil
+}
+
+// CancelSource cancels the source session with the given token.
+func (srv *Server) CancelSource(token cmbatch.SessionId) error {
+	log.Debugw("enter", "object", "Server", "method", "CancelSource", "token", token)
+	session, err := srv.sourceSession(token)
+	if err != nil {
+		return err
+	}
+	srv.cancelled.Add(token, time.Now())
+	return session.Cancel()
+}
+
+// CancelSink cancels the sink session with the given token.
+func (srv *Server) CancelSink(token cmbatch.SessionId) error {
+	log.Debugw("enter", "object", "Server", "method", "CancelSink", "token", token)
+	session, err := srv.sinkSession(token)
+	if err != nil {
+		return err
+	}
+	srv.cancelled.Add(token, time.Now())
+	return session.Cancel()
+}
+
+// CloseSource closes the source session with the given token once the transfers in progress are done.
+func (srv *Server) CloseSource(token cmbatch.SessionId) error {
+	log.Debugw("enter", "object", "Server", "method", "CloseSource", "token", token)
+	session, err := srv.sourceSession(token)
+	if err != nil {
+		return err
+	}
+	return session.Close()
+}
+
+// CloseSink closes the sink session with the given token once the transfers in progress are done.
+func (srv *Server) CloseSink(token cmbatch.SessionId) error {
+	log.Debugw("enter", "object", "Server", "method", "CloseSink", "token", token)
+	session, err := srv.sinkSession(token)
+	if err != nil {
+		return err
+	}
+	return session.Close()
+}
@@ -0,0 +1,259 @@
+package carmirror
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	cmbatch "github.com/fission-codes/go-car-mirror/batch"
+	cmcore "github.com/fission-codes/go-car-mirror/core"
+	cmhttp "github.com/fission-codes/go-car-mirror/http"
+	cmipld "github.com/fission-codes/go-car-mirror/ipld"
+	"github.com/fission-codes/go-car-mirror/messages"
+	"github.com/ipfs/boxo/ipld/merkledag"
+	ipld "github.com/ipfs/go-ipld-format"
+	"golang.org/x/exp/slices"
+)
+
+// blockingStore holds blocks being added until release is closed, telling adding when the first arrives.
+type blockingStore struct {
+	cmcore.BlockStore[cmipld.Cid]
+	adding  chan struct{}
+	release chan struct{}
+}
+
+func (bs *blockingStore) hold() {
+	select {
+	case bs.adding <- struct{}{}:
+	default:
+	}
+	<-bs.release
+}
+
+func (bs *blockingStore) Add(ctx context.Context, block cmcore.RawBlock[cmipld.Cid]) (cmcore.Block[cmipld.Cid], error) {
+	bs.hold()
+	return bs.BlockStore.Add(ctx, block)
+}
+
+func (bs *blockingStore) AddMany(ctx context.Context, blocks []cmcore.RawBlock[cmipld.Cid]) ([]cmcore.Block[cmipld.Cid], error) {
+	bs.hold()
+	return bs.BlockStore.AddMany(ctx, blocks)
+}
+
+func TestServerCancel(t *testing.T) {
+	nodes, err := MakeAPISwarm(context.Background(), false, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &blockingStore{BlockStore: NewKuboStore(nodes[0]), adding: make(chan struct{}, 1), release: make(chan struct{})}
+	srv := NewServer(store, cmbatch.Config{
+		MaxBlocksPerRound:    10,
+		MaxBlocksPerColdCall: 10,
+		BloomFunction:        HASH_FUNCTION,
+		BloomCapacity:        1024,
+	})
+	server := httptest.NewServer(http.HandlerFunc(srv.HandleBlocks))
+	defer server.Close()
+
+	if err := srv.CancelSink("unknown"); err != cmhttp.ErrInvalidSession {
+		t.Errorf("expected ErrInvalidSession for an unknown session, got %v", err)
+	}
+	if len(srv.SinkSessions()) != 0 {
+		t.Fatalf("expected looking up an unknown session not to start one")
+	}
+
+	block, err := cmipld.TryBlockFromCBOR("a block pushed to the server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body bytes.Buffer
+	if err := messages.NewBlocksMessage[cmipld.Cid, *cmipld.Cid]([]cmcore.RawBlock[cmipld.Cid]{block}).Write(&body); err != nil {
+		t.Fatal(err)
+	}
+	message := body.Bytes()
+
+	// The round is held in the store while the session is cancelled, so it is cancelled while it runs.
+	type response struct {
+		resp *http.Response
+		err  error
+	}
+	responses := make(chan response, 1)
+	go func() {
+		resp, err := http.Post(server.URL, "application/cbor", bytes.NewReader(message))
+		responses <- response{resp, err}
+	}()
+	<-store.adding
+	tokens := srv.SinkSessions()
+	if len(tokens) != 1 {
+		t.Fatalf("expected the round's session to be running, got %v", tokens)
+	}
+	if err := srv.CancelSink(tokens[0]); err != nil {
+		t.Fatal(err)
+	}
+	close(store.release)
+
+	res := <-responses
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	res.resp.Body.Close()
+	cookies := res.resp.Cookies()
+	if res.resp.StatusCode != http.StatusGone || len(cookies) != 1 || cmbatch.SessionId(cookies[0].Value) != tokens[0] {
+		t.Fatalf("expected the round in flight to be refused with the session cookie, got %d %v", res.resp.StatusCode, cookies)
+	}
+
+	// The client is turned away, rather than a new session being started with its token.
+	req, err := http.NewRequest("POST", server.URL, bytes.NewReader(message))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.AddCookie(cookies[0])
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusGone {
+		t.Errorf("expected a cancelled session's next round to be refused, got %d", resp.StatusCode)
+	}
+
+	// Tokens of cancelled sessions whose clients never come back are forgotten in time.
+	srv.cancelled.Add(tokens[0], time.Now().Add(-2*cancelledTokenTTL))
+	srv.reap()
+	if _, ok := srv.cancelled.Get(tokens[0]); ok {
+		t.Errorf("expected the token of a long cancelled session to be forgotten")
+	}
+}
+
+func TestServerSetConfig(t *testing.T) {
+	nodes, err := MakeAPISwarm(context.Background(), false, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &blockingStore{BlockStore: NewKuboStore(nodes[0]), adding: make(chan struct{}, 1), release: make(chan struct{})}
+	config := cmbatch.Config{
+		MaxBlocksPerRound:    10,
+		MaxBlocksPerColdCall: 10,
+		BloomFunction:        HASH_FUNCTION,
+		BloomCapacity:        1024,
+	}
+	srv := NewServer(store, config)
+	server := httptest.NewServer(http.HandlerFunc(srv.HandleBlocks))
+	defer server.Close()
+
+	block, err := cmipld.TryBlockFromCBOR("a block pushed while the config changes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body bytes.Buffer
+	if err := messages.NewBlocksMessage[cmipld.Cid, *cmipld.Cid]([]cmcore.RawBlock[cmipld.Cid]{block}).Write(&body); err != nil {
+		t.Fatal(err)
+	}
+
+	statuses := make(chan int, 1)
+	go func() {
+		resp, err := http.Post(server.URL, "application/cbor", &body)
+		if err != nil {
+			t.Error(err)
+			statuses <- 0
+			return
+		}
+		resp.Body.Close()
+		statuses <- resp.StatusCode
+	}()
+	<-store.adding
+
+	changed := config
+	changed.MaxBlocksPerRound = 20
+	srv.SetConfig(changed)
+	if len(srv.SinkSessions()) != 1 {
+		t.Errorf("expected the running session to be kept when the config changes")
+	}
+	close(store.release)
+	if status := <-statuses; status != http.StatusAccepted {
+		t.Errorf("expected the running session's round to be answered, got %d", status)
+	}
+	if config, _ := srv.sinkResponder.settings(); config.MaxBlocksPerRound != 20 {
+		t.Errorf("expected new sessions to start with the new config, got %+v", config)
+	}
+}
+
+func TestServerHas(t *testing.T) {
+	ctx := context.Background()
+	nodes, err := MakeAPISwarm(ctx, false, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(NewKuboStore(nodes[0]), cmbatch.Config{
+		MaxBlocksPerRound:    10,
+		MaxBlocksPerColdCall: 10,
+		BloomFunction:        HASH_FUNCTION,
+		BloomCapacity:        1024,
+	})
+	server := httptest.NewServer(http.HandlerFunc(srv.HandleHas))
+	defer server.Close()
+
+	// The server holds a root linking to a leaf, and a block outside it.
+	root, leaf := merkledag.NodeWithData([]byte("root")), merkledag.NewRawNode([]byte("leaf"))
+	if err := root.AddNodeLink("leaf", leaf); err != nil {
+		t.Fatal(err)
+	}
+	outside := merkledag.NewRawNode([]byte("outside"))
+	if err := nodes[0].Dag().AddMany(ctx, []ipld.Node{root, leaf, outside}); err != nil {
+		t.Fatal(err)
+	}
+
+	ask := func(query hasQuery) (int, []bool) {
+		body, err := json.Marshal(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.Post(server.URL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var answer hasResponse
+		if res.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(res.Body).Decode(&answer); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return res.StatusCode, answer.Have
+	}
+	cids := []string{leaf.Cid().String(), outside.Cid().String()}
+
+	if status, _ := ask(hasQuery{Cids: cids}); status != http.StatusBadRequest {
+		t.Errorf("expected a query without a root to be refused, got %d", status)
+	}
+
+	// Only blocks under the root are said to be held.
+	if status, have := ask(hasQuery{Root: root.Cid().String(), Cids: cids}); status != http.StatusOK || !slices.Equal(have, []bool{true, false}) {
+		t.Errorf("expected only the leaf to be held, got %d %v", status, have)
+	}
+
+	// The DAG followed for the root is kept for later queries, until no query has used it for a while.
+	scope, ok := srv.hasScopes.Get(root.Cid())
+	if !ok || !scope.reached[leaf.Cid()] {
+		t.Fatalf("expected the blocks reached under the root to be kept")
+	}
+	srv.reap()
+	if _, ok := srv.hasScopes.Get(root.Cid()); !ok {
+		t.Errorf("expected a scope just used to be kept")
+	}
+	scope.used = time.Now().Add(-2 * hasScopeTTL)
+	srv.reap()
+	if _, ok := srv.hasScopes.Get(root.Cid()); ok {
+		t.Errorf("expected an unused scope to be forgotten")
+	}
+
+	// Unless the request may be told about any block.
+	srv.answersAll = func(*http.Request) bool { return true }
+	if status, have := ask(hasQuery{Root: root.Cid().String(), Cids: cids}); status != http.StatusOK || !slices.Equal(have, []bool{true, true}) {
+		t.Errorf("expected both blocks to be held, got %d %v", status, have)
+	}
+}
@@ -0,0 +1,267 @@
+package carmirror
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	cmbatch "github.com/fission-codes/go-car-mirror/batch"
+)
+
+// Session states reported by ls. Running sessions are active, closing or cancelling,
+// and ended sessions completed or failed.
+const (
+	StateActive     = "active"
+	StateClosing    = "closing"
+	StateCancelling = "cancelling"
+	StateCompleted  = "completed"
+	StateFailed     = "failed"
+)
+
+// Sides of a session. The source sends blocks and the sink receives them.
+const (
+	SideSource = "source"
+	SideSink   = "sink"
+)
+
+// SessionSummary describes a running or ended session.
+type SessionSummary struct {
+	// ID identifies the session: a token of our own for our sessions, or the session token for sessions we serve.
+	ID        string
+	Role      string
+	Side      string
+	Direction string
+	Remote    string
+	// Transfer is the id of the push or pull that started the session, if it was given one.
+	Transfer string `json:",omitempty"`
+	State    string
+	Roots    []string
+	// Pending is how many blocks are waiting to be sent or processed.
+	Pending uint
+	Rounds  uint64
+	Blocks  uint64
+	Bytes   uint64
+	Start   *time.Time `json:",omitempty"`
+	End     *time.Time `json:",omitempty"`
+	Error   string     `json:",omitempty"`
+	// key is what the client keeps our own running sessions under
+	key string
+}
+
+// SessionFilter selects sessions. Empty fields match every session.
+type SessionFilter struct {
+	State     string
+	Role      string
+	Direction string
+	Remote    string
+	Transfer  string
+}
+
+func (f SessionFilter) matches(s *SessionSummary) bool {
+	return (f.State == "" || f.State == s.State) &&
+		(f.Role == "" || f.Role == s.Role) &&
+		(f.Direction == "" || f.Direction == s.Direction) &&
+		(f.Remote == "" || f.Remote == s.Remote) &&
+		(f.Transfer == "" || f.Transfer == s.Transfer)
+}
+
+// Validate confirms the filter only names known values.
+func (f SessionFilter) Validate() error {
+	switch f.State {
+	case "", StateActive, StateClosing, StateCancelling, StateCompleted, StateFailed:
+	default:
+		return fmt.Errorf("unknown state %q", f.State)
+	}
+	switch f.Role {
+	case "", RoleClient, RoleServer:
+	default:
+		return fmt.Errorf("unknown role %q", f.Role)
+	}
+	switch f.Direction {
+	case "", DirectionPush, DirectionPull:
+	default:
+		return fmt.Errorf("unknown direction %q", f.Direction)
+	}
+	return nil
+}
+
+// sessionSide returns which side of a session in direction we are, in role.
+// We are the source of our own pushes and of the pulls we serve.
+func sessionSide(role string, direction string) string {
+	if (role == RoleClient) == (direction == DirectionPush) {
+		return SideSource
+	}
+	return SideSink
+}
+
+// runningState returns the state of a running session from its orchestrator state.
+func runningState(state cmbatch.BatchState) string {
+	switch {
+	case state&cmbatch.CANCELLED != 0:
+		return StateCancelling
+	case state&(cmbatch.SOURCE_CLOSING|cmbatch.SINK_CLOSING|cmbatch.SOURCE_CLOSED|cmbatch.SINK_CLOSED) != 0:
+		return StateClosing
+	default:
+		return StateActive
+	}
+}
+
+// summarize describes a session from its history record.
+func summarize(record HistoryRecord) SessionSummary {
+	s := SessionSummary{
+		ID:        record.Session,
+		Role:      record.Role,
+		Side:      sessionSide(record.Role, record.Direction),
+		Direction: record.Direction,
+		Remote:    record.Remote,
+		Transfer:  record.Transfer,
+		Roots:     record.Roots,
+		Rounds:    record.Rounds,
+		Blocks:    record.Blocks,
+		Bytes:     record.Bytes,
+		Error:     record.Error,
+	}
+	if !record.Start.IsZero() {
+		start := record.Start
+		s.Start = &start
+	}
+	if !record.End.IsZero() {
+		end := record.End
+		s.End = &end
+		s.State = StateCompleted
+		if record.Error != "" {
+			s.State = StateFailed
+		}
+	}
+	return s
+}
+
+// Sessions lists the running sessions and, if history is kept, those that have ended, matching f.
+// They are sorted by start time, oldest first, then by role, direction and id.
+// A max above 0 lists only the first max sessions, reading no more of the history than that needs.
+func (cm *CarMirror) Sessions(ctx context.Context, f SessionFilter, max int) ([]SessionSummary, error) {
+	sessions := cm.runningSessions(f)
+
+	// Ended sessions can't match a running state.
+	if f.State == "" || f.State == StateCompleted || f.State == StateFailed {
+		// The history is read oldest first, as sessions are sorted, so any of the first max sessions that have ended
+		// are among the first max matching records.
+		records, err := cm.history.List(ctx, HistoryQuery{
+			Direction: f.Direction,
+			Remote:    f.Remote,
+			Limit:     max,
+			Oldest:    true,
+			Match: func(record *HistoryRecord) bool {
+				s := summarize(*record)
+				return f.matches(&s)
+			},
+		})
+		if err != nil && err != errNoHistory {
+			return nil, err
+		}
+		for _, record := range records {
+			sessions = append(sessions, summarize(record))
+		}
+	}
+
+	sortSessions(sessions)
+	return sessions, nil
+}
+
+// runningSessions lists the running sessions matching f, unsorted.
+func (cm *CarMirror) runningSessions(f SessionFilter) []SessionSummary {
+	running := cm.history.runningRecords()
+	// running holds what the history knows, and the orchestrator state says where the session has got to.
+	describe := func(record HistoryRecord, state cmbatch.BatchState, pending uint) SessionSummary {
+		s := summarize(record)
+		s.State = runningState(state)
+		s.Pending = pending
+		return s
+	}
+
+	sessions := make([]SessionSummary, 0)
+	add := func(s SessionSummary) {
+		if f.matches(&s) {
+			sessions = append(sessions, s)
+		}
+	}
+
+	for _, key := range cm.client.SourceSessions() {
+		if info, err := cm.client.SourceInfo(key); err == nil {
+			record, ok := running[sessionID(DirectionPush, key)]
+			if !ok {
+				record = HistoryRecord{Session: key, Role: RoleClient, Direction: DirectionPush, Remote: sessionRemote(key)}
+			}
+			s := describe(record, info.State, info.PendingBlocksCount)
+			s.key = key
+			add(s)
+		}
+	}
+	for _, key := range cm.client.SinkSessions() {
+		if info, err := cm.client.SinkInfo(key); err == nil {
+			record, ok := running[sessionID(DirectionPull, key)]
+			if !ok {
+				record = HistoryRecord{Session: key, Role: RoleClient, Direction: DirectionPull, Remote: sessionRemote(key)}
+			}
+			s := describe(record, info.State, info.PendingBlocksCount)
+			s.key = key
+			add(s)
+		}
+	}
+
+	// Remote clients pull from our source sessions and push to our sink sessions.
+	for _, token := range cm.server.SourceSessions() {
+		if info, err := cm.server.SourceInfo(token); err == nil {
+			record, ok := running[string(token)]
+			if !ok {
+				record = HistoryRecord{Session: string(token), Role: RoleServer, Direction: DirectionPull}
+			}
+			add(describe(record, info.State, info.PendingBlocksCount))
+		}
+	}
+	for _, token := range cm.server.SinkSessions() {
+		if info, err := cm.server.SinkInfo(token); err == nil {
+			record, ok := running[string(token)]
+			if !ok {
+				record = HistoryRecord{Session: string(token), Role: RoleServer, Direction: DirectionPush}
+			}
+			add(describe(record, info.State, info.PendingBlocksCount))
+		}
+	}
+
+	return sessions
+}
+
+// sortSessions sorts sessions by start time, oldest first, then by role, direction and id.
+// Sessions whose start wasn't seen sort first.
+func sortSessions(sessions []SessionSummary) {
+	sort.SliceStable(sessions, func(i, j int) bool {
+		a, b := sessions[i], sessions[j]
+		if (a.Start == nil) != (b.Start == nil) {
+			return a.Start == nil
+		}
+		if a.Start != nil && !a.Start.Equal(*b.Start) {
+			return a.Start.Before(*b.Start)
+		}
+		if a.Role != b.Role {
+			return a.Role < b.Role
+		}
+		if a.Direction != b.Direction {
+			return a.Direction < b.Direction
+		}
+		return a.ID < b.ID
+	})
+}
+
+// paginate returns the page of sessions starting at offset, with at most limit sessions. A limit of 0 means no limit.
+func paginate(sessions []SessionSummary, offset int, limit int) []SessionSummary {
+	if offset >= len(sessions) {
+		return []SessionSummary{}
+	}
+	sessions = sessions[offset:]
+	if limit > 0 && limit < len(sessions) {
+		sessions = sessions[:limit]
+	}
+	return sessions
+}
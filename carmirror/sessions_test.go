@@ -0,0 +1,54 @@
+package carmirror
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionSummaries(t *testing.T) {
+	start := time.Now()
+	ended := summarize(HistoryRecord{
+		Session:   "token",
+		Role:      RoleServer,
+		Direction: DirectionPull,
+		Start:     start,
+		End:       start.Add(time.Second),
+		Error:     "cancelled",
+	})
+	if ended.Side != SideSource || ended.State != StateFailed {
+		t.Errorf("expected a failed source session, got %+v", ended)
+	}
+
+	pushed := summarize(HistoryRecord{Session: "http://remote:2503", Role: RoleClient, Direction: DirectionPush, Start: start})
+	pushed.State = StateActive
+	unseen := SessionSummary{ID: "unseen", Role: RoleServer, Direction: DirectionPush, State: StateActive}
+	pulled := SessionSummary{ID: "http://remote:2503", Role: RoleClient, Direction: DirectionPull, State: StateActive, Start: pushed.Start}
+
+	sessions := []SessionSummary{ended, pushed, pulled, unseen}
+	sortSessions(sessions)
+	var order []string
+	for _, s := range sessions {
+		order = append(order, s.ID+" "+s.Direction)
+	}
+	expected := []string{"unseen push", "http://remote:2503 pull", "http://remote:2503 push", "token pull"}
+	for i := range expected {
+		if order[i] != expected[i] {
+			t.Fatalf("expected order %q, got %q", expected, order)
+		}
+	}
+
+	f := SessionFilter{State: StateActive, Role: RoleClient}
+	if !f.matches(&pushed) || f.matches(&ended) || f.matches(&unseen) {
+		t.Errorf("filter %+v matched the wrong sessions", f)
+	}
+	if err := (SessionFilter{State: "running"}).Validate(); err == nil {
+		t.Errorf("expected an unknown state to be rejected")
+	}
+
+	if page := paginate(sessions, 1, 2); len(page) != 2 || page[0].ID != sessions[1].ID {
+		t.Errorf("unexpected page %+v", page)
+	}
+	if page := paginate(sessions, 10, 2); len(page) != 0 {
+		t.Errorf("expected an empty page past the end, got %+v", page)
+	}
+}
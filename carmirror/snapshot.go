@@ -0,0 +1,122 @@
+package carmirror
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/fission-codes/go-bloom"
+	cmcore "github.com/fission-codes/go-car-mirror/core"
+	cmerrors "github.com/fission-codes/go-car-mirror/errors"
+	"github.com/fission-codes/go-car-mirror/filter"
+	cmipld "github.com/fission-codes/go-car-mirror/ipld"
+	gocid "github.com/ipfs/go-cid"
+)
+
+const (
+	// FilterSnapshotVersion is the version of the filter snapshot format written.
+	FilterSnapshotVersion = 1
+	// snapshotFalsePositiveRate is the chance a block missing from a snapshot is taken to be held, and so not sent.
+	// It is far lower than the filters of a session, which are corrected as the sink reports what it wants.
+	snapshotFalsePositiveRate = 1e-9
+)
+
+// FilterSnapshot is a portable summary of the blocks a node holds under some roots, from which a source can work
+// out what to send it without reaching it. It is written as JSON, with the fields:
+//
+//	Version  the format version, FilterSnapshotVersion
+//	Roots    the roots whose DAGs the filter holds
+//	Blocks   how many blocks were added to the filter
+//	Created  when the snapshot was taken, in RFC 3339 format
+//	Filter   a Bloom filter of the blocks' CIDs in go-car-mirror's wire format: bytes, the base64 encoded bit set;
+//	         hashFunction, the ID of the registered hash function; hashCount and bitCount
+//
+// Blocks under the roots that the node doesn't hold aren't in the filter.
+//
+// A source pushing against a snapshot takes every block the filter contains to be held. With no sink to correct it,
+// a block the filter wrongly contains, with a chance of snapshotFalsePositiveRate for each block, is left out without
+// any report, along with the DAG under it. A push over the network, whose sink reports what it is missing, fills in
+// anything an export against a snapshot left out.
+type FilterSnapshot struct {
+	Version int
+	Roots   []string
+	Blocks  int
+	Created time.Time
+	Filter  *filter.BloomFilter[cmipld.Cid]
+}
+
+// ReadFilterSnapshot reads a filter snapshot, checking it is a version this node understands.
+func ReadFilterSnapshot(r io.Reader) (*FilterSnapshot, error) {
+	var snapshot FilterSnapshot
+	if err := json.NewDecoder(r).Decode(&snapshot); err != nil {
+		return nil, fmt.Errorf("bad filter snapshot: %w", err)
+	}
+	if snapshot.Version != FilterSnapshotVersion {
+		return nil, fmt.Errorf("unsupported filter snapshot version %d", snapshot.Version)
+	}
+	if snapshot.Filter == nil {
+		return nil, fmt.Errorf("bad filter snapshot: no filter")
+	}
+	return &snapshot, nil
+}
+
+// readFilterSnapshotFile reads the filter snapshot at path.
+func readFilterSnapshotFile(path string) (*FilterSnapshot, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadFilterSnapshot(f)
+}
+
+// snapshotFilter takes a filter snapshot of the blocks held locally under roots.
+func (cm *CarMirror) snapshotFilter(ctx context.Context, roots []gocid.Cid) (*FilterSnapshot, error) {
+	if len(roots) == 0 {
+		return nil, fmt.Errorf("no roots to take a snapshot of")
+	}
+
+	var held []cmipld.Cid
+	err := walkDAG(ctx, cm.blockStore, roots, func(id gocid.Cid, _ cmcore.Block[cmipld.Cid], err error) (bool, error) {
+		if err == cmerrors.ErrBlockNotFound || err == ErrDeniedBlock {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		held = append(held, cmipld.WrapCid(id))
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	cm.reconfigure.Lock()
+	hashFunction := cm.cfg.BloomFunction
+	cm.reconfigure.Unlock()
+	hash, ok := filter.RegistryLookup[cmipld.Cid](hashFunction)
+	if !ok {
+		return nil, filter.ErrIncompatibleFilter
+	}
+	// An empty filter still needs room for a block.
+	bf, err := bloom.NewFilterWithEstimates(uint64(len(held)+1), snapshotFalsePositiveRate, hash)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range held {
+		bf.Add(id)
+	}
+	f, err := filter.TryNewBloomFilterFromBytes[cmipld.Cid](bf.Bytes(), bf.BitCount(), bf.HashCount(), hashFunction)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &FilterSnapshot{Version: FilterSnapshotVersion, Blocks: len(held), Created: time.Now().UTC(), Filter: f}
+	for _, root := range roots {
+		snapshot.Roots = append(snapshot.Roots, root.String())
+	}
+	return snapshot, nil
+}
@@ -0,0 +1,90 @@
+package carmirror
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	cmipld "github.com/fission-codes/go-car-mirror/ipld"
+	"github.com/ipfs/boxo/ipld/merkledag"
+	gocid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+func TestFilterSnapshot(t *testing.T) {
+	ctx := context.Background()
+	cms, nodes := newTestCarMirrors(t, 1)
+	cm := cms[0]
+
+	// The remote holds the old root and the left leaf. The new root links to both leaves.
+	left, right := merkledag.NewRawNode([]byte("left")), merkledag.NewRawNode([]byte("right"))
+	old, root := merkledag.NodeWithData([]byte("old")), merkledag.NodeWithData([]byte("new"))
+	if err := old.AddNodeLink("left", left); err != nil {
+		t.Fatal(err)
+	}
+	for name, leaf := range map[string]ipld.Node{"left": left, "right": right} {
+		if err := root.AddNodeLink(name, leaf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := nodes[0].Dag().AddMany(ctx, []ipld.Node{old, root, left, right}); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, err := cm.snapshotFilter(ctx, []gocid.Cid{old.Cid()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadFilterSnapshot(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.Blocks != 2 || len(read.Roots) != 1 || read.Roots[0] != old.Cid().String() {
+		t.Errorf("expected the old root and left leaf in the snapshot, got %+v", read)
+	}
+	for _, held := range []ipld.Node{old, left} {
+		if read.Filter.DoesNotContain(cmipld.WrapCid(held.Cid())) {
+			t.Errorf("expected %s in the filter", held.Cid())
+		}
+	}
+
+	if _, err := ReadFilterSnapshot(strings.NewReader(`{"Version":99}`)); err == nil {
+		t.Errorf("expected an unknown version to be rejected")
+	}
+	if _, err := ReadFilterSnapshot(strings.NewReader(`{"Version":1,"Roots":[]}`)); err == nil {
+		t.Errorf("expected a snapshot with no filter to be rejected")
+	}
+	var unknown map[string]interface{}
+	if data, err := json.Marshal(snapshot); err != nil {
+		t.Fatal(err)
+	} else if err := json.Unmarshal(data, &unknown); err != nil {
+		t.Fatal(err)
+	}
+	unknown["Filter"].(map[string]interface{})["hashFunction"] = 0xdead
+	if data, err := json.Marshal(unknown); err != nil {
+		t.Fatal(err)
+	} else if _, err := ReadFilterSnapshot(bytes.NewReader(data)); err == nil {
+		t.Errorf("expected a snapshot with an unknown hash function to be rejected")
+	}
+
+	res, err := cm.export(ctx, filepath.Join(t.TempDir(), "delta.car"), root.Cid(), gocid.Undef, read)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Blocks != 2 || res.Bytes != uint64(len(root.RawData())+len(right.RawData())) {
+		t.Errorf("expected only the new root and right leaf to be written, got %+v", res)
+	}
+
+	// A node configured with a hash function that isn't registered can't take a snapshot.
+	cm.cfg.BloomFunction = 0xdead
+	if _, err := cm.snapshotFilter(ctx, []gocid.Cid{old.Cid()}); err == nil {
+		t.Errorf("expected a snapshot with an unknown hash function to fail")
+	}
+}
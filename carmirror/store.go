@@ -2,6 +2,7 @@ package carmirror
 
 import (
 	"context"
+	goerrors "errors"
 	"strings"
 
 	cm "github.com/fission-codes/go-car-mirror/core"
@@ -13,10 +14,15 @@ import (
 	ipld "github.com/ipfs/go-ipld-format"
 )
 
+// ErrDeniedBlock is returned when getting or adding a block the content policy denies.
+var ErrDeniedBlock = goerrors.New("block denied by policy")
+
 type KuboStore struct {
 	store ipld.DAGService
 	lng   ipld.NodeGetter
 	pins  kubo.PinAPI
+	// Content policy; denied blocks are neither served nor stored
+	policy *Policy
 }
 
 func NewKuboStore(core kubo.CoreAPI) *KuboStore {
@@ -33,7 +39,16 @@ func NewKuboStore(core kubo.CoreAPI) *KuboStore {
 	}
 }
 
+// SetPolicy sets the content policy enforced by the store.
+func (ks *KuboStore) SetPolicy(policy *Policy) {
+	ks.policy = policy
+}
+
 func (ks *KuboStore) Get(ctx context.Context, cid cmipld.Cid) (cm.Block[cmipld.Cid], error) {
+	if ks.policy.IsDenied(cid.Unwrap()) {
+		ks.policy.countDenied("denied.blocks")
+		return nil, ErrDeniedBlock
+	}
 	if node, err := ks.lng.Get(ctx, cid.Unwrap()); err != nil {
 		// TODO: don't rely on string matching
 		if strings.Contains(err.Error(), "block was not found locally (offline)") {
@@ -46,6 +61,9 @@ func (ks *KuboStore) Get(ctx context.Context, cid cmipld.Cid) (cm.Block[cmipld.C
 }
 
 func (ks *KuboStore) Has(ctx context.Context, cid cmipld.Cid) (bool, error) {
+	if ks.policy.IsDenied(cid.Unwrap()) {
+		return false, nil
+	}
 	if _, err := ks.lng.Get(ctx, cid.Unwrap()); err != nil {
 		return false, nil
 	} else {
@@ -54,6 +72,10 @@ func (ks *KuboStore) Has(ctx context.Context, cid cmipld.Cid) (bool, error) {
 }
 
 func (ks *KuboStore) Add(ctx context.Context, block cm.RawBlock[cmipld.Cid]) (cm.Block[cmipld.Cid], error) {
+	if ks.policy.IsDenied(block.Id().Unwrap()) {
+		ks.policy.countDenied("denied.blocks")
+		return nil, ErrDeniedBlock
+	}
 	var ipfsBlock blocks.Block
 	if cmBlock, ok := block.(*cmipld.RawBlock); ok {
 		ipfsBlock = cmBlock.Unwrap()
@@ -80,6 +102,11 @@ func (ks *KuboStore) AddMany(ctx context.Context, rawBlocks []cm.RawBlock[cmipld
 	var nodes []ipld.Node
 	var blks []cm.Block[cmipld.Cid]
 	for _, block := range rawBlocks {
+		// Denied blocks are dropped rather than failing the whole batch
+		if ks.policy.IsDenied(block.Id().Unwrap()) {
+			ks.policy.countDenied("denied.blocks")
+			continue
+		}
 		if cmBlock, ok := block.(*cmipld.RawBlock); ok {
 			ipfsBlock = cmBlock.Unwrap()
 		} else {
@@ -104,6 +131,20 @@ func (ks *KuboStore) AddMany(ctx context.Context, rawBlocks []cm.RawBlock[cmipld
 	}
 }
 
+// deniedAsMissing is the store protocol sessions use, which reports blocks the content policy denies as not found,
+// as sessions only carry on past blocks that aren't found.
+type deniedAsMissing struct {
+	cm.BlockStore[cmipld.Cid]
+}
+
+func (s deniedAsMissing) Get(ctx context.Context, cid cmipld.Cid) (cm.Block[cmipld.Cid], error) {
+	block, err := s.BlockStore.Get(ctx, cid)
+	if err == ErrDeniedBlock {
+		return nil, errors.ErrBlockNotFound
+	}
+	return block, err
+}
+
 // There doesn't seem to be a clear way to list all the CIDs since the underlying
 // blockstore is not exposed in the core Kubo API. This method will therefore list
 // the cids of all pinned objects
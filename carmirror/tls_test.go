@@ -0,0 +1,120 @@
+package carmirror
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate and key written as PEM files, and what's needed to sign others with it.
+type testCert struct {
+	certFile string
+	keyFile  string
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+}
+
+// makeTestCert writes a certificate named name to dir, signed by ca, or self signed as a CA if ca is nil.
+func makeTestCert(t *testing.T, dir string, name string, ca *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	parent, signer := template, key
+	if ca == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tc := &testCert{certFile: filepath.Join(dir, name+".crt"), keyFile: filepath.Join(dir, name+".key"), cert: cert, key: key}
+	if err := os.WriteFile(tc.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(tc.keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return tc
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := makeTestCert(t, dir, "ca", nil)
+	serverCert := makeTestCert(t, dir, "server", ca)
+	clientCert := makeTestCert(t, dir, "client", ca)
+	otherCA := makeTestCert(t, dir, "other-ca", nil)
+	otherClientCert := makeTestCert(t, dir, "other-client", otherCA)
+
+	serverCfg := &Config{TLSCertFile: serverCert.certFile, TLSKeyFile: serverCert.keyFile, TLSClientCAFile: ca.certFile}
+	tlsConfig, err := serverCfg.serverTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	server.TLS = tlsConfig
+	server.StartTLS()
+	defer server.Close()
+
+	get := func(cfg *Config) error {
+		transport, err := cfg.clientTransport()
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	if err := get(&Config{TLSRootCAFile: ca.certFile}); err == nil {
+		t.Errorf("expected a client without a certificate to be rejected")
+	}
+	if err := get(&Config{TLSRootCAFile: ca.certFile, TLSClientCertFile: otherClientCert.certFile, TLSClientKeyFile: otherClientCert.keyFile}); err == nil {
+		t.Errorf("expected a client with a certificate from another CA to be rejected")
+	}
+	if err := get(&Config{TLSRootCAFile: ca.certFile, TLSClientCertFile: clientCert.certFile, TLSClientKeyFile: clientCert.keyFile}); err != nil {
+		t.Errorf("expected a client with a valid certificate to succeed, got %v", err)
+	}
+	// Without the custom roots, the server's certificate isn't trusted.
+	if err := get(&Config{TLSClientCertFile: clientCert.certFile, TLSClientKeyFile: clientCert.keyFile}); err == nil {
+		t.Errorf("expected the server's certificate to be rejected without the custom roots")
+	}
+}
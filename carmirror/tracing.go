@@ -0,0 +1,188 @@
+package carmirror
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	cmcore "github.com/fission-codes/go-car-mirror/core"
+	cmipld "github.com/fission-codes/go-car-mirror/ipld"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Trace exporters that can be configured.
+const (
+	// TracingExporterKubo uses Kubo's tracer provider, configured with the OTEL_TRACES_EXPORTER environment variables.
+	TracingExporterKubo   = ""
+	TracingExporterNone   = "none"
+	TracingExporterStdout = "stdout"
+	TracingExporterFile   = "file"
+)
+
+const tracerName = "github.com/fission-codes/kubo-car-mirror/carmirror"
+
+// Trace context is always propagated with the W3C headers, whatever the global propagator is.
+var propagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// newTracerProvider creates the tracer provider for an exporter, and a function to flush and stop it.
+// file is where the file exporter writes spans.
+func newTracerProvider(exporter string, file string) (trace.TracerProvider, func(context.Context) error, error) {
+	noShutdown := func(context.Context) error { return nil }
+
+	var out io.Writer
+	var closer io.Closer
+	switch exporter {
+	case TracingExporterKubo:
+		return otel.GetTracerProvider(), noShutdown, nil
+	case TracingExporterNone:
+		return trace.NewNoopTracerProvider(), noShutdown, nil
+	case TracingExporterStdout:
+		out = os.Stdout
+	case TracingExporterFile:
+		if file == "" {
+			return nil, nil, fmt.Errorf("the file trace exporter requires a file")
+		}
+		f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, nil, err
+		}
+		out, closer = f, f
+	default:
+		return nil, nil, fmt.Errorf("unsupported trace exporter %q, expected %s, %s or %s", exporter, TracingExporterStdout, TracingExporterFile, TracingExporterNone)
+	}
+
+	spanExporter, err := stdouttrace.New(stdouttrace.WithWriter(out))
+	if err != nil {
+		return nil, nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(spanExporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName("kubo-car-mirror"), semconv.ServiceVersion(Version))),
+	)
+
+	shutdown := func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if closer != nil {
+			if closeErr := closer.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		return err
+	}
+	return provider, shutdown, nil
+}
+
+// endSpan records err, if any, on span and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// tracingTransport traces each HTTP exchange of a client session as a round within the session's span,
+// and propagates the trace context to the remote so its spans join up.
+type tracingTransport struct {
+	base   http.RoundTripper
+	tracer trace.Tracer
+	// Context holding the session span
+	session context.Context
+}
+
+func (t *tracingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	_, span := t.tracer.Start(t.session, "carmirror.round",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.HTTPMethod(r.Method),
+			semconv.HTTPURL(r.URL.String()),
+		),
+	)
+
+	r = r.Clone(trace.ContextWithSpan(r.Context(), span))
+	propagator.Inject(r.Context(), propagation.HeaderCarrier(r.Header))
+
+	resp, err := t.base.RoundTrip(r)
+	if err != nil {
+		endSpan(span, err)
+		return nil, err
+	}
+	span.SetAttributes(semconv.HTTPStatusCode(resp.StatusCode))
+	if resp.StatusCode >= http.StatusBadRequest {
+		span.SetStatus(codes.Error, resp.Status)
+	}
+
+	// The round ends once the response has been read.
+	resp.Body = &observedBody{ReadCloser: resp.Body, done: func() { span.End() }}
+	return resp, nil
+}
+
+// traceHandler traces the rounds of a remote protocol handler, continuing the trace of the client's round.
+// cookie is the name of the session cookie the handler issues.
+func traceHandler(next http.HandlerFunc, tracer trace.Tracer, name string, cookie string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, name,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(semconv.NetSockPeerAddr(r.RemoteAddr)),
+		)
+		defer span.End()
+
+		next(w, r.WithContext(ctx))
+
+		if session := sessionFromRequest(w, r, cookie); session != "" {
+			span.SetAttributes(attribute.String("carmirror.session", session))
+		}
+	}
+}
+
+// tracingStore traces the block store calls made by a session, within the session's span.
+type tracingStore struct {
+	cmcore.BlockStore[cmipld.Cid]
+	tracer trace.Tracer
+	// Context holding the session span
+	session context.Context
+}
+
+func (ts *tracingStore) start(name string, cid cmipld.Cid) trace.Span {
+	_, span := ts.tracer.Start(ts.session, name, trace.WithAttributes(attribute.String("carmirror.cid", cid.String())))
+	return span
+}
+
+func (ts *tracingStore) Get(ctx context.Context, cid cmipld.Cid) (cmcore.Block[cmipld.Cid], error) {
+	span := ts.start("carmirror.store.Get", cid)
+	block, err := ts.BlockStore.Get(ctx, cid)
+	endSpan(span, err)
+	return block, err
+}
+
+func (ts *tracingStore) Has(ctx context.Context, cid cmipld.Cid) (bool, error) {
+	span := ts.start("carmirror.store.Has", cid)
+	has, err := ts.BlockStore.Has(ctx, cid)
+	endSpan(span, err)
+	return has, err
+}
+
+func (ts *tracingStore) Add(ctx context.Context, block cmcore.RawBlock[cmipld.Cid]) (cmcore.Block[cmipld.Cid], error) {
+	span := ts.start("carmirror.store.Add", block.Id())
+	added, err := ts.BlockStore.Add(ctx, block)
+	endSpan(span, err)
+	return added, err
+}
+
+func (ts *tracingStore) AddMany(ctx context.Context, blocks []cmcore.RawBlock[cmipld.Cid]) ([]cmcore.Block[cmipld.Cid], error) {
+	_, span := ts.tracer.Start(ts.session, "carmirror.store.AddMany", trace.WithAttributes(attribute.Int("carmirror.blocks", len(blocks))))
+	added, err := ts.BlockStore.AddMany(ctx, blocks)
+	endSpan(span, err)
+	return added, err
+}
@@ -0,0 +1,118 @@
+package carmirror
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	cmbatch "github.com/fission-codes/go-car-mirror/batch"
+	cmcore "github.com/fission-codes/go-car-mirror/core"
+	cmipld "github.com/fission-codes/go-car-mirror/ipld"
+	"github.com/fission-codes/go-car-mirror/messages"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracePropagation(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer(tracerName)
+
+	server := httptest.NewServer(traceHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}, tracer, "carmirror.serve.blocks", "sinkSessionId"))
+	defer server.Close()
+
+	session, sessionSpan := tracer.Start(context.Background(), "carmirror.push")
+	client := &http.Client{Transport: &tracingTransport{base: http.DefaultTransport, tracer: tracer, session: session}}
+	resp, err := client.Post(server.URL+"/dag/cm/blocks", "application/cbor", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	sessionSpan.End()
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	round, serve := spans["carmirror.round"], spans["carmirror.serve.blocks"]
+	if round == nil || serve == nil {
+		t.Fatalf("expected round and serve spans, got %v", spans)
+	}
+
+	if round.Parent().SpanID() != sessionSpan.SpanContext().SpanID() {
+		t.Errorf("expected round to be a child of the session span")
+	}
+	if serve.Parent().SpanID() != round.SpanContext().SpanID() || !serve.Parent().IsRemote() {
+		t.Errorf("expected server span to continue the client's round")
+	}
+}
+
+func TestServedSessionSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer(tracerName)
+
+	nodes, err := MakeAPISwarm(context.Background(), false, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(NewKuboStore(nodes[0]), cmbatch.Config{
+		MaxBlocksPerRound:    10,
+		MaxBlocksPerColdCall: 10,
+		BloomFunction:        HASH_FUNCTION,
+		BloomCapacity:        1024,
+	})
+	srv.SetTracer(tracer)
+	server := httptest.NewServer(traceHandler(srv.HandleBlocks, tracer, "carmirror.serve.blocks", "sinkSessionId"))
+	defer server.Close()
+
+	block, err := cmipld.TryBlockFromCBOR("a block pushed to the server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body bytes.Buffer
+	if err := messages.NewBlocksMessage[cmipld.Cid, *cmipld.Cid]([]cmcore.RawBlock[cmipld.Cid]{block}).Write(&body); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(server.URL, "application/cbor", &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected the round to be accepted, got %d", resp.StatusCode)
+	}
+	// The session's span ends with the session.
+	for _, token := range srv.SinkSessions() {
+		if session, err := srv.sinkSession(token); err == nil {
+			session.Cancel()
+		}
+	}
+
+	var session sdktrace.ReadOnlySpan
+	for deadline := time.Now().Add(5 * time.Second); session == nil && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		for _, span := range recorder.Ended() {
+			if span.Name() == "carmirror.serve.push" {
+				session = span
+			}
+		}
+	}
+	if session == nil {
+		t.Fatalf("expected the served session to be traced")
+	}
+	stored := false
+	for _, span := range recorder.Ended() {
+		if strings.HasPrefix(span.Name(), "carmirror.store.") && span.Parent().SpanID() == session.SpanContext().SpanID() {
+			stored = true
+		}
+	}
+	if !stored {
+		t.Errorf("expected the served session's store calls to be traced within it")
+	}
+}
@@ -0,0 +1,646 @@
+package carmirror
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	cmipld "github.com/fission-codes/go-car-mirror/ipld"
+	"github.com/fission-codes/go-car-mirror/messages"
+	"github.com/fission-codes/go-car-mirror/util"
+	coreiface "github.com/ipfs/boxo/coreiface"
+	blocks "github.com/ipfs/go-block-format"
+	gocid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	cryptopb "github.com/libp2p/go-libp2p/core/crypto/pb"
+	"github.com/mr-tron/base58"
+	"github.com/pkg/errors"
+)
+
+const (
+	// CapabilityPush allows pushing blocks for a root into the node.
+	CapabilityPush = "car-mirror/push"
+	// CapabilityPull allows pulling the DAG under a root from the node.
+	CapabilityPull = "car-mirror/pull"
+	// CapabilityAll allows both pushing and pulling.
+	CapabilityAll = "car-mirror/*"
+
+	// ResourceAll matches every root.
+	ResourceAll = "ipfs://*"
+
+	didKeyPrefix = "did:key:z"
+)
+
+// ed25519 public key multicodec prefix, as used by did:key.
+var ed25519Multicodec = []byte{0xed, 0x01}
+
+var (
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrInvalidUCAN  = errors.New("invalid UCAN")
+)
+
+// Capability is a UCAN attenuation, granting an ability on a resource.
+type Capability struct {
+	With string `json:"with"`
+	Can  string `json:"can"`
+}
+
+// RootResource returns the UCAN resource naming a root CID.
+func RootResource(cid gocid.Cid) string {
+	return "ipfs://" + cid.String()
+}
+
+// covers reports whether c grants at least what other asks for.
+func (c Capability) covers(other Capability) bool {
+	if c.With != other.With && c.With != ResourceAll {
+		return false
+	}
+	return c.Can == other.Can || c.Can == CapabilityAll
+}
+
+type ucanHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Ucv string `json:"ucv"`
+}
+
+// UCANPayload is the claims section of a UCAN.
+type UCANPayload struct {
+	Iss string       `json:"iss"`
+	Aud string       `json:"aud"`
+	Nbf int64        `json:"nbf,omitempty"`
+	Exp int64        `json:"exp,omitempty"`
+	Att []Capability `json:"att"`
+	Prf []string     `json:"prf"`
+}
+
+// UCAN is a parsed token whose signature, and those of its proofs, have been verified.
+type UCAN struct {
+	Payload UCANPayload
+	Proofs  []*UCAN
+}
+
+// nodeDID returns the did:key of the node's identity, which must be an ed25519 key.
+func nodeDID(ctx context.Context, capi coreiface.CoreAPI) (string, error) {
+	self, err := capi.Key().Self(ctx)
+	if err != nil {
+		return "", err
+	}
+	pub, err := self.ID().ExtractPublicKey()
+	if err != nil {
+		return "", err
+	}
+	if pub.Type() != cryptopb.KeyType_Ed25519 {
+		return "", fmt.Errorf("the node's key is %s, not ed25519", pub.Type())
+	}
+	raw, err := pub.Raw()
+	if err != nil {
+		return "", err
+	}
+	return DIDFromPublicKey(raw), nil
+}
+
+// DIDFromPublicKey returns the did:key for an ed25519 public key.
+func DIDFromPublicKey(pub ed25519.PublicKey) string {
+	return didKeyPrefix + base58.Encode(append(append([]byte{}, ed25519Multicodec...), pub...))
+}
+
+// publicKeyFromDID extracts the ed25519 public key from a did:key.
+func publicKeyFromDID(did string) (ed25519.PublicKey, error) {
+	if !strings.HasPrefix(did, didKeyPrefix) {
+		return nil, fmt.Errorf("unsupported DID %q", did)
+	}
+	b, err := base58.Decode(strings.TrimPrefix(did, didKeyPrefix))
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding did:key")
+	}
+	if len(b) != len(ed25519Multicodec)+ed25519.PublicKeySize || !bytes.HasPrefix(b, ed25519Multicodec) {
+		return nil, fmt.Errorf("DID %q is not an ed25519 key", did)
+	}
+	return ed25519.PublicKey(b[len(ed25519Multicodec):]), nil
+}
+
+// NewUCAN issues a UCAN signed by key. A zero exp means the token does not expire.
+func NewUCAN(key ed25519.PrivateKey, aud string, att []Capability, exp time.Time, proofs ...string) (string, error) {
+	payload := UCANPayload{
+		Iss: DIDFromPublicKey(key.Public().(ed25519.PublicKey)),
+		Aud: aud,
+		Att: att,
+		Prf: proofs,
+	}
+	if !exp.IsZero() {
+		payload.Exp = exp.Unix()
+	}
+	if payload.Prf == nil {
+		payload.Prf = []string{}
+	}
+
+	header, err := json.Marshal(ucanHeader{Alg: "EdDSA", Typ: "JWT", Ucv: "0.9.1"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	sig := ed25519.Sign(key, []byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// ParseUCAN decodes a UCAN and its embedded proofs, verifying every signature.
+func ParseUCAN(raw string) (*UCAN, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.Wrap(ErrInvalidUCAN, "expected three segments")
+	}
+
+	var header ucanHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	if header.Alg != "EdDSA" {
+		return nil, errors.Wrapf(ErrInvalidUCAN, "unsupported algorithm %q", header.Alg)
+	}
+
+	u := &UCAN{}
+	if err := decodeSegment(parts[1], &u.Payload); err != nil {
+		return nil, err
+	}
+
+	pub, err := publicKeyFromDID(u.Payload.Iss)
+	if err != nil {
+		return nil, errors.Wrap(ErrInvalidUCAN, err.Error())
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.Wrap(ErrInvalidUCAN, "decoding signature")
+	}
+	if !ed25519.Verify(pub, []byte(parts[0]+"."+parts[1]), sig) {
+		return nil, errors.Wrap(ErrInvalidUCAN, "bad signature")
+	}
+
+	for _, prf := range u.Payload.Prf {
+		proof, err := ParseUCAN(prf)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing proof")
+		}
+		u.Proofs = append(u.Proofs, proof)
+	}
+
+	return u, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return errors.Wrap(ErrInvalidUCAN, "decoding segment")
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return errors.Wrap(ErrInvalidUCAN, "unmarshaling segment")
+	}
+	return nil
+}
+
+func (u *UCAN) activeAt(now time.Time) bool {
+	if u.Payload.Nbf != 0 && now.Unix() < u.Payload.Nbf {
+		return false
+	}
+	if u.Payload.Exp != 0 && now.Unix() >= u.Payload.Exp {
+		return false
+	}
+	return true
+}
+
+// UCANVerifier checks that tokens grant capabilities through a delegation chain
+// that starts at one of the trusted root DIDs.
+type UCANVerifier struct {
+	trustedRoots map[string]bool
+	// Audience, if set, must match the aud of presented tokens.
+	audience string
+	now      func() time.Time
+}
+
+// NewUCANVerifier creates a verifier trusting the given root DIDs.
+func NewUCANVerifier(trustedRoots []string, audience string) *UCANVerifier {
+	v := &UCANVerifier{
+		trustedRoots: make(map[string]bool),
+		audience:     audience,
+		now:          time.Now,
+	}
+	for _, did := range trustedRoots {
+		v.trustedRoots[did] = true
+	}
+	return v
+}
+
+// Authorize verifies raw and checks that it grants can on every root, of which there must be at least one.
+func (v *UCANVerifier) Authorize(raw string, can string, roots []gocid.Cid) error {
+	if len(roots) == 0 {
+		return errors.Wrap(ErrUnauthorized, "no roots to authorize")
+	}
+	u, err := v.verify(raw)
+	if err != nil {
+		return err
+	}
+
+	now := v.now()
+	for _, root := range roots {
+		if !v.grants(u, Capability{With: RootResource(root), Can: can}, now) {
+			return errors.Wrapf(ErrUnauthorized, "%s not granted on %s", can, root)
+		}
+	}
+	return nil
+}
+
+// AuthorizeAll verifies raw and checks that it grants can on every root, through ResourceAll.
+func (v *UCANVerifier) AuthorizeAll(raw string, can string) error {
+	u, err := v.verify(raw)
+	if err != nil {
+		return err
+	}
+	if !v.grants(u, Capability{With: ResourceAll, Can: can}, v.now()) {
+		return errors.Wrapf(ErrUnauthorized, "%s not granted on every root", can)
+	}
+	return nil
+}
+
+// verify parses raw and checks it is addressed to us.
+func (v *UCANVerifier) verify(raw string) (*UCAN, error) {
+	u, err := ParseUCAN(raw)
+	if err != nil {
+		return nil, err
+	}
+	if v.audience != "" && u.Payload.Aud != v.audience {
+		return nil, errors.Wrapf(ErrUnauthorized, "token audience is %s", u.Payload.Aud)
+	}
+	return u, nil
+}
+
+// grants reports whether u holds capability, either directly as a trusted root
+// or delegated through one of its proofs.
+func (v *UCANVerifier) grants(u *UCAN, capability Capability, now time.Time) bool {
+	if !u.activeAt(now) {
+		return false
+	}
+
+	attenuated := false
+	for _, att := range u.Payload.Att {
+		if att.covers(capability) {
+			attenuated = true
+			break
+		}
+	}
+	if !attenuated {
+		return false
+	}
+
+	if v.trustedRoots[u.Payload.Iss] {
+		return true
+	}
+
+	for _, proof := range u.Proofs {
+		if proof.Payload.Aud == u.Payload.Iss && v.grants(proof, capability, now) {
+			return true
+		}
+	}
+	return false
+}
+
+// bearerToken extracts the token from an `Authorization: Bearer` header.
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return ""
+	}
+	return strings.TrimPrefix(auth, "Bearer ")
+}
+
+// ucanAuthorizer guards the remote protocol handlers.
+// Sessions are authorized on their first request, using the roots found in that request's message.
+// Every later request in the session is checked against the same capability: the blocks a pull wants and the
+// blocks a push sends must be in the DAGs under the session's roots, or be roots of their own the token grants.
+type ucanAuthorizer struct {
+	verifier *UCANVerifier
+	sessions *util.SynchronizedMap[string, *ucanSession]
+	// links lists the links of a local block, reporting whether the block is held,
+	// and running reports whether the remote server is running a session.
+	links   func(ctx context.Context, id gocid.Cid) ([]gocid.Cid, bool, error)
+	running func(token string) bool
+}
+
+// ucanSession is what an authorized session may transfer.
+type ucanSession struct {
+	can string
+	mu  sync.Mutex
+	// The roots the token has been checked against, and blocks known to be in the DAGs under them
+	roots []gocid.Cid
+	under map[gocid.Cid]bool
+	// Blocks under the roots whose links are in under, and those whose links haven't been followed yet
+	followed map[gocid.Cid]bool
+	pending  []gocid.Cid
+}
+
+func newUCANSession(can string, roots []gocid.Cid) *ucanSession {
+	s := &ucanSession{can: can, under: make(map[gocid.Cid]bool), followed: make(map[gocid.Cid]bool)}
+	for _, root := range roots {
+		s.addRoot(root)
+	}
+	return s
+}
+
+// addRoot adds a root the token has been checked against.
+func (s *ucanSession) addRoot(root gocid.Cid) {
+	s.roots = append(s.roots, root)
+	s.add(root)
+}
+
+// add marks id as under the session's roots, to have its links followed.
+func (s *ucanSession) add(id gocid.Cid) {
+	if !s.under[id] {
+		s.under[id] = true
+		s.pending = append(s.pending, id)
+	}
+}
+
+func newUCANAuthorizer(verifier *UCANVerifier, links func(ctx context.Context, id gocid.Cid) ([]gocid.Cid, bool, error), running func(token string) bool) *ucanAuthorizer {
+	return &ucanAuthorizer{
+		verifier: verifier,
+		sessions: util.NewSynchronizedMap[string, *ucanSession](),
+		links:    links,
+		running:  running,
+	}
+}
+
+// Wrap returns a handler that only calls next if the request carries a token granting can.
+// cookie is the name of the session cookie the wrapped handler issues, or empty if it starts no session.
+func (a *ucanAuthorizer) Wrap(next http.HandlerFunc, can string, cookie string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := bearerToken(r)
+		if token == "" {
+			http.Error(w, "missing UCAN", http.StatusUnauthorized)
+			return
+		}
+
+		var session *ucanSession
+		if cookie != "" {
+			if c, err := r.Cookie(cookie); err == nil {
+				session, _ = a.sessions.Get(c.Value)
+			}
+		}
+
+		if session != nil {
+			session.mu.Lock()
+			err := a.verifier.Authorize(token, can, session.roots)
+			if err == nil {
+				err = a.check(r, session, token)
+			}
+			session.mu.Unlock()
+			if err != nil {
+				log.Debugw("unauthorized", "object", "ucanAuthorizer", "method", "Wrap", "error", err)
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+			next(w, r)
+			return
+		}
+
+		// A session we haven't authorized, which the handler will start.
+		roots, err := requestRoots(r, can)
+		if err != nil {
+			http.Error(w, "bad message format", http.StatusBadRequest)
+			return
+		}
+		if err := a.verifier.Authorize(token, can, roots); err != nil {
+			log.Debugw("unauthorized", "object", "ucanAuthorizer", "method", "Wrap", "error", err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		if cookie == "" {
+			next(w, r)
+			return
+		}
+
+		session = newUCANSession(can, roots)
+		// The rest of the first message is held to the session's roots too.
+		if err := a.check(r, session, token); err != nil {
+			log.Debugw("unauthorized", "object", "ucanAuthorizer", "method", "Wrap", "error", err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		next(w, r)
+
+		// Remember the session the handler just created.
+		for _, c := range (&http.Response{Header: w.Header()}).Cookies() {
+			if c.Name == cookie {
+				a.sessions.Add(c.Value, session)
+			}
+		}
+	}
+}
+
+// check reads the blocks a request of an authorized session wants or sends, leaving the body intact, and checks that
+// each is in the DAGs under the session's roots. Blocks that aren't start DAGs of their own, which are added to the
+// session as roots if the token grants its capability on them. The local DAGs under the roots are followed only as
+// far as needed, and each block held is read once per session. The caller holds the session's lock.
+func (a *ucanAuthorizer) check(r *http.Request, s *ucanSession, token string) error {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	var ids []gocid.Cid
+	// Links of the blocks a push sends, which are in the session once the block is
+	children := make(map[gocid.Cid][]gocid.Cid)
+	switch s.can {
+	case CapabilityPull:
+		message := messages.StatusMessage[cmipld.Cid, *cmipld.Cid]{}
+		if err := message.Read(bufio.NewReader(bytes.NewReader(body))); err != nil {
+			return err
+		}
+		for _, id := range message.Want {
+			ids = append(ids, id.Unwrap())
+		}
+	case CapabilityPush:
+		message := messages.BlocksMessage[cmipld.Cid, *cmipld.Cid]{}
+		if err := message.Read(bufio.NewReader(bytes.NewReader(body))); err != io.EOF {
+			return err
+		}
+		for _, raw := range message.Car.Blocks {
+			id := raw.Id().Unwrap()
+			ids = append(ids, id)
+			block, err := blocks.NewBlockWithCid(raw.RawData(), id)
+			if err != nil {
+				continue
+			}
+			// Blocks that can't be decoded have no links we can follow, and the store refuses them anyway.
+			if node, err := ipld.DefaultBlockDecoder.Decode(block); err == nil {
+				for _, link := range node.Links() {
+					children[id] = append(children[id], link.Cid)
+				}
+			}
+		}
+	}
+
+	followed := false
+	for len(ids) > 0 {
+		var left []gocid.Cid
+		for _, id := range ids {
+			if !s.under[id] {
+				left = append(left, id)
+				continue
+			}
+			if links, ok := children[id]; ok {
+				s.followed[id] = true
+				for _, child := range links {
+					s.add(child)
+				}
+			}
+		}
+		if len(left) == len(ids) {
+			if !followed {
+				// Blocks received earlier in the session, or held before it, may link the rest in.
+				followed = true
+				if err := a.follow(r.Context(), s); err != nil {
+					return err
+				}
+			} else {
+				if err := a.verifier.Authorize(token, s.can, left[:1]); err != nil {
+					return err
+				}
+				s.addRoot(left[0])
+			}
+		}
+		ids = left
+	}
+	return nil
+}
+
+// follow adds the links of the session's pending blocks to the blocks under its roots, and theirs in turn.
+// Blocks that aren't held stay pending, as they may be received later in the session.
+func (a *ucanAuthorizer) follow(ctx context.Context, s *ucanSession) error {
+	queue := s.pending
+	s.pending = nil
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		if s.followed[id] {
+			continue
+		}
+		links, held, err := a.links(ctx, id)
+		if err != nil {
+			return err
+		}
+		if !held {
+			s.pending = append(s.pending, id)
+			continue
+		}
+		s.followed[id] = true
+		for _, link := range links {
+			if !s.under[link] {
+				s.under[link] = true
+				queue = append(queue, link)
+			}
+		}
+	}
+	return nil
+}
+
+// grantsAll reports whether the request carries a token granting can on every root.
+// A nil authorizer, for a server that requires no tokens, grants everything.
+func (a *ucanAuthorizer) grantsAll(r *http.Request, can string) bool {
+	if a == nil {
+		return true
+	}
+	return a.verifier.AuthorizeAll(bearerToken(r), can) == nil
+}
+
+// reap forgets the sessions the remote server is no longer running.
+func (a *ucanAuthorizer) reap() {
+	if a == nil {
+		return
+	}
+	for _, id := range a.sessions.Keys() {
+		if !a.running(id) {
+			a.sessions.Remove(id)
+		}
+	}
+}
+
+// requestRoots reads the roots a session starts with from the first message of the session,
+// leaving the body intact for the protocol handler.
+// A pull starts with a status message wanting the roots; a push cold call starts with the root block.
+// A has query, asked before a push, names the root it would push.
+func requestRoots(r *http.Request, can string) ([]gocid.Cid, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	var roots []gocid.Cid
+	switch {
+	case r.URL.Path == hasQueryPath:
+		var query hasQuery
+		if err := json.Unmarshal(body, &query); err != nil {
+			return nil, err
+		}
+		root, err := gocid.Parse(query.Root)
+		if err != nil {
+			return nil, fmt.Errorf("has query root: %w", err)
+		}
+		roots = append(roots, root)
+	case can == CapabilityPull:
+		message := messages.StatusMessage[cmipld.Cid, *cmipld.Cid]{}
+		if err := message.Read(bufio.NewReader(bytes.NewReader(body))); err != nil {
+			return nil, err
+		}
+		for _, id := range message.Want {
+			roots = append(roots, id.Unwrap())
+		}
+	case can == CapabilityPush:
+		message := messages.BlocksMessage[cmipld.Cid, *cmipld.Cid]{}
+		if err := message.Read(bufio.NewReader(bytes.NewReader(body))); err != io.EOF {
+			return nil, err
+		}
+		if len(message.Car.Blocks) > 0 {
+			roots = append(roots, message.Car.Blocks[0].Id().Unwrap())
+		}
+	}
+
+	if len(roots) == 0 {
+		return nil, fmt.Errorf("no roots in request")
+	}
+	return roots, nil
+}
+
+// tokenTransport attaches a session's bearer token to its outgoing requests.
+type tokenTransport struct {
+	base  http.RoundTripper
+	token string
+}
+
+func (t *tokenTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	token := t.token
+	if token == "" {
+		return t.base.RoundTrip(r)
+	}
+	r = r.Clone(r.Context())
+	r.Header.Set("Authorization", "Bearer "+token)
+	return t.base.RoundTrip(r)
+}
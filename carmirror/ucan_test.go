@@ -0,0 +1,264 @@
+package carmirror
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	cmbatch "github.com/fission-codes/go-car-mirror/batch"
+	cmcore "github.com/fission-codes/go-car-mirror/core"
+	cmipld "github.com/fission-codes/go-car-mirror/ipld"
+	"github.com/fission-codes/go-car-mirror/messages"
+	"github.com/fission-codes/go-car-mirror/util"
+	"github.com/ipfs/boxo/ipld/merkledag"
+	gocid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+func TestUCANDelegation(t *testing.T) {
+	rootPub, rootKey, _ := ed25519.GenerateKey(nil)
+	userPub, userKey, _ := ed25519.GenerateKey(nil)
+	_, strangerKey, _ := ed25519.GenerateKey(nil)
+	serverPub, _, _ := ed25519.GenerateKey(nil)
+
+	rootDID := DIDFromPublicKey(rootPub)
+	userDID := DIDFromPublicKey(userPub)
+	serverDID := DIDFromPublicKey(serverPub)
+
+	root := gocid.MustParse("QmWXCR7ZwcQpvzJA5fjkQMJTe2rwJgYUtoSxBXFZ3uBY1W")
+	other := gocid.MustParse("bafyreiabvqm2pj3jfsffymh5zqhdkfffmjq5gy7mxjvvvdrgpyqj7lzy6q")
+
+	// The trusted root delegates push on one root to the user, who invokes it against the server.
+	delegation, err := NewUCAN(rootKey, userDID, []Capability{{With: RootResource(root), Can: CapabilityPush}}, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	invocation, err := NewUCAN(userKey, serverDID, []Capability{{With: RootResource(root), Can: CapabilityPush}}, time.Now().Add(time.Hour), delegation)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifier := NewUCANVerifier([]string{rootDID}, serverDID)
+
+	if err := verifier.Authorize(invocation, CapabilityPush, []gocid.Cid{root}); err != nil {
+		t.Errorf("expected push on root to be authorized, got %v", err)
+	}
+	if err := verifier.Authorize(invocation, CapabilityPull, []gocid.Cid{root}); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("expected pull to be unauthorized, got %v", err)
+	}
+	if err := verifier.Authorize(invocation, CapabilityPush, []gocid.Cid{other}); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("expected push on another root to be unauthorized, got %v", err)
+	}
+	if err := verifier.Authorize(invocation, CapabilityPush, nil); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("expected a request without roots to be unauthorized, got %v", err)
+	}
+	if err := verifier.AuthorizeAll(invocation, CapabilityPush); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("expected push on one root not to grant push on every root, got %v", err)
+	}
+
+	// Delegation that doesn't chain back to a trusted root
+	forged, _ := NewUCAN(strangerKey, userDID, []Capability{{With: ResourceAll, Can: CapabilityAll}}, time.Time{})
+	escalated, _ := NewUCAN(userKey, serverDID, []Capability{{With: RootResource(root), Can: CapabilityPush}}, time.Time{}, forged)
+	if err := verifier.Authorize(escalated, CapabilityPush, []gocid.Cid{root}); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("expected untrusted chain to be unauthorized, got %v", err)
+	}
+
+	// Expired delegation
+	verifier.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	if err := verifier.Authorize(invocation, CapabilityPush, []gocid.Cid{root}); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("expected expired token to be unauthorized, got %v", err)
+	}
+}
+
+func TestUCANSignature(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(nil)
+	token, err := NewUCAN(key, "", []Capability{{With: ResourceAll, Can: CapabilityAll}}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ParseUCAN(token); err != nil {
+		t.Errorf("expected token to parse, got %v", err)
+	}
+
+	// Change a character well inside the signature, since the last one carries padding bits.
+	i := len(token) - 10
+	replacement := "A"
+	if token[i] == 'A' {
+		replacement = "B"
+	}
+	tampered := token[:i] + replacement + token[i+1:]
+	if _, err := ParseUCAN(tampered); !errors.Is(err, ErrInvalidUCAN) {
+		t.Errorf("expected tampered token to be invalid, got %v", err)
+	}
+}
+
+func TestUCANSessionScope(t *testing.T) {
+	rootPub, rootKey, _ := ed25519.GenerateKey(nil)
+	leaf := merkledag.NewRawNode([]byte("leaf"))
+	child, root := merkledag.NodeWithData([]byte("child")), merkledag.NodeWithData([]byte("root"))
+	if err := child.AddNodeLink("leaf", leaf); err != nil {
+		t.Fatal(err)
+	}
+	if err := root.AddNodeLink("child", child); err != nil {
+		t.Fatal(err)
+	}
+	other := merkledag.NewRawNode([]byte("other"))
+
+	token, err := NewUCAN(rootKey, "", []Capability{{With: RootResource(root.Cid()), Can: CapabilityAll}}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	running := true
+	// The DAG under the root is held here, and each block is read at most once a session.
+	held := map[gocid.Cid][]gocid.Cid{root.Cid(): {child.Cid()}, child.Cid(): {leaf.Cid()}, leaf.Cid(): nil}
+	reads := make(map[gocid.Cid]int)
+	links := func(ctx context.Context, id gocid.Cid) ([]gocid.Cid, bool, error) {
+		reads[id]++
+		if reads[id] > 1 {
+			t.Errorf("expected %s to be read once", id)
+		}
+		children, ok := held[id]
+		return children, ok, nil
+	}
+	auth := newUCANAuthorizer(NewUCANVerifier([]string{DIDFromPublicKey(rootPub)}, ""), links, func(string) bool { return running })
+
+	// The handler issues a session cookie on the first request, as the server does.
+	handler := func(cookie string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if _, err := r.Cookie(cookie); err != nil {
+				http.SetCookie(w, &http.Cookie{Name: cookie, Value: "session"})
+			}
+			w.WriteHeader(http.StatusAccepted)
+		}
+	}
+	round := func(h http.HandlerFunc, cookie bool, message interface{ Write(io.Writer) error }) int {
+		var body bytes.Buffer
+		if err := message.Write(&body); err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest(http.MethodPost, "/", &body)
+		r.Header.Set("Authorization", "Bearer "+token)
+		if cookie {
+			r.AddCookie(&http.Cookie{Name: "sinkSessionId", Value: "session"})
+			r.AddCookie(&http.Cookie{Name: "sourceSessionId", Value: "session"})
+		}
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w.Code
+	}
+	push := func(cookie bool, nodes ...ipld.Node) int {
+		var raw []cmcore.RawBlock[cmipld.Cid]
+		for _, node := range nodes {
+			raw = append(raw, cmipld.WrapRawBlock(node))
+		}
+		return round(auth.Wrap(handler("sinkSessionId"), CapabilityPush, "sinkSessionId"), cookie, messages.NewBlocksMessage[cmipld.Cid, *cmipld.Cid](raw))
+	}
+	pull := func(cookie bool, ids ...gocid.Cid) int {
+		var want []cmipld.Cid
+		for _, id := range ids {
+			want = append(want, cmipld.WrapCid(id))
+		}
+		have := cmbatch.NewBloomAllocator[cmipld.Cid](&cmbatch.Config{BloomCapacity: 1024, BloomFunction: HASH_FUNCTION})()
+		return round(auth.Wrap(handler("sourceSessionId"), CapabilityPull, "sourceSessionId"), cookie, messages.NewStatusMessage[cmipld.Cid, *cmipld.Cid](have, want))
+	}
+
+	if code := push(false, root); code != http.StatusAccepted {
+		t.Fatalf("expected the push of the root to be authorized, got %d", code)
+	}
+	// Blocks linked from those already pushed are in the session, in whatever order they come.
+	if code := push(true, leaf, child); code != http.StatusAccepted {
+		t.Errorf("expected blocks under the root to be authorized, got %d", code)
+	}
+	if code := push(true, other); code != http.StatusForbidden {
+		t.Errorf("expected a block outside the root's DAG to be refused, got %d", code)
+	}
+
+	auth.sessions = util.NewSynchronizedMap[string, *ucanSession]()
+	reads = make(map[gocid.Cid]int)
+	if code := pull(false, root.Cid()); code != http.StatusAccepted {
+		t.Fatalf("expected the pull of the root to be authorized, got %d", code)
+	}
+	if code := pull(true, leaf.Cid()); code != http.StatusAccepted {
+		t.Errorf("expected wanting a block under the root to be authorized, got %d", code)
+	}
+	if code := pull(true, other.Cid()); code != http.StatusForbidden {
+		t.Errorf("expected wanting a block outside the root's DAG to be refused, got %d", code)
+	}
+	if code := pull(true, child.Cid()); code != http.StatusAccepted {
+		t.Errorf("expected wanting another block under the root to be authorized, got %d", code)
+	}
+
+	auth.reap()
+	if len(auth.sessions.Keys()) != 1 {
+		t.Errorf("expected the running session to be kept")
+	}
+	running = false
+	auth.reap()
+	if len(auth.sessions.Keys()) != 0 {
+		t.Errorf("expected the ended session to be forgotten")
+	}
+}
+
+func TestSessionToken(t *testing.T) {
+	var got []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.Header.Get("Authorization"))
+	}))
+	defer srv.Close()
+
+	c := NewClient(nil, cmbatch.Config{}, nil)
+	c.defaultToken = "default"
+	own := c.newHTTPClient(context.Background(), "own", srv.URL, 0, "mine")
+	shared := c.newHTTPClient(context.Background(), "shared", srv.URL, 0, "")
+
+	// A token given for one session isn't presented by another with the same remote.
+	for _, client := range []*http.Client{own, shared, own} {
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if want := []string{"Bearer mine", "Bearer default", "Bearer mine"}; len(got) != 3 || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+		t.Errorf("expected %v to be presented, got %v", want, got)
+	}
+}
+
+func TestUCANAudienceRequired(t *testing.T) {
+	nodes, err := MakeAPISwarm(context.Background(), false, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootPub, _, _ := ed25519.GenerateKey(nil)
+	serverPub, _, _ := ed25519.GenerateKey(nil)
+	config := func(audience string) func(cfg *Config) {
+		return func(cfg *Config) {
+			cfg.HTTPRemoteAddr = "127.0.0.1:0"
+			cfg.MaxBlocksPerRound = 10
+			cfg.MaxBlocksPerColdCall = 10
+			cfg.TracingExporter = TracingExporterNone
+			cfg.UCANTrustedRoots = []string{DIDFromPublicKey(rootPub)}
+			cfg.UCANAudience = audience
+		}
+	}
+
+	// The test node's identity isn't an ed25519 key, so there is no DID to default the audience to.
+	if _, err := New(nodes[0], NewKuboStore(nodes[0]), config("")); err == nil || !strings.Contains(err.Error(), "UCANAudience") {
+		t.Errorf("expected UCANs to be refused without an audience, got %v", err)
+	}
+	cm, err := New(nodes[0], NewKuboStore(nodes[0]), config(DIDFromPublicKey(serverPub)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cm.auth.verifier.audience != DIDFromPublicKey(serverPub) {
+		t.Errorf("expected the configured audience, got %q", cm.auth.verifier.audience)
+	}
+}
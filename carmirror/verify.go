@@ -0,0 +1,147 @@
+package carmirror
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	cmcore "github.com/fission-codes/go-car-mirror/core"
+	cmerrors "github.com/fission-codes/go-car-mirror/errors"
+	cmipld "github.com/fission-codes/go-car-mirror/ipld"
+	gocid "github.com/ipfs/go-cid"
+)
+
+const (
+	// maxVerifyReported is how many missing or corrupt CIDs a verification lists, beyond which it only counts them.
+	maxVerifyReported = 1000
+	// How long a repair may take, after which the DAG is verified again as it is.
+	repairTimeout = 10 * time.Minute
+)
+
+// VerifyParams select the DAG to verify, and the remote to pull its missing blocks from, if any.
+type VerifyParams struct {
+	Cid        string
+	RepairFrom string
+	Token      string `json:"-"`
+	Rate       string
+}
+
+// VerifyResponse reports whether the DAG under a root is complete and intact locally.
+type VerifyResponse struct {
+	Cid      string
+	Complete bool
+	// Blocks and Bytes are the intact blocks found under the root.
+	Blocks int
+	Bytes  uint64
+	// MissingBlocks are blocks linked to that aren't held locally, and CorruptBlocks blocks whose data doesn't match
+	// their CID or can't be decoded. Blocks under them can't be reached, so aren't counted.
+	MissingBlocks int
+	CorruptBlocks int
+	// DeniedBlocks are blocks the content policy denies, which can't be read or repaired.
+	DeniedBlocks int
+	// Missing, Corrupt and Denied list the first maxVerifyReported of each.
+	Missing []string `json:",omitempty"`
+	Corrupt []string `json:",omitempty"`
+	Denied  []string `json:",omitempty"`
+	// RepairFrom is the remote missing blocks were pulled from, and Repaired how many of them are now held.
+	RepairFrom  string `json:",omitempty"`
+	Repaired    int    `json:",omitempty"`
+	RepairError string `json:",omitempty"`
+}
+
+// verifyDAG walks the DAG under root in store, re-hashing each block. It returns what it found, and every block
+// found missing. Denied blocks aren't counted as missing, as a repair couldn't store them.
+func verifyDAG(ctx context.Context, store cmcore.BlockStore[cmipld.Cid], root gocid.Cid) (*VerifyResponse, []gocid.Cid, error) {
+	res := &VerifyResponse{Cid: root.String()}
+	var missing []gocid.Cid
+	err := walkDAG(ctx, store, []gocid.Cid{root}, func(id gocid.Cid, block cmcore.Block[cmipld.Cid], err error) (bool, error) {
+		if err == cmerrors.ErrBlockNotFound {
+			missing = append(missing, id)
+			if len(res.Missing) < maxVerifyReported {
+				res.Missing = append(res.Missing, id.String())
+			}
+			return false, nil
+		}
+		if err == ErrDeniedBlock {
+			res.DeniedBlocks++
+			if len(res.Denied) < maxVerifyReported {
+				res.Denied = append(res.Denied, id.String())
+			}
+			return false, nil
+		}
+		if err == nil {
+			err = checkHash(id, block.RawData())
+		}
+		if err != nil {
+			log.Debugw("corrupt block", "object", "CarMirror", "method", "verifyDAG", "cid", id, "error", err)
+			res.CorruptBlocks++
+			if len(res.Corrupt) < maxVerifyReported {
+				res.Corrupt = append(res.Corrupt, id.String())
+			}
+			return false, nil
+		}
+
+		res.Blocks++
+		res.Bytes += uint64(len(block.RawData()))
+		return true, nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	res.MissingBlocks = len(missing)
+	res.Complete = res.MissingBlocks == 0 && res.CorruptBlocks == 0 && res.DeniedBlocks == 0
+	return res, missing, nil
+}
+
+// checkHash checks data hashes to id.
+func checkHash(id gocid.Cid, data []byte) error {
+	sum, err := id.Prefix().Sum(data)
+	if err != nil {
+		return err
+	}
+	if !sum.Equals(id) {
+		return fmt.Errorf("data hashes to %s", sum)
+	}
+	return nil
+}
+
+// verify verifies the DAG under root is complete and intact locally, without fetching from the network.
+// With p.RepairFrom set, blocks found missing, and the blocks under them, are pulled from that remote, and the DAG
+// verified again. Corrupt blocks aren't repaired, as they are held and so wouldn't be pulled.
+func (cm *CarMirror) verify(ctx context.Context, p VerifyParams, root gocid.Cid) (*VerifyResponse, error) {
+	res, missing, err := verifyDAG(ctx, cm.blockStore, root)
+	if err != nil || p.RepairFrom == "" || len(missing) == 0 {
+		return res, err
+	}
+
+	rate, err := cm.remoteParams([]string{p.RepairFrom}, p.Rate)
+	if err != nil {
+		return nil, err
+	}
+
+	repairErr := cm.repair(ctx, p.RepairFrom, rate, p.Token, missing)
+	repaired, _, err := verifyDAG(ctx, cm.blockStore, root)
+	if err != nil {
+		return nil, err
+	}
+	repaired.RepairFrom = p.RepairFrom
+	if n := res.MissingBlocks - repaired.MissingBlocks; n > 0 {
+		repaired.Repaired = n
+	}
+	if repairErr != nil {
+		repaired.RepairError = repairErr.Error()
+	}
+	return repaired, nil
+}
+
+// repair pulls the DAGs under missing from remote in a session of its own, and waits for the session to end,
+// cancelling it after repairTimeout. The blocks already held under them aren't pulled again. rate and token are as for pull.
+func (cm *CarMirror) repair(ctx context.Context, remote string, rate uint64, token string, missing []gocid.Cid) error {
+	pullCtx, cancel := context.WithTimeout(ctx, repairTimeout)
+	defer cancel()
+	err := cm.pull(pullCtx, remote, rate, token, "", missing)
+	if err != nil && ctx.Err() == nil && pullCtx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("repair timed out")
+	}
+	return err
+}
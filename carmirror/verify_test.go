@@ -0,0 +1,116 @@
+package carmirror
+
+import (
+	"context"
+	"testing"
+
+	cmcore "github.com/fission-codes/go-car-mirror/core"
+	cmerrors "github.com/fission-codes/go-car-mirror/errors"
+	cmipld "github.com/fission-codes/go-car-mirror/ipld"
+	"github.com/ipfs/boxo/ipld/merkledag"
+	blocks "github.com/ipfs/go-block-format"
+	gocid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// mapStore holds blocks in a map, which needn't match their CIDs, and denies the blocks in denied.
+type mapStore struct {
+	cmcore.BlockStore[cmipld.Cid]
+	blocks map[gocid.Cid]cmcore.Block[cmipld.Cid]
+	denied map[gocid.Cid]bool
+}
+
+func (ms *mapStore) Get(ctx context.Context, cid cmipld.Cid) (cmcore.Block[cmipld.Cid], error) {
+	if ms.denied[cid.Unwrap()] {
+		return nil, ErrDeniedBlock
+	}
+	if block, ok := ms.blocks[cid.Unwrap()]; ok {
+		return block, nil
+	}
+	return nil, cmerrors.ErrBlockNotFound
+}
+
+func TestVerifyDAG(t *testing.T) {
+	ctx := context.Background()
+	root := merkledag.NodeWithData([]byte("root"))
+	leaves := make(map[string]ipld.Node)
+	for _, s := range []string{"intact", "corrupt", "missing", "denied"} {
+		leaves[s] = merkledag.NewRawNode([]byte(s))
+		if err := root.AddNodeLink(s, leaves[s]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tampered, err := blocks.NewBlockWithCid([]byte("tampered"), leaves["corrupt"].Cid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt, err := merkledag.DecodeRawBlock(tampered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &mapStore{blocks: map[gocid.Cid]cmcore.Block[cmipld.Cid]{
+		root.Cid():             cmipld.WrapBlock(root),
+		leaves["intact"].Cid(): cmipld.WrapBlock(leaves["intact"]),
+		corrupt.Cid():          cmipld.WrapBlock(corrupt),
+		leaves["denied"].Cid(): cmipld.WrapBlock(leaves["denied"]),
+	}, denied: map[gocid.Cid]bool{leaves["denied"].Cid(): true}}
+
+	res, missing, err := verifyDAG(ctx, store, root.Cid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Complete || res.Blocks != 2 || res.Bytes != uint64(len(root.RawData())+len("intact")) {
+		t.Errorf("expected the root and intact leaf to be verified, got %+v", res)
+	}
+	if res.MissingBlocks != 1 || len(missing) != 1 || missing[0] != leaves["missing"].Cid() {
+		t.Errorf("expected the missing leaf to be found, got %+v", res)
+	}
+	if res.CorruptBlocks != 1 || res.Corrupt[0] != leaves["corrupt"].Cid().String() {
+		t.Errorf("expected the corrupt leaf to be found, got %+v", res)
+	}
+	if res.DeniedBlocks != 1 || res.Denied[0] != leaves["denied"].Cid().String() {
+		t.Errorf("expected the denied leaf to be reported as denied, got %+v", res)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	ctx := context.Background()
+	cms, apis := newTestCarMirrors(t, 2)
+	local, remote := cms[0], cms[1]
+	if err := remote.StartRemote(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+
+	// The remote has the whole DAG, and the local node is missing a leaf.
+	root := merkledag.NodeWithData([]byte("root"))
+	left, right := merkledag.NewRawNode([]byte("left")), merkledag.NewRawNode([]byte("right"))
+	for name, leaf := range map[string]ipld.Node{"left": left, "right": right} {
+		if err := root.AddNodeLink(name, leaf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := apis[0].Dag().AddMany(ctx, []ipld.Node{root, left}); err != nil {
+		t.Fatal(err)
+	}
+	if err := apis[1].Dag().AddMany(ctx, []ipld.Node{root, left, right}); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := local.verify(ctx, VerifyParams{}, root.Cid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Complete || res.Blocks != 2 || res.MissingBlocks != 1 || res.Missing[0] != right.Cid().String() {
+		t.Fatalf("expected the right leaf to be missing, got %+v", res)
+	}
+
+	res, err = local.verify(ctx, VerifyParams{RepairFrom: "http://" + remote.RemoteAddr().String()}, root.Cid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Complete || res.Blocks != 3 || res.Repaired != 1 || res.RepairError != "" {
+		t.Fatalf("expected the right leaf to be repaired, got %+v", res)
+	}
+}
@@ -0,0 +1,98 @@
+package carmirror
+
+import (
+	"context"
+	"errors"
+
+	cmcore "github.com/fission-codes/go-car-mirror/core"
+	cmerrors "github.com/fission-codes/go-car-mirror/errors"
+	cmipld "github.com/fission-codes/go-car-mirror/ipld"
+	gocid "github.com/ipfs/go-cid"
+)
+
+// errStopWalk is returned by a walkDAG visit function to end the walk early without failing it.
+var errStopWalk = errors.New("walk stopped")
+
+// walkVisit is called by walkDAG for each block it comes to, with the block, or the error reading it.
+// err is cmerrors.ErrBlockNotFound for blocks that aren't held, and ErrDeniedBlock for blocks the content policy
+// denies. It returns whether to walk the children of a block read without error.
+type walkVisit func(id gocid.Cid, block cmcore.Block[cmipld.Cid], err error) (bool, error)
+
+// walkDAG walks the blocks under roots in store breadth first, visiting each block once.
+// It stops at the first error visit returns, which it returns unless it is errStopWalk.
+func walkDAG(ctx context.Context, store cmcore.BlockStore[cmipld.Cid], roots []gocid.Cid, visit walkVisit) error {
+	seen := make(map[gocid.Cid]bool)
+	queue := make([]gocid.Cid, 0, len(roots))
+	for _, root := range roots {
+		if !seen[root] {
+			seen[root] = true
+			queue = append(queue, root)
+		}
+	}
+
+	for len(queue) > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		id := queue[0]
+		queue = queue[1:]
+
+		block, getErr := store.Get(ctx, cmipld.WrapCid(id))
+		if getErr != nil && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		descend, err := visit(id, block, getErr)
+		if err == errStopWalk {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !descend || getErr != nil {
+			continue
+		}
+		for _, child := range block.Children() {
+			if c := child.Unwrap(); !seen[c] {
+				seen[c] = true
+				queue = append(queue, c)
+			}
+		}
+	}
+	return nil
+}
+
+// walk walks the local blocks under root breadth first, returning the first limit blocks it comes to, or all of
+// them if limit is 0. Blocks that aren't here, or are denied, are included, but not walked.
+func (cm *CarMirror) walk(ctx context.Context, root gocid.Cid, limit int) ([]gocid.Cid, error) {
+	var walked []gocid.Cid
+	err := walkDAG(ctx, cm.blockStore, []gocid.Cid{root}, func(id gocid.Cid, _ cmcore.Block[cmipld.Cid], err error) (bool, error) {
+		if limit > 0 && len(walked) == limit {
+			return false, errStopWalk
+		}
+		walked = append(walked, id)
+		if err != nil && err != cmerrors.ErrBlockNotFound && err != ErrDeniedBlock {
+			return false, err
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return walked, nil
+}
+
+// links returns the links of the local block id, and whether it is held. Denied blocks aren't.
+func (cm *CarMirror) links(ctx context.Context, id gocid.Cid) ([]gocid.Cid, bool, error) {
+	block, err := cm.blockStore.Get(ctx, cmipld.WrapCid(id))
+	if err == cmerrors.ErrBlockNotFound || err == ErrDeniedBlock {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	var links []gocid.Cid
+	for _, child := range block.Children() {
+		links = append(links, child.Unwrap())
+	}
+	return links, true, nil
+}
@@ -0,0 +1,69 @@
+package carmirror
+
+import (
+	"context"
+	"testing"
+
+	cmcore "github.com/fission-codes/go-car-mirror/core"
+	cmerrors "github.com/fission-codes/go-car-mirror/errors"
+	cmipld "github.com/fission-codes/go-car-mirror/ipld"
+	"github.com/ipfs/boxo/ipld/merkledag"
+	gocid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+func TestWalkDAG(t *testing.T) {
+	ctx := context.Background()
+	nodes, err := MakeAPISwarm(ctx, false, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewKuboStore(nodes[0])
+
+	// A root linking to a node with a leaf, and to a leaf that isn't held.
+	root, middle := merkledag.NodeWithData([]byte("root")), merkledag.NodeWithData([]byte("middle"))
+	leaf, gone := merkledag.NewRawNode([]byte("leaf")), merkledag.NewRawNode([]byte("gone"))
+	if err := middle.AddNodeLink("leaf", leaf); err != nil {
+		t.Fatal(err)
+	}
+	for name, child := range map[string]ipld.Node{"middle": middle, "gone": gone} {
+		if err := root.AddNodeLink(name, child); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := nodes[0].Dag().AddMany(ctx, []ipld.Node{root, middle, leaf}); err != nil {
+		t.Fatal(err)
+	}
+
+	walk := func(roots []gocid.Cid, visit walkVisit) map[gocid.Cid]error {
+		visited := make(map[gocid.Cid]error)
+		err := walkDAG(ctx, store, roots, func(id gocid.Cid, block cmcore.Block[cmipld.Cid], err error) (bool, error) {
+			if _, ok := visited[id]; ok {
+				t.Errorf("expected %s to be visited once", id)
+			}
+			visited[id] = err
+			return visit(id, block, err)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return visited
+	}
+
+	visited := walk([]gocid.Cid{root.Cid(), middle.Cid()}, func(gocid.Cid, cmcore.Block[cmipld.Cid], error) (bool, error) { return true, nil })
+	if len(visited) != 4 || visited[gone.Cid()] != cmerrors.ErrBlockNotFound || visited[leaf.Cid()] != nil {
+		t.Errorf("expected every block to be visited once, the missing one as not found, got %v", visited)
+	}
+
+	// Children of blocks not descended into aren't visited.
+	visited = walk([]gocid.Cid{root.Cid()}, func(id gocid.Cid, _ cmcore.Block[cmipld.Cid], _ error) (bool, error) { return id != middle.Cid(), nil })
+	if _, ok := visited[leaf.Cid()]; ok || len(visited) != 3 {
+		t.Errorf("expected the leaf under the middle node not to be visited, got %v", visited)
+	}
+
+	// Stopping ends the walk without failing it.
+	visited = walk([]gocid.Cid{root.Cid()}, func(gocid.Cid, cmcore.Block[cmipld.Cid], error) (bool, error) { return true, errStopWalk })
+	if len(visited) != 1 {
+		t.Errorf("expected the walk to stop at the root, got %v", visited)
+	}
+}
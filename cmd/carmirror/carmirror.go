@@ -2,19 +2,26 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
-	"io/ioutil"
-	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/fission-codes/kubo-car-mirror/carmirror/client"
 	golog "github.com/ipfs/go-log"
 	"github.com/spf13/cobra"
 )
 
 var (
-	defaultCmdAddr = "http://localhost:2502"
+	defaultCmdAddr = client.DefaultAddr
+	// Environment variable holding the bearer token for the local commands API
+	commandsTokenEnv = "CARMIRROR_COMMANDS_TOKEN"
+	// How long a command may take
+	commandTimeout = 10 * time.Minute
 )
 
 var log = golog.Logger("kubo-car-mirror")
@@ -24,6 +31,33 @@ var cid string
 var addr string
 var diff string
 var session string
+var token string
+var rate string
+var commandsTokenFile string
+var direction string
+var remote string
+var transfer string
+var limit int
+var historyLimit int
+var offset int
+var state string
+var role string
+var all bool
+var mirrorName string
+var mirrorSource string
+var mirrorRemotes []string
+var pinName string
+var addrs []string
+var quorum int
+var dryRun bool
+var toFile string
+var scheduleName string
+var scheduleCron string
+var schedulePins bool
+var repairFrom string
+var filterRoots []string
+var filterFile string
+var output string
 
 var root = &cobra.Command{
 	Use:   "carmirror",
@@ -34,70 +68,214 @@ https://github.com/fission-codes/kubo-car-mirror`,
 
 var push *cobra.Command = &cobra.Command{
 	Use:   "push",
-	Short: "copy cid from local repo to remote addr",
+	Short: "copy cid from local repo to remote addr, or to several remotes at once",
 	Run: func(cmd *cobra.Command, args []string) {
-		var bgString string
-		if background {
-			bgString = "true"
-		} else {
-			bgString = "false"
+		// Dry runs and exports have no method of their own in the client.
+		if dryRun || toFile != "" {
+			params := url.Values{}
+			params.Set("cid", cid)
+			for _, a := range addrs {
+				params.Add("addr", a)
+			}
+			if diff != "" {
+				params.Set("diff", diff)
+			}
+			if token != "" {
+				params.Set("token", token)
+			}
+			if rate != "" {
+				params.Set("rate", rate)
+			}
+			if dryRun {
+				params.Set("dry_run", "true")
+			}
+			if toFile != "" {
+				// The files are the daemon's, and relative paths are taken relative to its ExportDir.
+				params.Set("to_file", toFile)
+				if filterFile != "" {
+					params.Set("filter", filterFile)
+				}
+			}
+			res, err := call("/push/new", params)
+			if err != nil {
+				fmt.Println(err.Error())
+				return
+			}
+
+			// Dry runs report what each remote is missing, and exports what was written.
+			if dryRun {
+				printListResponse("estimate", res, nil)
+			} else {
+				printListResponse("export", res, nil)
+			}
+			return
+		}
+		if len(addrs) == 0 {
+			fmt.Println("give a remote to push to with -a, or a file with --to-file")
+			return
 		}
 
-		var endpoint string
-		if diff != "" {
-			endpoint = fmt.Sprintf("/push/new?cid=%s&addr=%s&diff=%s&background=%s", cid, addr, diff, bgString)
-		} else {
-			endpoint = fmt.Sprintf("/push/new?cid=%s&addr=%s&background=%s", cid, addr, bgString)
+		c, err := newClient()
+		if err != nil {
+			fmt.Println(err.Error())
+			return
 		}
+		ctx, cancel := commandContext()
+		defer cancel()
+		res, err := c.Push(ctx, client.PushRequest{Cid: cid, Addrs: addrs, Quorum: quorum, Diff: diff, TransferOptions: transferOptions()})
 
-		_, err := doRemoteHTTPReq("POST", endpoint)
+		// Pushes to several remotes report how each got on, even when the quorum is missed.
+		if len(addrs) > 1 && res != nil {
+			printJSON("remotes", res)
+		}
 		if err != nil {
 			fmt.Println(err.Error())
 			return
 		}
+		if len(addrs) > 1 {
+			return
+		}
 
-		// TODO: get session id from response instead of hard coding knowledge here that session ids for the client are the address.
 		if background {
-			fmt.Printf("Opened background session: %s\n", addr)
+			fmt.Printf("Opened background transfer: %s\n", res.Transfer)
 		} else {
-			fmt.Printf("Completed session: %s\n", addr)
+			fmt.Printf("Completed transfer: %s\n", res.Transfer)
 		}
 	},
 }
 
 var pull = &cobra.Command{
 	Use:   "pull",
-	Short: "copy remote cid from remote addr to local repo",
+	Short: "copy remote cid from remote addr to local repo, or from several remotes at once",
 	Run: func(cmd *cobra.Command, args []string) {
-		var bgString string
-		if background {
-			bgString = "true"
-		} else {
-			bgString = "false"
+		c, err := newClient()
+		if err != nil {
+			fmt.Println(err.Error())
+			return
 		}
+		ctx, cancel := commandContext()
+		defer cancel()
+		res, err := c.Pull(ctx, client.PullRequest{Cid: cid, Addrs: addrs, TransferOptions: transferOptions()})
 
-		endpoint := fmt.Sprintf("/pull/new?cid=%s&addr=%s&background=%s", cid, addr, bgString)
-		_, err := doRemoteHTTPReq("POST", endpoint)
+		// Pulls from several sources report how each got on, even when the DAG can't be completed.
+		if len(addrs) > 1 && res != nil {
+			printJSON("sources", res)
+		}
 		if err != nil {
 			fmt.Println(err.Error())
 			return
 		}
+		if len(addrs) > 1 {
+			return
+		}
 
-		// TODO: get session id from response instead of hard coding knowledge here that session ids for the client are the address.
 		if background {
-			fmt.Printf("Opened background session: %s\n", addr)
+			fmt.Printf("Opened background transfer: %s\n", res.Transfer)
 		} else {
-			fmt.Printf("Completed session: %s\n", addr)
+			fmt.Printf("Completed transfer: %s\n", res.Transfer)
 		}
 	},
 }
 
+// transferOptions returns the options the flags set for a push or pull.
+func transferOptions() client.TransferOptions {
+	return client.TransferOptions{Token: token, Rate: rate, Background: background}
+}
+
+// sessionFilter returns the sessions the flags select.
+func sessionFilter() client.SessionFilter {
+	return client.SessionFilter{State: state, Role: role, Direction: direction, Remote: remote, Transfer: transfer}
+}
+
 var ls = &cobra.Command{
 	Use:   "ls",
-	Short: "list all active transfers",
+	Short: "list transfers, running and ended",
 	Run: func(cmd *cobra.Command, args []string) {
-		endpoint := "/ls"
-		res, err := doRemoteHTTPReq("POST", endpoint)
+		c, err := newClient()
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		ctx, cancel := commandContext()
+		defer cancel()
+		sessions, err := c.Ls(ctx, client.LsRequest{SessionFilter: sessionFilter(), Offset: offset, Limit: limit})
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+
+		printJSON("sessions", sessions)
+	},
+}
+
+var cancel = &cobra.Command{
+	Use:   "cancel",
+	Short: "cancels sessions, abandoning transfers in progress",
+	Run: func(cmd *cobra.Command, args []string) {
+		stopSessions((*client.Client).Cancel)
+	},
+}
+
+var closeCmd = &cobra.Command{
+	Use:   "close",
+	Short: "closes sessions once transfers in progress are done",
+	Run: func(cmd *cobra.Command, args []string) {
+		stopSessions((*client.Client).Close)
+	},
+}
+
+// stopSessions cancels or closes the sessions selected by the flags.
+func stopSessions(stop func(c *client.Client, ctx context.Context, r client.StopRequest) (*client.StopResponse, error)) {
+	c, err := newClient()
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	ctx, cancel := commandContext()
+	defer cancel()
+	res, err := stop(c, ctx, client.StopRequest{Session: session, SessionFilter: sessionFilter(), All: all})
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	printJSON("response", res)
+}
+
+var stats = &cobra.Command{
+	Use:   "stats",
+	Short: "displays stats about the session",
+	Run: func(cmd *cobra.Command, args []string) {
+		c, err := newClient()
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		ctx, cancel := commandContext()
+		defer cancel()
+		buckets, err := c.Stats(ctx, session)
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+
+		printJSON("response", buckets)
+	},
+}
+
+var history = &cobra.Command{
+	Use:   "history",
+	Short: "lists sessions that have ended, newest first",
+	Run: func(cmd *cobra.Command, args []string) {
+		params := url.Values{}
+		params.Set("limit", strconv.Itoa(historyLimit))
+		if direction != "" {
+			params.Set("direction", direction)
+		}
+		if remote != "" {
+			params.Set("remote", remote)
+		}
+		res, err := call("/history", params)
 		if err != nil {
 			fmt.Println(err.Error())
 			return
@@ -114,12 +292,16 @@ var ls = &cobra.Command{
 	},
 }
 
-var cancel = &cobra.Command{
-	Use:   "cancel",
-	Short: "cancels the client session",
+var policy = &cobra.Command{
+	Use:   "policy",
+	Short: "manages the content and peer policy",
+}
+
+var policyReload = &cobra.Command{
+	Use:   "reload",
+	Short: "re-reads the denylist, allowlist and denied peers files",
 	Run: func(cmd *cobra.Command, args []string) {
-		endpoint := fmt.Sprintf("/cancel?session=%s", session)
-		res, err := doRemoteHTTPReq("POST", endpoint)
+		res, err := call("/policy/reload", nil)
 		if err != nil {
 			fmt.Println(err.Error())
 			return
@@ -138,12 +320,215 @@ var cancel = &cobra.Command{
 	},
 }
 
-var stats = &cobra.Command{
-	Use:   "stats",
-	Short: "displays stats about the session",
+var mirror = &cobra.Command{
+	Use:   "mirror",
+	Short: "manages rules that push IPNS names, MFS paths and pins to remotes whenever they change",
+}
+
+var mirrorLs = &cobra.Command{
+	Use:   "ls",
+	Short: "lists mirror rules and the roots last mirrored to each remote",
 	Run: func(cmd *cobra.Command, args []string) {
-		endpoint := fmt.Sprintf("/stats?session=%s", session)
-		res, err := doRemoteHTTPReq("POST", endpoint)
+		printMirrorResponse(call("/mirrors", nil))
+	},
+}
+
+var mirrorAdd = &cobra.Command{
+	Use:   "add",
+	Short: "adds a mirror rule, which is mirrored straight away",
+	Run: func(cmd *cobra.Command, args []string) {
+		params := url.Values{}
+		params.Set("name", mirrorName)
+		params.Set("source", mirrorSource)
+		for _, remote := range mirrorRemotes {
+			params.Add("remote", remote)
+		}
+		printMirrorResponse(call("/mirrors/add", params))
+	},
+}
+
+var mirrorRm = &cobra.Command{
+	Use:   "rm",
+	Short: "removes a mirror rule added with mirror add",
+	Run: func(cmd *cobra.Command, args []string) {
+		printMirrorResponse(call("/mirrors/remove", url.Values{"name": {mirrorName}}))
+	},
+}
+
+func printMirrorResponse(res string, err error) {
+	printListResponse("mirrors", res, err)
+}
+
+var pin = &cobra.Command{
+	Use:   "pin",
+	Short: "manages pin names, which mirror rules with pin: sources follow",
+}
+
+var pinLs = &cobra.Command{
+	Use:   "ls",
+	Short: "lists pin names and the roots they name",
+	Run: func(cmd *cobra.Command, args []string) {
+		printPinResponse(call("/pins", nil))
+	},
+}
+
+var pinAdd = &cobra.Command{
+	Use:   "add",
+	Short: "pins a cid recursively under a name, replacing the root the name had",
+	Run: func(cmd *cobra.Command, args []string) {
+		printPinResponse(call("/pins/add", url.Values{"name": {pinName}, "cid": {cid}}))
+	},
+}
+
+var pinRm = &cobra.Command{
+	Use:   "rm",
+	Short: "removes a pin name, leaving the root it named pinned",
+	Run: func(cmd *cobra.Command, args []string) {
+		printPinResponse(call("/pins/remove", url.Values{"name": {pinName}}))
+	},
+}
+
+func printPinResponse(res string, err error) {
+	printListResponse("pins", res, err)
+}
+
+var schedule = &cobra.Command{
+	Use:   "schedule",
+	Short: "manages jobs that push or pull with a remote on a cron schedule",
+}
+
+var scheduleLs = &cobra.Command{
+	Use:   "ls",
+	Short: "lists scheduled jobs, their recent runs and when they next run",
+	Run: func(cmd *cobra.Command, args []string) {
+		printScheduleResponse(call("/schedules", nil))
+	},
+}
+
+var scheduleAdd = &cobra.Command{
+	Use:   "add",
+	Short: "adds a job that pushes or pulls cid, or pushes every recursive pin, on a cron schedule",
+	Run: func(cmd *cobra.Command, args []string) {
+		params := url.Values{}
+		params.Set("name", scheduleName)
+		params.Set("cron", scheduleCron)
+		params.Set("direction", direction)
+		params.Set("addr", addr)
+		params.Set("cid", cid)
+		params.Set("pins", strconv.FormatBool(schedulePins))
+		printScheduleResponse(call("/schedules/add", params))
+	},
+}
+
+var scheduleRm = &cobra.Command{
+	Use:   "rm",
+	Short: "removes a scheduled job",
+	Run: func(cmd *cobra.Command, args []string) {
+		printScheduleResponse(call("/schedules/remove", url.Values{"name": {scheduleName}}))
+	},
+}
+
+func printScheduleResponse(res string, err error) {
+	printListResponse("schedules", res, err)
+}
+
+var verify = &cobra.Command{
+	Use:   "verify",
+	Short: "checks the DAG under cid is complete and intact locally, without fetching from the network",
+	Run: func(cmd *cobra.Command, args []string) {
+		params := url.Values{}
+		params.Set("cid", cid)
+		if repairFrom != "" {
+			params.Set("repair_from", repairFrom)
+		}
+		if token != "" {
+			params.Set("token", token)
+		}
+		if rate != "" {
+			params.Set("rate", rate)
+		}
+		printVerifyResponse(call("/verify", params))
+	},
+}
+
+func printVerifyResponse(res string, err error) {
+	printListResponse("verify", res, err)
+}
+
+var filterCmd = &cobra.Command{
+	Use:   "filter",
+	Short: "manages filter snapshots, portable summaries of the blocks a node holds",
+}
+
+var filterExport = &cobra.Command{
+	Use:   "export",
+	Short: "writes a filter snapshot of the blocks held under each cid, for a source to push --to-file against",
+	Run: func(cmd *cobra.Command, args []string) {
+		params := url.Values{}
+		for _, c := range filterRoots {
+			params.Add("cid", c)
+		}
+		res, err := call("/filter/export", params)
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+
+		if output == "" {
+			fmt.Println(res)
+			return
+		}
+		if err := os.WriteFile(output, []byte(res), 0644); err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		fmt.Printf("wrote filter snapshot to %s\n", output)
+	},
+}
+
+var importCmd = &cobra.Command{
+	Use:   "import FILE",
+	Short: "adds the blocks in a CAR file as a push would, and reports which of its roots are now complete",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		// The file is the daemon's, and a relative path is taken relative to its ImportDir.
+		printImportResponse(call("/import", url.Values{"path": {args[0]}}))
+	},
+}
+
+func printImportResponse(res string, err error) {
+	printListResponse("import", res, err)
+}
+
+func printListResponse(label string, res string, err error) {
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	log.Debugf("response: %s\n", res)
+
+	var prettyJSON bytes.Buffer
+	err = json.Indent(&prettyJSON, []byte(res), "", "  ")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	fmt.Printf("%s:\n%s\n", label, prettyJSON.Bytes())
+}
+
+var config = &cobra.Command{
+	Use:   "config",
+	Short: "shows and changes the plugin configuration",
+}
+
+var configGet = &cobra.Command{
+	Use:   "get [KEY]",
+	Short: "shows the configuration in effect, or one key of it, and the keys waiting for a restart",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		res, err := call("/config", nil)
 		if err != nil {
 			fmt.Println(err.Error())
 			return
@@ -151,6 +536,29 @@ var stats = &cobra.Command{
 
 		log.Debugf("response: %s\n", res)
 
+		if len(args) == 1 {
+			var response struct {
+				Config          map[string]json.RawMessage
+				RestartRequired []string
+			}
+			if err := json.Unmarshal([]byte(res), &response); err != nil {
+				fmt.Println(err)
+				return
+			}
+			value, ok := response.Config[args[0]]
+			if !ok {
+				fmt.Printf("unknown key %s\n", args[0])
+				return
+			}
+			fmt.Printf("%s\n", value)
+			for _, key := range response.RestartRequired {
+				if key == args[0] {
+					fmt.Println("a new value has been set, and takes effect once Kubo restarts")
+				}
+			}
+			return
+		}
+
 		var prettyJSON bytes.Buffer
 		err = json.Indent(&prettyJSON, []byte(res), "", "  ")
 		if err != nil {
@@ -158,32 +566,139 @@ var stats = &cobra.Command{
 			return
 		}
 
-		fmt.Printf("response:\n%s\n", prettyJSON.Bytes())
+		fmt.Printf("config:\n%s\n", prettyJSON.Bytes())
+	},
+}
+
+var configSet = &cobra.Command{
+	Use:   "set KEY VALUE",
+	Short: "sets a key to a JSON value, applying it straight away if it doesn't need a restart",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		params := url.Values{}
+		params.Set("key", args[0])
+		params.Set("value", args[1])
+		res, err := call("/config", params)
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+
+		log.Debugf("response: %s\n", res)
+
+		var response struct {
+			RestartRequired []string
+		}
+		if err := json.Unmarshal([]byte(res), &response); err != nil {
+			fmt.Println(err)
+			return
+		}
+		for _, key := range response.RestartRequired {
+			if key == args[0] {
+				fmt.Printf("%s saved, restart Kubo to apply it\n", args[0])
+				return
+			}
+		}
+		fmt.Printf("%s applied\n", args[0])
 	},
 }
 
 func init() {
-	root.PersistentFlags().StringVar(&defaultCmdAddr, "commands-address", defaultCmdAddr, "address to issue requests that control local carmirror")
+	root.PersistentFlags().StringVar(&defaultCmdAddr, "commands-address", defaultCmdAddr, "address to issue requests that control local carmirror, or unix:///path/to/socket")
+	root.PersistentFlags().StringVar(&commandsTokenFile, "commands-token-file", "", fmt.Sprintf("file containing the bearer token for the commands address, overriding $%s", commandsTokenEnv))
 
 	push.Flags().StringVarP(&cid, "cid", "c", "", "cid to push")
-	push.Flags().StringVarP(&addr, "addr", "a", "", "remote address to push to")
-	push.Flags().StringP("diff", "d", "", "diff against cid")
+	push.Flags().StringArrayVarP(&addrs, "addr", "a", nil, "remote address to push to, may be repeated to push to several at once")
+	push.Flags().IntVarP(&quorum, "quorum", "q", 0, "how many remotes must complete for the push to succeed, 0 for all")
+	push.Flags().StringVarP(&diff, "diff", "d", "", "diff against cid")
 	push.Flags().BoolVarP(&background, "background", "b", false, "push in background")
+	push.Flags().BoolVar(&dryRun, "dry-run", false, "report the blocks and bytes each remote is missing without pushing")
+	push.Flags().StringVar(&toFile, "to-file", "", "write the blocks a remote holding the diff cid would need to this CAR file instead of pushing")
+	push.Flags().StringVar(&filterFile, "filter", "", "filter snapshot of the blocks the remote holds, written by filter export, for use with --to-file")
+	push.Flags().StringVarP(&token, "ucan", "u", "", "UCAN granting car-mirror/push on cid at the remote")
+	push.Flags().StringVarP(&rate, "rate", "r", "", "bandwidth limit for the remote, e.g. 5MiB per second")
 	push.MarkFlagRequired("cid")
-	push.MarkFlagRequired("addr")
 
 	pull.Flags().StringVarP(&cid, "cid", "c", "", "cid to pull")
-	pull.Flags().StringVarP(&addr, "addr", "a", "", "remote address to pull from")
+	pull.Flags().StringArrayVarP(&addrs, "addr", "a", nil, "remote address to pull from, may be repeated to pull different subtrees from several at once")
 	pull.Flags().BoolVarP(&background, "background", "b", false, "pull in background")
+	pull.Flags().StringVarP(&token, "ucan", "u", "", "UCAN granting car-mirror/pull on cid at the remote")
+	pull.Flags().StringVarP(&rate, "rate", "r", "", "bandwidth limit for the remote, e.g. 5MiB per second")
 	pull.MarkFlagRequired("cid")
 	pull.MarkFlagRequired("addr")
 
-	cancel.Flags().StringVarP(&session, "session", "s", "", "session id to cancel")
-	cancel.MarkFlagRequired("session")
+	ls.Flags().StringVarP(&state, "state", "s", "", "only list sessions in this state: active, closing, cancelling, completed or failed")
+	ls.Flags().StringVar(&role, "role", "", "only list client or server sessions")
+	ls.Flags().StringVarP(&direction, "direction", "d", "", "only list push or pull sessions")
+	ls.Flags().StringVarP(&remote, "remote", "r", "", "only list sessions with this remote")
+	ls.Flags().StringVarP(&transfer, "transfer", "t", "", "only list the sessions of this push or pull")
+	ls.Flags().IntVar(&offset, "offset", 0, "sessions to skip")
+	ls.Flags().IntVarP(&limit, "limit", "n", 0, "most sessions to list, 0 for all")
+
+	for _, c := range []*cobra.Command{cancel, closeCmd} {
+		c.Flags().StringVarP(&session, "session", "s", "", "session id to stop")
+		c.Flags().StringVar(&state, "state", "", "stop every session in this state: active, closing or cancelling")
+		c.Flags().StringVar(&role, "role", "", "stop every client or server session")
+		c.Flags().StringVarP(&direction, "direction", "d", "", "stop every push or pull session")
+		c.Flags().StringVarP(&remote, "remote", "r", "", "stop every session with this remote")
+		c.Flags().StringVarP(&transfer, "transfer", "t", "", "stop every session of this push or pull")
+		c.Flags().BoolVar(&all, "all", false, "stop every session")
+	}
 
 	stats.Flags().StringVarP(&session, "session", "s", "", "session id to display stats for")
 
-	root.AddCommand(push, pull, ls, stats, cancel)
+	history.Flags().StringVarP(&direction, "direction", "d", "", "only list push or pull sessions")
+	history.Flags().StringVarP(&remote, "remote", "r", "", "only list sessions with this remote")
+	history.Flags().IntVarP(&historyLimit, "limit", "n", 20, "most sessions to list, 0 for all")
+
+	policy.AddCommand(policyReload)
+
+	config.AddCommand(configGet, configSet)
+
+	mirrorAdd.Flags().StringVarP(&mirrorName, "name", "n", "", "name of the rule")
+	mirrorAdd.Flags().StringVarP(&mirrorSource, "source", "s", "", "ipns:KEY, mfs:/PATH or pin:NAME to mirror")
+	mirrorAdd.Flags().StringArrayVarP(&mirrorRemotes, "addr", "a", nil, "remote address to mirror to, may be repeated")
+	mirrorAdd.MarkFlagRequired("name")
+	mirrorAdd.MarkFlagRequired("source")
+	mirrorAdd.MarkFlagRequired("addr")
+	mirrorRm.Flags().StringVarP(&mirrorName, "name", "n", "", "name of the rule to remove")
+	mirrorRm.MarkFlagRequired("name")
+	mirror.AddCommand(mirrorLs, mirrorAdd, mirrorRm)
+
+	pinAdd.Flags().StringVarP(&pinName, "name", "n", "", "name of the pin")
+	pinAdd.Flags().StringVarP(&cid, "cid", "c", "", "cid to pin")
+	pinAdd.MarkFlagRequired("name")
+	pinAdd.MarkFlagRequired("cid")
+	pinRm.Flags().StringVarP(&pinName, "name", "n", "", "name of the pin to remove")
+	pinRm.MarkFlagRequired("name")
+	pin.AddCommand(pinLs, pinAdd, pinRm)
+
+	scheduleAdd.Flags().StringVarP(&scheduleName, "name", "n", "", "name of the job")
+	scheduleAdd.Flags().StringVarP(&scheduleCron, "cron", "s", "", "when to run, as cron fields such as \"0 2 * * *\", or @hourly, @daily or @every 30m")
+	scheduleAdd.Flags().StringVarP(&direction, "direction", "d", "", "push or pull")
+	scheduleAdd.Flags().StringVarP(&addr, "addr", "a", "", "remote address to push to or pull from")
+	scheduleAdd.Flags().StringVarP(&cid, "cid", "c", "", "cid to push or pull")
+	scheduleAdd.Flags().BoolVarP(&schedulePins, "pins", "p", false, "push every recursive pin instead of a cid")
+	scheduleAdd.MarkFlagRequired("name")
+	scheduleAdd.MarkFlagRequired("cron")
+	scheduleAdd.MarkFlagRequired("direction")
+	scheduleAdd.MarkFlagRequired("addr")
+	scheduleRm.Flags().StringVarP(&scheduleName, "name", "n", "", "name of the job to remove")
+	scheduleRm.MarkFlagRequired("name")
+	schedule.AddCommand(scheduleLs, scheduleAdd, scheduleRm)
+
+	verify.Flags().StringVarP(&cid, "cid", "c", "", "cid to verify")
+	verify.Flags().StringVar(&repairFrom, "repair-from", "", "remote address to pull missing blocks from")
+	verify.Flags().StringVarP(&token, "ucan", "u", "", "UCAN granting car-mirror/pull on the missing blocks at the remote")
+	verify.Flags().StringVarP(&rate, "rate", "r", "", "bandwidth limit for the remote, e.g. 5MiB per second")
+	verify.MarkFlagRequired("cid")
+
+	filterExport.Flags().StringArrayVarP(&filterRoots, "cid", "c", nil, "root of a DAG to summarise, may be repeated")
+	filterExport.Flags().StringVarP(&output, "output", "o", "", "file to write the snapshot to, instead of standard output")
+	filterExport.MarkFlagRequired("cid")
+	filterCmd.AddCommand(filterExport)
+
+	root.AddCommand(push, pull, ls, stats, cancel, closeCmd, history, policy, config, mirror, pin, schedule, verify, filterCmd, importCmd)
 }
 
 func main() {
@@ -192,43 +707,59 @@ func main() {
 	}
 }
 
-func doRemoteHTTPReq(method, endpoint string) (resMsg string, err error) {
-	url := fmt.Sprintf("%s%s", defaultCmdAddr, endpoint)
-	req, err := http.NewRequest(method, url, nil)
-	log.Debugf("req = %v", req)
-	if err != nil {
-		return
+// commandsToken returns the bearer token for the commands API, if any.
+func commandsToken() (string, error) {
+	if commandsTokenFile != "" {
+		b, err := os.ReadFile(commandsTokenFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(b)), nil
 	}
+	return os.Getenv(commandsTokenEnv), nil
+}
 
-	var httpClient = &http.Client{
-		// TODO: Decide timeouts, and possibly make settings configurable.
-		// We'll want different timeouts for different operations.
-		Timeout: time.Minute * 10,
+// newClient returns a client of the commands API at the commands address.
+func newClient() (*client.Client, error) {
+	bearer, err := commandsToken()
+	if err != nil {
+		return nil, err
 	}
+	return client.New(defaultCmdAddr, func(cfg *client.Config) {
+		cfg.Token = bearer
+	})
+}
 
-	res, err := httpClient.Do(req)
-	log.Debugf("res = %v", res)
+// commandContext bounds a command, which for pushes and pulls waits for the transfer to end.
+// TODO: Decide timeouts, and possibly make settings configurable.
+// We'll want different timeouts for different operations.
+func commandContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), commandTimeout)
+}
+
+// call POSTs params to an endpoint the client has no method for, returning the response as written.
+func call(path string, params url.Values) (string, error) {
+	c, err := newClient()
 	if err != nil {
-		return
+		return "", err
 	}
-	defer res.Body.Close()
-
-	log.Debugf("before reading all body, err=%v", err)
-	resBytes, err := ioutil.ReadAll(res.Body)
-	if resBytes == nil {
-		return
+	ctx, cancel := commandContext()
+	defer cancel()
+	var res json.RawMessage
+	if err := c.Call(ctx, path, params, &res); err != nil {
+		return "", err
 	}
+	return string(res), nil
+}
 
-	// Handle errors in status codes
-	if res.StatusCode != 200 {
-		var prettyJSON bytes.Buffer
-		if err = json.Indent(&prettyJSON, []byte(resBytes), "", "  "); err != nil {
-			return "", err
-		}
-
-		return "", errors.New(prettyJSON.String())
+// printJSON prints res as indented JSON under label.
+func printJSON(label string, res interface{}) {
+	b, err := json.MarshalIndent(res, "", "  ")
+	if err != nil {
+		fmt.Println(err)
+		return
 	}
+	log.Debugf("response: %s\n", b)
 
-	resMsg = string(resBytes)
-	return
+	fmt.Printf("%s:\n%s\n", label, b)
 }
@@ -0,0 +1,465 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	instrumented "github.com/fission-codes/go-car-mirror/core/instrumented"
+	"github.com/fission-codes/kubo-car-mirror/carmirror"
+	golog "github.com/ipfs/go-log"
+)
+
+// Config is the plugin's configuration, read from Plugins.Plugins.car-mirror.Config in Kubo's config.
+// Keys are the field names, and keys that are left out keep their defaults.
+type Config struct {
+	// Log level
+	LogLevel string
+	// HTTPCommandsAddr is the address CAR Mirror will listen on for local commands, which are application concerns.
+	// Defaults to `127.0.0.1:2502`.
+	HTTPCommandsAddr string
+	// HTTPCommandsSocket is a Unix domain socket path to serve local commands on instead of HTTPCommandsAddr.
+	// The socket is only accessible to the user running the daemon.
+	HTTPCommandsSocket string
+	// HTTPCommandsToken, if set, is the bearer token local commands must present.
+	HTTPCommandsToken string
+	// HTTPRemoteAddr is the address CAR Mirror will listen on for remote requests, which are protocol concerns.
+	// Defaults to `:2503`.
+	HTTPRemoteAddr string
+	// HTTPReadTimeout and HTTPWriteTimeout, e.g. "100s", bound remote requests and responses. "0s" means no limit.
+	HTTPReadTimeout  Duration
+	HTTPWriteTimeout Duration
+	// HTTPMaxHeaderBytes limits the size of remote request headers.
+	HTTPMaxHeaderBytes int
+	// MaxBlocksPerRound is the most blocks sent in a round of a session.
+	MaxBlocksPerRound uint32
+	// MaxBlocksPerColdCall is the most blocks pushed in the first round, before the remote has said what it has.
+	MaxBlocksPerColdCall uint32
+	// BloomCapacity is the number of blocks bloom filters are sized for.
+	BloomCapacity uint
+	// BloomFunction is the id of the registered hash function bloom filters use.
+	BloomFunction uint64
+	// Instrument lists the parts of the protocol reporting stats: orchestrator, store, filter and sender.
+	Instrument []string
+	// TLSCertFile and TLSKeyFile are PEM files that enable TLS on the remote server.
+	TLSCertFile string
+	TLSKeyFile  string
+	// TLSClientCAFile is a PEM file of CAs used to verify remote clients, enabling mutual TLS.
+	TLSClientCAFile string
+	// TLSRootCAFile is a PEM file of CAs used to verify https:// remotes instead of the system roots.
+	TLSRootCAFile string
+	// TLSClientCertFile and TLSClientKeyFile are PEM files presented to https:// remotes requiring mutual TLS.
+	TLSClientCertFile string
+	TLSClientKeyFile  string
+	// UCANTrustedRoots are the DIDs that may root UCAN delegation chains. Setting them requires UCANs on remote requests.
+	UCANTrustedRoots []string
+	// UCANAudience is the audience remote UCANs must be issued to. Empty means this node's DID.
+	UCANAudience string
+	// UCANToken is the UCAN presented to remotes when a push or pull doesn't supply one.
+	UCANToken string
+	// MaxOutboundRate and MaxInboundRate limit total bandwidth, e.g. "5MiB" per second. Empty means unlimited.
+	MaxOutboundRate Rate
+	MaxInboundRate  Rate
+	// RemoteRates limit the bandwidth used with individual remotes, by remote URL.
+	RemoteRates map[string]Rate
+	// MaxSessions limits the sessions the remote server runs at once. 0 means unlimited.
+	MaxSessions int
+	// SessionQueueDepth is how many new sessions may wait for a free slot once MaxSessions is reached.
+	SessionQueueDepth int
+	// SessionQueueTimeout is how long, e.g. "30s", a new session waits for a slot before being asked to retry.
+	SessionQueueTimeout Duration
+	// MaxRetries is how many times requests to busy remotes are retried.
+	MaxRetries int
+	// DenylistFile is a denylist of CIDs that are never served or stored.
+	DenylistFile string
+	// AllowlistFile, if set, lists the only roots remote sessions may start from.
+	AllowlistFile string
+	// DeniedPeersFile lists IP addresses, CIDR ranges and DIDs whose remote requests are refused.
+	DeniedPeersFile string
+	// Compression is the content coding used for protocol bodies: zstd, gzip or none.
+	Compression string
+	// CompressionLevel is the zstd or gzip compression level. 0 means the coding's default.
+	CompressionLevel int
+	// TracingExporter is stdout, file or none. Empty uses Kubo's tracing, configured with OTEL_TRACES_EXPORTER.
+	TracingExporter string
+	// TracingFile is the file the file exporter appends spans to.
+	TracingFile string
+	// ShutdownGracePeriod is how long, e.g. "30s", running sessions are given to finish when Kubo stops.
+	ShutdownGracePeriod Duration
+	// Mirrors are rules pushing the root of an IPNS name ("ipns:KEY") or MFS path ("mfs:/PATH") to remotes whenever it changes.
+	Mirrors []carmirror.MirrorRule
+	// MirrorInterval is how often, e.g. "1m", mirror sources are checked for a new root.
+	MirrorInterval Duration
+	// HistoryRetention is how long, e.g. "720h", the records of ended sessions are kept. "0s" keeps them for ever.
+	HistoryRetention Duration
+	// ExportDir is the directory pushes to a file write their CAR files in, and read filter snapshots from.
+	// Empty refuses pushes to a file.
+	ExportDir string
+	// ImportDir is the directory CAR files are imported from. Empty refuses imports.
+	ImportDir string
+}
+
+// DefaultConfig returns the configuration used for keys that aren't set.
+func DefaultConfig() Config {
+	defaults := carmirror.DefaultConfig()
+	return Config{
+		LogLevel:             "info",
+		HTTPRemoteAddr:       ":2503",
+		HTTPCommandsAddr:     "127.0.0.1:2502",
+		HTTPReadTimeout:      Duration(defaults.HTTPReadTimeout),
+		HTTPWriteTimeout:     Duration(defaults.HTTPWriteTimeout),
+		HTTPMaxHeaderBytes:   defaults.HTTPMaxHeaderBytes,
+		MaxBlocksPerRound:    100,
+		MaxBlocksPerColdCall: 10,
+		BloomCapacity:        defaults.BloomCapacity,
+		BloomFunction:        defaults.BloomFunction,
+		Instrument:           instrumentNames(defaults.Instrument),
+		SessionQueueTimeout:  Duration(30 * time.Second),
+		MaxRetries:           5,
+		Compression:          carmirror.EncodingZstd,
+		ShutdownGracePeriod:  Duration(30 * time.Second),
+		MirrorInterval:       Duration(defaults.MirrorInterval),
+		HistoryRetention:     Duration(defaults.HistoryRetention),
+	}
+}
+
+// ParseConfig reads the plugin's configuration from Kubo's config, which has been decoded from JSON,
+// on top of the defaults. Unknown keys and values of the wrong type or out of range are errors naming the key.
+func ParseConfig(raw interface{}) (Config, error) {
+	cfg := DefaultConfig()
+	if raw == nil {
+		return cfg, nil
+	}
+	// Decoding the JSON again gives us its checks on types, such as whole numbers that fit the field.
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return cfg, err
+	}
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(data, &values); err != nil {
+		return cfg, fmt.Errorf("car-mirror config must be an object")
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := cfg.set(key, values[key]); err != nil {
+			return cfg, err
+		}
+	}
+
+	return cfg, cfg.Validate()
+}
+
+// set decodes value as the setting for key, replacing the current setting.
+// Errors name the key. The configuration as a whole isn't validated.
+func (cfg *Config) set(key string, value json.RawMessage) error {
+	// Keys are matched exactly, though encoding/json would ignore their case.
+	field := reflect.ValueOf(cfg).Elem().FieldByName(key)
+	if !field.IsValid() {
+		return fmt.Errorf("%s: unknown key", key)
+	}
+	// encoding/json reuses slices and merges into maps, so start from nothing.
+	field.Set(reflect.Zero(field.Type()))
+
+	data, err := json.Marshal(map[string]json.RawMessage{key: value})
+	if err != nil {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+	// Keys inside settings, such as those of mirror rules, must be known too.
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			return fmt.Errorf("%s: expected %s, got %s", key, typeErr.Type, typeErr.Value)
+		}
+		return fmt.Errorf("%s: %w", key, err)
+	}
+	return nil
+}
+
+// Validate confirms the configuration is valid, including the settings passed on to CAR Mirror.
+func (cfg *Config) Validate() error {
+	if _, err := golog.LevelFromString(cfg.LogLevel); err != nil {
+		return fmt.Errorf("LogLevel: unknown level %q", cfg.LogLevel)
+	}
+
+	if cfg.HTTPCommandsAddr == "" && cfg.HTTPCommandsSocket == "" {
+		return fmt.Errorf("HTTPCommandsAddr or HTTPCommandsSocket is required")
+	}
+
+	c := carmirror.DefaultConfig()
+	if err := cfg.apply(c); err != nil {
+		return err
+	}
+	return c.Validate()
+}
+
+// apply sets CAR Mirror's configuration from the plugin's.
+func (cfg *Config) apply(c *carmirror.Config) error {
+	instrument, err := parseInstrument(cfg.Instrument)
+	if err != nil {
+		return err
+	}
+
+	remoteRates := make(map[string]uint64, len(cfg.RemoteRates))
+	for remote, rate := range cfg.RemoteRates {
+		remoteRates[remote] = uint64(rate)
+	}
+
+	c.HTTPRemoteAddr = cfg.HTTPRemoteAddr
+	c.HTTPReadTimeout = time.Duration(cfg.HTTPReadTimeout)
+	c.HTTPWriteTimeout = time.Duration(cfg.HTTPWriteTimeout)
+	c.HTTPMaxHeaderBytes = cfg.HTTPMaxHeaderBytes
+	c.MaxBlocksPerRound = cfg.MaxBlocksPerRound
+	c.MaxBlocksPerColdCall = cfg.MaxBlocksPerColdCall
+	c.BloomCapacity = cfg.BloomCapacity
+	c.BloomFunction = cfg.BloomFunction
+	c.Instrument = instrument
+	c.TLSCertFile = cfg.TLSCertFile
+	c.TLSKeyFile = cfg.TLSKeyFile
+	c.TLSClientCAFile = cfg.TLSClientCAFile
+	c.TLSRootCAFile = cfg.TLSRootCAFile
+	c.TLSClientCertFile = cfg.TLSClientCertFile
+	c.TLSClientKeyFile = cfg.TLSClientKeyFile
+	c.UCANTrustedRoots = cfg.UCANTrustedRoots
+	c.UCANAudience = cfg.UCANAudience
+	c.UCANToken = cfg.UCANToken
+	c.MaxOutboundRate = uint64(cfg.MaxOutboundRate)
+	c.MaxInboundRate = uint64(cfg.MaxInboundRate)
+	c.RemoteRates = remoteRates
+	c.MaxSessions = cfg.MaxSessions
+	c.SessionQueueDepth = cfg.SessionQueueDepth
+	c.SessionQueueTimeout = time.Duration(cfg.SessionQueueTimeout)
+	c.MaxRetries = cfg.MaxRetries
+	c.DenylistFile = cfg.DenylistFile
+	c.AllowlistFile = cfg.AllowlistFile
+	c.DeniedPeersFile = cfg.DeniedPeersFile
+	c.Compression = cfg.Compression
+	c.CompressionLevel = cfg.CompressionLevel
+	c.TracingExporter = cfg.TracingExporter
+	c.TracingFile = cfg.TracingFile
+	c.ShutdownGracePeriod = time.Duration(cfg.ShutdownGracePeriod)
+	c.Mirrors = cfg.Mirrors
+	c.MirrorInterval = time.Duration(cfg.MirrorInterval)
+	c.HistoryRetention = time.Duration(cfg.HistoryRetention)
+	c.ExportDir = cfg.ExportDir
+	c.ImportDir = cfg.ImportDir
+	return nil
+}
+
+// Names of the parts of the protocol that can be instrumented.
+var instrumentOptions = map[string]instrumented.InstrumentationOptions{
+	"orchestrator": instrumented.INSTRUMENT_ORCHESTRATOR,
+	"store":        instrumented.INSTRUMENT_STORE,
+	"filter":       instrumented.INSTRUMENT_FILTER,
+	"sender":       instrumented.INSTRUMENT_SENDER,
+}
+
+func parseInstrument(names []string) (instrumented.InstrumentationOptions, error) {
+	var options instrumented.InstrumentationOptions
+	for _, name := range names {
+		option, ok := instrumentOptions[strings.ToLower(name)]
+		if !ok {
+			return 0, fmt.Errorf("Instrument: unknown option %q, expected orchestrator, store, filter or sender", name)
+		}
+		options |= option
+	}
+	return options, nil
+}
+
+func instrumentNames(options instrumented.InstrumentationOptions) []string {
+	names := make([]string, 0, len(instrumentOptions))
+	for name, option := range instrumentOptions {
+		if options&option != 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Duration is a time.Duration written as a string, such as "30s".
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("expected a duration such as \"30s\", got %s", data)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Rate is a bandwidth in bytes per second, written as a string such as "5MiB". Empty means unlimited.
+type Rate uint64
+
+func (r Rate) MarshalJSON() ([]byte, error) {
+	if r == 0 {
+		return json.Marshal("")
+	}
+	return json.Marshal(fmt.Sprintf("%dB", uint64(r)))
+}
+
+func (r *Rate) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("expected a rate such as \"5MiB\", got %s", data)
+	}
+	v, err := carmirror.ParseRate(s)
+	if err != nil {
+		return err
+	}
+	*r = Rate(v)
+	return nil
+}
+
+// reloadable are the keys whose changes take effect while Kubo is running. The others need a restart.
+var reloadable = map[string]bool{
+	"LogLevel":             true,
+	"MaxBlocksPerRound":    true,
+	"MaxBlocksPerColdCall": true,
+	"BloomCapacity":        true,
+	"BloomFunction":        true,
+	"Instrument":           true,
+	"MaxOutboundRate":      true,
+	"MaxInboundRate":       true,
+	"RemoteRates":          true,
+	"MaxRetries":           true,
+}
+
+// configPrefix is where the plugin's configuration lives in Kubo's config.
+const configPrefix = "Plugins.Plugins.car-mirror.Config."
+
+// ConfigResponse is the configuration in effect, and the keys that have been set since Kubo started
+// but only take effect once it restarts.
+type ConfigResponse struct {
+	Config          Config
+	RestartRequired []string
+}
+
+// redacted stands in for secrets that are set, which the configuration is never described with.
+const redacted = "REDACTED"
+
+// configResponse describes the configuration, with its secrets redacted. It must be called holding mu.
+func (p *CarMirrorPlugin) configResponse() ConfigResponse {
+	res := ConfigResponse{Config: p.Config, RestartRequired: []string{}}
+	effective := reflect.ValueOf(p.Config)
+	configured := reflect.ValueOf(p.configured)
+	for i := 0; i < effective.NumField(); i++ {
+		if !reflect.DeepEqual(effective.Field(i).Interface(), configured.Field(i).Interface()) {
+			res.RestartRequired = append(res.RestartRequired, effective.Type().Field(i).Name)
+		}
+	}
+	for _, secret := range []*string{&res.Config.HTTPCommandsToken, &res.Config.UCANToken} {
+		if *secret != "" {
+			*secret = redacted
+		}
+	}
+	return res
+}
+
+// setConfig validates value, which is JSON, as the setting for key, and saves it in Kubo's config.
+// Reloadable settings are put into effect, for sessions started from now on.
+func (p *CarMirrorPlugin) setConfig(key string, value string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var raw interface{}
+	if err := json.Unmarshal([]byte(value), &raw); err != nil {
+		return fmt.Errorf("%s: value must be JSON, such as 32 or \"5MiB\"", key)
+	}
+
+	configured := p.configured
+	if err := configured.set(key, json.RawMessage(value)); err != nil {
+		return err
+	}
+	if err := configured.Validate(); err != nil {
+		return err
+	}
+
+	effective := p.Config
+	if reloadable[key] {
+		// Decoded again, so the effective and configured settings don't share slices or maps.
+		if err := effective.set(key, json.RawMessage(value)); err != nil {
+			return err
+		}
+		if err := effective.Validate(); err != nil {
+			return err
+		}
+	}
+
+	// The log level is set before saving, so a level that can't be set isn't kept.
+	if key == "LogLevel" {
+		if err := p.setLogLevel(effective.LogLevel); err != nil {
+			return err
+		}
+	}
+
+	if p.persist != nil {
+		if err := p.persist(configPrefix+key, raw); err != nil {
+			if key == "LogLevel" {
+				p.setLogLevel(p.Config.LogLevel)
+			}
+			return fmt.Errorf("saving %s: %w", key, err)
+		}
+	}
+	p.configured = configured
+
+	if !reloadable[key] {
+		log.Infow("setting saved, restart Kubo to apply it", "key", key)
+		return nil
+	}
+
+	if key != "LogLevel" {
+		if err := p.carmirror.Reconfigure(func(cfg *carmirror.Config) { effective.apply(cfg) }); err != nil {
+			return err
+		}
+	}
+	p.Config = effective
+	log.Infow("setting applied", "key", key)
+	return nil
+}
+
+// ConfigHandler shows the configuration, and sets a key to a JSON value if one is given.
+func (p *CarMirrorPlugin) ConfigHandler() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			key := r.FormValue("key")
+			value := r.FormValue("value")
+			log.Debugw("ConfigHandler", "key", key)
+
+			if key != "" {
+				if err := p.setConfig(key, value); err != nil {
+					log.Debugw("ConfigHandler", "error", err)
+					carmirror.WriteError(w, err)
+					return
+				}
+			}
+
+			p.mu.Lock()
+			res := p.configResponse()
+			p.mu.Unlock()
+			json.NewEncoder(w).Encode(res)
+		}
+	})
+}
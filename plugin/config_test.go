@@ -0,0 +1,174 @@
+package plugin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	instrumented "github.com/fission-codes/go-car-mirror/core/instrumented"
+	"github.com/fission-codes/kubo-car-mirror/carmirror"
+	"go.uber.org/zap/zapcore"
+)
+
+// kuboConfig decodes s as Kubo does, so numbers arrive as float64.
+func kuboConfig(t *testing.T, s string) interface{} {
+	var raw interface{}
+	if err := json.Unmarshal([]byte(s), &raw); err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func TestParseConfig(t *testing.T) {
+	cfg, err := ParseConfig(kuboConfig(t, `{
+		"MaxBlocksPerRound": 32,
+		"MaxBlocksPerColdCall": 8,
+		"BloomCapacity": 4096,
+		"Instrument": ["store", "sender"],
+		"SessionQueueTimeout": "1m",
+		"MaxOutboundRate": "5MiB",
+		"RemoteRates": {"https://backup.example.com:2503": "1MiB"}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := carmirror.DefaultConfig()
+	if err := cfg.apply(c); err != nil {
+		t.Fatal(err)
+	}
+	if c.MaxBlocksPerRound != 32 || c.MaxBlocksPerColdCall != 8 || c.BloomCapacity != 4096 {
+		t.Errorf("unexpected batch settings %+v", c)
+	}
+	if c.Instrument != instrumented.INSTRUMENT_STORE|instrumented.INSTRUMENT_SENDER {
+		t.Errorf("unexpected instrumentation %v", c.Instrument)
+	}
+	if c.SessionQueueTimeout != time.Minute || c.MaxOutboundRate != 5<<20 || c.RemoteRates["https://backup.example.com:2503"] != 1<<20 {
+		t.Errorf("unexpected limits %+v", c)
+	}
+	// Keys that aren't set keep their defaults.
+	if c.HTTPRemoteAddr != ":2503" || c.MaxRetries != 5 || c.ShutdownGracePeriod != 30*time.Second {
+		t.Errorf("expected defaults, got %+v", c)
+	}
+
+	for config, key := range map[string]string{
+		`{"MaxBlocksPerRound": -1}`:           "MaxBlocksPerRound",
+		`{"MaxBlocksPerRound": 1.5}`:          "MaxBlocksPerRound",
+		`{"MaxBlocksPerColdCall": 0}`:         "MaxBlocksPerColdCall",
+		`{"MaxSessions": "16"}`:               "MaxSessions",
+		`{"SessionQueueTimeout": 30}`:         "SessionQueueTimeout",
+		`{"ShutdownGracePeriod": "soon"}`:     "ShutdownGracePeriod",
+		`{"MaxInboundRate": "fast"}`:          "MaxInboundRate",
+		`{"RemoteRates": {"http://a": 1}}`:    "RemoteRates",
+		`{"Instrument": ["everything"]}`:      "Instrument",
+		`{"BloomFunction": 42}`:               "BloomFunction",
+		`{"Compression": "brotli"}`:           "Compression",
+		`{"LogLevel": "chatty"}`:              "LogLevel",
+		`{"maxblocksperround": 32}`:           "maxblocksperround",
+		`{"UCANTrustedRoots": "did:key:z6M"}`: "UCANTrustedRoots",
+	} {
+		if _, err := ParseConfig(kuboConfig(t, config)); err == nil || !strings.HasPrefix(err.Error(), key) {
+			t.Errorf("expected %s to be rejected naming %s, got %v", config, key, err)
+		}
+	}
+}
+
+func TestSetConfig(t *testing.T) {
+	cfg, err := ParseConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.UCANToken = "secret"
+	saved := make(map[string]interface{})
+	p := &CarMirrorPlugin{Config: cfg, configured: cfg, persist: func(key string, value interface{}) error {
+		saved[key] = value
+		return nil
+	}}
+
+	// The log level is applied straight away, and the listen address once Kubo restarts.
+	if err := p.setConfig("LogLevel", `"debug"`); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.setConfig("HTTPRemoteAddr", `":2504"`); err != nil {
+		t.Fatal(err)
+	}
+	res := p.configResponse()
+	if res.Config.LogLevel != "debug" || res.Config.HTTPRemoteAddr != ":2503" {
+		t.Errorf("unexpected effective config %+v", res.Config)
+	}
+	if res.Config.UCANToken != redacted || res.Config.HTTPCommandsToken != "" || p.Config.UCANToken != "secret" {
+		t.Errorf("expected only the token that is set to be redacted, got %q and %q", res.Config.UCANToken, res.Config.HTTPCommandsToken)
+	}
+	if len(res.RestartRequired) != 1 || res.RestartRequired[0] != "HTTPRemoteAddr" {
+		t.Errorf("expected only HTTPRemoteAddr to need a restart, got %v", res.RestartRequired)
+	}
+	if saved[configPrefix+"HTTPRemoteAddr"] != ":2504" || saved[configPrefix+"LogLevel"] != "debug" {
+		t.Errorf("expected both settings to be saved, got %v", saved)
+	}
+
+	for key, value := range map[string]string{
+		"MaxBlocksPerRound": `0`,
+		"MaxRetries":        `"5"`,
+		"Compression":       `brotli`,
+		"Unknown":           `1`,
+	} {
+		if err := p.setConfig(key, value); err == nil || !strings.HasPrefix(err.Error(), key) {
+			t.Errorf("expected %s = %s to be rejected naming the key, got %v", key, value, err)
+		}
+		if _, ok := saved[configPrefix+key]; ok {
+			t.Errorf("expected the rejected %s not to be saved", key)
+		}
+	}
+}
+
+func TestSetLogLevel(t *testing.T) {
+	t.Setenv("GOLOG_LOG_LEVEL", "")
+	cfg, err := ParseConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := make(map[string]interface{})
+	p := &CarMirrorPlugin{Config: cfg, configured: cfg, persist: func(key string, value interface{}) error {
+		saved[key] = value
+		return nil
+	}}
+	defer p.setLogLevel(cfg.LogLevel)
+
+	set := func(level string) *httptest.ResponseRecorder {
+		form := url.Values{"key": {"LogLevel"}, "value": {level}}
+		req := httptest.NewRequest("POST", "/config", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		p.ConfigHandler()(w, req)
+		return w
+	}
+
+	// The level is set on the logger the plugin and CAR Mirror log through.
+	if w := set(`"debug"`); w.Code != http.StatusOK {
+		t.Fatalf("expected the level to be set, got %d: %s", w.Code, w.Body)
+	}
+	if !log.Desugar().Core().Enabled(zapcore.DebugLevel) {
+		t.Errorf("expected the kubo-car-mirror logger to log at debug")
+	}
+	if w := set(`"error"`); w.Code != http.StatusOK {
+		t.Fatalf("expected the level to be set, got %d: %s", w.Code, w.Body)
+	}
+	if log.Desugar().Core().Enabled(zapcore.WarnLevel) || !log.Desugar().Core().Enabled(zapcore.ErrorLevel) {
+		t.Errorf("expected the kubo-car-mirror logger to log at error")
+	}
+	if saved[configPrefix+"LogLevel"] != "error" {
+		t.Errorf("expected the level to be saved, got %v", saved)
+	}
+
+	// A level that isn't set isn't saved.
+	if w := set(`"loud"`); w.Code == http.StatusOK {
+		t.Errorf("expected an unknown level to be refused")
+	}
+	if saved[configPrefix+"LogLevel"] != "error" || p.Config.LogLevel != "error" {
+		t.Errorf("expected the refused level not to be kept, got %v and %q", saved, p.Config.LogLevel)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package plugin
+
+import (
+	"fmt"
+	"net"
+)
+
+// listenUnix is only supported where the socket's permissions can be restricted before it is created.
+func listenUnix(path string) (net.Listener, error) {
+	return nil, fmt.Errorf("HTTPCommandsSocket is not supported on this platform")
+}
@@ -0,0 +1,51 @@
+//go:build unix
+
+package plugin
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// How long listenUnix waits to find out whether something is listening on an existing socket.
+const staleSocketTimeout = time.Second
+
+// listenUnix listens on a Unix domain socket at path, restricted to the current user.
+// An existing socket nothing is listening on is replaced, but anything else at path is left alone.
+func listenUnix(path string) (net.Listener, error) {
+	info, err := os.Lstat(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	case info.Mode()&os.ModeSocket == 0:
+		return nil, fmt.Errorf("%s exists and is not a socket", path)
+	default:
+		if conn, err := net.DialTimeout("unix", path, staleSocketTimeout); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	// The socket is created with the umask applied, so it is never reachable by others, even briefly.
+	// The umask is process wide, and files other goroutines create meanwhile are only made more private.
+	umask := syscall.Umask(0077)
+	listener, err := net.Listen("unix", path)
+	syscall.Umask(umask)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return listener, nil
+}
@@ -0,0 +1,56 @@
+//go:build unix
+
+package plugin
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenUnix(t *testing.T) {
+	// Socket paths are limited to about 100 bytes, which t.TempDir can exceed.
+	dir, err := os.MkdirTemp("", "carmirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "commands.sock")
+
+	listener, err := listenUnix(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected the socket to be private, got %v", info.Mode().Perm())
+	}
+
+	if _, err := listenUnix(path); err == nil {
+		t.Errorf("expected a socket in use not to be replaced")
+	}
+
+	// A socket left behind by a process that has gone is replaced.
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+	listener, err = listenUnix(path)
+	if err != nil {
+		t.Fatalf("expected a stale socket to be replaced, got %v", err)
+	}
+	listener.Close()
+
+	other := filepath.Join(dir, "not-a-socket")
+	if err := os.WriteFile(other, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listenUnix(other); err == nil {
+		t.Errorf("expected a file that isn't a socket not to be replaced")
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("expected the file to be left alone, got %v", err)
+	}
+}
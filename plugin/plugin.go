@@ -2,13 +2,17 @@ package plugin
 
 import (
 	"context"
-	"errors"
+	"fmt"
+	"net"
 	"net/http"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/fission-codes/kubo-car-mirror/carmirror"
-	coreiface "github.com/ipfs/boxo/coreiface"
 	golog "github.com/ipfs/go-log"
+	"github.com/ipfs/kubo/core"
+	"github.com/ipfs/kubo/core/coreapi"
 	plugin "github.com/ipfs/kubo/plugin"
 )
 
@@ -23,31 +27,32 @@ var Plugins = []plugin.Plugin{
 type CarMirrorPlugin struct {
 	// A CarMirror struct
 	carmirror *carmirror.CarMirror
-	// Log level
-	LogLevel string
-	// HTTPCommandsAddr is the address CAR Mirror will listen on for local commands, which are application concerns.
-	// Defaults to `127.0.0.1:2502`.
-	HTTPCommandsAddr string
-	// HTTPRemoteAddr is the address CAR Mirror will listen on for remote requests, which are protocol concerns.
-	// Defaults to `:2503`.
-	HTTPRemoteAddr       string
-	MaxBlocksPerRound    uint32
-	MaxBlocksPerColdCall uint32
+	// Configuration in effect, from Kubo's config
+	Config
+	// mu guards the configuration once running. configured is the latest configuration,
+	// including settings that need a restart, and persist saves settings in Kubo's config.
+	mu         sync.Mutex
+	configured Config
+	persist    func(key string, value interface{}) error
+
+	// HTTP server for local commands, and its goroutine
+	commands *http.Server
+	wg       sync.WaitGroup
 }
 
+// How long local commands in flight are given to return once CAR Mirror has shut down.
+const commandsShutdownTimeout = 5 * time.Second
+
 // NewCarMirrorPlugin creates a CarMirrorPlugin with some sensible defaults
 func NewCarMirrorPlugin() *CarMirrorPlugin {
 	return &CarMirrorPlugin{
-		LogLevel:             "info",
-		HTTPRemoteAddr:       ":2503",
-		HTTPCommandsAddr:     "127.0.0.1:2502",
-		MaxBlocksPerRound:    100,
-		MaxBlocksPerColdCall: 10,
+		Config: DefaultConfig(),
 	}
 }
 
-// assert at compile time that CarMirrorPlugin support the PluginDaemon interface
-var _ plugin.PluginDaemon = (*CarMirrorPlugin)(nil)
+// assert at compile time that CarMirrorPlugin support the PluginDaemonInternal interface,
+// which gives us the node's datastore to keep session history in
+var _ plugin.PluginDaemonInternal = (*CarMirrorPlugin)(nil)
 
 func (*CarMirrorPlugin) Name() string {
 	return "car-mirror"
@@ -59,30 +64,51 @@ func (*CarMirrorPlugin) Version() string {
 
 func (p *CarMirrorPlugin) Init(env *plugin.Environment) error {
 	log.Debugw("enter", "object", "CarMirrorPlugin", "method", "Init")
-	p.loadConfig(env.Config)
+	cfg, err := ParseConfig(env.Config)
+	if err != nil {
+		return fmt.Errorf("car-mirror config: %w", err)
+	}
+	p.Config = cfg
+	p.configured = cfg
 
-	// Only set default log level if env var isn't set
-	if lvl := os.Getenv("GOLOG_LOG_LEVEL"); lvl == "" {
-		golog.SetLogLevel("car-mirror", p.LogLevel)
+	if err := p.setLogLevel(p.LogLevel); err != nil {
+		return fmt.Errorf("car-mirror config: %w", err)
 	}
 
 	return nil
 }
 
-func (p *CarMirrorPlugin) Start(capi coreiface.CoreAPI) error {
+// setLogLevel sets the level of our logger, unless the GOLOG_LOG_LEVEL env var sets it.
+func (p *CarMirrorPlugin) setLogLevel(level string) error {
+	if lvl := os.Getenv("GOLOG_LOG_LEVEL"); lvl != "" {
+		return nil
+	}
+	return golog.SetLogLevel("kubo-car-mirror", level)
+}
+
+func (p *CarMirrorPlugin) Start(node *core.IpfsNode) error {
 	log.Debugw("enter", "object", "CarMirrorPlugin", "method", "Start")
 
+	capi, err := coreapi.NewCoreAPI(node)
+	if err != nil {
+		return err
+	}
+
 	blockStore := carmirror.NewKuboStore(capi)
 
-	var err error
+	var applyErr error
 	p.carmirror, err = carmirror.New(capi, blockStore, func(cfg *carmirror.Config) {
-		cfg.HTTPRemoteAddr = p.HTTPRemoteAddr
-		cfg.MaxBlocksPerRound = 100
-		cfg.MaxBlocksPerColdCall = 10
+		applyErr = p.Config.apply(cfg)
+		cfg.Datastore = node.Repo.Datastore()
+		cfg.FilesRoot = node.FilesRoot
 	})
+	if applyErr != nil {
+		return applyErr
+	}
 	if err != nil {
 		return err
 	}
+	p.persist = node.Repo.SetConfigKey
 
 	// Start the CAR Mirror protocol server
 	if err = p.carmirror.StartRemote(context.Background()); err != nil {
@@ -90,97 +116,87 @@ func (p *CarMirrorPlugin) Start(capi coreiface.CoreAPI) error {
 	}
 
 	// Start the application level server
-	go p.listenLocalCommands()
+	if err = p.listenLocalCommands(); err != nil {
+		p.carmirror.Close()
+		return err
+	}
 
 	return nil
 }
 
+// Close shuts CAR Mirror down, giving running sessions the grace period to finish, then stops the local commands server.
 func (p *CarMirrorPlugin) Close() error {
 	log.Debugw("enter", "object", "CarMirrorPlugin", "method", "Close")
-	return nil
+	var err error
+	if p.carmirror != nil {
+		err = p.carmirror.Close()
+	}
+
+	// Commands waiting on sessions return once CAR Mirror has shut down.
+	if p.commands != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), commandsShutdownTimeout)
+		defer cancel()
+		if shutdownErr := p.commands.Shutdown(ctx); shutdownErr != nil {
+			p.commands.Close()
+			if err == nil {
+				err = shutdownErr
+			}
+		}
+		p.wg.Wait()
+	}
+	return err
 }
 
+// listenLocalCommands starts serving local commands, returning once it is listening.
 func (p *CarMirrorPlugin) listenLocalCommands() error {
 	m := http.NewServeMux()
 	m.Handle("/push/new", p.carmirror.NewPushSessionHandler())
 	m.Handle("/pull/new", p.carmirror.NewPullSessionHandler())
 	m.Handle("/ls", p.carmirror.LsHandler())
 	m.Handle("/cancel", p.carmirror.CancelHandler())
+	m.Handle("/close", p.carmirror.CloseHandler())
 	m.Handle("/stats", p.carmirror.StatsHandler())
-	return http.ListenAndServe(p.HTTPCommandsAddr, m)
-}
-
-func (p *CarMirrorPlugin) loadConfig(cfg interface{}) {
-	if v := getString(cfg, "HTTPRemoteAddr"); v != "" {
-		p.HTTPRemoteAddr = v
-	}
-	if v := getString(cfg, "HTTPCommandsAddr"); v != "" {
-		p.HTTPCommandsAddr = v
-	}
-	if v := getString(cfg, "LogLevel"); v != "" {
-		p.LogLevel = v
-	}
-	if v, err := getUint32(cfg, "MaxBlocksPerRound"); err != nil {
-		p.MaxBlocksPerRound = v
-	}
-	if v, err := getUint32(cfg, "MaxBlocksPerColdCall"); err != nil {
-		p.MaxBlocksPerColdCall = v
-	}
-}
-
-func getString(config interface{}, name string) string {
-	if config == nil {
-		return ""
-	}
-	mapIface, ok := config.(map[string]interface{})
-	if !ok {
-		return ""
-	}
-	rawValue, ok := mapIface[name]
-	if !ok || rawValue == "" {
-		return ""
-	}
-	value, ok := rawValue.(string)
-	if !ok {
-		return ""
-	}
-	return value
-}
-
-func getInt64(config interface{}, name string) int64 {
-	if config == nil {
-		return -1
-	}
-	mapIface, ok := config.(map[string]interface{})
-	if !ok {
-		return -1
-	}
-	rawValue, ok := mapIface[name]
-	if !ok || rawValue == "" {
-		return -1
+	m.Handle("/history", p.carmirror.HistoryHandler())
+	m.Handle("/policy/reload", p.carmirror.PolicyReloadHandler())
+	m.Handle("/metrics", p.carmirror.MetricsHandler())
+	m.Handle("/config", p.ConfigHandler())
+	m.Handle("/mirrors", p.carmirror.MirrorsHandler())
+	m.Handle("/mirrors/add", p.carmirror.MirrorAddHandler())
+	m.Handle("/mirrors/remove", p.carmirror.MirrorRemoveHandler())
+	m.Handle("/pins", p.carmirror.PinsHandler())
+	m.Handle("/pins/add", p.carmirror.PinAddHandler())
+	m.Handle("/pins/remove", p.carmirror.PinRemoveHandler())
+	m.Handle("/schedules", p.carmirror.SchedulesHandler())
+	m.Handle("/schedules/add", p.carmirror.ScheduleAddHandler())
+	m.Handle("/schedules/remove", p.carmirror.ScheduleRemoveHandler())
+	m.Handle("/verify", p.carmirror.VerifyHandler())
+	m.Handle("/filter/export", p.carmirror.FilterExportHandler())
+	m.Handle("/import", p.carmirror.ImportHandler())
+
+	var handler http.Handler = m
+	if p.HTTPCommandsToken != "" {
+		handler = carmirror.RequireBearerToken(p.HTTPCommandsToken, m)
+	}
+
+	var listener net.Listener
+	var err error
+	if p.HTTPCommandsSocket != "" {
+		listener, err = listenUnix(p.HTTPCommandsSocket)
+	} else {
+		listener, err = net.Listen("tcp", p.HTTPCommandsAddr)
 	}
-	value, ok := rawValue.(int64)
-	if !ok {
-		return -1
+	if err != nil {
+		log.Errorw("could not listen for local commands", "addr", p.HTTPCommandsAddr, "socket", p.HTTPCommandsSocket, "error", err)
+		return err
 	}
-	return value
-}
 
-func getUint32(config interface{}, name string) (uint32, error) {
-	if config == nil {
-		return 0, errors.New("nil config")
-	}
-	mapIface, ok := config.(map[string]interface{})
-	if !ok {
-		return 0, errors.New("can't convert config to map")
-	}
-	rawValue, ok := mapIface[name]
-	if !ok || rawValue == "" {
-		return 0, errors.New("name not found in config map")
-	}
-	value, ok := rawValue.(uint32)
-	if !ok {
-		return 0, errors.New("unable to cast value to uint32")
-	}
-	return value, nil
+	p.commands = &http.Server{Handler: handler}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		if err := p.commands.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Errorw("local commands server stopped", "error", err)
+		}
+	}()
+	return nil
 }